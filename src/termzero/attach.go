@@ -0,0 +1,120 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strings"
+)
+
+// attachMain: termzero attach [-sock path] [-ro] [name], lists the
+// ports without a name.
+func attachMain(args []string) int {
+	fs := flag.NewFlagSet("attach", flag.ExitOnError)
+	sock := fs.String("sock", DAEMON_SOCK, "Unix socket of the daemon")
+	ro := fs.Bool("ro", false, "Attach read only, as a spectator")
+	esc := fs.String("e", "a", "Escape key is ctrl+<key>, ctrl+<key> d detaches")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: termzero attach [flags] [name]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 || *esc == "" {
+		fs.Usage()
+		return 2
+	}
+	conn, err := net.Dial("unix", *sock)
+	if err != nil {
+		fmt.Println("Fatal: no daemon:", err)
+		return 1
+	}
+	defer conn.Close()
+	if fs.NArg() == 0 {
+		fmt.Fprintln(conn, "list")
+		io.Copy(os.Stdout, conn)
+		return 0
+	}
+
+	who := "unknown"
+	if u, err := user.Current(); err == nil {
+		who = u.Username
+	}
+	if h, err := os.Hostname(); err == nil {
+		who += "@" + h
+	}
+	who += fmt.Sprintf("[%d]", os.Getpid())
+	access := "rw"
+	if *ro {
+		access = "ro"
+	}
+	fmt.Fprintf(conn, "attach %s %s %s\n", fs.Arg(0), access, who)
+	ok, err := readLine(conn)
+	if err != nil {
+		fmt.Println("Fatal: daemon:", err)
+		return 1
+	}
+	if !strings.HasPrefix(ok, "ok ") {
+		fmt.Println("Fatal:", strings.TrimPrefix(ok, "error: "))
+		return 1
+	}
+	fmt.Printf("attached to %s", ok[3:])
+	if *ro {
+		fmt.Print(", read only")
+	}
+	key := (*esc)[0] & 0x1f
+	fmt.Printf(", ctrl+%c d detaches\n", (*esc)[0])
+
+	if isTerminal(os.Stdin) {
+		restore, err := makeRaw(os.Stdin)
+		if err != nil {
+			fmt.Println("Fatal: stdio raw mode:", err)
+			return 1
+		}
+		defer restore()
+	}
+	done := make(chan string, 2)
+	go func() {
+		io.Copy(os.Stdout, conn)
+		done <- "\n*** the daemon dropped us\n"
+	}()
+	go func() {
+		r := bufio.NewReader(os.Stdin)
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				done <- ""
+				return
+			}
+			if c == key {
+				if c, err = r.ReadByte(); err != nil {
+					done <- ""
+					return
+				}
+				switch {
+				case c == 'd' || c == 'q':
+					done <- "\n*** detached\n"
+					return
+				case c != key:
+					// not ours, both go out
+					conn.Write([]byte{key})
+				}
+			}
+			if _, err := conn.Write([]byte{c}); err != nil {
+				return
+			}
+		}
+	}()
+	fmt.Print(<-done)
+	return 0
+}
@@ -0,0 +1,97 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"termzero/display"
+	"termzero/sers"
+	"termzero/sniff"
+	"termzero/stamp"
+)
+
+// runBridge opens the second port dev at the session's mode changed by
+// mode and bridges the session's port to it, shown in the display mode
+// dm and stamped as tsm asks, logged if the session logs.
+func runBridge(s *session, port sers.SerialPort, dev, mode string, dm display.Mode,
+	tsm stamp.Mode, micro, color bool) error {
+	m := s.mode
+	if mode != "" {
+		if err := m.Set(mode); err != nil {
+			return err
+		}
+	}
+	b, err := sers.Open(dev)
+	if err != nil {
+		return err
+	}
+	if err := m.Apply(b); err != nil {
+		b.Close()
+		return err
+	}
+	// not closed at the end, that waits for the blocked read; exit does
+	fmt.Printf("bridge A %s %s <-> B %s %s\n", s.dev, &s.mode, dev, &m)
+
+	labels := [2]string{"A>B", "B>A"}
+	now := time.Now()
+	outs := []*sniff.Writer{sniff.NewWriter(os.Stdout, dm,
+		stamp.NewStamper(tsm, micro, now), labels, color && isTerminal(os.Stdout))}
+	if s.log != nil {
+		fmt.Fprintf(s.log, "# bridge A %s %s <-> B %s %s\n", s.dev, &s.mode, dev, &m)
+		outs = append(outs, sniff.NewWriter(s.log, dm,
+			stamp.NewStamper(tsm, micro, now), labels, false))
+	}
+	return bridge(port, b, outs)
+}
+
+// bridge forwards between the ports a and b, each at its own mode,
+// until a port fails or a signal ends it. Both directions go to the
+// sniff writers, e.g. the display and the log.
+func bridge(a, b io.ReadWriter, outs []*sniff.Writer) error {
+	errc := make(chan error, 2)
+	forward := func(d sniff.Dir, from io.Reader, to io.Writer) {
+		buf := make([]byte, 4096)
+		for {
+			n, err := from.Read(buf)
+			if n > 0 {
+				t := time.Now()
+				if _, werr := to.Write(buf[:n]); werr != nil {
+					errc <- werr
+					return
+				}
+				for _, o := range outs {
+					o.WriteAt(d, buf[:n], t)
+				}
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+	}
+	go forward(sniff.A_TO_B, a, b)
+	go forward(sniff.B_TO_A, b, a)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	var err error
+	select {
+	case err = <-errc:
+	case <-sig:
+	}
+	for _, o := range outs {
+		o.Flush()
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"termzero/capture"
+	"termzero/pcapng"
+	"termzero/sers"
+)
+
+// openCapture starts capturing the traffic of port to the file fn.
+func openCapture(fn, dev string, mode *sers.Mode, port sers.SerialPort) (*capture.Tap, error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	cw, err := capture.NewWriter(f, capture.Header{Port: dev, Mode: mode.String()})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	atExit = append(atExit, func() { f.Close() })
+	fmt.Println("capturing to", fn)
+	return capture.NewTap(port, cw), nil
+}
+
+// openPcap starts writing the traffic of port to the pcapng file fn.
+func openPcap(fn, dev string, mode *sers.Mode, gap time.Duration,
+	linktype uint, port sers.SerialPort) (*capture.Tap, error) {
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := pcapng.NewWriter(f, pcapng.Config{
+		LinkType: uint16(linktype),
+		Gap:      gap,
+		Comment:  fmt.Sprintf("%s %s", dev, mode),
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	atExit = append(atExit, func() { f.Close() }, func() { pw.Close() })
+	fmt.Println("pcapng to", fn)
+	return capture.NewTap(port, pw), nil
+}
+
+type replay struct {
+	f      *os.File
+	r      *capture.Reader
+	toPort bool
+	dirs   capture.Dir
+	scale  float64
+}
+
+func openReplay(fn, to, dir string, scale float64) (*replay, error) {
+	rp := &replay{scale: scale}
+	switch to {
+	case "port":
+		rp.toPort, rp.dirs = true, capture.TX
+	case "display":
+		rp.dirs = capture.RX
+	default:
+		return nil, fmt.Errorf("replay to port or display, not %q", to)
+	}
+	if dir != "" {
+		var err error
+		if rp.dirs, err = capture.ParseDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	if scale < 0 {
+		return nil, fmt.Errorf("negative scale %g", scale)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	if rp.r, err = capture.NewReader(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	rp.f = f
+	return rp, nil
+}
+
+func (rp *replay) run(s *session, w io.Writer) error {
+	defer rp.f.Close()
+	h := rp.r.Header()
+	s.printf("*** replay %s of %s %s captured %s\n", rp.dirs, h.Port, h.Mode,
+		h.Start.Format(time.RFC3339))
+	return capture.Replay(rp.r, w, rp.dirs, rp.scale, nil)
+}
+
+// rxWriter shows everything written to it like received data.
+type rxWriter struct {
+	s *session
+}
+
+func (w rxWriter) Write(p []byte) (int, error) {
+	if err := w.s.showAt(p, time.Now()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
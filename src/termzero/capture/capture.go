@@ -0,0 +1,259 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package capture records the traffic of a serial port with its
+// direction and timing and replays it later.
+//
+// The capture format is JSON lines. The first line is the header,
+//
+//	{"format":"termzero-capture","version":1,"port":"/dev/ttyUSB0",
+//	 "mode":"38400,8N1","start":"2015-03-01T12:00:00.123456789+01:00"}
+//
+// every following line is one chunk as returned by a single Read or
+// passed to a single Write,
+//
+//	{"t":1234567,"dir":"rx","data":"SGVsbG8="}
+//
+// where t is the time in nanoseconds since start, dir is "rx" for
+// received and "tx" for sent data and data is the base64 encoded
+// payload.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"termzero/sers"
+)
+
+const (
+	Format  = "termzero-capture"
+	Version = 1
+)
+
+// Dir is the direction of a chunk.
+type Dir int
+
+const (
+	RX Dir = 1 << iota // received from the port
+	TX                 // sent to the port
+)
+
+func (d Dir) String() string {
+	switch d {
+	case RX:
+		return "rx"
+	case TX:
+		return "tx"
+	case RX | TX:
+		return "rx,tx"
+	}
+	return fmt.Sprintf("Dir(%d)", int(d))
+}
+
+// ParseDir parses "rx", "tx" or "rx,tx".
+func ParseDir(s string) (Dir, error) {
+	switch s {
+	case "rx":
+		return RX, nil
+	case "tx":
+		return TX, nil
+	case "rx,tx", "tx,rx", "both":
+		return RX | TX, nil
+	}
+	return 0, fmt.Errorf("bad direction %q, have rx, tx or rx,tx", s)
+}
+
+func (d Dir) MarshalJSON() ([]byte, error) {
+	if d != RX && d != TX {
+		return nil, fmt.Errorf("capture: can't marshal %v", d)
+	}
+	return json.Marshal(d.String())
+}
+
+func (d *Dir) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch s {
+	case "rx":
+		*d = RX
+	case "tx":
+		*d = TX
+	default:
+		return fmt.Errorf("capture: bad direction %q", s)
+	}
+	return nil
+}
+
+// Header is the first line of a capture.
+type Header struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Port    string    `json:"port,omitempty"`
+	Mode    string    `json:"mode,omitempty"`
+	Start   time.Time `json:"start"`
+}
+
+// Record is one chunk of traffic.
+type Record struct {
+	T    time.Duration `json:"t"` // since Header.Start
+	Dir  Dir           `json:"dir"`
+	Data []byte        `json:"data"`
+}
+
+// Recorder gets the traffic seen by a Tap.
+type Recorder interface {
+	Record(dir Dir, t time.Time, p []byte) error
+}
+
+// Writer writes a capture, it is a Recorder.
+type Writer struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	enc   *json.Encoder
+	start time.Time
+}
+
+// NewWriter writes the header h, a zero h.Start is set to now.
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	if h.Start.IsZero() {
+		h.Start = time.Now()
+	}
+	h.Format, h.Version = Format, Version
+	bw := bufio.NewWriter(w)
+	cw := &Writer{w: bw, enc: json.NewEncoder(bw), start: h.Start}
+	if err := cw.enc.Encode(&h); err != nil {
+		return nil, err
+	}
+	return cw, bw.Flush()
+}
+
+// Record writes the chunk p which went in direction dir at t.
+func (w *Writer) Record(dir Dir, t time.Time, p []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.enc.Encode(&Record{t.Sub(w.start), dir, p}); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// Reader reads a capture.
+type Reader struct {
+	h   Header
+	dec *json.Decoder
+}
+
+var ErrFormat = errors.New("capture: not a termzero capture")
+
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &Reader{dec: json.NewDecoder(r)}
+	if err := cr.dec.Decode(&cr.h); err != nil {
+		return nil, err
+	}
+	if cr.h.Format != Format {
+		return nil, ErrFormat
+	}
+	if cr.h.Version != Version {
+		return nil, fmt.Errorf("capture: unsupported version %d", cr.h.Version)
+	}
+	return cr, nil
+}
+
+func (r *Reader) Header() Header {
+	return r.h
+}
+
+// Next returns the next record, io.EOF at the end.
+func (r *Reader) Next() (Record, error) {
+	var rec Record
+	err := r.dec.Decode(&rec)
+	return rec, err
+}
+
+// Replay writes the data of the records going in one of the
+// directions dirs to w. The original timing is kept, with the gaps
+// multiplied by scale; a scale of 0 replays as fast as possible.
+// Replay stops early when stop gets closed.
+func Replay(r *Reader, w io.Writer, dirs Dir, scale float64, stop <-chan struct{}) error {
+	start := time.Now()
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rec.Dir&dirs == 0 {
+			continue
+		}
+		if d := time.Duration(float64(rec.T)*scale) - time.Since(start); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-stop:
+				return nil
+			}
+		}
+		if _, err := w.Write(rec.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// Tap wraps a port and hands the traffic to a Recorder, stamped
+// right after the Read or Write returned.
+type Tap struct {
+	sers.SerialPort
+	rec Recorder
+	err error // first recording error
+	mu  sync.Mutex
+}
+
+func NewTap(p sers.SerialPort, rec Recorder) *Tap {
+	return &Tap{SerialPort: p, rec: rec}
+}
+
+func (t *Tap) Read(b []byte) (int, error) {
+	n, err := t.SerialPort.Read(b)
+	if n > 0 {
+		t.record(RX, time.Now(), b[:n])
+	}
+	return n, err
+}
+
+func (t *Tap) Write(b []byte) (int, error) {
+	n, err := t.SerialPort.Write(b)
+	if n > 0 {
+		t.record(TX, time.Now(), b[:n])
+	}
+	return n, err
+}
+
+// record keeps the first error instead of failing the port I/O.
+func (t *Tap) record(dir Dir, now time.Time, p []byte) {
+	if err := t.rec.Record(dir, now, p); err != nil {
+		t.mu.Lock()
+		if t.err == nil {
+			t.err = err
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Err returns the first error the Recorder reported.
+func (t *Tap) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
@@ -0,0 +1,145 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package cksum implements the small checksums and CRCs found in
+// serial protocols.
+package cksum
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Sum8 is the 8 bit sum of b.
+func Sum8(b []byte) byte {
+	var s byte
+	for _, c := range b {
+		s += c
+	}
+	return s
+}
+
+// Xor8 is the xor of all bytes of b.
+func Xor8(b []byte) byte {
+	var x byte
+	for _, c := range b {
+		x ^= c
+	}
+	return x
+}
+
+// CRC8 is the CRC-8 with polynomial 0x07, init 0.
+func CRC8(b []byte) byte {
+	var crc byte
+	for _, c := range b {
+		crc ^= c
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// CRC16Modbus is the CRC-16/MODBUS (reflected 0x8005, init 0xffff).
+// On the wire it goes low byte first.
+func CRC16Modbus(b []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// CRC16CCITT is the CRC-16 with polynomial 0x1021, MSB first. With
+// init 0 it is the XMODEM CRC, with init 0xffff CRC-16/CCITT-FALSE.
+func CRC16CCITT(init uint16, b []byte) uint16 {
+	crc := init
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// CRC16Kermit is the CRC-16 with polynomial 0x1021, LSB first and
+// init 0, the block check type 3 of Kermit.
+func CRC16Kermit(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Kind selects a checksum to append to a frame.
+type Kind int
+
+const (
+	NO_CK Kind = iota
+	SUM_CK
+	XOR_CK
+	CRC8_CK
+	MODBUS_CK
+)
+
+var kindNames = []string{"none", "sum", "xor", "crc8", "modbus"}
+
+func ParseKind(s string) (Kind, error) {
+	for i, n := range kindNames {
+		if n == s {
+			return Kind(i), nil
+		}
+	}
+	return NO_CK, fmt.Errorf("unknown checksum %q, have %s",
+		s, strings.Join(kindNames, ", "))
+}
+
+func (k Kind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+	return kindNames[k]
+}
+
+// Append appends the checksum of b to b.
+func (k Kind) Append(b []byte) []byte {
+	switch k {
+	case SUM_CK:
+		return append(b, Sum8(b))
+	case XOR_CK:
+		return append(b, Xor8(b))
+	case CRC8_CK:
+		return append(b, CRC8(b))
+	case MODBUS_CK:
+		crc := CRC16Modbus(b)
+		return append(b, byte(crc), byte(crc>>8))
+	}
+	return b
+}
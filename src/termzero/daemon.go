@@ -0,0 +1,291 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"termzero/logfile"
+	"termzero/netser"
+	"termzero/sers"
+)
+
+// The Unix socket of the daemon, where attach finds it.
+const DAEMON_SOCK = "/tmp/termzero.sock"
+
+// REOPEN is how long the daemon waits before it tries a failed port
+// again, e.g. an unplugged dongle.
+const REOPEN = 5 * time.Second
+
+// console is a port the daemon keeps open.
+type console struct {
+	name string
+	dev  string
+	mode sers.Mode
+	log  logfile.Config
+
+	mu  sync.Mutex
+	srv *netser.Server // nil while the port is closed
+	err error          // why it is closed
+}
+
+// readConsoles reads the daemon's configuration, a port per line:
+//
+//	# name  port          mode        log (optional)
+//	uno     /dev/ttyUSB0  115200      /var/log/termzero/uno-{date}.log
+//
+// The log defaults to "<name>-{date}-{time}.log".
+func readConsoles(fn string) ([]*console, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cs []*console
+	names := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		t := strings.TrimSpace(sc.Text())
+		if t == "" || t[0] == '#' {
+			continue
+		}
+		fs := strings.Fields(t)
+		if len(fs) < 3 || len(fs) > 4 {
+			return nil, fmt.Errorf("%s:%d: want name, port, mode and maybe a log", fn, line)
+		}
+		if names[fs[0]] {
+			return nil, fmt.Errorf("%s:%d: %s again", fn, line, fs[0])
+		}
+		names[fs[0]] = true
+		c := &console{
+			name: fs[0],
+			dev:  fs[1],
+			mode: sers.Mode{Baudrate: uint32(defBaudrate), Databits: databits,
+				Parity: parity, Stopbits: stopbits, Handshake: handshake},
+			log: logfile.Config{Template: fs[0] + "-{date}-{time}.log", Dev: fs[1]},
+		}
+		if err := c.mode.Set(fs[2]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fn, line, err)
+		}
+		if len(fs) == 4 {
+			c.log.Template = fs[3]
+		}
+		c.log.Header = fmt.Sprintf("# termzero log {start} console %s port %s mode %s\n",
+			c.name, c.dev, &c.mode)
+		cs = append(cs, c)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(cs) == 0 {
+		return nil, fmt.Errorf("%s: no ports", fn)
+	}
+	return cs, nil
+}
+
+func (c *console) logf(format string, a ...interface{}) {
+	fmt.Printf("%s %s: %s\n", time.Now().Format("2006-01-02 15:04:05"), c.name,
+		fmt.Sprintf(format, a...))
+}
+
+func (c *console) server() (*netser.Server, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.srv, c.err
+}
+
+// keep keeps the port open and logged, reopening it when it fails.
+func (c *console) keep(log *logfile.Log) {
+	for {
+		port, err := sers.Open(c.dev)
+		if err == nil {
+			if err = c.mode.Apply(port); err != nil {
+				port.Close()
+			}
+		}
+		if err != nil {
+			c.mu.Lock()
+			if c.err == nil || c.err.Error() != err.Error() {
+				c.logf("%v, trying again every %v", err, REOPEN)
+			}
+			c.err = err
+			c.mu.Unlock()
+			time.Sleep(REOPEN)
+			continue
+		}
+		srv := netser.New(rw{io.TeeReader(port, log), port}, netser.Config{
+			Writers: netser.ONE,
+			Port:    port,
+			Line:    c.mode,
+			Logf:    c.logf,
+		})
+		c.mu.Lock()
+		c.srv, c.err = srv, nil
+		c.mu.Unlock()
+		c.logf("%s open at %s", c.dev, &c.mode)
+		err = srv.Run()
+		port.Close()
+		c.mu.Lock()
+		c.srv, c.err = nil, err
+		c.mu.Unlock()
+		c.logf("%s failed: %v", c.dev, err)
+		time.Sleep(REOPEN)
+	}
+}
+
+// daemonMain: termzero daemon [-sock path] <config>
+func daemonMain(args []string) int {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	sock := fs.String("sock", DAEMON_SOCK, "Unix socket for the attach clients")
+	logsize := fs.String("logsize", "0", "Rotate the logs at that size, e.g. 10M")
+	logage := fs.Duration("logage", 24*time.Hour, "Rotate the logs after that time")
+	loggz := fs.Bool("loggz", false, "Gzip the rotated logs")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: termzero daemon [flags] <config>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	size, err := logfile.ParseSize(*logsize)
+	if err != nil {
+		fmt.Println("Fatal: -logsize:", err)
+		return 1
+	}
+	cs, err := readConsoles(fs.Arg(0))
+	if err != nil {
+		fmt.Println("Fatal:", err)
+		return 1
+	}
+	for _, c := range cs {
+		c.log.MaxSize, c.log.MaxAge, c.log.Gzip = size, *logage, *loggz
+		log, err := logfile.Open(c.log)
+		if err != nil {
+			fmt.Println("Fatal: log:", err)
+			return 1
+		}
+		defer log.Close()
+		c.logf("logging to %s", log.Name())
+		go c.keep(log)
+	}
+
+	// a socket left by a killed daemon is in the way
+	if conn, err := net.Dial("unix", *sock); err == nil {
+		conn.Close()
+		fmt.Println("Fatal: a daemon is listening on", *sock)
+		return 1
+	}
+	os.Remove(*sock)
+	ln, err := net.Listen("unix", *sock)
+	if err != nil {
+		fmt.Println("Fatal:", err)
+		return 1
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		ln.Close()
+	}()
+	fmt.Printf("termzero daemon, %d ports, attach at %s\n", len(cs), *sock)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		go serveAttach(conn, cs)
+	}
+	os.Remove(*sock)
+	return 0
+}
+
+// serveAttach serves a client of the socket. It asks with a line,
+// "list" or "attach <name> <rw|ro> <who>", and gets "ok" and the port
+// or "error: ..." back.
+func serveAttach(conn net.Conn, cs []*console) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	req, err := readLine(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	fs := strings.Fields(req)
+	if len(fs) == 1 && fs[0] == "list" {
+		for _, c := range cs {
+			state := "open"
+			srv, err := c.server()
+			if srv == nil {
+				state = fmt.Sprintf("closed (%v)", err)
+			} else if n := len(srv.Clients()); n > 0 {
+				state = fmt.Sprintf("open, %d attached", n)
+				if o := srv.Owner(); o != "" {
+					state += ", owner " + o
+				}
+			}
+			fmt.Fprintf(conn, "%-12s %-16s %-14s %s\n", c.name, c.dev, &c.mode, state)
+		}
+		conn.Close()
+		return
+	}
+	if len(fs) != 4 || fs[0] != "attach" || fs[2] != "rw" && fs[2] != "ro" {
+		fmt.Fprintf(conn, "error: bad request %q\n", req)
+		conn.Close()
+		return
+	}
+	var c *console
+	for _, k := range cs {
+		if k.name == fs[1] {
+			c = k
+		}
+	}
+	if c == nil {
+		fmt.Fprintf(conn, "error: no port %s\n", fs[1])
+		conn.Close()
+		return
+	}
+	srv, err := c.server()
+	if srv == nil {
+		fmt.Fprintf(conn, "error: %s is closed: %v\n", c.name, err)
+		conn.Close()
+		return
+	}
+	ok := fmt.Sprintf("ok %s %s %s\n", c.name, c.dev, &c.mode)
+	if err := srv.Attach(conn, fs[3], fs[2] == "ro", []byte(ok)); err != nil {
+		fmt.Fprintf(conn, "error: %s is owned by %s, attach read only\n", c.name, srv.Owner())
+		conn.Close()
+	}
+}
+
+// readLine reads a line without reading ahead.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 256 {
+		if _, err := r.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimRight(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("line too long")
+}
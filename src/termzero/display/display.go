@@ -0,0 +1,176 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package display renders a received byte stream for a terminal:
+// raw, as a hexdump, or with the non printable bytes escaped so
+// binary data can't mess up the terminal.
+package display
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+type Mode int
+
+const (
+	RAW   Mode = iota // bytes as they are
+	HEX               // hexdump: offset, hex and ASCII columns
+	MIXED             // printable ASCII, <0x1B> for the rest
+	CARET             // caret notation, ^[ for ESC
+	CESC              // C escapes, \r \n \x1b
+)
+
+var modeNames = []string{"raw", "hex", "mixed", "caret", "c"}
+
+func ParseMode(s string) (Mode, error) {
+	for i, n := range modeNames {
+		if n == s {
+			return Mode(i), nil
+		}
+	}
+	return RAW, fmt.Errorf("unknown display mode %q, have %s",
+		s, strings.Join(modeNames, ", "))
+}
+
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(modeNames) {
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+	return modeNames[m]
+}
+
+// Writer renders everything written to it in the current mode. The
+// mode may be switched at any time.
+type Writer struct {
+	w io.Writer
+
+	mu  sync.Mutex
+	m   Mode
+	off int64 // hexdump offset
+	out []byte
+	bol bool // what was written ended a line
+}
+
+func NewWriter(w io.Writer, m Mode) *Writer {
+	return &Writer{w: w, m: m, bol: true}
+}
+
+// AtLineStart tells whether the last write ended its line, the way a
+// hexdump always does.
+func (w *Writer) AtLineStart() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.bol
+}
+
+func (w *Writer) Mode() Mode {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.m
+}
+
+// SetMode switches the display mode, the hexdump offset restarts.
+func (w *Writer) SetMode(m Mode) {
+	w.mu.Lock()
+	w.m = m
+	w.off = 0
+	w.mu.Unlock()
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch w.m {
+	case RAW:
+		if len(p) > 0 {
+			w.bol = p[len(p)-1] == '\n'
+		}
+		return w.w.Write(p)
+	case HEX:
+		w.out = hexDump(w.out[:0], p, w.off)
+		w.off += int64(len(p))
+	default:
+		w.out = w.out[:0]
+		for _, c := range p {
+			w.out = escape(w.out, c, w.m)
+		}
+	}
+	if len(w.out) > 0 {
+		w.bol = w.out[len(w.out)-1] == '\n'
+	}
+	if _, err := w.w.Write(w.out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// hexDump appends p as hexdump -C like lines starting at offset off.
+// A short last line is padded so every chunk ends on a line of its
+// own.
+func hexDump(dst, p []byte, off int64) []byte {
+	const hex = "0123456789abcdef"
+	for len(p) > 0 {
+		n := len(p)
+		if n > 16 {
+			n = 16
+		}
+		dst = append(dst, fmt.Sprintf("%08x  ", off)...)
+		for i := 0; i < 16; i++ {
+			if i < n {
+				dst = append(dst, hex[p[i]>>4], hex[p[i]&0xf], ' ')
+			} else {
+				dst = append(dst, "   "...)
+			}
+			if i == 7 {
+				dst = append(dst, ' ')
+			}
+		}
+		dst = append(dst, " |"...)
+		for _, c := range p[:n] {
+			if c < 0x20 || c >= 0x7f {
+				c = '.'
+			}
+			dst = append(dst, c)
+		}
+		dst = append(dst, "|\n"...)
+		p = p[n:]
+		off += int64(n)
+	}
+	return dst
+}
+
+var cEscapes = map[byte]string{
+	0x00: `\0`, 0x07: `\a`, 0x08: `\b`, 0x09: `\t`, 0x0a: `\n`,
+	0x0b: `\v`, 0x0c: `\f`, 0x0d: `\r`, 0x1b: `\e`, '\\': `\\`,
+}
+
+// escape appends c in the escaped mode m. A LF is rendered and
+// still breaks the line.
+func escape(dst []byte, c byte, m Mode) []byte {
+	switch {
+	case c == '\\' && m == CESC:
+		dst = append(dst, `\\`...)
+	case c >= 0x20 && c < 0x7f:
+		dst = append(dst, c)
+	case m == MIXED:
+		dst = append(dst, fmt.Sprintf("<0x%02X>", c)...)
+	case m == CARET && c < 0x20:
+		dst = append(dst, '^', c+0x40)
+	case m == CARET && c == 0x7f:
+		dst = append(dst, "^?"...)
+	case m == CESC && cEscapes[c] != "":
+		dst = append(dst, cEscapes[c]...)
+	default:
+		dst = append(dst, fmt.Sprintf(`\x%02x`, c)...)
+	}
+	if c == '\n' {
+		dst = append(dst, '\n')
+	}
+	return dst
+}
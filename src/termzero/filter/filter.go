@@ -0,0 +1,185 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package filter offers io.Reader and io.Writer filters for the
+// byte stream of a serial port: line ending translation and local
+// echo. The map names follow picocom.
+package filter
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Map is a set of translations.
+type Map uint32
+
+const (
+	CR_LF   Map = 1 << iota // map CR to LF
+	CR_CRLF                 // map CR to CR LF
+	LF_CR                   // map LF to CR
+	LF_CRLF                 // map LF to CR LF
+	DROP_CR                 // ignore CR
+	DROP_LF                 // ignore LF
+	DEL_BS                  // map DEL to BS
+	BS_DEL                  // map BS to DEL
+)
+
+var mapNames = []string{
+	"crlf", "crcrlf", "lfcr", "lfcrlf", "igncr", "ignlf", "delbs", "bsdel",
+}
+
+// ParseMap parses a comma separated list of map names, e.g.
+// "crcrlf,delbs".
+func ParseMap(s string) (Map, error) {
+	var m Map
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		i := 0
+		for ; i < len(mapNames); i++ {
+			if mapNames[i] == f {
+				break
+			}
+		}
+		if i == len(mapNames) {
+			return 0, fmt.Errorf("unknown map %q, have %s",
+				f, strings.Join(mapNames, ", "))
+		}
+		m |= 1 << uint(i)
+	}
+	return m, nil
+}
+
+func (m Map) String() string {
+	var n []string
+	for i, s := range mapNames {
+		if m&(1<<uint(i)) != 0 {
+			n = append(n, s)
+		}
+	}
+	return strings.Join(n, ",")
+}
+
+// Translate appends the translated src to dst.
+func (m Map) Translate(dst, src []byte) []byte {
+	for _, c := range src {
+		switch {
+		case c == '\r' && m&DROP_CR != 0:
+		case c == '\r' && m&CR_CRLF != 0:
+			dst = append(dst, '\r', '\n')
+		case c == '\r' && m&CR_LF != 0:
+			dst = append(dst, '\n')
+		case c == '\n' && m&DROP_LF != 0:
+		case c == '\n' && m&LF_CRLF != 0:
+			dst = append(dst, '\r', '\n')
+		case c == '\n' && m&LF_CR != 0:
+			dst = append(dst, '\r')
+		case c == 0x7f && m&DEL_BS != 0:
+			dst = append(dst, 0x08)
+		case c == 0x08 && m&BS_DEL != 0:
+			dst = append(dst, 0x7f)
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+// Reader translates the bytes read from the underlying reader.
+type Reader struct {
+	r    io.Reader
+	m    Map
+	buf  []byte
+	out  []byte
+	pend []byte
+	err  error
+}
+
+func NewReader(r io.Reader, m Map) *Reader {
+	return &Reader{r: r, m: m, buf: make([]byte, 256)}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.m == 0 && len(r.pend) == 0 {
+		return r.r.Read(p)
+	}
+	for len(r.pend) == 0 {
+		if r.err != nil {
+			err := r.err
+			r.err = nil
+			return 0, err
+		}
+		var n int
+		n, r.err = r.r.Read(r.buf)
+		r.out = r.m.Translate(r.out[:0], r.buf[:n])
+		r.pend = r.out
+	}
+	n := copy(p, r.pend)
+	r.pend = r.pend[n:]
+	return n, nil
+}
+
+// Writer translates the bytes written to the underlying writer.
+type Writer struct {
+	w   io.Writer
+	m   Map
+	out []byte
+}
+
+func NewWriter(w io.Writer, m Map) *Writer {
+	return &Writer{w: w, m: m}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.m == 0 {
+		return w.w.Write(p)
+	}
+	w.out = w.m.Translate(w.out[:0], p)
+	if _, err := w.w.Write(w.out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Echo writes to the underlying writer and, while echoing is on,
+// copies whatever got written to the echo writer as well.
+type Echo struct {
+	w io.Writer
+	e io.Writer
+
+	mu sync.Mutex
+	on bool
+}
+
+func NewEcho(w, echo io.Writer, on bool) *Echo {
+	return &Echo{w: w, e: echo, on: on}
+}
+
+func (e *Echo) Write(p []byte) (int, error) {
+	n, err := e.w.Write(p)
+	if n > 0 && e.Echoing() {
+		// a broken echo is not worth failing the write
+		e.e.Write(p[:n])
+	}
+	return n, err
+}
+
+func (e *Echo) SetEcho(on bool) {
+	e.mu.Lock()
+	e.on = on
+	e.mu.Unlock()
+}
+
+func (e *Echo) Echoing() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.on
+}
@@ -0,0 +1,160 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"termzero/fwimage"
+	"termzero/link"
+	"termzero/msp430"
+	"termzero/stk500"
+	"termzero/stm32"
+)
+
+// Optiboot's rate on the Uno and most newer boards, the old
+// ATmega168 bootloaders want 19200.
+const AVR_BAUD = 115200
+
+// bootMode switches the port to the mode of a bootloader, e.g.
+// "9600,8E1", the returned function goes back to the session's mode.
+func (s *session) bootMode(mode string) (func(), error) {
+	m := s.mode
+	if err := m.Set(mode); err != nil {
+		return nil, err
+	}
+	if err := m.Apply(s.port); err != nil {
+		s.mode.Apply(s.port)
+		return nil, fmt.Errorf("setup serial port: %v", err)
+	}
+	return func() {
+		s.mode.Apply(s.port)
+		s.printf("\n*** back at %s\n", &s.mode)
+	}, nil
+}
+
+// cmdAVR: avr <file> [baud]
+func cmdAVR(s *session, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return cmdError("usage: avr <file> [baud]")
+	}
+	baud := strconv.Itoa(AVR_BAUD)
+	if len(args) == 2 {
+		if b, err := strconv.ParseUint(args[1], 10, 32); err != nil || b == 0 {
+			return cmdError("bad baud rate " + args[1])
+		}
+		baud = args[1]
+	}
+	m, err := fwimage.Load(args[0])
+	if err != nil {
+		return cmdError(err.Error())
+	}
+	name := "avr flash " + args[0]
+	// every byte counts when written and when verified
+	o := &stk500.Options{Progress: s.progress(name, 2*int64(m.Len()))}
+	return s.startTransfer(name, false, func(l *link.Link, abort <-chan struct{}) error {
+		restore, err := s.bootMode(baud)
+		if err != nil {
+			return err
+		}
+		defer restore()
+		if err := stk500.Reset(s.port); err != nil {
+			s.printf("\n*** can't reset (%v), press the reset button\n", err)
+		}
+		part, err := stk500.Flash(l, m, o)
+		if err != nil {
+			return err
+		}
+		s.printf("\n*** %s, %d bytes written and verified\n", part.Name, m.Len())
+		return nil
+	})
+}
+
+// cmdMSP: msp <file> [5xx]
+func cmdMSP(s *session, args []string) error {
+	if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "5xx") {
+		return cmdError("usage: msp <file> [5xx]")
+	}
+	m, err := fwimage.Load(args[0])
+	if err != nil {
+		return cmdError(err.Error())
+	}
+	name := "msp430 flash " + args[0]
+	o := &msp430.Options{Progress: s.progress(name, 2*int64(m.Len()))}
+	if len(args) == 2 {
+		o.Family = msp430.F5XX
+	}
+	return s.startTransfer(name, false, func(l *link.Link, abort <-chan struct{}) error {
+		restore, err := s.bootMode(msp430.BOOT_MODE)
+		if err != nil {
+			return err
+		}
+		defer restore()
+		if err := msp430.Enter(s.port); err != nil {
+			s.printf("\n*** can't enter the BSL (%v), do it by hand\n", err)
+		}
+		if err := msp430.Flash(l, m, o); err != nil {
+			return err
+		}
+		s.printf("\n*** %d bytes written and verified\n", m.Len())
+		if err := msp430.Reset(s.port); err != nil {
+			s.printf("\n*** can't reset (%v), press the reset button\n", err)
+		}
+		return nil
+	})
+}
+
+// cmdSTM32: stm32 <file> [addr], the address places a binary.
+func cmdSTM32(s *session, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return cmdError("usage: stm32 <file> [addr]")
+	}
+	addr := uint64(stm32.FLASH_BASE)
+	if len(args) == 2 {
+		var err error
+		if addr, err = strconv.ParseUint(args[1], 0, 32); err != nil {
+			return cmdError("bad address " + args[1])
+		}
+	}
+	var m *fwimage.Image
+	f, err := fwimage.FormatOf(args[0])
+	if err == nil && f == fwimage.BINARY {
+		var r *os.File
+		if r, err = os.Open(args[0]); err == nil {
+			m, err = fwimage.ReadBinary(r, uint32(addr))
+			r.Close()
+		}
+	} else if err == nil {
+		m, err = fwimage.Load(args[0])
+	}
+	if err != nil {
+		return cmdError(err.Error())
+	}
+	name := "stm32 flash " + args[0]
+	o := &stm32.Options{Progress: s.progress(name, 2*int64(m.Len()))}
+	return s.startTransfer(name, false, func(l *link.Link, abort <-chan struct{}) error {
+		restore, err := s.bootMode(stm32.BOOT_MODE)
+		if err != nil {
+			return err
+		}
+		defer restore()
+		if err := stm32.Enter(s.port); err != nil {
+			s.printf("\n*** can't start the bootloader (%v), do it by hand\n", err)
+		}
+		pid, err := stm32.Flash(l, m, o)
+		if err != nil {
+			return err
+		}
+		s.printf("\n*** %s, %d bytes written and verified\n", stm32.ChipName(pid), m.Len())
+		// Go started it, the next reset should too
+		s.port.SetRTS(false)
+		return nil
+	})
+}
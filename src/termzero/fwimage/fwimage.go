@@ -0,0 +1,320 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package fwimage holds firmware as a sparse memory image and reads
+// and writes it in the file formats of the microcontroller tool
+// chains: Intel HEX, Motorola S-records, TI-TXT and raw binaries.
+package fwimage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Segment is a run of contiguous bytes.
+type Segment struct {
+	Addr uint32
+	Data []byte
+}
+
+// End is the address after the segment.
+func (s Segment) End() uint32 {
+	return s.Addr + uint32(len(s.Data))
+}
+
+// Image is a sparse memory image, its segments are sorted, don't
+// overlap and adjacent ones are merged.
+type Image struct {
+	Segments []Segment
+	Start    uint32 // entry point, if the file had one
+	HasStart bool
+}
+
+// Write stores data at addr, over what was there.
+func (m *Image) Write(addr uint32, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	end := addr + uint32(len(data))
+	segs := m.Segments
+	// segs[i:j] overlap or are adjacent to the data
+	i := sort.Search(len(segs), func(i int) bool { return segs[i].End() >= addr })
+	j := sort.Search(len(segs), func(j int) bool { return segs[j].Addr > end })
+	if i == j {
+		segs = append(segs, Segment{})
+		copy(segs[i+1:], segs[i:])
+		segs[i] = Segment{addr, append([]byte(nil), data...)}
+		m.Segments = segs
+		return
+	}
+	// merge them, the data wins
+	lo, hi := segs[i].Addr, segs[j-1].End()
+	if addr < lo {
+		lo = addr
+	}
+	if end > hi {
+		hi = end
+	}
+	s := &segs[i]
+	if s.Addr == lo {
+		// grown in place, records in order don't copy it over
+		s.Data = append(s.Data, make([]byte, hi-s.End())...)
+	} else {
+		b := make([]byte, hi-lo)
+		copy(b[s.Addr-lo:], s.Data)
+		*s = Segment{lo, b}
+	}
+	for _, t := range segs[i+1 : j] {
+		copy(s.Data[t.Addr-lo:], t.Data)
+	}
+	copy(s.Data[addr-lo:], data)
+	m.Segments = append(segs[:i+1], segs[j:]...)
+}
+
+// Len is the number of bytes in the image.
+func (m *Image) Len() int {
+	n := 0
+	for _, s := range m.Segments {
+		n += len(s.Data)
+	}
+	return n
+}
+
+// Bounds returns the lowest and the address after the highest byte.
+func (m *Image) Bounds() (lo, hi uint32) {
+	if len(m.Segments) == 0 {
+		return 0, 0
+	}
+	return m.Segments[0].Addr, m.Segments[len(m.Segments)-1].End()
+}
+
+// Count is the number of image bytes in [lo, hi).
+func (m *Image) Count(lo, hi uint32) int {
+	n := 0
+	for _, s := range m.Segments {
+		a, b := s.Addr, s.End()
+		if a < lo {
+			a = lo
+		}
+		if b > hi {
+			b = hi
+		}
+		if a < b {
+			n += int(b - a)
+		}
+	}
+	return n
+}
+
+// Pages cuts the image into the pages of size bytes it touches,
+// filling the gaps with fill.
+func (m *Image) Pages(size int, fill byte) []Segment {
+	var pages []Segment
+	for _, s := range m.Segments {
+		for a := s.Addr - s.Addr%uint32(size); a < s.End(); a += uint32(size) {
+			if n := len(pages); n > 0 && pages[n-1].Addr == a {
+				// shared with the segment before
+				m.fill(pages[n-1], s)
+				continue
+			}
+			p := Segment{a, make([]byte, size)}
+			for i := range p.Data {
+				p.Data[i] = fill
+			}
+			m.fill(p, s)
+			pages = append(pages, p)
+		}
+	}
+	return pages
+}
+
+// fill copies the part of s inside page p.
+func (m *Image) fill(p, s Segment) {
+	lo, hi := p.Addr, p.End()
+	if s.Addr > lo {
+		lo = s.Addr
+	}
+	if s.End() < hi {
+		hi = s.End()
+	}
+	if lo < hi {
+		copy(p.Data[lo-p.Addr:], s.Data[lo-s.Addr:hi-s.Addr])
+	}
+}
+
+// Merge writes the segments of o over m.
+func (m *Image) Merge(o *Image) {
+	for _, s := range o.Segments {
+		m.Write(s.Addr, s.Data)
+	}
+	if o.HasStart {
+		m.Start, m.HasStart = o.Start, true
+	}
+}
+
+// Fill fills the gaps in [lo, hi) with fill, the data stays.
+func (m *Image) Fill(lo, hi uint32, fill byte) {
+	if lo >= hi {
+		return
+	}
+	b := make([]byte, hi-lo)
+	for i := range b {
+		b[i] = fill
+	}
+	f := &Image{}
+	f.Write(lo, b)
+	f.Merge(m)
+	m.Segments = f.Segments
+}
+
+// Flat returns the image as one run of bytes from its lowest address,
+// the gaps filled with fill.
+func (m *Image) Flat(fill byte) (uint32, []byte) {
+	lo, hi := m.Bounds()
+	f := &Image{Segments: m.Segments}
+	f.Fill(lo, hi, fill)
+	if len(f.Segments) == 0 {
+		return 0, nil
+	}
+	return lo, f.Segments[0].Data
+}
+
+// Error is a syntax error in an image file.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// ReadBinary reads a raw binary that goes to addr.
+func ReadBinary(r io.Reader, addr uint32) (*Image, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &Image{}
+	m.Write(addr, b)
+	return m, nil
+}
+
+// Format is a file format of images.
+type Format int
+
+const (
+	BINARY Format = iota // raw bytes, at address 0 when read
+	IHEX                 // Intel HEX
+	SREC                 // Motorola S-record
+	TITXT                // TI-TXT
+)
+
+var formatNames = []string{"bin", "ihex", "srec", "titxt"}
+
+func ParseFormat(s string) (Format, error) {
+	for i, n := range formatNames {
+		if n == s {
+			return Format(i), nil
+		}
+	}
+	return BINARY, fmt.Errorf("unknown image format %q, have %s",
+		s, strings.Join(formatNames, ", "))
+}
+
+func (f Format) String() string {
+	if f < 0 || int(f) >= len(formatNames) {
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+	return formatNames[f]
+}
+
+// FormatOf guesses the format of the file name from its extension.
+func FormatOf(name string) (Format, error) {
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".bin":
+		return BINARY, nil
+	case ".hex", ".ihx", ".ihex":
+		return IHEX, nil
+	case ".srec", ".s19", ".s28", ".s37", ".mot":
+		return SREC, nil
+	case ".txt":
+		return TITXT, nil
+	default:
+		return BINARY, fmt.Errorf("%s: unknown image format %q", name, ext)
+	}
+}
+
+// Read reads an image in the format f.
+func Read(r io.Reader, f Format) (*Image, error) {
+	switch f {
+	case IHEX:
+		return ReadIntelHex(r)
+	case SREC:
+		return ReadSRecord(r)
+	case TITXT:
+		return ReadTITxt(r)
+	}
+	return ReadBinary(r, 0)
+}
+
+// Write writes m in the format f, the gaps of a binary filled with
+// fill.
+func Write(w io.Writer, m *Image, f Format, fill byte) error {
+	switch f {
+	case IHEX:
+		return WriteIntelHex(w, m)
+	case SREC:
+		return WriteSRecord(w, m)
+	case TITXT:
+		return WriteTITxt(w, m)
+	}
+	_, b := m.Flat(fill)
+	_, err := w.Write(b)
+	return err
+}
+
+// Load reads the image file name, the format comes from the
+// extension.
+func Load(name string) (*Image, error) {
+	f, err := FormatOf(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	m, err := Read(r, f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return m, nil
+}
+
+// Save writes m to the file name, the format comes from the
+// extension.
+func Save(name string, m *Image, fill byte) error {
+	f, err := FormatOf(name)
+	if err != nil {
+		return err
+	}
+	w, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = Write(w, m, f, fill)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,231 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package fwimage
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// image returns an image with a segment across a 64K boundary, one
+// above it and the start at base.
+func image(base uint32) *Image {
+	m := &Image{Start: base + 1, HasStart: true}
+	d := make([]byte, 40)
+	for i := range d {
+		d[i] = byte(i * 7)
+	}
+	m.Write(base+0xfff0, d)
+	m.Write(base+0x20000, []byte("tail"))
+	return m
+}
+
+// roundTrip writes m in f and reads it back.
+func roundTrip(t *testing.T, m *Image, f Format) (*Image, string) {
+	t.Helper()
+	var b bytes.Buffer
+	if err := Write(&b, m, f, 0xff); err != nil {
+		t.Fatal(err)
+	}
+	text := b.String()
+	got, err := Read(&b, f)
+	if err != nil {
+		t.Fatalf("%s: %v\n%s", f, err, text)
+	}
+	return got, text
+}
+
+func TestIntelHex(t *testing.T) {
+	m := image(0)
+	got, text := roundTrip(t, m, IHEX)
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("read back %+v", got)
+	}
+	// a record up to the boundary, a linear address record, the rest
+	for _, r := range []string{":10FFF0", ":020000040001F9\n:10000000"} {
+		if !strings.Contains(text, r) {
+			t.Errorf("no %s in\n%s", r, text)
+		}
+	}
+
+	// extended segment addresses, base << 4
+	in := rec(IHEX_EXT_SEGMENT, 0, 0x10, 0x00) + rec(IHEX_DATA, 0x0010, 1, 2, 3) +
+		rec(IHEX_START_SEG, 0, 0x10, 0x00, 0x00, 0x10) + rec(IHEX_EOF, 0)
+	m, err := ReadIntelHex(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Segment{{0x10010, []byte{1, 2, 3}}}
+	if !reflect.DeepEqual(m.Segments, want) || m.Start != 0x10010 {
+		t.Errorf("segments %v, start %#x", m.Segments, m.Start)
+	}
+}
+
+// rec returns an Intel HEX record.
+func rec(typ byte, addr uint16, data ...byte) string {
+	b := append([]byte{byte(len(data)), byte(addr >> 8), byte(addr), typ}, data...)
+	var sum byte
+	for _, c := range b {
+		sum += c
+	}
+	return fmt.Sprintf(":%X\n", append(b, -sum))
+}
+
+func TestSRecord(t *testing.T) {
+	for _, c := range []struct {
+		base uint32
+		typ  string
+	}{
+		{0, "S2"}, // 0x20004 needs 24 bits
+		{0x1000000, "S3"},
+	} {
+		m := image(c.base)
+		got, text := roundTrip(t, m, SREC)
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("%s: read back %+v", c.typ, got)
+		}
+		if !strings.HasPrefix(text, c.typ) {
+			t.Errorf("%s: written as\n%s", c.typ, text)
+		}
+		// 40 bytes in two records, 4 in one
+		if !strings.Contains(text, "\nS5030003F9\n") {
+			t.Errorf("%s: no count of 3 in\n%s", c.typ, text)
+		}
+	}
+	m := &Image{}
+	m.Write(0x1234, []byte("short"))
+	if _, text := roundTrip(t, m, SREC); !strings.HasPrefix(text, "S1") {
+		t.Errorf("16 bit addresses written as\n%s", text)
+	}
+
+	// a wrong count
+	var b bytes.Buffer
+	WriteSRecord(&b, m)
+	text := strings.Replace(b.String(), "S5030001FB", "S5030002FA", 1)
+	_, err := ReadSRecord(strings.NewReader(text))
+	if e, ok := err.(*Error); !ok || e.Line != 2 || !strings.Contains(e.Msg, "count 2") {
+		t.Errorf("wrong count: %v", err)
+	}
+}
+
+func TestTITxt(t *testing.T) {
+	m := image(0)
+	m.HasStart, m.Start = false, 0 // TI-TXT has none
+	got, text := roundTrip(t, m, TITXT)
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("read back %+v", got)
+	}
+	if !strings.HasPrefix(text, "@FFF0\n00 07 0E") || !strings.HasSuffix(text, "\nq\n") {
+		t.Errorf("written as\n%s", text)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, c := range []struct {
+		f    Format
+		in   string
+		line int
+		msg  string
+	}{
+		{IHEX, rec(IHEX_DATA, 0, 1) + ":0100000002FC\n", 2, "checksum 0xfc, want 0xfd"},
+		{IHEX, rec(IHEX_DATA, 0, 1) + "\n" + rec(IHEX_DATA, 1, 2), 3, "missing end of file record"},
+		{IHEX, "01000000FF\n", 1, "missing ':'"},
+		{SREC, "S1050000010200\n", 1, "checksum 0x00, want 0xf7"},
+		{SREC, "S4030000FC\n", 1, "unknown record type S4"},
+		{TITXT, "@100\n01 02\n03 4\nq\n", 3, "bad byte 4"},
+		{TITXT, "@100\n01 02\n", 2, "missing q at the end"},
+		{TITXT, "01\nq\n", 1, "data before the first address"},
+	} {
+		_, err := Read(strings.NewReader(c.in), c.f)
+		want := fmt.Sprintf("line %d: %s", c.line, c.msg)
+		if e, ok := err.(*Error); !ok || e.Error() != want {
+			t.Errorf("%s %q: got %v, want %s", c.f, c.in, err, want)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	m := &Image{}
+	m.Write(0x100, []byte("aaaa"))
+	m.Write(0x102, []byte("bbbb")) // over the end
+	m.Write(0x106, []byte("c"))    // adjacent
+	m.Write(0xfe, []byte("dd"))    // adjacent before
+	m.Write(0x200, []byte("x"))
+	m.Write(0x110, []byte("y"))
+	m.Write(0x101, []byte("e")) // inside
+	want := []Segment{
+		{0xfe, []byte("ddaebbbbc")},
+		{0x110, []byte("y")},
+		{0x200, []byte("x")},
+	}
+	if !reflect.DeepEqual(m.Segments, want) {
+		t.Errorf("segments %v", m.Segments)
+	}
+	// one over all
+	m.Write(0xf0, bytes.Repeat([]byte("z"), 0x120))
+	if len(m.Segments) != 1 || m.Len() != 0x120 || m.Count(0x100, 0x200) != 0x100 {
+		t.Errorf("segments %v", m.Segments)
+	}
+
+	// records in order, from a reused buffer
+	m = &Image{}
+	buf := make([]byte, 16)
+	for a := 0; a < 0x10000; a += len(buf) {
+		for k := range buf {
+			buf[k] = byte(a >> 4)
+		}
+		m.Write(uint32(a), buf)
+	}
+	if len(m.Segments) != 1 || m.Len() != 0x10000 || m.Segments[0].Data[0x1230] != 0x23 {
+		t.Errorf("%d segments, %d bytes", len(m.Segments), m.Len())
+	}
+}
+
+func TestPages(t *testing.T) {
+	m := &Image{}
+	m.Write(0x101, []byte{1, 2, 3})
+	m.Write(0x1fe, []byte{4, 5, 6, 7})
+	m.Write(0x400, []byte{8})
+	pages := m.Pages(0x100, 0xff)
+	if len(pages) != 3 {
+		t.Fatalf("%d pages", len(pages))
+	}
+	for i, a := range []uint32{0x100, 0x200, 0x400} {
+		if p := pages[i]; p.Addr != a || len(p.Data) != 0x100 {
+			t.Errorf("page %d at %#x, %d bytes", i, p.Addr, len(p.Data))
+		}
+	}
+	p := pages[0].Data
+	if p[0] != 0xff || p[1] != 1 || p[3] != 3 || p[4] != 0xff || p[0xfe] != 4 || p[0xff] != 5 {
+		t.Errorf("first page % x", p[:8])
+	}
+	if p := pages[1].Data; p[0] != 6 || p[1] != 7 || p[2] != 0xff {
+		t.Errorf("second page % x", p[:4])
+	}
+}
+
+func TestFill(t *testing.T) {
+	m := &Image{}
+	m.Write(0x104, []byte{1, 2})
+	m.Write(0x10a, []byte{3})
+	m.Fill(0x100, 0x110, 0xff)
+	want := []Segment{{0x100, []byte{0xff, 0xff, 0xff, 0xff, 1, 2, 0xff, 0xff,
+		0xff, 0xff, 3, 0xff, 0xff, 0xff, 0xff, 0xff}}}
+	if !reflect.DeepEqual(m.Segments, want) {
+		t.Errorf("filled % x", m.Segments)
+	}
+
+	m = &Image{}
+	m.Write(0x10, []byte{1})
+	m.Write(0x13, []byte{2})
+	if lo, b := m.Flat(0); lo != 0x10 || !bytes.Equal(b, []byte{1, 0, 0, 2}) {
+		t.Errorf("flat at %#x: % x", lo, b)
+	}
+}
@@ -0,0 +1,133 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package fwimage
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Intel HEX record types.
+const (
+	IHEX_DATA         = 0
+	IHEX_EOF          = 1
+	IHEX_EXT_SEGMENT  = 2 // base = value << 4
+	IHEX_START_SEG    = 3 // CS:IP
+	IHEX_EXT_LINEAR   = 4 // base = value << 16
+	IHEX_START_LINEAR = 5 // EIP
+)
+
+// ReadIntelHex reads an Intel HEX file, up to the end of file record.
+func ReadIntelHex(r io.Reader) (*Image, error) {
+	m := &Image{}
+	sc := bufio.NewScanner(r)
+	var base uint32
+	line := 0
+	for sc.Scan() {
+		line++
+		t := strings.TrimSpace(sc.Text())
+		if t == "" {
+			continue
+		}
+		if t[0] != ':' {
+			return nil, &Error{line, "missing ':'"}
+		}
+		b, err := hex.DecodeString(t[1:])
+		if err != nil {
+			return nil, &Error{line, "bad hex digits"}
+		}
+		if len(b) < 5 || len(b) != 5+int(b[0]) {
+			return nil, &Error{line, "bad record length"}
+		}
+		var sum byte
+		for _, c := range b {
+			sum += c
+		}
+		if sum != 0 {
+			return nil, &Error{line, fmt.Sprintf("checksum 0x%02x, want 0x%02x",
+				b[len(b)-1], b[len(b)-1]-sum)}
+		}
+		addr := uint32(b[1])<<8 | uint32(b[2])
+		data := b[4 : len(b)-1]
+		switch b[3] {
+		case IHEX_DATA:
+			m.Write(base+addr, data)
+		case IHEX_EOF:
+			return m, nil
+		case IHEX_EXT_SEGMENT, IHEX_EXT_LINEAR:
+			if len(data) != 2 {
+				return nil, &Error{line, "bad address record"}
+			}
+			base = uint32(data[0])<<8 | uint32(data[1])
+			if b[3] == IHEX_EXT_SEGMENT {
+				base <<= 4
+			} else {
+				base <<= 16
+			}
+		case IHEX_START_SEG, IHEX_START_LINEAR:
+			if len(data) != 4 {
+				return nil, &Error{line, "bad start record"}
+			}
+			v := uint32(data[0])<<24 | uint32(data[1])<<16 |
+				uint32(data[2])<<8 | uint32(data[3])
+			if b[3] == IHEX_START_SEG {
+				// CS:IP
+				v = v>>16<<4 + v&0xffff
+			}
+			m.Start, m.HasStart = v, true
+		default:
+			return nil, &Error{line, fmt.Sprintf("unknown record type %d", b[3])}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, &Error{line, "missing end of file record"}
+}
+
+// WriteIntelHex writes m as Intel HEX, 16 data bytes per record and
+// extended linear address records above 64K.
+func WriteIntelHex(w io.Writer, m *Image) error {
+	bw := bufio.NewWriter(w)
+	rec := func(typ byte, addr uint16, data []byte) {
+		b := append([]byte{byte(len(data)), byte(addr >> 8), byte(addr), typ}, data...)
+		var sum byte
+		for _, c := range b {
+			sum += c
+		}
+		fmt.Fprintf(bw, ":%X\n", append(b, -sum))
+	}
+	var base uint32
+	for _, s := range m.Segments {
+		for off := 0; off < len(s.Data); {
+			a := s.Addr + uint32(off)
+			if a&^0xffff != base {
+				base = a &^ 0xffff
+				rec(IHEX_EXT_LINEAR, 0, []byte{byte(base >> 24), byte(base >> 16)})
+			}
+			// not across a 64K boundary
+			n := 16
+			if k := int(0x10000 - a&0xffff); k < n {
+				n = k
+			}
+			if k := len(s.Data) - off; k < n {
+				n = k
+			}
+			rec(IHEX_DATA, uint16(a), s.Data[off:off+n])
+			off += n
+		}
+	}
+	if m.HasStart {
+		a := m.Start
+		rec(IHEX_START_LINEAR, 0, []byte{byte(a >> 24), byte(a >> 16), byte(a >> 8), byte(a)})
+	}
+	rec(IHEX_EOF, 0, nil)
+	return bw.Flush()
+}
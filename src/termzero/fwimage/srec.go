@@ -0,0 +1,136 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package fwimage
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ReadSRecord reads a Motorola S-record file. The S1/S2/S3 data
+// records carry 16, 24 and 32 bit addresses, S7/S8/S9 the start.
+func ReadSRecord(r io.Reader) (*Image, error) {
+	m := &Image{}
+	sc := bufio.NewScanner(r)
+	line := 0
+	records := 0 // data records, for S5/S6
+	for sc.Scan() {
+		line++
+		t := strings.TrimSpace(sc.Text())
+		if t == "" {
+			continue
+		}
+		if len(t) < 4 || t[0] != 'S' && t[0] != 's' {
+			return nil, &Error{line, "missing 'S'"}
+		}
+		b, err := hex.DecodeString(t[2:])
+		if err != nil {
+			return nil, &Error{line, "bad hex digits"}
+		}
+		if len(b) < 3 || len(b) != 1+int(b[0]) {
+			return nil, &Error{line, "bad record length"}
+		}
+		var sum byte
+		for _, c := range b[:len(b)-1] {
+			sum += c
+		}
+		if ^sum != b[len(b)-1] {
+			return nil, &Error{line, fmt.Sprintf("checksum 0x%02x, want 0x%02x",
+				b[len(b)-1], ^sum)}
+		}
+		typ := t[1]
+		n := 0 // address bytes
+		switch typ {
+		case '0', '1', '5', '9':
+			n = 2
+		case '2', '6', '8':
+			n = 3
+		case '3', '7':
+			n = 4
+		default:
+			return nil, &Error{line, fmt.Sprintf("unknown record type S%c", typ)}
+		}
+		if len(b) < 2+n {
+			return nil, &Error{line, "record too short for its address"}
+		}
+		var addr uint32
+		for _, c := range b[1 : 1+n] {
+			addr = addr<<8 | uint32(c)
+		}
+		data := b[1+n : len(b)-1]
+		switch typ {
+		case '1', '2', '3':
+			m.Write(addr, data)
+			records++
+		case '5', '6':
+			if int(addr) != records {
+				return nil, &Error{line, fmt.Sprintf("record count %d, have %d", addr, records)}
+			}
+		case '7', '8', '9':
+			m.Start, m.HasStart = addr, true
+			return m, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if line == 0 {
+		return nil, &Error{line, "empty file"}
+	}
+	// the termination record is optional in practice
+	return m, nil
+}
+
+// WriteSRecord writes m as S-records with the shortest addresses
+// that fit, 32 data bytes per record.
+func WriteSRecord(w io.Writer, m *Image) error {
+	bw := bufio.NewWriter(w)
+	_, hi := m.Bounds()
+	if m.HasStart && m.Start >= hi {
+		hi = m.Start + 1
+	}
+	n, typ := 2, byte('1')
+	switch {
+	case hi > 1<<24:
+		n, typ = 4, '3'
+	case hi > 1<<16:
+		n, typ = 3, '2'
+	}
+	rec := func(typ byte, n int, addr uint32, data []byte) {
+		b := []byte{byte(n + len(data) + 1)}
+		for i := n - 1; i >= 0; i-- {
+			b = append(b, byte(addr>>(8*uint(i))))
+		}
+		b = append(b, data...)
+		var sum byte
+		for _, c := range b {
+			sum += c
+		}
+		fmt.Fprintf(bw, "S%c%X\n", typ, append(b, ^sum))
+	}
+	records := 0
+	for _, s := range m.Segments {
+		for off := 0; off < len(s.Data); off += 32 {
+			d := s.Data[off:]
+			if len(d) > 32 {
+				d = d[:32]
+			}
+			rec(typ, n, s.Addr+uint32(off), d)
+			records++
+		}
+	}
+	if records <= 0xffff {
+		rec('5', 2, uint32(records), nil)
+	} else {
+		rec('6', 3, uint32(records), nil)
+	}
+	rec('9'-(typ-'1'), n, m.Start, nil)
+	return bw.Flush()
+}
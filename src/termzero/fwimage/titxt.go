@@ -0,0 +1,82 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package fwimage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ReadTITxt reads a TI-TXT file: "@ADDR" lines start a section, hex
+// bytes follow, "q" ends the file.
+func ReadTITxt(r io.Reader) (*Image, error) {
+	m := &Image{}
+	sc := bufio.NewScanner(r)
+	var addr uint32
+	have := false // seen an address
+	line := 0
+	for sc.Scan() {
+		line++
+		t := strings.TrimSpace(sc.Text())
+		switch {
+		case t == "":
+			continue
+		case t == "q" || t == "Q":
+			return m, nil
+		case t[0] == '@':
+			a, err := strconv.ParseUint(t[1:], 16, 32)
+			if err != nil {
+				return nil, &Error{line, "bad address " + t}
+			}
+			addr, have = uint32(a), true
+			continue
+		}
+		if !have {
+			return nil, &Error{line, "data before the first address"}
+		}
+		var data []byte
+		for _, f := range strings.Fields(t) {
+			b, err := strconv.ParseUint(f, 16, 8)
+			if err != nil || len(f) != 2 {
+				return nil, &Error{line, "bad byte " + f}
+			}
+			data = append(data, byte(b))
+		}
+		m.Write(addr, data)
+		addr += uint32(len(data))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, &Error{line, "missing q at the end"}
+}
+
+// WriteTITxt writes m as TI-TXT, 16 bytes per line.
+func WriteTITxt(w io.Writer, m *Image) error {
+	bw := bufio.NewWriter(w)
+	for _, s := range m.Segments {
+		fmt.Fprintf(bw, "@%04X\n", s.Addr)
+		for off := 0; off < len(s.Data); off += 16 {
+			d := s.Data[off:]
+			if len(d) > 16 {
+				d = d[:16]
+			}
+			for i, c := range d {
+				if i > 0 {
+					bw.WriteByte(' ')
+				}
+				fmt.Fprintf(bw, "%02X", c)
+			}
+			bw.WriteByte('\n')
+		}
+	}
+	bw.WriteString("q\n")
+	return bw.Flush()
+}
@@ -0,0 +1,119 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package input turns typed lines into the bytes to send: hex
+// dumps like "01 03 00 00 00 0A C5 CD" or escaped text like
+// "\x02STATUS\x03".
+package input
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Mode int
+
+const (
+	TEXT Mode = iota // keys are sent as typed
+	HEX              // lines of hex bytes
+	ESC              // lines of text with C escapes
+)
+
+var modeNames = []string{"text", "hex", "esc"}
+
+func ParseMode(s string) (Mode, error) {
+	for i, n := range modeNames {
+		if n == s {
+			return Mode(i), nil
+		}
+	}
+	return TEXT, fmt.Errorf("unknown input mode %q, have %s",
+		s, strings.Join(modeNames, ", "))
+}
+
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(modeNames) {
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+	return modeNames[m]
+}
+
+// Parse parses line according to m, TEXT returns it unchanged.
+func Parse(m Mode, line string) ([]byte, error) {
+	switch m {
+	case HEX:
+		return ParseHex(line)
+	case ESC:
+		return Unescape(line)
+	}
+	return []byte(line), nil
+}
+
+// ParseHex parses hex bytes. They may be separated by white space,
+// commas or colons and carry a 0x prefix; runs of digits are taken
+// two at a time, so "0103" is the same as "01 03".
+func ParseHex(s string) ([]byte, error) {
+	var b []byte
+	f := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ',' || r == ':'
+	})
+	for _, h := range f {
+		if strings.HasPrefix(h, "0x") || strings.HasPrefix(h, "0X") {
+			h = h[2:]
+		}
+		if len(h)%2 != 0 {
+			return nil, fmt.Errorf("odd number of hex digits in %q", h)
+		}
+		for i := 0; i < len(h); i += 2 {
+			v, err := strconv.ParseUint(h[i:i+2], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("bad hex byte %q", h[i:i+2])
+			}
+			b = append(b, byte(v))
+		}
+	}
+	return b, nil
+}
+
+var escapes = map[byte]byte{
+	'0': 0x00, 'a': 0x07, 'b': 0x08, 't': 0x09, 'n': 0x0a,
+	'v': 0x0b, 'f': 0x0c, 'r': 0x0d, 'e': 0x1b, '\\': '\\',
+}
+
+// Unescape resolves the C escapes \xNN, \0, \a, \b, \t, \n, \v, \f,
+// \r, \e and \\ in s.
+func Unescape(s string) ([]byte, error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return nil, fmt.Errorf("trailing \\")
+		}
+		if s[i] == 'x' {
+			if i+3 > len(s) {
+				return nil, fmt.Errorf("short \\x escape at %d", i-1)
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("bad \\x escape %q", s[i-1:i+3])
+			}
+			b = append(b, byte(v))
+			i += 2
+			continue
+		}
+		c, ok := escapes[s[i]]
+		if !ok {
+			return nil, fmt.Errorf("unknown escape \\%c", s[i])
+		}
+		b = append(b, c)
+	}
+	return b, nil
+}
@@ -0,0 +1,65 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package input
+
+import "fmt"
+
+// Token is a word, a "literal" or a /regex/ of a script line.
+type Token struct {
+	S      string
+	Quoted bool // a "literal", unescaped
+	Regex  bool // a /regex/, as written but \/
+}
+
+// Tokenize splits a line of a rule or script file into words,
+// "literals" and /regexes/, up to a # outside of them.
+func Tokenize(line string) ([]Token, error) {
+	var ts []Token
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c == '#':
+			return ts, nil
+		case c == '"' || c == '/':
+			var b []byte
+			j := i + 1
+			for ; j < len(line) && line[j] != c; j++ {
+				if line[j] == '\\' && j+1 < len(line) {
+					j++
+					if line[j] != c {
+						b = append(b, '\\')
+					}
+				}
+				b = append(b, line[j])
+			}
+			if j == len(line) {
+				return nil, fmt.Errorf("no closing %c", c)
+			}
+			t := Token{S: string(b), Regex: c == '/', Quoted: c == '"'}
+			if t.Quoted {
+				u, err := Unescape(t.S)
+				if err != nil {
+					return nil, err
+				}
+				t.S = string(u)
+			}
+			ts = append(ts, t)
+			i = j + 1
+		default:
+			j := i
+			for j < len(line) && line[j] != ' ' && line[j] != '\t' {
+				j++
+			}
+			ts = append(ts, Token{S: line[i:j]})
+			i = j
+		}
+	}
+	return ts, nil
+}
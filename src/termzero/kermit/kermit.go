@@ -0,0 +1,549 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package kermit implements the Kermit file transfer protocol on top
+// of a link.Link: stop-and-wait with block check types 1 to 3, long
+// packets, control, 8th bit and repeat prefixing, attribute packets
+// and text or binary files. Sliding windows are not supported, the
+// Send-Init always offers a window of 1.
+package kermit
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"termzero/cksum"
+	"termzero/link"
+)
+
+const (
+	SOH = 0x01 // packet mark
+
+	// capabilities
+	capLong = 2 // extended length packets
+	capWin  = 4 // sliding windows
+	capAttr = 8 // attribute packets
+
+	maxShort = 94   // longest LEN of a normal packet
+	maxLong  = 9024 // longest packet we offer
+)
+
+var (
+	ErrRetries = errors.New("kermit: too many retries")
+	ErrSkip    = errors.New("kermit: skip file")
+
+	errPacket = errors.New("kermit: bad packet")
+)
+
+// PeerError is an error packet of the peer.
+type PeerError string
+
+func (e PeerError) Error() string {
+	return "kermit: peer: " + string(e)
+}
+
+type Options struct {
+	// Text converts the line ends of sent files to CRLF and marks
+	// them as text, received text files get LF line ends.
+	Text bool
+	// SevenBit asks for prefixing of the 8th bit, for lines with
+	// parity.
+	SevenBit bool
+	Check    int           // block check type 1, 2 or 3, 3 if 0
+	MaxLen   int           // longest packet, 94 or less disables long packets, 4096 if 0
+	Retries  int           // 10 if 0
+	Timeout  time.Duration // for a packet, 5s if 0
+	Progress func(n int64) // called with the file bytes transferred so far
+}
+
+func (o *Options) retries() int {
+	if o.Retries == 0 {
+		return 10
+	}
+	return o.Retries
+}
+
+func (o *Options) timeout() time.Duration {
+	if o.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return o.Timeout
+}
+
+func (o *Options) check() int {
+	if o.Check < 1 || o.Check > 3 {
+		return 3
+	}
+	return o.Check
+}
+
+func (o *Options) maxLen() int {
+	switch {
+	case o.MaxLen == 0:
+		return 4096
+	case o.MaxLen > maxLong:
+		return maxLong
+	}
+	return o.MaxLen
+}
+
+func (o *Options) progress(n int64) {
+	if o.Progress != nil {
+		o.Progress(n)
+	}
+}
+
+func tochar(x int) byte { return byte(x + 32) }
+func unchar(c byte) int { return int(c) - 32 }
+func ctl(c byte) byte   { return c ^ 64 }
+
+// params are the Send-Init parameters of a side.
+type params struct {
+	maxl  int  // longest normal packet
+	time  int  // timeout in seconds
+	npad  int  // padding before a packet
+	padc  byte // padding character
+	eol   byte // ends a packet
+	qctl  byte // control prefix
+	qbin  byte // 8th bit prefix, 'Y' will, 'N' won't
+	chkt  int  // block check type
+	rept  byte // repeat prefix, ' ' none
+	capas int
+	maxlx int // longest long packet
+}
+
+func (p *params) encode() []byte {
+	return []byte{
+		tochar(p.maxl), tochar(p.time), tochar(p.npad), ctl(p.padc),
+		tochar(int(p.eol)), p.qctl, p.qbin, byte('0' + p.chkt), p.rept,
+		tochar(p.capas), tochar(1), tochar(p.maxlx / 95), tochar(p.maxlx % 95),
+	}
+}
+
+// parseParams parses the data of a Send-Init or its ACK, missing
+// fields get the defaults of the protocol.
+func parseParams(d []byte) *params {
+	p := &params{maxl: 80, time: 5, eol: '\r', qctl: '#', qbin: ' ', chkt: 1, rept: ' ', maxlx: 500}
+	field := func(i int) (byte, bool) {
+		if i < len(d) && d[i] != ' ' {
+			return d[i], true
+		}
+		return 0, false
+	}
+	if c, ok := field(0); ok {
+		p.maxl = unchar(c)
+	}
+	if c, ok := field(1); ok {
+		p.time = unchar(c)
+	}
+	if c, ok := field(2); ok {
+		p.npad = unchar(c)
+	}
+	if c, ok := field(3); ok {
+		p.padc = ctl(c)
+	}
+	if c, ok := field(4); ok {
+		p.eol = byte(unchar(c))
+	}
+	if c, ok := field(5); ok {
+		p.qctl = c
+	}
+	if c, ok := field(6); ok {
+		p.qbin = c
+	}
+	if c, ok := field(7); ok && c >= '1' && c <= '3' {
+		p.chkt = int(c - '0')
+	}
+	if c, ok := field(8); ok {
+		p.rept = c
+	}
+	// the capability bytes end with a byte without bit 0
+	i := 9
+	for ; i < len(d); i++ {
+		c := unchar(d[i])
+		if i == 9 {
+			p.capas = c
+		}
+		if c&1 == 0 {
+			break
+		}
+	}
+	// window, then the long packet length
+	if i += 2; i+1 < len(d) && p.capas&capLong != 0 {
+		p.maxlx = unchar(d[i])*95 + unchar(d[i+1])
+	}
+	if p.maxl < 10 {
+		p.maxl = 80
+	}
+	return p
+}
+
+// prefixed reports whether c is usable as 8th bit or repeat prefix.
+func prefixed(c byte) bool {
+	return c >= 33 && c <= 62 || c >= 96 && c <= 126
+}
+
+// conn sends and receives packets with the negotiated parameters.
+type conn struct {
+	l   *link.Link
+	o   *Options
+	me  *params
+	seq int // of the next packet
+
+	chk   int  // block check in use
+	maxl  int  // longest packet the peer takes
+	long  bool // extended length packets
+	attrs bool // attribute packets
+	eol   byte
+	npad  int
+	padc  byte
+	qbin  byte // 0 if not prefixing
+	rept  byte // 0 if not compressing
+	rqctl byte // control prefix of the peer, ours is '#'
+}
+
+func newConn(l *link.Link, o *Options) *conn {
+	qbin := byte('Y')
+	if o.SevenBit {
+		qbin = '&'
+	}
+	me := &params{
+		maxl: o.maxLen(), time: int(o.timeout() / time.Second), padc: 0, eol: '\r',
+		qctl: '#', qbin: qbin, chkt: o.check(), rept: '~', maxlx: o.maxLen(),
+	}
+	if me.maxlx > maxShort {
+		me.maxl = maxShort
+		me.capas = capLong | capAttr
+	} else {
+		me.capas = capAttr
+	}
+	return &conn{l: l, o: o, me: me, chk: 1, maxl: 80, eol: '\r', rqctl: '#'}
+}
+
+// negotiate applies the peer's Send-Init parameters.
+func (c *conn) negotiate(peer *params) {
+	if peer.chkt == c.me.chkt {
+		c.chk = peer.chkt
+	} else {
+		c.chk = 1
+	}
+	c.maxl = peer.maxl
+	if c.maxl > c.me.maxl {
+		c.maxl = c.me.maxl
+	}
+	if c.me.capas&capLong != 0 && peer.capas&capLong != 0 {
+		c.long = true
+		c.maxl = c.me.maxlx
+		if peer.maxlx < c.maxl {
+			c.maxl = peer.maxlx
+		}
+	}
+	c.attrs = c.me.capas&capAttr != 0 && peer.capas&capAttr != 0
+	c.eol, c.npad, c.padc = peer.eol, peer.npad, peer.padc
+	c.rqctl = peer.qctl
+	switch {
+	case c.me.qbin == 'Y' && prefixed(peer.qbin):
+		c.qbin = peer.qbin
+	case prefixed(c.me.qbin) && (peer.qbin == 'Y' || peer.qbin == c.me.qbin):
+		c.qbin = c.me.qbin
+	default:
+		c.qbin = 0
+	}
+	if peer.rept == c.me.rept {
+		c.rept = c.me.rept
+	}
+}
+
+// capacity is the room for data in a packet.
+func (c *conn) capacity() int {
+	if c.long {
+		return c.maxl - 9 - c.chk
+	}
+	return c.maxl - 2 - c.chk
+}
+
+// block returns the block check of b, type chk.
+func block(b []byte, chk int) []byte {
+	switch chk {
+	case 2:
+		s := 0
+		for _, x := range b {
+			s += int(x)
+		}
+		return []byte{tochar(s >> 6 & 63), tochar(s & 63)}
+	case 3:
+		crc := int(cksum.CRC16Kermit(b))
+		return []byte{tochar(crc >> 12 & 15), tochar(crc >> 6 & 63), tochar(crc & 63)}
+	}
+	return []byte{check1(b)}
+}
+
+func check1(b []byte) byte {
+	s := 0
+	for _, x := range b {
+		s += int(x)
+	}
+	return tochar((s + (s&192)>>6) & 63)
+}
+
+// checkType is the block check of a packet of type typ, the
+// Send-Init and its ACK always use type 1.
+func (c *conn) checkType(typ byte) int {
+	if typ == 'S' || typ == 'I' {
+		return 1
+	}
+	return c.chk
+}
+
+// packet builds a packet with the block check chk.
+func (c *conn) packet(seq int, typ byte, data []byte, chk int) []byte {
+	b := make([]byte, 0, c.npad+len(data)+16)
+	for i := 0; i < c.npad; i++ {
+		b = append(b, c.padc)
+	}
+	b = append(b, SOH)
+	start := len(b)
+	if n := 2 + len(data) + chk; n <= maxShort {
+		b = append(b, tochar(n), tochar(seq%64), typ)
+	} else {
+		n = len(data) + chk
+		b = append(b, tochar(0), tochar(seq%64), typ, tochar(n/95), tochar(n%95))
+		b = append(b, check1(b[start:]))
+	}
+	b = append(b, data...)
+	b = append(b, block(b[start:], chk)...)
+	return append(b, c.eol)
+}
+
+func (c *conn) send(seq int, typ byte, data []byte) error {
+	_, err := c.l.Write(c.packet(seq, typ, data, c.checkType(typ)))
+	return err
+}
+
+type packet struct {
+	seq  int
+	typ  byte
+	data []byte
+}
+
+// read waits up to d for a packet, skipping noise. errPacket reports
+// a garbled one.
+func (c *conn) read(d time.Duration) (*packet, error) {
+	deadline := time.Now().Add(d)
+	get := func() (byte, error) {
+		b, err := c.l.GetByte(deadline.Sub(time.Now()))
+		if err == nil && b == SOH {
+			// a new packet starts, the current one is lost
+			return 0, errPacket
+		}
+		return b, err
+	}
+	for {
+		b, err := c.l.GetByte(deadline.Sub(time.Now()))
+		if err != nil {
+			return nil, err
+		}
+		if b != SOH {
+			continue
+		}
+		p, err := c.readPacket(get)
+		if err == errPacket {
+			// resynchronize on the next mark
+			continue
+		}
+		return p, err
+	}
+}
+
+func (c *conn) readPacket(get func() (byte, error)) (*packet, error) {
+	var hdr []byte
+	for i := 0; i < 3; i++ {
+		b, err := get()
+		if err != nil {
+			return nil, err
+		}
+		hdr = append(hdr, b)
+	}
+	n := unchar(hdr[0])
+	typ := hdr[2]
+	chk := c.checkType(typ)
+	if n == 0 {
+		for i := 0; i < 3; i++ {
+			b, err := get()
+			if err != nil {
+				return nil, err
+			}
+			hdr = append(hdr, b)
+		}
+		if check1(hdr[:5]) != hdr[5] {
+			return nil, errPacket
+		}
+		n = unchar(hdr[3])*95 + unchar(hdr[4])
+	} else if n < 2 {
+		return nil, errPacket
+	} else {
+		n -= 2
+	}
+	if n < chk || n > maxLong {
+		return nil, errPacket
+	}
+	rest := make([]byte, n)
+	for i := range rest {
+		b, err := get()
+		if err != nil {
+			return nil, err
+		}
+		rest[i] = b
+	}
+	all := append(hdr, rest[:n-chk]...)
+	if string(block(all, chk)) != string(rest[n-chk:]) {
+		return nil, errPacket
+	}
+	seq := unchar(hdr[1])
+	if seq < 0 || seq > 63 {
+		return nil, errPacket
+	}
+	return &packet{seq, typ, rest[:n-chk]}, nil
+}
+
+// encode appends the encoding of p to b while it stays within max
+// bytes and returns the bytes of p consumed.
+func (c *conn) encode(b, p []byte, max int) ([]byte, int) {
+	i := 0
+	for i < len(p) {
+		x := p[i]
+		run := 1
+		if c.rept != 0 {
+			for i+run < len(p) && p[i+run] == x && run < 94 {
+				run++
+			}
+			if run < 3 {
+				run = 1
+			}
+		}
+		var e []byte
+		if run > 1 {
+			e = append(e, c.rept, tochar(run))
+		}
+		if c.qbin != 0 && x&0x80 != 0 {
+			e = append(e, c.qbin)
+			x &= 0x7f
+		}
+		x7 := x & 0x7f
+		switch {
+		case x7 < 32 || x7 == 127:
+			e = append(e, '#', ctl(x))
+		case x7 == '#' || c.qbin != 0 && x7 == c.qbin || c.rept != 0 && x7 == c.rept:
+			e = append(e, '#', x)
+		default:
+			e = append(e, x)
+		}
+		if len(b)+len(e) > max {
+			break
+		}
+		b = append(b, e...)
+		i += run
+	}
+	return b, i
+}
+
+// decode appends the decoded data d to b.
+func (c *conn) decode(b, d []byte) ([]byte, error) {
+	for i := 0; i < len(d); {
+		run := 1
+		if c.rept != 0 && d[i] == c.rept {
+			if i+1 >= len(d) {
+				return nil, errPacket
+			}
+			run = unchar(d[i+1])
+			i += 2
+		}
+		var bit8 byte
+		if i < len(d) && c.qbin != 0 && d[i] == c.qbin {
+			bit8 = 0x80
+			i++
+		}
+		quoted := i < len(d) && d[i] == c.rqctl
+		if quoted {
+			i++
+		}
+		if i >= len(d) {
+			return nil, errPacket
+		}
+		x := d[i]
+		i++
+		if x7 := x & 0x7f; quoted && (x7 >= 0x40 && x7 <= 0x5f || x7 == '?') {
+			x = ctl(x)
+		}
+		x |= bit8
+		for ; run > 0; run-- {
+			b = append(b, x)
+		}
+	}
+	return b, nil
+}
+
+// attributes of a file, as sent in an A packet.
+func attributes(size int64, mtime time.Time, text bool) []byte {
+	var b []byte
+	add := func(tag byte, v string) {
+		b = append(b, tag, tochar(len(v)))
+		b = append(b, v...)
+	}
+	if text {
+		add('"', "A")
+	} else {
+		add('"', "B8")
+	}
+	if size >= 0 {
+		add('!', strconv.FormatInt((size+1023)/1024, 10))
+		add('1', strconv.FormatInt(size, 10))
+	}
+	if !mtime.IsZero() {
+		add('#', mtime.Format("20060102 15:04:05"))
+	}
+	return b
+}
+
+// parseAttributes fills f from the data of an A packet.
+func parseAttributes(f *FileInfo, d []byte) {
+	for i := 0; i+1 < len(d); {
+		tag, n := d[i], unchar(d[i+1])
+		i += 2
+		if n < 0 || i+n > len(d) {
+			return
+		}
+		v := string(d[i : i+n])
+		i += n
+		switch tag {
+		case '"':
+			f.Text = len(v) > 0 && v[0] == 'A'
+		case '1':
+			if s, err := strconv.ParseInt(v, 10, 64); err == nil {
+				f.Size = s
+			}
+		case '!':
+			if s, err := strconv.ParseInt(v, 10, 64); err == nil && f.Size < 0 {
+				f.Size = s * 1024
+			}
+		case '#':
+			if t, err := time.ParseInLocation("20060102 15:04:05", v, time.Local); err == nil {
+				f.ModTime = t
+			}
+		}
+	}
+}
+
+// fail tells the peer why we give up, unless it was the peer.
+func (c *conn) fail(err error) error {
+	if _, ok := err.(PeerError); !ok {
+		msg, _ := c.encode(nil, []byte(fmt.Sprint(err)), c.capacity())
+		c.send(c.seq, 'E', msg)
+	}
+	return err
+}
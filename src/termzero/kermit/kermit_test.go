@@ -0,0 +1,257 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package kermit
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"termzero/link"
+	"termzero/sers"
+	"termzero/sers/serstest"
+)
+
+// tap records what is written.
+type tap struct {
+	io.ReadWriter
+	out bytes.Buffer
+}
+
+func (t *tap) Write(p []byte) (int, error) {
+	t.out.Write(p)
+	return t.ReadWriter.Write(p)
+}
+
+type result struct {
+	n     int64 // Receive returned
+	infos []*FileInfo
+	files map[string]*serstest.Buffer
+	wire  []byte // what the sender sent
+}
+
+// xfer sends files from so to ro over a virtual port pair in mode,
+// 9600,8N1 if nil.
+func xfer(t *testing.T, files []File, so, ro *Options, mode *sers.Mode) *result {
+	t.Helper()
+	r := &result{files: map[string]*serstest.Buffer{}}
+	tp := &tap{}
+	_, _, err := serstest.Exchange(serstest.Options{}, func(p *serstest.Port) error {
+		// the receiver waits for the Send-Init
+		if mode != nil {
+			mode.Apply(p)
+			mode.Apply(p.Peer())
+		}
+		tp.ReadWriter = p
+		_, err := Send(link.New(tp), files, so)
+		return err
+	}, func(p *serstest.Port) error {
+		var err error
+		r.n, err = Receive(link.New(p), func(f *FileInfo) (io.WriteCloser, error) {
+			r.infos = append(r.infos, f)
+			r.files[f.Name] = &serstest.Buffer{}
+			return r.files[f.Name], nil
+		}, ro)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.wire = tp.out.Bytes()
+	return r
+}
+
+// packets splits the wire into packets and checks them with the
+// block check chk.
+func packets(t *testing.T, wire []byte, chk int) (ps []*packet, long []bool) {
+	t.Helper()
+	c := &conn{chk: chk}
+	for _, f := range bytes.Split(wire, []byte{SOH})[1:] {
+		i := 0
+		p, err := c.readPacket(func() (byte, error) {
+			if i == len(f) {
+				return 0, io.EOF
+			}
+			i++
+			return f[i-1], nil
+		})
+		if err != nil {
+			t.Fatalf("packet %q with block check %d: %v", f, chk, err)
+		}
+		ps = append(ps, p)
+		long = append(long, f[0] == tochar(0))
+	}
+	return ps, long
+}
+
+func TestCheckTypes(t *testing.T) {
+	d := serstest.Bytes(3000)
+	for _, c := range []struct{ send, recv, want int }{
+		{1, 1, 1}, {2, 2, 2}, {3, 3, 3}, {0, 3, 3},
+		{3, 2, 1}, // no agreement, type 1
+	} {
+		files := []File{{Name: "f.bin", Size: int64(len(d)), R: bytes.NewReader(d)}}
+		r := xfer(t, files, &Options{Check: c.send}, &Options{Check: c.recv}, nil)
+		if !bytes.Equal(r.files["f.bin"].Bytes(), d) {
+			t.Errorf("check %d/%d: the file came different", c.send, c.recv)
+		}
+		// the Send-Init is type 1, checkType knows
+		ps, _ := packets(t, r.wire, c.want)
+		if typ := string(ps[0].typ) + string(ps[len(ps)-1].typ); typ != "SB" {
+			t.Errorf("check %d/%d: packets from %s", c.send, c.recv, typ)
+		}
+	}
+}
+
+func TestPacketLength(t *testing.T) {
+	d := serstest.Bytes(5000)
+	for _, c := range []struct {
+		maxLen int
+		long   bool
+	}{
+		{0, true},
+		{1000, true},
+		{94, false},
+		{60, false},
+	} {
+		files := []File{{Name: "f.bin", Size: int64(len(d)), R: bytes.NewReader(d)}}
+		o := &Options{MaxLen: c.maxLen}
+		r := xfer(t, files, o, o, nil)
+		if !bytes.Equal(r.files["f.bin"].Bytes(), d) {
+			t.Errorf("MaxLen %d: the file came different", c.maxLen)
+		}
+		ps, long := packets(t, r.wire, 3)
+		max := 0
+		for i, p := range ps {
+			if p.typ != 'D' {
+				continue
+			}
+			if long[i] != c.long {
+				t.Errorf("MaxLen %d: long packet %v, want %v", c.maxLen, long[i], c.long)
+				break
+			}
+			if len(p.data) > max {
+				max = len(p.data)
+			}
+		}
+		// LEN, SEQ, TYPE, the long header and the block check
+		room := c.maxLen - 2 - 3
+		switch {
+		case c.maxLen == 0:
+			room = 4096 - 9 - 3
+		case c.long:
+			room = c.maxLen - 9 - 3
+		}
+		// a prefixed byte takes up to 4
+		if max > room || max <= room-4 {
+			t.Errorf("MaxLen %d: data packets up to %d bytes, want %d", c.maxLen, max, room)
+		}
+	}
+}
+
+func TestSevenBit(t *testing.T) {
+	d := serstest.Bytes(2000) // all the 8 bit values
+	files := []File{{Name: "f.bin", Size: int64(len(d)), R: bytes.NewReader(d)}}
+	o := &Options{SevenBit: true}
+	mode := &sers.Mode{Baudrate: 9600, Databits: 7, Parity: sers.E, Stopbits: 1}
+	r := xfer(t, files, o, o, mode)
+	if !bytes.Equal(r.files["f.bin"].Bytes(), d) {
+		t.Error("the file didn't make it over 7E1")
+	}
+	for _, c := range r.wire {
+		if c&0x80 != 0 {
+			t.Fatalf("%#x on the wire", c)
+		}
+	}
+	ps, _ := packets(t, r.wire, 3)
+	if ps[0].data[6] != '&' {
+		t.Errorf("Send-Init offers %q as 8th bit prefix", ps[0].data[6])
+	}
+
+	// without, the 8th bit goes as is
+	files[0].R = bytes.NewReader(d)
+	r = xfer(t, files, &Options{}, &Options{}, nil)
+	high := 0
+	for _, c := range r.wire {
+		if c&0x80 != 0 {
+			high++
+		}
+	}
+	if high == 0 {
+		t.Error("8 bit data got prefixed on an 8 bit line")
+	}
+}
+
+func TestText(t *testing.T) {
+	text := "one\ntwo\r\n\nlast"
+	files := []File{{Name: "f.txt", Size: int64(len(text)), R: bytes.NewReader([]byte(text))}}
+	// the receiver learns it's text from the attributes
+	r := xfer(t, files, &Options{Text: true}, &Options{}, nil)
+	if !r.infos[0].Text {
+		t.Error("the receiver didn't take the file for text")
+	}
+	if got := r.files["f.txt"].String(); got != "one\ntwo\n\nlast" {
+		t.Errorf("received %q", got)
+	}
+	ps, _ := packets(t, r.wire, 3)
+	c := &conn{rqctl: '#', rept: '~'}
+	var sent []byte
+	for _, p := range ps {
+		if p.typ == 'D' {
+			sent, _ = c.decode(sent, p.data)
+		}
+	}
+	if string(sent) != "one\r\ntwo\r\n\r\nlast" {
+		t.Errorf("sent %q", sent)
+	}
+
+	// a binary file keeps its CRs
+	files[0].R = bytes.NewReader([]byte(text))
+	r = xfer(t, files, &Options{}, &Options{}, nil)
+	if r.infos[0].Text || r.files["f.txt"].String() != text {
+		t.Errorf("binary: received %q", r.files["f.txt"].String())
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	mt := time.Date(2015, 3, 1, 12, 30, 15, 0, time.Local)
+	files := []File{
+		{Name: "a.bin", Size: 3000, ModTime: mt, R: bytes.NewReader(serstest.Bytes(3000))},
+		{Name: "unknown", Size: -1, R: bytes.NewReader([]byte("size"))},
+		{Name: "empty", Size: 0, R: bytes.NewReader(nil)},
+	}
+	var progress int64
+	r := xfer(t, files, &Options{}, &Options{Progress: func(n int64) { progress = n }}, nil)
+	if len(r.infos) != 3 {
+		t.Fatalf("%d files", len(r.infos))
+	}
+	if f := r.infos[0]; f.Name != "a.bin" || f.Size != 3000 || !f.ModTime.Equal(mt) || f.Text {
+		t.Errorf("a.bin: %+v", f)
+	}
+	if f := r.infos[1]; f.Size != -1 || !f.ModTime.IsZero() {
+		t.Errorf("unknown: %+v", f)
+	}
+	if f := r.infos[2]; f.Size != 0 || r.files["empty"].Len() != 0 || !r.files["empty"].Closed {
+		t.Errorf("empty: %+v", f)
+	}
+	if r.n != 3004 || progress != 3004 {
+		t.Errorf("received %d, progress %d, want 3004", r.n, progress)
+	}
+
+	// one for every file
+	ps, _ := packets(t, r.wire, 3)
+	as := 0
+	for _, p := range ps {
+		if p.typ == 'A' {
+			as++
+		}
+	}
+	if as != 3 {
+		t.Errorf("%d attribute packets, want 3", as)
+	}
+}
@@ -0,0 +1,182 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package kermit
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"termzero/link"
+)
+
+// FileInfo describes an incoming file, as far as the sender told.
+type FileInfo struct {
+	Name    string // as sent, may contain a path
+	Size    int64  // -1 if unknown
+	ModTime time.Time
+	Text    bool // CRLF line ends get converted to LF
+}
+
+type receiver struct {
+	*conn
+	lastAck []byte // for duplicates of the last packet
+}
+
+// Receive receives files until the sender ends the batch. create is
+// called with the first data of a file, after its attributes arrived;
+// ErrSkip makes the sender skip the file. Receive returns the file
+// bytes received.
+func Receive(l *link.Link, create func(f *FileInfo) (io.WriteCloser, error), o *Options) (int64, error) {
+	if o == nil {
+		o = &Options{}
+	}
+	r := &receiver{conn: newConn(l, o)}
+	var f *FileInfo
+	var w io.WriteCloser
+	var total, n int64
+	var skip, cr bool
+	defer func() {
+		if w != nil {
+			w.Close()
+		}
+	}()
+	open := func() error {
+		var err error
+		if w, err = create(f); err == ErrSkip {
+			w, skip = nil, true
+			return nil
+		}
+		return err
+	}
+	tries := 0
+	for {
+		p, err := r.read(o.timeout())
+		if err == link.ErrTimeout || err == errPacket {
+			if tries++; tries >= o.retries() {
+				return total, r.fail(ErrRetries)
+			}
+			r.send(r.seq, 'N', nil)
+			continue
+		}
+		if err != nil {
+			return total, r.fail(err)
+		}
+		if p.typ == 'E' {
+			msg, _ := r.decode(nil, p.data)
+			return total, PeerError(msg)
+		}
+		if p.seq == (r.seq+63)%64 && r.lastAck != nil {
+			r.l.Write(r.lastAck)
+			continue
+		}
+		if p.seq != r.seq%64 {
+			continue
+		}
+		tries = 0
+		if p.typ != 'S' && r.seq == 0 {
+			return total, r.fail(fmt.Errorf("kermit: expected Send-Init, got %q", p.typ))
+		}
+		var ack []byte
+		switch p.typ {
+		case 'S':
+			// the ACK goes out with the old block check
+			r.lastAck = r.packet(r.seq, 'Y', r.me.encode(), 1)
+			r.seq++
+			r.l.Write(r.lastAck)
+			r.negotiate(parseParams(p.data))
+			continue
+		case 'F':
+			name, err := r.decode(nil, p.data)
+			if err != nil {
+				return total, r.fail(err)
+			}
+			f = &FileInfo{Name: string(name), Size: -1, Text: o.Text}
+			n, skip, cr = 0, false, false
+		case 'A':
+			if f == nil {
+				return total, r.fail(fmt.Errorf("kermit: attributes without a file"))
+			}
+			d, err := r.decode(nil, p.data)
+			if err != nil {
+				return total, r.fail(err)
+			}
+			parseAttributes(f, d)
+		case 'D':
+			if f == nil {
+				return total, r.fail(fmt.Errorf("kermit: data without a file"))
+			}
+			if w == nil && !skip {
+				if err := open(); err != nil {
+					return total, r.fail(err)
+				}
+			}
+			if skip {
+				ack = []byte("X")
+				break
+			}
+			d, err := r.decode(nil, p.data)
+			if err != nil {
+				return total, r.fail(err)
+			}
+			n += int64(len(d))
+			if f.Text {
+				d = fromCRLF(nil, d, &cr)
+			}
+			if _, err := w.Write(d); err != nil {
+				return total, r.fail(err)
+			}
+			o.progress(total + n)
+		case 'Z':
+			if f == nil {
+				return total, r.fail(fmt.Errorf("kermit: end of file without a file"))
+			}
+			discard := len(p.data) > 0 && p.data[0] == 'D'
+			if w == nil && !skip && !discard {
+				// an empty file
+				if err := open(); err != nil {
+					return total, r.fail(err)
+				}
+			}
+			if w != nil {
+				if cr {
+					w.Write([]byte{'\r'})
+				}
+				err := w.Close()
+				w = nil
+				if err != nil {
+					return total, r.fail(err)
+				}
+			}
+			total += n
+			f = nil
+		case 'B':
+			r.l.Write(r.packet(r.seq, 'Y', nil, r.chk))
+			return total, nil
+		default:
+			return total, r.fail(fmt.Errorf("kermit: unexpected packet %q", p.typ))
+		}
+		r.lastAck = r.packet(r.seq, 'Y', ack, r.chk)
+		r.seq++
+		r.l.Write(r.lastAck)
+	}
+}
+
+// fromCRLF appends src to dst with CRLF turned into LF, cr tells
+// whether a CR is pending from the data before.
+func fromCRLF(dst, src []byte, cr *bool) []byte {
+	for _, b := range src {
+		if *cr && b != '\n' {
+			dst = append(dst, '\r')
+		}
+		*cr = b == '\r'
+		if !*cr {
+			dst = append(dst, b)
+		}
+	}
+	return dst
+}
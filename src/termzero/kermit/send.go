@@ -0,0 +1,161 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package kermit
+
+import (
+	"io"
+	"time"
+
+	"termzero/link"
+)
+
+// File is a file to send.
+type File struct {
+	Name    string
+	Size    int64 // -1 if unknown
+	ModTime time.Time
+	R       io.Reader
+}
+
+type sender struct {
+	*conn
+	sent int64 // file bytes of the finished files
+}
+
+// Send sends files and returns the file bytes sent.
+func Send(l *link.Link, files []File, o *Options) (int64, error) {
+	if o == nil {
+		o = &Options{}
+	}
+	s := &sender{conn: newConn(l, o)}
+	d, err := s.exchange('S', s.me.encode())
+	if err != nil {
+		return 0, s.fail(err)
+	}
+	s.negotiate(parseParams(d))
+	for _, f := range files {
+		if err := s.file(f); err != nil {
+			return s.sent, s.fail(err)
+		}
+	}
+	if _, err := s.exchange('B', nil); err != nil {
+		return s.sent, s.fail(err)
+	}
+	return s.sent, nil
+}
+
+// exchange sends a packet until it gets ACKed and returns the data
+// of the ACK.
+func (s *sender) exchange(typ byte, data []byte) ([]byte, error) {
+	pk := s.packet(s.seq, typ, data, s.checkType(typ))
+	for try := 0; try < s.o.retries(); try++ {
+		if _, err := s.l.Write(pk); err != nil {
+			return nil, err
+		}
+	wait:
+		p, err := s.read(s.o.timeout())
+		if err == link.ErrTimeout || err == errPacket {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case p.typ == 'E':
+			msg, _ := s.decode(nil, p.data)
+			return nil, PeerError(msg)
+		case p.typ == 'Y' && p.seq == s.seq%64:
+			s.seq++
+			return p.data, nil
+		case p.typ == 'N' && p.seq == (s.seq+1)%64:
+			// the NAK of the next packet ACKs this one
+			s.seq++
+			return nil, nil
+		case p.typ == 'N':
+			continue
+		}
+		// a late ACK of an earlier packet
+		goto wait
+	}
+	return nil, ErrRetries
+}
+
+// file sends the F, A, D and Z packets of a file.
+func (s *sender) file(f File) error {
+	name, _ := s.encode(nil, []byte(f.Name), s.capacity())
+	if _, err := s.exchange('F', name); err != nil {
+		return err
+	}
+	if s.attrs {
+		a, _ := s.encode(nil, attributes(f.Size, f.ModTime, s.o.Text), s.capacity())
+		d, err := s.exchange('A', a)
+		if err != nil {
+			return err
+		}
+		if len(d) > 0 && d[0] == 'N' {
+			// refused
+			_, err := s.exchange('Z', []byte("D"))
+			return err
+		}
+	}
+	room := s.capacity()
+	in := make([]byte, room)
+	var pend []byte
+	var n int64 // file bytes read
+	var last byte
+	eof := false
+	for {
+		for !eof && len(pend) < room {
+			m, err := f.R.Read(in)
+			n += int64(m)
+			if s.o.Text {
+				pend = toCRLF(pend, in[:m], &last)
+			} else {
+				pend = append(pend, in[:m]...)
+			}
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if len(pend) == 0 {
+			break
+		}
+		data, m := s.encode(nil, pend, room)
+		pend = append(pend[:0], pend[m:]...)
+		d, err := s.exchange('D', data)
+		if err != nil {
+			return err
+		}
+		// what is still pending wasn't sent, close enough for text
+		if sent := n - int64(len(pend)); sent > 0 {
+			s.o.progress(s.sent + sent)
+		}
+		if len(d) > 0 && (d[0] == 'X' || d[0] == 'Z') {
+			// the receiver doesn't want the rest
+			_, err := s.exchange('Z', []byte("D"))
+			return err
+		}
+	}
+	s.sent += n
+	_, err := s.exchange('Z', nil)
+	return err
+}
+
+// toCRLF appends src to dst with the lone LFs turned into CRLF, last
+// is the byte before src.
+func toCRLF(dst, src []byte, last *byte) []byte {
+	for _, b := range src {
+		if b == '\n' && *last != '\r' {
+			dst = append(dst, '\r')
+		}
+		dst = append(dst, b)
+		*last = b
+	}
+	return dst
+}
@@ -0,0 +1,194 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package link offers reads with timeouts on top of a byte stream,
+// the thing every transfer protocol needs. The received data is
+// either pulled from an io.Reader by a goroutine of the Link or,
+// when somebody else already reads the port, fed to it.
+package link
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Forever is a timeout that never expires.
+const Forever = time.Duration(1<<63 - 1)
+
+var ErrTimeout = errors.New("link: timeout")
+
+type Link struct {
+	w io.Writer
+
+	mu   sync.Mutex
+	buf  []byte
+	err  error         // read error, after buf is drained
+	more chan struct{} // signalled on new data
+}
+
+// New returns a Link reading from and writing to rw.
+func New(rw io.ReadWriter) *Link {
+	l := NewFed(rw)
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, err := rw.Read(b)
+			l.Feed(b[:n])
+			if err != nil {
+				l.FeedError(err)
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// NewFed returns a Link writing to w, its data comes from Feed.
+func NewFed(w io.Writer) *Link {
+	return &Link{w: w, more: make(chan struct{}, 1)}
+}
+
+// Feed appends received data.
+func (l *Link) Feed(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	l.mu.Lock()
+	l.buf = append(l.buf, p...)
+	l.mu.Unlock()
+	l.signal()
+}
+
+// FeedError ends the stream, reads return err once the buffered
+// data is consumed.
+func (l *Link) FeedError(err error) {
+	l.mu.Lock()
+	if l.err == nil {
+		l.err = err
+	}
+	l.mu.Unlock()
+	l.signal()
+}
+
+func (l *Link) signal() {
+	select {
+	case l.more <- struct{}{}:
+	default:
+	}
+}
+
+func (l *Link) Write(p []byte) (int, error) {
+	return l.w.Write(p)
+}
+
+// Read blocks until there is data.
+func (l *Link) Read(p []byte) (int, error) {
+	return l.ReadTimeout(p, Forever)
+}
+
+// wait calls f with the buffer until it reports done or the
+// timeout d expires.
+func (l *Link) wait(d time.Duration, f func(buf []byte) (consumed int, done bool)) error {
+	var timeout <-chan time.Time
+	if d != Forever {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for {
+		l.mu.Lock()
+		n, done := f(l.buf)
+		l.buf = l.buf[n:]
+		err := l.err
+		empty := len(l.buf) == 0
+		l.mu.Unlock()
+		if done {
+			return nil
+		}
+		if err != nil && empty {
+			return err
+		}
+		select {
+		case <-l.more:
+		case <-timeout:
+			return ErrTimeout
+		}
+	}
+}
+
+// ReadTimeout reads what is there, waiting up to d for the first
+// byte.
+func (l *Link) ReadTimeout(p []byte, d time.Duration) (int, error) {
+	var n int
+	err := l.wait(d, func(buf []byte) (int, bool) {
+		n = copy(p, buf)
+		return n, n > 0 || len(p) == 0
+	})
+	return n, err
+}
+
+// GetByte waits up to d for a byte.
+func (l *Link) GetByte(d time.Duration) (byte, error) {
+	var b [1]byte
+	_, err := l.ReadTimeout(b[:], d)
+	return b[0], err
+}
+
+// ReadFull fills p, waiting up to d for all of it.
+func (l *Link) ReadFull(p []byte, d time.Duration) error {
+	n := 0
+	return l.wait(d, func(buf []byte) (int, bool) {
+		m := copy(p[n:], buf)
+		n += m
+		return m, n == len(p)
+	})
+}
+
+// WaitFor consumes data until pat was seen or d expired.
+func (l *Link) WaitFor(pat []byte, d time.Duration) error {
+	var seen []byte
+	return l.wait(d, func(buf []byte) (int, bool) {
+		// keep a tail for matches across chunks
+		seen = append(seen, buf...)
+		if i := bytes.Index(seen, pat); i >= 0 {
+			// hand back what came after the match
+			rest := len(seen) - i - len(pat)
+			return len(buf) - rest, true
+		}
+		if k := len(seen) - len(pat); k > 0 {
+			seen = seen[k:]
+		}
+		return len(buf), false
+	})
+}
+
+// Ready reports whether a read would return without waiting, with
+// data or with the error that ended the stream.
+func (l *Link) Ready() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buf) > 0 || l.err != nil
+}
+
+// Purge discards the buffered data.
+func (l *Link) Purge() {
+	l.mu.Lock()
+	l.buf = l.buf[:0]
+	l.mu.Unlock()
+}
+
+// Drain discards data until the line stayed quiet for d.
+func (l *Link) Drain(d time.Duration) {
+	var b [256]byte
+	for {
+		if _, err := l.ReadTimeout(b[:], d); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,222 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package logfile writes session logs with size and time based
+// rotation and optional gzip compression of the rotated files.
+package logfile
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config describes a log.
+type Config struct {
+	// Template is the file name, "{dev}" is replaced by the base
+	// name of Dev, "{date}" and "{time}" by the local date and time
+	// the file was started, e.g. "{dev}-{date}-{time}.log".
+	Template string
+	Dev      string
+	MaxSize  int64         // rotate after that many bytes, 0 never
+	MaxAge   time.Duration // rotate after that long, 0 never
+	Gzip     bool          // compress rotated files
+	// Header, if not empty, starts every file. It is expanded like
+	// Template, "{start}" is replaced by the RFC 3339 start time.
+	Header string
+}
+
+// Log is an io.WriteCloser safe for concurrent use.
+type Log struct {
+	c Config
+
+	mu      sync.Mutex
+	f       *os.File
+	name    string
+	size    int64
+	started time.Time
+	gz      sync.WaitGroup
+	gzErr   error
+}
+
+func (c *Config) expand(s string, t time.Time) string {
+	r := strings.NewReplacer(
+		"{dev}", filepath.Base(c.Dev),
+		"{date}", t.Format("20060102"),
+		"{time}", t.Format("150405"),
+		"{start}", t.Format(time.RFC3339))
+	return r.Replace(s)
+}
+
+// Name expands the template for t.
+func (c *Config) Name(t time.Time) string {
+	return c.expand(c.Template, t)
+}
+
+func Open(c Config) (*Log, error) {
+	l := &Log{c: c}
+	if err := l.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open starts a new file, never overwriting an existing one.
+func (l *Log) open(t time.Time) error {
+	name := l.c.Name(t)
+	for i := 1; fileExist(name) || fileExist(name+".gz"); i++ {
+		name = fmt.Sprintf("%s.%d", l.c.Name(t), i)
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	l.f, l.name, l.size, l.started = f, name, 0, t
+	if l.c.Header != "" {
+		n, err := io.WriteString(f, l.c.expand(l.c.Header, t))
+		l.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetHeader changes the header of the files to come.
+func (l *Log) SetHeader(h string) {
+	l.mu.Lock()
+	l.c.Header = h
+	l.mu.Unlock()
+}
+
+// Name returns the name of the current file.
+func (l *Log) Name() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.name
+}
+
+func (l *Log) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return 0, os.ErrClosed
+	}
+	now := time.Now()
+	if l.size > 0 && ((l.c.MaxSize > 0 && l.size+int64(len(p)) > l.c.MaxSize) ||
+		(l.c.MaxAge > 0 && now.Sub(l.started) >= l.c.MaxAge)) {
+		if err := l.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Rotate closes the current file and starts a new one.
+func (l *Log) Rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rotate(time.Now())
+}
+
+func (l *Log) rotate(t time.Time) error {
+	old := l.name
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+	if l.c.Gzip {
+		l.gz.Add(1)
+		go func() {
+			defer l.gz.Done()
+			if err := gzipFile(old); err != nil {
+				l.mu.Lock()
+				l.gzErr = err
+				l.mu.Unlock()
+			}
+		}()
+	}
+	return l.open(t)
+}
+
+// Close closes the log and waits for pending compressions. The
+// current file is left uncompressed.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	var err error
+	if l.f != nil {
+		err = l.f.Close()
+		l.f = nil
+	}
+	l.mu.Unlock()
+	l.gz.Wait()
+	if err == nil {
+		err = l.gzErr
+	}
+	return err
+}
+
+// gzipFile replaces name by name.gz.
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(name)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+func fileExist(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// ParseSize parses a size with an optional k, M or G suffix.
+func ParseSize(s string) (int64, error) {
+	mul := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k', 'K':
+			mul = 1 << 10
+		case 'M':
+			mul = 1 << 20
+		case 'G':
+			mul = 1 << 30
+		}
+		if mul != 1 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return v * mul, nil
+}
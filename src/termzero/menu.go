@@ -0,0 +1,350 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+
+	"termzero/cksum"
+	"termzero/display"
+	"termzero/input"
+	"termzero/sers"
+	"termzero/stamp"
+)
+
+type menuCmd struct {
+	name string
+	args string
+	help string
+	run  func(s *session, args []string) error
+}
+
+// cmdError is a user error, printed but otherwise harmless.
+type cmdError string
+
+func (e cmdError) Error() string {
+	return string(e)
+}
+
+var menuCmds = []menuCmd{
+	{"q", "", "quit termzero", cmdQuit},
+	{"b", "<baudrate>", "change the baud rate", cmdBaud},
+	{"m", "<mode>", "change the mode, e.g. 8N1 or 115200,7E1,rtscts", cmdMode},
+	{"dtr", "[0|1]", "toggle or set DTR", cmdDTR},
+	{"rts", "[0|1]", "toggle or set RTS", cmdRTS},
+	{"break", "[ms]", "send BREAK, 250 ms by default", cmdBreak},
+	{"echo", "", "toggle local echo", cmdEcho},
+	{"hex", "", "toggle hex display", cmdHex},
+	{"d", "<mode>", "display mode: raw, hex, mixed, caret or c", cmdDisplay},
+	{"i", "<mode> [cksum]", "input mode: text, hex or esc; checksum: none, sum, xor, crc8 or modbus", cmdInput},
+	{"t", "<mode> [ms|us]", "timestamps: none, abs, rel or delta", cmdStamp},
+	{"send", "<file> [opt]", "send a file paced, opt: cd=10ms ld=100ms prompt=> echo timeout=5s", cmdSend},
+	{"fw", "<file> [format]", "send a firmware image as binary, ihex, srec or titxt", cmdFW},
+	{"sx", "<file> [1k]", "send a file with XMODEM", cmdSX},
+	{"rx", "<file> [sum]", "receive a file with XMODEM", cmdRX},
+	{"sb", "<file>...", "send files with YMODEM", cmdSB},
+	{"rb", "[dir]", "receive files with YMODEM", cmdRB},
+	{"sz", "<file>...", "send files with ZMODEM", cmdSZ},
+	{"rz", "[dir]", "receive files with ZMODEM", cmdRZ},
+	{"ks", "<file>...", "send files with Kermit", cmdKS},
+	{"kt", "<file>...", "send text files with Kermit", cmdKT},
+	{"kr", "[dir]", "receive files with Kermit", cmdKR},
+	{"avr", "<file> [baud]", "flash an Arduino through its STK500 bootloader", cmdAVR},
+	{"msp", "<file> [5xx]", "flash an MSP430 through its BSL", cmdMSP},
+	{"stm32", "<file> [addr]", "flash an STM32 through its bootloader, a .bin at addr", cmdSTM32},
+	{"mpy", "<ls|get|put|run> [args]", "MicroPython raw REPL: list, get and put files, run a script", cmdMPY},
+	{"s", "", "show port status", cmdStatus},
+	{"e", "", "send the escape key", cmdEsc},
+}
+
+// menu reads one command line from r and runs it. Pressing the
+// escape key a second time sends it to the port.
+func (s *session) menu(r *bufio.Reader) error {
+	s.print("\n*** termzero> ")
+	line, esc, err := s.readLine(r)
+	if err != nil {
+		return err
+	}
+	if esc {
+		s.print("\n")
+		return cmdEsc(s, nil)
+	}
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return nil
+	}
+	if f[0] == "h" || f[0] == "?" || f[0] == "help" {
+		s.menuHelp()
+		return nil
+	}
+	for _, c := range menuCmds {
+		if c.name == f[0] {
+			err = c.run(s, f[1:])
+			if _, ok := err.(cmdError); ok {
+				s.print("*** ", err, "\n")
+				return nil
+			}
+			return err
+		}
+	}
+	s.printf("*** unknown command %q, h for help\n", f[0])
+	return nil
+}
+
+func (s *session) menuHelp() {
+	for _, c := range menuCmds {
+		s.printf("*** %-6s %-14s %s\n", c.name, c.args, c.help)
+	}
+	s.printf("*** ctrl+%c twice sends ctrl+%c\n", s.esc|0x60, s.esc|0x60)
+}
+
+// readLine reads and echoes a command line from the raw terminal.
+// esc reports the escape key pressed right at the start.
+func (s *session) readLine(r *bufio.Reader) (line string, esc bool, err error) {
+	var b []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", false, err
+		}
+		switch {
+		case c == s.esc && len(b) == 0:
+			return "", true, nil
+		case c == '\r' || c == '\n':
+			s.print("\n")
+			return string(b), false, nil
+		case c == 0x03 || c == 0x1b: // ctrl+c, esc
+			s.print(" -\n")
+			return "", false, nil
+		case c == 0x7f || c == 0x08:
+			if len(b) > 0 {
+				b = b[:len(b)-1]
+				s.print("\b \b")
+			}
+		case c >= 0x20 && c < 0x7f:
+			b = append(b, c)
+			s.print(string(c))
+		}
+	}
+}
+
+func cmdQuit(s *session, args []string) error {
+	s.print("*** bye\n")
+	exit(0)
+	return nil
+}
+
+func (s *session) setMode(m string) error {
+	mode := s.mode
+	if err := mode.Set(m); err != nil {
+		return cmdError(err.Error())
+	}
+	if err := mode.Apply(s.port); err != nil {
+		s.mode.Apply(s.port)
+		return cmdError("setup serial port: " + err.Error())
+	}
+	s.mode = mode
+	if s.log != nil {
+		s.log.SetHeader(s.logHeader(false))
+	}
+	if s.txlog != nil {
+		s.txlog.SetHeader(s.logHeader(true))
+	}
+	s.printf("*** mode %s\n", &s.mode)
+	return nil
+}
+
+func cmdBaud(s *session, args []string) error {
+	if len(args) != 1 {
+		return cmdError("usage: b <baudrate>")
+	}
+	if _, err := strconv.ParseUint(args[0], 10, 32); err != nil {
+		return cmdError("bad baud rate " + args[0])
+	}
+	return s.setMode(args[0])
+}
+
+func cmdMode(s *session, args []string) error {
+	if len(args) != 1 {
+		return cmdError("usage: m <mode>")
+	}
+	return s.setMode(args[0])
+}
+
+// boolArg parses an optional 0/1 argument, toggling cur if absent.
+func boolArg(args []string, cur bool) (bool, error) {
+	if len(args) == 0 {
+		return !cur, nil
+	}
+	switch args[0] {
+	case "0", "off":
+		return false, nil
+	case "1", "on":
+		return true, nil
+	}
+	return false, cmdError("expected 0 or 1, not " + args[0])
+}
+
+func (s *session) setLine(name string, line uint32, args []string,
+	set func(bool) error) error {
+
+	lines, err := s.port.ModemLines()
+	if err != nil {
+		return cmdError("get modem lines: " + err.Error())
+	}
+	on, err := boolArg(args, lines&line != 0)
+	if err != nil {
+		return err
+	}
+	if err = set(on); err != nil {
+		return cmdError("set " + name + ": " + err.Error())
+	}
+	s.printf("*** %s %s\n", name, onOff(on))
+	return nil
+}
+
+func cmdDTR(s *session, args []string) error {
+	return s.setLine("DTR", sers.DTR_LINE, args, s.port.SetDTR)
+}
+
+func cmdRTS(s *session, args []string) error {
+	return s.setLine("RTS", sers.RTS_LINE, args, s.port.SetRTS)
+}
+
+func cmdBreak(s *session, args []string) error {
+	ms := 250
+	if len(args) > 0 {
+		var err error
+		if ms, err = strconv.Atoi(args[0]); err != nil || ms <= 0 {
+			return cmdError("bad duration " + args[0])
+		}
+	}
+	if err := s.port.SendBreak(time.Duration(ms) * time.Millisecond); err != nil {
+		return cmdError("break: " + err.Error())
+	}
+	s.printf("*** break %d ms\n", ms)
+	return nil
+}
+
+func cmdEcho(s *session, args []string) error {
+	on := !s.echo.Echoing()
+	s.echo.SetEcho(on)
+	s.printf("*** echo %s\n", onOff(on))
+	return nil
+}
+
+func cmdHex(s *session, args []string) error {
+	m := display.HEX
+	if s.disp.Mode() == display.HEX {
+		m = display.RAW
+	}
+	s.disp.SetMode(m)
+	s.printf("*** display %s\n", m)
+	return nil
+}
+
+func cmdDisplay(s *session, args []string) error {
+	if len(args) != 1 {
+		return cmdError("usage: d <mode>")
+	}
+	m, err := display.ParseMode(args[0])
+	if err != nil {
+		return cmdError(err.Error())
+	}
+	s.disp.SetMode(m)
+	s.printf("*** display %s\n", m)
+	return nil
+}
+
+func cmdInput(s *session, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return cmdError("usage: i <mode> [cksum]")
+	}
+	m, err := input.ParseMode(args[0])
+	if err != nil {
+		return cmdError(err.Error())
+	}
+	ck := s.ck
+	if len(args) == 2 {
+		if ck, err = cksum.ParseKind(args[1]); err != nil {
+			return cmdError(err.Error())
+		}
+	}
+	s.in, s.ck = m, ck
+	s.printf("*** input %s cksum %s\n", m, ck)
+	return nil
+}
+
+func cmdStamp(s *session, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return cmdError("usage: t <mode> [ms|us]")
+	}
+	m, err := stamp.ParseMode(args[0])
+	if err != nil {
+		return cmdError(err.Error())
+	}
+	s.mu.Lock()
+	micro := s.st.Micro
+	s.mu.Unlock()
+	if len(args) == 2 {
+		switch args[1] {
+		case "ms":
+			micro = false
+		case "us":
+			micro = true
+		default:
+			return cmdError("precision is ms or us, not " + args[1])
+		}
+	}
+	s.mu.Lock()
+	s.st.Mode, s.st.Micro = m, micro
+	s.mu.Unlock()
+	s.printf("*** timestamps %s\n", m)
+	return nil
+}
+
+func cmdStatus(s *session, args []string) error {
+	bi, bo := s.port.Baudrate()
+	s.printf("*** port %s mode %s baudrate (i/o): %d %d\n", s.dev, &s.mode, bo, bi)
+	if lines, err := s.port.ModemLines(); err != nil {
+		s.printf("*** modem lines: %v\n", err)
+	} else {
+		s.print("*** lines:")
+		for i, n := range []string{"DTR", "RTS", "CTS", "DSR", "RI", "DCD"} {
+			s.printf(" %s %s", n, onOff(lines&(1<<uint(i)) != 0))
+		}
+		s.print("\n")
+	}
+	s.printf("*** echo %s display %s imap %q omap %q\n",
+		onOff(s.echo.Echoing()), s.disp.Mode(), s.imap, s.omap)
+	s.mu.Lock()
+	tsm := s.st.Mode
+	s.mu.Unlock()
+	s.printf("*** input %s cksum %s timestamps %s\n", s.in, s.ck, tsm)
+	if s.log != nil {
+		s.printf("*** logging to %s\n", s.log.Name())
+	}
+	if s.txlog != nil {
+		s.printf("*** logging the sent data to %s\n", s.txlog.Name())
+	}
+	return nil
+}
+
+func cmdEsc(s *session, args []string) error {
+	return s.send([]byte{s.esc})
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,146 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"termzero/link"
+	"termzero/mpy"
+)
+
+// cmdMPY: mpy ls [dir] | get <file> [local] | put <file> [remote] |
+// run <script>
+func cmdMPY(s *session, args []string) error {
+	usage := cmdError("usage: mpy ls [dir] | get <file> [local] | put <file> [remote] | run <script>")
+	if len(args) < 1 {
+		return usage
+	}
+	var fn func(b *mpy.Board) error
+	var f *os.File // of a put
+	name := "mpy " + args[0]
+	o := &mpy.Options{}
+	switch args[0] {
+	case "ls":
+		if len(args) > 2 {
+			return usage
+		}
+		dir := ""
+		if len(args) == 2 {
+			dir = args[1]
+		}
+		fn = func(b *mpy.Board) error {
+			files, err := b.List(dir)
+			if err != nil {
+				return err
+			}
+			s.print("\n")
+			for _, f := range files {
+				if f.Dir {
+					s.printf("%10s  %s/\n", "", f.Name)
+				} else {
+					s.printf("%10d  %s\n", f.Size, f.Name)
+				}
+			}
+			return nil
+		}
+	case "get":
+		if len(args) < 2 || len(args) > 3 {
+			return usage
+		}
+		local := filepath.Base(args[1])
+		if len(args) == 3 {
+			local = args[2]
+		}
+		name += " " + args[1]
+		o.Progress = s.progress(name, 0)
+		fn = func(b *mpy.Board) error {
+			f, err := os.Create(local)
+			if err != nil {
+				return err
+			}
+			n, err := b.Get(args[1], f)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(local)
+				return err
+			}
+			s.printf("\n*** %d bytes to %s\n", n, local)
+			return nil
+		}
+	case "put":
+		if len(args) < 2 || len(args) > 3 {
+			return usage
+		}
+		remote := filepath.Base(args[1])
+		if len(args) == 3 {
+			remote = args[2]
+		}
+		var err error
+		if f, err = os.Open(args[1]); err != nil {
+			return cmdError(err.Error())
+		}
+		var total int64
+		if fi, err := f.Stat(); err == nil {
+			total = fi.Size()
+		}
+		name += " " + args[1]
+		o.Progress = s.progress(name, total)
+		fn = func(b *mpy.Board) error {
+			defer f.Close()
+			n, err := b.Put(remote, f)
+			if err != nil {
+				return err
+			}
+			s.printf("\n*** %d bytes to %s\n", n, remote)
+			return nil
+		}
+	case "run":
+		if len(args) != 2 {
+			return usage
+		}
+		code, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return cmdError(err.Error())
+		}
+		name += " " + args[1]
+		fn = func(b *mpy.Board) error {
+			// the traceback comes after the output
+			var stderr bytes.Buffer
+			err := b.Exec(code, s, &stderr)
+			if stderr.Len() > 0 {
+				s.print("\n*** stderr\n")
+				s.show(stderr.Bytes())
+			}
+			return err
+		}
+	default:
+		return usage
+	}
+	err := s.startTransfer(name, false, func(l *link.Link, abort <-chan struct{}) error {
+		b := mpy.New(l, o)
+		if err := b.Enter(); err != nil {
+			return err
+		}
+		err := fn(b)
+		if err == errAborted {
+			b.Interrupt()
+		}
+		b.Exit()
+		return err
+	})
+	if err != nil && f != nil {
+		f.Close()
+	}
+	return err
+}
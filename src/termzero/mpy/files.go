@@ -0,0 +1,142 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package mpy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The helpers run on MicroPython and, for trying them, CPython.
+const (
+	hexImports = "try:\n from binascii import hexlify as x, unhexlify as h\n" +
+		"except ImportError:\n from ubinascii import hexlify as x, unhexlify as h\n"
+
+	listCode = "import os\np=%s\nd=p.rstrip('/')+'/' if p else ''\n" +
+		"for n in sorted(os.listdir(p or '.')):\n s=os.stat(d+n)\n" +
+		" print(-1 if s[0]&0x4000 else s[6],n)\n"
+
+	getCode = hexImports + "f=open(%s,'rb')\nwhile 1:\n b=f.read(%d)\n" +
+		" if not b:break\n print(x(b).decode())\nf.close()\n"
+
+	putOpen  = hexImports + "f=open(%s,'wb')\nw=f.write\n"
+	putClose = "f.close()\n"
+
+	FILE_CHUNK = 256 // file bytes per line of hex
+	PUT_LINES  = 16  // lines per Exec of a put
+)
+
+// pyString quotes s for Python, Go's escapes are Python's too.
+func pyString(s string) string {
+	return strconv.Quote(s)
+}
+
+// FileInfo is an entry of a directory on the board.
+type FileInfo struct {
+	Name string
+	Size int64
+	Dir  bool
+}
+
+// List lists the directory dir, the current one if empty.
+func (b *Board) List(dir string) ([]FileInfo, error) {
+	out, err := b.ExecOutput(fmt.Sprintf(listCode, pyString(dir)))
+	if err != nil {
+		return nil, err
+	}
+	var files []FileInfo
+	for _, l := range strings.Split(string(out), "\n") {
+		f := strings.SplitN(strings.TrimRight(l, "\r"), " ", 2)
+		if len(f) != 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(f[0], 10, 64)
+		if err != nil {
+			return nil, ErrSync
+		}
+		files = append(files, FileInfo{Name: f[1], Size: n, Dir: n < 0})
+	}
+	return files, nil
+}
+
+// hexLines decodes the lines of hex the get helper prints.
+type hexLines struct {
+	w    io.Writer
+	line []byte
+	n    int64
+	b    *Board
+}
+
+func (h *hexLines) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c != '\n' {
+			h.line = append(h.line, c)
+			continue
+		}
+		d, err := hex.DecodeString(strings.TrimSpace(string(h.line)))
+		if err != nil {
+			return 0, ErrSync
+		}
+		h.line = h.line[:0]
+		if _, err := h.w.Write(d); err != nil {
+			return 0, err
+		}
+		h.n += int64(len(d))
+		h.b.o.progress(h.n)
+	}
+	return len(p), nil
+}
+
+// Get copies the file name on the board to w.
+func (b *Board) Get(name string, w io.Writer) (int64, error) {
+	h := &hexLines{w: w, b: b}
+	err := b.Exec([]byte(fmt.Sprintf(getCode, pyString(name), FILE_CHUNK)), h, nil)
+	return h.n, err
+}
+
+// Put copies r to the file name on the board.
+func (b *Board) Put(name string, r io.Reader) (n int64, err error) {
+	if _, err := b.ExecOutput(fmt.Sprintf(putOpen, pyString(name))); err != nil {
+		return 0, err
+	}
+	// the file is closed on the board whatever happened to the copy
+	defer func() {
+		if _, cerr := b.ExecOutput(putClose); err == nil {
+			err = cerr
+		}
+	}()
+	br := bufio.NewReader(r)
+	chunk := make([]byte, FILE_CHUNK)
+	for eof := false; !eof; {
+		var code bytes.Buffer
+		for i := 0; i < PUT_LINES && !eof; i++ {
+			k, err := io.ReadFull(br, chunk)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return n, err
+			}
+			if k > 0 {
+				fmt.Fprintf(&code, "w(h('%x'))\n", chunk[:k])
+				n += int64(k)
+			}
+		}
+		if code.Len() == 0 {
+			break
+		}
+		if _, err := b.ExecOutput(code.String()); err != nil {
+			return n, err
+		}
+		b.o.progress(n)
+	}
+	return n, nil
+}
@@ -0,0 +1,295 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package mpy drives the raw REPL of a MicroPython board: it runs
+// code, with the flow controlled raw-paste mode when the board has
+// it, and moves files through small helper programs, the way
+// mpremote does.
+package mpy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"termzero/link"
+)
+
+const (
+	CTRL_A = 0x01 // raw REPL
+	CTRL_B = 0x02 // friendly REPL
+	CTRL_C = 0x03 // interrupt
+	CTRL_D = 0x04 // execute, end of output
+	CTRL_E = 0x05 // paste mode, raw-paste within the raw REPL
+
+	CHUNK = 256 // code sent at once without raw-paste
+)
+
+var (
+	RAW_BANNER = []byte("raw REPL; CTRL-B to exit\r\n>")
+	RAW_PASTE  = []byte{CTRL_E, 'A', CTRL_A}
+)
+
+var (
+	ErrNoREPL = errors.New("mpy: no raw REPL")
+	ErrSync   = errors.New("mpy: unexpected answer")
+)
+
+// Error is an exception raised on the board.
+type Error struct {
+	Stderr string // the traceback
+}
+
+func (e *Error) Error() string {
+	// the last line names the exception
+	lines := strings.Split(strings.TrimSpace(e.Stderr), "\n")
+	return "mpy: " + strings.TrimSpace(lines[len(lines)-1])
+}
+
+type Options struct {
+	NoPaste bool          // don't try raw-paste
+	Timeout time.Duration // for the answers of the REPL, 5s if 0
+	// Idle is how long a running program may stay silent, forever
+	// if 0.
+	Idle     time.Duration
+	Progress func(n int64) // file bytes moved
+}
+
+func (o *Options) timeout() time.Duration {
+	if o == nil || o.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return o.Timeout
+}
+
+func (o *Options) idle() time.Duration {
+	if o == nil || o.Idle == 0 {
+		return link.Forever
+	}
+	return o.Idle
+}
+
+func (o *Options) progress(n int64) {
+	if o != nil && o.Progress != nil {
+		o.Progress(n)
+	}
+}
+
+// Board is a MicroPython board behind a link.
+type Board struct {
+	l     *link.Link
+	o     *Options
+	paste int // raw-paste: 0 untried, 1 works, -1 not there
+}
+
+func New(l *link.Link, o *Options) *Board {
+	if o == nil {
+		o = &Options{}
+	}
+	b := &Board{l: l, o: o}
+	if o.NoPaste {
+		b.paste = -1
+	}
+	return b
+}
+
+// Enter interrupts what runs and enters the raw REPL.
+func (b *Board) Enter() error {
+	if _, err := b.l.Write([]byte{'\r', CTRL_C, CTRL_C}); err != nil {
+		return err
+	}
+	b.l.Drain(100 * time.Millisecond)
+	if _, err := b.l.Write([]byte{'\r', CTRL_A}); err != nil {
+		return err
+	}
+	if err := b.l.WaitFor(RAW_BANNER, b.o.timeout()); err != nil {
+		if err == link.ErrTimeout {
+			return ErrNoREPL
+		}
+		return err
+	}
+	return nil
+}
+
+// Exit goes back to the friendly REPL.
+func (b *Board) Exit() error {
+	_, err := b.l.Write([]byte{'\r', CTRL_B})
+	return err
+}
+
+// Interrupt stops the running program with a KeyboardInterrupt.
+func (b *Board) Interrupt() error {
+	_, err := b.l.Write([]byte{CTRL_C, CTRL_C})
+	return err
+}
+
+// Exec runs code, its output goes to stdout and stderr as it comes.
+// An exception makes Exec return an *Error with the traceback, which
+// went to stderr too.
+func (b *Board) Exec(code []byte, stdout, stderr io.Writer) error {
+	if err := b.send(code); err != nil {
+		return err
+	}
+	if err := b.follow(stdout); err != nil {
+		return err
+	}
+	var eb bytes.Buffer
+	if stderr == nil {
+		stderr = &eb
+	} else {
+		stderr = io.MultiWriter(stderr, &eb)
+	}
+	if err := b.follow(stderr); err != nil {
+		return err
+	}
+	// ready for the next one
+	if c, err := b.l.GetByte(b.o.timeout()); err != nil {
+		return err
+	} else if c != '>' {
+		return ErrSync
+	}
+	if eb.Len() > 0 {
+		return &Error{eb.String()}
+	}
+	return nil
+}
+
+// ExecOutput runs code and returns its stdout.
+func (b *Board) ExecOutput(code string) ([]byte, error) {
+	var out bytes.Buffer
+	err := b.Exec([]byte(code), &out, nil)
+	return out.Bytes(), err
+}
+
+// send sends code and starts it.
+func (b *Board) send(code []byte) error {
+	if b.paste >= 0 {
+		ok, err := b.rawPaste(code)
+		if ok || err != nil {
+			return err
+		}
+	}
+	for len(code) > 0 {
+		n := len(code)
+		if n > CHUNK {
+			n = CHUNK
+		}
+		if _, err := b.l.Write(code[:n]); err != nil {
+			return err
+		}
+		code = code[n:]
+		// the raw REPL has no flow control
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := b.l.Write([]byte{CTRL_D}); err != nil {
+		return err
+	}
+	ok := make([]byte, 2)
+	if err := b.l.ReadFull(ok, b.o.timeout()); err != nil {
+		return err
+	}
+	if string(ok) != "OK" {
+		return ErrSync
+	}
+	return nil
+}
+
+// rawPaste sends code in raw-paste mode, if the board has it. The
+// board grants windows of bytes to send and acknowledges each with
+// CTRL_A.
+func (b *Board) rawPaste(code []byte) (bool, error) {
+	if _, err := b.l.Write(RAW_PASTE); err != nil {
+		return false, err
+	}
+	r := make([]byte, 2)
+	if err := b.l.ReadFull(r, b.o.timeout()); err != nil {
+		return false, err
+	}
+	switch string(r) {
+	case "R\x01":
+		b.paste = 1
+	case "R\x00":
+		// understood, but not there
+		b.paste = -1
+		return false, nil
+	default:
+		// an old board took it for a CTRL_A and repeated the banner
+		b.paste = -1
+		if !bytes.HasPrefix(RAW_BANNER, r) {
+			return false, ErrSync
+		}
+		return false, b.l.WaitFor(RAW_BANNER[2:], b.o.timeout())
+	}
+	if err := b.l.ReadFull(r, b.o.timeout()); err != nil {
+		return true, err
+	}
+	window := int(r[0]) | int(r[1])<<8
+	remain := window
+	for len(code) > 0 {
+		for remain == 0 || b.l.Ready() {
+			c, err := b.l.GetByte(b.o.timeout())
+			if err != nil {
+				return true, err
+			}
+			switch c {
+			case CTRL_A:
+				remain += window
+			case CTRL_D:
+				// the board ended it, a syntax error is on the way
+				_, err := b.l.Write([]byte{CTRL_D})
+				return true, err
+			default:
+				return true, ErrSync
+			}
+		}
+		n := len(code)
+		if n > remain {
+			n = remain
+		}
+		if _, err := b.l.Write(code[:n]); err != nil {
+			return true, err
+		}
+		code = code[n:]
+		remain -= n
+	}
+	if _, err := b.l.Write([]byte{CTRL_D}); err != nil {
+		return true, err
+	}
+	// the end of the code, window acks may come first
+	for {
+		c, err := b.l.GetByte(b.o.timeout())
+		if err != nil {
+			return true, err
+		}
+		if c == CTRL_D {
+			return true, nil
+		}
+	}
+}
+
+// follow copies the output to w up to the CTRL_D that ends it.
+func (b *Board) follow(w io.Writer) error {
+	var buf []byte
+	for {
+		c, err := b.l.GetByte(b.o.idle())
+		if err != nil {
+			return err
+		}
+		if c == CTRL_D {
+			_, err := w.Write(buf)
+			return err
+		}
+		buf = append(buf, c)
+		if !b.l.Ready() || len(buf) >= 1024 {
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+	}
+}
@@ -0,0 +1,290 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package mpy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"termzero/link"
+	"termzero/sers/serstest"
+)
+
+// board is a fake MicroPython board: a raw REPL, raw-paste with
+// window acks, and for the file helpers a file system.
+type board struct {
+	paste  bool // has raw-paste
+	old    bool // doesn't know CTRL_E in the raw REPL
+	window int
+
+	acks   int      // windows acknowledged
+	codes  []string // run
+	files  map[string][]byte
+	open   string   // the file open for writing
+	closed []string // the files closed
+}
+
+func (bd *board) serve(l *link.Link) {
+	raw := false
+	var code []byte
+	for {
+		c, err := l.GetByte(link.Forever)
+		if err != nil {
+			return
+		}
+		switch {
+		case c == CTRL_A:
+			raw, code = true, nil
+			l.Write(RAW_BANNER)
+		case !raw:
+		case c == CTRL_B:
+			raw = false
+		case c == CTRL_C:
+			code = nil
+		case c == CTRL_E && !bd.old:
+			// the rest of RAW_PASTE
+			l.GetByte(time.Second)
+			l.GetByte(time.Second)
+			if !bd.paste {
+				l.Write([]byte("R\x00"))
+				continue
+			}
+			l.Write([]byte{'R', 1, byte(bd.window), byte(bd.window >> 8)})
+			code = bd.receive(l)
+			l.Write([]byte{CTRL_D})
+			bd.run(l, code)
+			code = nil
+		case c == CTRL_D:
+			l.Write([]byte("OK"))
+			bd.run(l, code)
+			code = nil
+		default:
+			code = append(code, c)
+		}
+	}
+}
+
+// receive reads raw-paste code, acknowledging every window.
+func (bd *board) receive(l *link.Link) []byte {
+	var code []byte
+	for n := 0; ; {
+		c, err := l.GetByte(time.Second)
+		if err != nil || c == CTRL_D {
+			return code
+		}
+		code = append(code, c)
+		if n++; n == bd.window {
+			n = 0
+			bd.acks++
+			l.Write([]byte{CTRL_A})
+		}
+	}
+}
+
+func (bd *board) run(l *link.Link, code []byte) {
+	out, errout := bd.exec(string(code))
+	l.Write([]byte(out + "\x04" + errout + "\x04>"))
+}
+
+// name returns the quoted name after open( in code.
+func name(code string) string {
+	s := code[strings.Index(code, "open(")+5:]
+	n, _ := strconv.Unquote(s[:strings.IndexByte(s, ',')])
+	return n
+}
+
+func (bd *board) exec(code string) (stdout, stderr string) {
+	bd.codes = append(bd.codes, code)
+	switch {
+	case strings.Contains(code, "raise"):
+		return "before\r\n", "Traceback (most recent call last):\r\n" +
+			"  File \"<stdin>\", line 1, in <module>\r\nValueError: bad\r\n"
+	case strings.Contains(code, "os.listdir"):
+		var names []string
+		for n := range bd.files {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		out := "-1 lib\r\n"
+		for _, n := range names {
+			out += fmt.Sprintf("%d %s\r\n", len(bd.files[n]), n)
+		}
+		return out, ""
+	case strings.Contains(code, ",'rb')"):
+		d, ok := bd.files[name(code)]
+		if !ok {
+			return "", "Traceback (most recent call last):\r\nOSError: [Errno 2] ENOENT\r\n"
+		}
+		var out string
+		for len(d) > 0 {
+			n := len(d)
+			if n > FILE_CHUNK {
+				n = FILE_CHUNK
+			}
+			out += hex.EncodeToString(d[:n]) + "\r\n"
+			d = d[n:]
+		}
+		return out, ""
+	case strings.Contains(code, ",'wb')"):
+		bd.open = name(code)
+		bd.files[bd.open] = nil
+		return "", ""
+	case strings.HasPrefix(code, "w(h('"):
+		for _, line := range strings.Split(strings.TrimSpace(code), "\n") {
+			d, _ := hex.DecodeString(strings.TrimSuffix(strings.TrimPrefix(line, "w(h('"), "'))"))
+			bd.files[bd.open] = append(bd.files[bd.open], d...)
+		}
+		return "", ""
+	case code == putClose:
+		bd.closed = append(bd.closed, bd.open)
+		bd.open = ""
+		return "", ""
+	}
+	return "ran " + code, ""
+}
+
+// connect connects a Board with o to bd and enters the raw REPL.
+func connect(t *testing.T, bd *board, o *Options) *Board {
+	t.Helper()
+	a, b := serstest.Pair(serstest.Options{})
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	if bd.files == nil {
+		bd.files = map[string][]byte{}
+	}
+	go bd.serve(link.New(b))
+	mb := New(link.New(a), o)
+	if err := mb.Enter(); err != nil {
+		t.Fatal(err)
+	}
+	return mb
+}
+
+func TestRawPaste(t *testing.T) {
+	bd := &board{paste: true, window: 32}
+	b := connect(t, bd, nil)
+	code := strings.Repeat("x = 1\n", 50)
+	out, err := b.ExecOutput(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "ran "+code {
+		t.Errorf("output %q", out)
+	}
+	if bd.acks != len(code)/32 || bd.codes[0] != code {
+		t.Errorf("%d windows acknowledged, the board ran %q", bd.acks, bd.codes[0])
+	}
+	if b.paste != 1 {
+		t.Errorf("paste %d", b.paste)
+	}
+}
+
+func TestNoPaste(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		bd   *board
+		o    *Options
+	}{
+		{"refused", &board{}, nil},
+		{"old board", &board{old: true}, nil},
+		{"NoPaste", &board{paste: true, window: 32}, &Options{NoPaste: true}},
+	} {
+		b := connect(t, c.bd, c.o)
+		for i, code := range []string{"print(1)", strings.Repeat("y", 600)} {
+			out, err := b.ExecOutput(code)
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			if string(out) != "ran "+code || c.bd.codes[i] != code {
+				t.Errorf("%s: ran %q, output %q", c.name, c.bd.codes[i], out)
+			}
+		}
+		if b.paste != -1 || c.bd.acks != 0 {
+			t.Errorf("%s: paste %d, %d acks", c.name, b.paste, c.bd.acks)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	b := connect(t, &board{paste: true, window: 64}, nil)
+	var stdout, stderr bytes.Buffer
+	err := b.Exec([]byte("raise ValueError('bad')"), &stdout, &stderr)
+	if e, ok := err.(*Error); !ok || e.Error() != "mpy: ValueError: bad" || e.Stderr != stderr.String() {
+		t.Errorf("got %v", err)
+	}
+	if stdout.String() != "before\r\n" || !strings.HasPrefix(stderr.String(), "Traceback") {
+		t.Errorf("stdout %q, stderr %q", stdout.String(), stderr.String())
+	}
+	// still in step
+	if out, err := b.ExecOutput("1"); err != nil || string(out) != "ran 1" {
+		t.Errorf("after the exception: %q, %v", out, err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	bd := &board{paste: true, window: 128}
+	var progress int64
+	b := connect(t, bd, &Options{Progress: func(n int64) { progress = n }})
+	d := serstest.Bytes(5000)
+	if n, err := b.Put("dir/a b.bin", bytes.NewReader(d)); err != nil || n != 5000 {
+		t.Fatalf("put %d: %v", n, err)
+	}
+	if !bytes.Equal(bd.files["dir/a b.bin"], d) || fmt.Sprint(bd.closed) != "[dir/a b.bin]" {
+		t.Errorf("the board has %d bytes, closed %v", len(bd.files["dir/a b.bin"]), bd.closed)
+	}
+	// open, 5000 bytes in 16 lines of 256 at a time, close
+	if len(bd.codes) != 4 || progress != 5000 {
+		t.Errorf("%d execs, progress %d", len(bd.codes), progress)
+	}
+
+	// a failing reader still leaves the file closed
+	bad := io.MultiReader(bytes.NewReader(d[:300]), iotest.ErrReader(errors.New("disk")))
+	if n, err := b.Put("bad", bad); err == nil || err.Error() != "disk" || n != 256 {
+		t.Errorf("put from a failing reader: %d, %v", n, err)
+	}
+	if fmt.Sprint(bd.closed) != "[dir/a b.bin bad]" || len(bd.files["bad"]) != 0 {
+		t.Errorf("closed %v, bad has %d bytes", bd.closed, len(bd.files["bad"]))
+	}
+
+	var got bytes.Buffer
+	if n, err := b.Get("dir/a b.bin", &got); err != nil || n != 5000 || !bytes.Equal(got.Bytes(), d) {
+		t.Errorf("get %d: %v", n, err)
+	}
+	if _, err := b.Get("none", &got); err == nil || err.Error() != "mpy: OSError: [Errno 2] ENOENT" {
+		t.Errorf("get of a missing file: %v", err)
+	}
+
+	files, err := b.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FileInfo{{"lib", -1, true}, {"bad", 0, false}, {"dir/a b.bin", 5000, false}}
+	if fmt.Sprint(files) != fmt.Sprint(want) {
+		t.Errorf("list %v", files)
+	}
+}
+
+func TestNoREPL(t *testing.T) {
+	a, b := serstest.Pair(serstest.Options{})
+	defer a.Close()
+	defer b.Close()
+	mb := New(link.New(a), &Options{Timeout: 200 * time.Millisecond})
+	if err := mb.Enter(); err != ErrNoREPL {
+		t.Errorf("got %v, want %v", err, ErrNoREPL)
+	}
+}
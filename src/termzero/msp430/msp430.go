@@ -0,0 +1,503 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package msp430 implements the UART bootstrap loader (BSL) of the
+// TI MSP430: the classic ROM BSL of the F1xx/F2xx/F4xx families and
+// the framing of the 5xx/6xx BSL, both at 9600 baud 8E1.
+package msp430
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"termzero/cksum"
+	"termzero/fwimage"
+	"termzero/link"
+)
+
+// Family selects the framing.
+type Family int
+
+const (
+	CLASSIC Family = iota // F1xx, F2xx, F4xx ROM BSL
+	F5XX                  // 5xx, 6xx UART BSL
+)
+
+// The classic BSL.
+const (
+	SYNC     = 0x80 // also the frame header
+	DATA_ACK = 0x90
+	DATA_NAK = 0xa0
+
+	RX_PASSWORD   = 0x10
+	RX_DATA_BLOCK = 0x12
+	TX_DATA_BLOCK = 0x14
+	ERASE_SEGMENT = 0x16
+	MASS_ERASE    = 0x18
+	LOAD_PC       = 0x1a
+	TX_VERSION    = 0x1e
+)
+
+// The 5xx/6xx BSL core commands and answers.
+const (
+	F5_RX_DATA_BLOCK = 0x10
+	F5_RX_PASSWORD   = 0x11
+	F5_MASS_ERASE    = 0x15
+	F5_LOAD_PC       = 0x17
+	F5_TX_DATA_BLOCK = 0x18
+	F5_TX_VERSION    = 0x19
+
+	F5_DATA    = 0x3a // data follows
+	F5_MESSAGE = 0x3b // a status byte follows
+)
+
+const (
+	BLOCK_SIZE    = 240 // data bytes per frame
+	PASSWORD_SIZE = 32  // the interrupt vectors
+	FLASH_FILL    = 0xff
+	BOOT_MODE     = "9600,8E1"
+)
+
+var (
+	ErrNAK    = errors.New("msp430: command refused")
+	ErrNoSync = errors.New("msp430: no answer from the BSL")
+	ErrFrame  = errors.New("msp430: bad answer")
+)
+
+// F5Error is a message of the 5xx BSL core or an error of its UART
+// layer.
+type F5Error byte
+
+var f5Errors = map[F5Error]string{
+	0x01: "flash write check failed",
+	0x02: "flash fail bit set",
+	0x03: "voltage change during program",
+	0x04: "BSL locked",
+	0x05: "BSL password error",
+	0x06: "byte write forbidden",
+	0x07: "unknown command",
+	0x08: "packet length exceeds buffer",
+	0x51: "header incorrect",
+	0x52: "checksum incorrect",
+	0x53: "packet size zero",
+	0x54: "packet size exceeds buffer",
+	0x55: "unknown error",
+	0x56: "unknown baud rate",
+}
+
+func (e F5Error) Error() string {
+	if s, ok := f5Errors[e]; ok {
+		return "msp430: " + s
+	}
+	return fmt.Sprintf("msp430: error 0x%02x", byte(e))
+}
+
+type Options struct {
+	Family  Family
+	Retries int // per frame, 3 if 0
+	// Timeout for an answer, 2s if 0, the mass erase gets five times.
+	Timeout  time.Duration
+	Progress func(n int64) // image bytes written plus verified
+}
+
+func (o *Options) retries() int {
+	if o == nil || o.Retries == 0 {
+		return 3
+	}
+	return o.Retries
+}
+
+func (o *Options) timeout() time.Duration {
+	if o == nil || o.Timeout == 0 {
+		return 2 * time.Second
+	}
+	return o.Timeout
+}
+
+func (o *Options) progress(n int64) {
+	if o != nil && o.Progress != nil {
+		o.Progress(n)
+	}
+}
+
+// Lines are the modem control lines of a port. The usual wiring
+// (TI's and the mspgcc tools') puts RST on DTR and TEST on RTS,
+// both inverted: an active line pulls the pin low.
+type Lines interface {
+	SetDTR(on bool) error
+	SetRTS(on bool) error
+}
+
+type pins struct {
+	p   Lines
+	err error
+}
+
+func (s *pins) rst(high bool) {
+	if s.err == nil {
+		s.err = s.p.SetDTR(!high)
+	}
+}
+
+func (s *pins) test(high bool) {
+	if s.err == nil {
+		s.err = s.p.SetRTS(!high)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Enter starts the BSL: two rising edges on TEST while RST is low,
+// then RST goes high with TEST high.
+func Enter(p Lines) error {
+	s := &pins{p: p}
+	s.rst(false)
+	s.test(false)
+	time.Sleep(100 * time.Millisecond)
+	s.test(true)
+	s.test(false)
+	s.test(true)
+	s.rst(true)
+	time.Sleep(10 * time.Millisecond)
+	s.test(false)
+	time.Sleep(100 * time.Millisecond)
+	return s.err
+}
+
+// Reset starts the application: RST pulses low with TEST low.
+func Reset(p Lines) error {
+	s := &pins{p: p}
+	s.test(false)
+	s.rst(false)
+	time.Sleep(100 * time.Millisecond)
+	s.rst(true)
+	return s.err
+}
+
+// Programmer talks to a BSL.
+type Programmer struct {
+	l *link.Link
+	o *Options
+}
+
+func New(l *link.Link, o *Options) *Programmer {
+	if o == nil {
+		o = &Options{}
+	}
+	return &Programmer{l: l, o: o}
+}
+
+// classicFrame builds a classic BSL frame.
+func classicFrame(cmd byte, addr uint32, n int, data []byte) []byte {
+	l := byte(4 + len(data))
+	b := []byte{SYNC, cmd, l, l, byte(addr), byte(addr >> 8), byte(n), byte(n >> 8)}
+	b = append(b, data...)
+	return appendClassicSum(b)
+}
+
+// appendClassicSum appends the inverted xor of the even and the odd
+// bytes.
+func appendClassicSum(b []byte) []byte {
+	var lo, hi byte
+	for i, c := range b {
+		if i&1 == 0 {
+			lo ^= c
+		} else {
+			hi ^= c
+		}
+	}
+	return append(b, ^lo, ^hi)
+}
+
+// f5Frame wraps a 5xx core command.
+func f5Frame(core []byte) []byte {
+	b := []byte{SYNC, byte(len(core)), byte(len(core) >> 8)}
+	b = append(b, core...)
+	crc := cksum.CRC16CCITT(0xffff, core)
+	return append(b, byte(crc), byte(crc>>8))
+}
+
+// classic sends a classic frame and returns the n data bytes of the
+// answer, or nothing when n is 0 and an ACK came.
+func (p *Programmer) classic(cmd byte, addr uint32, n int, data []byte, d time.Duration) ([]byte, error) {
+	var err error
+	for try := 0; try < p.o.retries(); try++ {
+		p.l.Purge()
+		if _, err = p.l.Write([]byte{SYNC}); err != nil {
+			return nil, err
+		}
+		var c byte
+		if c, err = p.l.GetByte(p.o.timeout()); err != nil || c != DATA_ACK {
+			if err == nil || err == link.ErrTimeout {
+				err = ErrNoSync
+				continue
+			}
+			return nil, err
+		}
+		if _, err = p.l.Write(classicFrame(cmd, addr, n, data)); err != nil {
+			return nil, err
+		}
+		if cmd != TX_DATA_BLOCK && cmd != TX_VERSION {
+			if c, err = p.l.GetByte(d); err == nil {
+				switch c {
+				case DATA_ACK:
+					return nil, nil
+				case DATA_NAK:
+					return nil, ErrNAK
+				}
+				err = ErrFrame
+			}
+		} else {
+			var b []byte
+			if b, err = p.classicData(n, d); err == nil {
+				return b, nil
+			}
+			if err == ErrNAK {
+				return nil, err
+			}
+		}
+		if err == link.ErrTimeout {
+			err = ErrNoSync
+		} else if err != ErrFrame {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// classicData reads a data frame of n bytes.
+func (p *Programmer) classicData(n int, d time.Duration) ([]byte, error) {
+	c, err := p.l.GetByte(d)
+	if err != nil {
+		return nil, err
+	}
+	if c == DATA_NAK {
+		return nil, ErrNAK
+	}
+	b := make([]byte, 4+n+2)
+	b[0] = c
+	if err := p.l.ReadFull(b[1:], d); err != nil {
+		return nil, err
+	}
+	if b[0] != SYNC || b[2] != byte(n) || b[3] != byte(n) {
+		return nil, ErrFrame
+	}
+	sum := appendClassicSum(b[: 4+n : 4+n])
+	if sum[4+n] != b[4+n] || sum[5+n] != b[5+n] {
+		return nil, ErrFrame
+	}
+	return b[4 : 4+n], nil
+}
+
+// f5 sends a 5xx core command and returns the core answer without
+// the leading F5_DATA or F5_MESSAGE.
+func (p *Programmer) f5(core []byte, d time.Duration) ([]byte, error) {
+	var err error
+	for try := 0; try < p.o.retries(); try++ {
+		p.l.Purge()
+		if _, err = p.l.Write(f5Frame(core)); err != nil {
+			return nil, err
+		}
+		var c byte
+		if c, err = p.l.GetByte(d); err != nil {
+			if err == link.ErrTimeout {
+				err = ErrNoSync
+				continue
+			}
+			return nil, err
+		}
+		if c != 0 {
+			err = F5Error(c)
+			if c == 0x52 {
+				// corrupted on the way, try again
+				continue
+			}
+			return nil, err
+		}
+		var b []byte
+		if b, err = p.f5Answer(d); err == nil {
+			if b[0] == F5_MESSAGE {
+				if len(b) != 2 {
+					return nil, ErrFrame
+				}
+				if b[1] != 0 {
+					return nil, F5Error(b[1])
+				}
+			}
+			return b[1:], nil
+		}
+		if err == link.ErrTimeout {
+			err = ErrNoSync
+		} else if err != ErrFrame {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func (p *Programmer) f5Answer(d time.Duration) ([]byte, error) {
+	h := make([]byte, 3)
+	if err := p.l.ReadFull(h, d); err != nil {
+		return nil, err
+	}
+	n := int(h[1]) | int(h[2])<<8
+	if h[0] != SYNC || n == 0 || n > 1024 {
+		return nil, ErrFrame
+	}
+	b := make([]byte, n+2)
+	if err := p.l.ReadFull(b, d); err != nil {
+		return nil, err
+	}
+	crc := cksum.CRC16CCITT(0xffff, b[:n])
+	if b[n] != byte(crc) || b[n+1] != byte(crc>>8) {
+		return nil, ErrFrame
+	}
+	return b[:n], nil
+}
+
+func addr24(a uint32) []byte {
+	return []byte{byte(a), byte(a >> 8), byte(a >> 16)}
+}
+
+// MassErase erases all of the flash, the password becomes all 0xff.
+func (p *Programmer) MassErase() error {
+	d := 5 * p.o.timeout()
+	if p.o.Family == F5XX {
+		_, err := p.f5([]byte{F5_MASS_ERASE}, d)
+		return err
+	}
+	// any address in main memory, 0xa506 erases it all
+	_, err := p.classic(MASS_ERASE, 0xfffe, 0xa506, nil, d)
+	return err
+}
+
+// Password unlocks the BSL with the 32 bytes of the interrupt vector
+// table, erased flash if pw is nil.
+func (p *Programmer) Password(pw []byte) error {
+	if pw == nil {
+		pw = make([]byte, PASSWORD_SIZE)
+		for i := range pw {
+			pw[i] = FLASH_FILL
+		}
+	}
+	if len(pw) != PASSWORD_SIZE {
+		return fmt.Errorf("msp430: the password has %d bytes, not %d", len(pw), PASSWORD_SIZE)
+	}
+	if p.o.Family == F5XX {
+		_, err := p.f5(append([]byte{F5_RX_PASSWORD}, pw...), p.o.timeout())
+		return err
+	}
+	_, err := p.classic(RX_PASSWORD, 0, 0, pw, p.o.timeout())
+	return err
+}
+
+// Write writes data at addr, in blocks. The classic BSL wants an
+// even address and length.
+func (p *Programmer) Write(addr uint32, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > BLOCK_SIZE {
+			n = BLOCK_SIZE
+		}
+		var err error
+		if p.o.Family == F5XX {
+			core := append(append([]byte{F5_RX_DATA_BLOCK}, addr24(addr)...), data[:n]...)
+			_, err = p.f5(core, p.o.timeout())
+		} else {
+			if addr+uint32(n) > 0x10000 {
+				return fmt.Errorf("msp430: 0x%05x is out of the classic BSL's reach", addr)
+			}
+			_, err = p.classic(RX_DATA_BLOCK, addr, n, data[:n], p.o.timeout())
+		}
+		if err != nil {
+			return fmt.Errorf("%v at 0x%05x", err, addr)
+		}
+		addr += uint32(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+// Read reads n bytes at addr.
+func (p *Programmer) Read(addr uint32, n int) ([]byte, error) {
+	var out []byte
+	for n > 0 {
+		k := n
+		if k > BLOCK_SIZE {
+			k = BLOCK_SIZE
+		}
+		var b []byte
+		var err error
+		if p.o.Family == F5XX {
+			core := append(append([]byte{F5_TX_DATA_BLOCK}, addr24(addr)...), byte(k), byte(k>>8))
+			if b, err = p.f5(core, p.o.timeout()); err == nil && len(b) != k {
+				err = ErrFrame
+			}
+		} else {
+			b, err = p.classic(TX_DATA_BLOCK, addr, k, nil, p.o.timeout())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v at 0x%05x", err, addr)
+		}
+		out = append(out, b...)
+		addr += uint32(k)
+		n -= k
+	}
+	return out, nil
+}
+
+// Flash erases the chip, unlocks it with the password of the erased
+// chip and writes and verifies m. The caller resets the chip to run
+// the application.
+func Flash(l *link.Link, m *fwimage.Image, o *Options) error {
+	p := New(l, o)
+	if err := p.MassErase(); err != nil {
+		return err
+	}
+	// whatever the password was, it is erased flash now
+	if err := p.Password(nil); err != nil {
+		return err
+	}
+	var blocks []fwimage.Segment
+	for _, s := range m.Segments {
+		blocks = append(blocks, even(s))
+	}
+	var n int64
+	for _, b := range blocks {
+		if err := p.Write(b.Addr, b.Data); err != nil {
+			return err
+		}
+		n += int64(m.Count(b.Addr, b.End()))
+		p.o.progress(n)
+	}
+	for _, b := range blocks {
+		r, err := p.Read(b.Addr, len(b.Data))
+		if err != nil {
+			return err
+		}
+		for i := range r {
+			if r[i] != b.Data[i] {
+				return fmt.Errorf("msp430: verify error at 0x%05x: 0x%02x, want 0x%02x",
+					b.Addr+uint32(i), r[i], b.Data[i])
+			}
+		}
+		n += int64(m.Count(b.Addr, b.End()))
+		p.o.progress(n)
+	}
+	return nil
+}
+
+// even pads s with erased flash to an even address and length. The
+// segments of an image have gaps, the padding doesn't overwrite.
+func even(s fwimage.Segment) fwimage.Segment {
+	if s.Addr&1 != 0 {
+		s = fwimage.Segment{Addr: s.Addr - 1, Data: append([]byte{FLASH_FILL}, s.Data...)}
+	}
+	if len(s.Data)&1 != 0 {
+		s.Data = append(s.Data, FLASH_FILL)
+	}
+	return s
+}
@@ -0,0 +1,199 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package msp430
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"termzero/fwimage"
+	"termzero/link"
+	"termzero/sers/serstest"
+)
+
+// faulty spoils the line on the target's side: it flips a bit of the
+// in-th byte read and loses the out-th write, counted from 1.
+type faulty struct {
+	io.ReadWriter
+	in, out   int
+	nin, nout int
+}
+
+func (f *faulty) Read(b []byte) (int, error) {
+	n, err := f.ReadWriter.Read(b)
+	if f.in > f.nin && f.in <= f.nin+n {
+		b[f.in-f.nin-1] ^= 0x01
+	}
+	f.nin += n
+	return n, err
+}
+
+func (f *faulty) Write(b []byte) (int, error) {
+	if f.nout++; f.nout == f.out {
+		return len(b), nil
+	}
+	return f.ReadWriter.Write(b)
+}
+
+// flash flashes m into tg over a virtual port pair, through f if
+// not nil.
+func flash(t *testing.T, tg *Target, f *faulty, m *fwimage.Image, o *Options) error {
+	t.Helper()
+	a, b := serstest.Pair(serstest.Options{})
+	done := make(chan error, 1)
+	go func() {
+		var rw io.ReadWriter = b
+		if f != nil {
+			f.ReadWriter = b
+			rw = f
+		}
+		done <- tg.Serve(rw)
+	}()
+	err := Flash(link.New(a), m, o)
+	a.Close()
+	if serr := <-done; serr != io.EOF {
+		t.Errorf("target: %v", serr)
+	}
+	return err
+}
+
+// odd has odd addresses and lengths, and more than a block.
+func odd(base uint32) *fwimage.Image {
+	m := &fwimage.Image{}
+	m.Write(base+1, []byte{1, 2, 3})
+	m.Write(base+0x101, bytes.Repeat([]byte{0x5a}, 2*BLOCK_SIZE+1))
+	return m
+}
+
+func TestFlash(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		f    Family
+		base uint32
+	}{
+		{"classic", CLASSIC, 0xc000},
+		{"5xx", F5XX, 0x10000},
+	} {
+		tg := NewTarget(c.f)
+		m := odd(c.base)
+		var progress int64
+		o := &Options{Family: c.f, Timeout: 500 * time.Millisecond,
+			Progress: func(n int64) { progress = n }}
+		if err := flash(t, tg, nil, m, o); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got := tg.Mem[c.base : c.base+6]; !bytes.Equal(got, []byte{0xff, 1, 2, 3, 0xff, 0xff}) {
+			t.Errorf("%s: at 0x%05x: % x", c.name, c.base, got)
+		}
+		want := append([]byte{0xff}, bytes.Repeat([]byte{0x5a}, 2*BLOCK_SIZE+1)...)
+		want = append(want, 0xff, 0xff)
+		if !bytes.Equal(tg.Mem[c.base+0x100:c.base+0x100+uint32(len(want))], want) {
+			t.Errorf("%s: the blocks at 0x%05x didn't make it", c.name, c.base+0x100)
+		}
+		if progress != 2*int64(m.Len()) {
+			t.Errorf("%s: progress %d, want %d written plus verified", c.name, progress, 2*m.Len())
+		}
+	}
+}
+
+func TestClassicReach(t *testing.T) {
+	m := &fwimage.Image{}
+	m.Write(0xfff0, make([]byte, 32))
+	err := flash(t, NewTarget(CLASSIC), nil, m, &Options{Timeout: 500 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "out of the classic BSL's reach") {
+		t.Errorf("got %v, want 0xfff0 out of reach", err)
+	}
+}
+
+// connect serves tg on a virtual port pair and returns a programmer
+// on the other end.
+func connect(t *testing.T, tg *Target, o *Options) *Programmer {
+	t.Helper()
+	a, b := serstest.Pair(serstest.Options{})
+	go tg.Serve(b)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return New(link.New(a), o)
+}
+
+func TestPassword(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		f     Family
+		wrong error
+	}{
+		{"classic", CLASSIC, ErrNAK},
+		{"5xx", F5XX, F5Error(0x05)},
+	} {
+		// an application's vectors
+		tg := NewTarget(c.f)
+		vectors := tg.password()
+		for i := range vectors {
+			vectors[i] = byte(i)
+		}
+		pw := append([]byte(nil), vectors...)
+		o := &Options{Family: c.f, Timeout: 500 * time.Millisecond}
+		p := connect(t, tg, o)
+		if err := p.Password(nil); err != c.wrong {
+			t.Errorf("%s: the erased password: got %v, want %v", c.name, err, c.wrong)
+		}
+		if c.f == CLASSIC {
+			if err := p.Password(pw); err != nil {
+				t.Errorf("%s: the vectors: %v", c.name, err)
+			}
+			if got, err := p.Read(0xffe0, 4); err != nil || !bytes.Equal(got, pw[:4]) {
+				t.Errorf("%s: unlocked read % x, %v", c.name, got, err)
+			}
+		}
+		if err := p.Password(pw[:8]); err == nil || err.Error() != "msp430: the password has 8 bytes, not 32" {
+			t.Errorf("%s: short password: got %v", c.name, err)
+		}
+
+		// flashing doesn't need it
+		tg = NewTarget(c.f)
+		copy(tg.password(), pw)
+		if err := flash(t, tg, nil, odd(0xc000), o); err != nil {
+			t.Errorf("%s: flash over an application: %v", c.name, err)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	o := &Options{Timeout: 100 * time.Millisecond}
+	// the ACK of the password gets lost, after the SYNC's
+	if err := flash(t, NewTarget(CLASSIC), &faulty{out: 4}, odd(0xc000), o); err != nil {
+		t.Errorf("classic, lost ACK: %v", err)
+	}
+	// a bad checksum, the classic BSL only NAKs
+	if err := flash(t, NewTarget(CLASSIC), &faulty{in: 5}, odd(0xc000), o); err != ErrNAK {
+		t.Errorf("classic, corrupted frame: got %v, want %v", err, ErrNAK)
+	}
+
+	o = &Options{Family: F5XX, Timeout: 100 * time.Millisecond}
+	// the 5xx BSL reports the bad checksum of the first frame
+	if err := flash(t, NewTarget(F5XX), &faulty{in: 4}, odd(0x10000), o); err != nil {
+		t.Errorf("5xx, corrupted frame: %v", err)
+	}
+	// the answer to the password gets lost
+	if err := flash(t, NewTarget(F5XX), &faulty{out: 2}, odd(0x10000), o); err != nil {
+		t.Errorf("5xx, lost answer: %v", err)
+	}
+	// no BSL at all
+	a, b := serstest.Pair(serstest.Options{})
+	defer a.Close()
+	defer b.Close()
+	o.Retries = 2
+	if err := Flash(link.New(a), odd(0x10000), o); err != ErrNoSync {
+		t.Errorf("no BSL: got %v, want %v", err, ErrNoSync)
+	}
+}
@@ -0,0 +1,216 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package msp430
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"termzero/cksum"
+)
+
+// Target emulates a BSL, for trying the programmer on a pty or a
+// loopback without an MSP430 at hand. Like flash, writes can only
+// clear bits.
+type Target struct {
+	Family Family
+	Mem    []byte // 64K for CLASSIC, 1M for F5XX
+	locked bool
+}
+
+func NewTarget(f Family) *Target {
+	n := 1 << 16
+	if f == F5XX {
+		n = 1 << 20
+	}
+	t := &Target{Family: f, Mem: make([]byte, n), locked: true}
+	for i := range t.Mem {
+		t.Mem[i] = FLASH_FILL
+	}
+	return t
+}
+
+// password is the interrupt vector table.
+func (t *Target) password() []byte {
+	return t.Mem[0xffe0:0x10000]
+}
+
+func (t *Target) write(addr uint32, data []byte) bool {
+	if int(addr)+len(data) > len(t.Mem) {
+		return false
+	}
+	for i, b := range data {
+		t.Mem[int(addr)+i] &= b
+	}
+	return true
+}
+
+func (t *Target) read(addr uint32, n int) []byte {
+	if int(addr)+n > len(t.Mem) {
+		return nil
+	}
+	return t.Mem[addr : int(addr)+n]
+}
+
+func (t *Target) erase() {
+	// main memory, the classic BSL keeps its info memory
+	for i := 0x1100; i < len(t.Mem); i++ {
+		t.Mem[i] = FLASH_FILL
+	}
+}
+
+// Serve answers the frames read from rw until reading fails.
+func (t *Target) Serve(rw io.ReadWriter) error {
+	r := bufio.NewReader(rw)
+	if t.Family == F5XX {
+		return t.serveF5(r, rw)
+	}
+	return t.serveClassic(r, rw)
+}
+
+func (t *Target) serveClassic(r *bufio.Reader, w io.Writer) error {
+	synced := false
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if c != SYNC {
+			continue
+		}
+		if !synced {
+			synced = true
+			w.Write([]byte{DATA_ACK})
+			continue
+		}
+		synced = false
+		b := make([]byte, 3)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		cmd, l := b[0], int(b[1])
+		if b[1] != b[2] || l < 4 {
+			w.Write([]byte{DATA_NAK})
+			continue
+		}
+		f := make([]byte, 4+l+2)
+		f[0], f[1], f[2], f[3] = SYNC, cmd, b[1], b[2]
+		if _, err := io.ReadFull(r, f[4:]); err != nil {
+			return err
+		}
+		if !bytes.Equal(appendClassicSum(f[:4+l:4+l]), f) {
+			w.Write([]byte{DATA_NAK})
+			continue
+		}
+		addr := uint32(f[4]) | uint32(f[5])<<8
+		n := int(f[6]) | int(f[7])<<8
+		data := f[8 : 4+l]
+		ok := true
+		switch cmd {
+		case RX_PASSWORD:
+			if t.locked = !bytes.Equal(data, t.password()); t.locked {
+				ok = false
+			}
+		case MASS_ERASE:
+			t.erase()
+		case RX_DATA_BLOCK:
+			ok = !t.locked && t.write(addr, data)
+		case TX_DATA_BLOCK:
+			d := t.read(addr, n)
+			if t.locked || d == nil || n > 250 {
+				ok = false
+				break
+			}
+			w.Write(appendClassicSum(append([]byte{SYNC, 0, byte(n), byte(n)}, d...)))
+			continue
+		default:
+			ok = false
+		}
+		if ok {
+			w.Write([]byte{DATA_ACK})
+		} else {
+			w.Write([]byte{DATA_NAK})
+		}
+	}
+}
+
+func (t *Target) serveF5(r *bufio.Reader, w io.Writer) error {
+	answer := func(core ...byte) {
+		b := []byte{0, SYNC, byte(len(core)), byte(len(core) >> 8)}
+		b = append(b, core...)
+		crc := cksum.CRC16CCITT(0xffff, core)
+		w.Write(append(b, byte(crc), byte(crc>>8)))
+	}
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if c != SYNC {
+			w.Write([]byte{0x51})
+			continue
+		}
+		h := make([]byte, 2)
+		if _, err := io.ReadFull(r, h); err != nil {
+			return err
+		}
+		n := int(h[0]) | int(h[1])<<8
+		if n == 0 {
+			w.Write([]byte{0x53})
+			continue
+		}
+		if n > 260 {
+			w.Write([]byte{0x54})
+			continue
+		}
+		core := make([]byte, n+2)
+		if _, err := io.ReadFull(r, core); err != nil {
+			return err
+		}
+		crc := cksum.CRC16CCITT(0xffff, core[:n])
+		if core[n] != byte(crc) || core[n+1] != byte(crc>>8) {
+			w.Write([]byte{0x52})
+			continue
+		}
+		core = core[:n]
+		var addr uint32
+		if n >= 4 {
+			addr = uint32(core[1]) | uint32(core[2])<<8 | uint32(core[3])<<16
+		}
+		switch {
+		case core[0] == F5_MASS_ERASE:
+			t.erase()
+			answer(F5_MESSAGE, 0)
+		case core[0] == F5_RX_PASSWORD:
+			if t.locked = !bytes.Equal(core[1:], t.password()); t.locked {
+				// the real one mass erases now
+				t.erase()
+				answer(F5_MESSAGE, 0x05)
+			} else {
+				answer(F5_MESSAGE, 0)
+			}
+		case t.locked:
+			answer(F5_MESSAGE, 0x04)
+		case core[0] == F5_RX_DATA_BLOCK && n >= 4:
+			if t.write(addr, core[4:]) {
+				answer(F5_MESSAGE, 0)
+			} else {
+				answer(F5_MESSAGE, 0x01)
+			}
+		case core[0] == F5_TX_DATA_BLOCK && n == 6:
+			d := t.read(addr, int(core[4])|int(core[5])<<8)
+			if d == nil {
+				answer(F5_MESSAGE, 0x08)
+				break
+			}
+			answer(append([]byte{F5_DATA}, d...)...)
+		default:
+			answer(F5_MESSAGE, 0x07)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package netser
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"termzero/sers"
+)
+
+// ANSWER_TIMEOUT is how long a Port waits for the server to confirm a
+// setting.
+const ANSWER_TIMEOUT = 3 * time.Second
+
+var ErrNoComPort = errors.New("netser: the server has no COM-PORT-OPTION")
+
+func init() {
+	sers.Register("rfc2217", func(addr string) (sers.SerialPort, error) {
+		return Dial(addr)
+	})
+}
+
+// Port is a serial port behind an RFC 2217 server. It is what
+// sers.Open returns for "rfc2217://host:port".
+type Port struct {
+	conn net.Conn
+	tn   *telnet // decodes with mu held
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []byte // received
+	err     error  // of the reader
+	answers map[byte][]byte
+	mode    sers.Mode
+	lines   uint32        // DTR and RTS as set, the rest as notified
+	timeout time.Duration // of Read, forever if 0
+}
+
+// Dial connects to the RFC 2217 server at addr and reads the settings
+// of its port.
+func Dial(addr string) (*Port, error) {
+	conn, err := net.DialTimeout("tcp", addr, ANSWER_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	p := &Port{
+		conn:    conn,
+		tn:      newTelnet([]byte{OPT_BINARY, OPT_SGA, OPT_COM_PORT}, []byte{OPT_BINARY, OPT_SGA}),
+		answers: map[byte][]byte{},
+		lines:   sers.DTR_LINE | sers.RTS_LINE,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	p.tn.sub = p.answer
+	start := p.tn.start([]byte{OPT_BINARY, OPT_SGA, OPT_COM_PORT}, []byte{OPT_BINARY, OPT_SGA})
+	if _, err := conn.Write(start); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go p.read()
+	// a query of every setting, the answers say the server has the
+	// option
+	if err := p.query(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Port) query() error {
+	b, err := p.request(CPO_SET_BAUDRATE, 0, 0, 0, 0)
+	if err == errNoAnswer {
+		return ErrNoComPort
+	}
+	if err != nil {
+		return err
+	}
+	m := sers.Mode{Baudrate: binary.BigEndian.Uint32(b)}
+	if b, err = p.request(CPO_SET_DATASIZE, 0); err != nil {
+		return err
+	}
+	m.Databits = uint32(b[0])
+	if b, err = p.request(CPO_SET_PARITY, 0); err != nil {
+		return err
+	}
+	m.Parity, _ = sersParity(b[0])
+	if b, err = p.request(CPO_SET_STOPSIZE, 0); err != nil {
+		return err
+	}
+	m.Stopbits = uint32(b[0])
+	if b, err = p.request(CPO_SET_CONTROL, CTL_FLOW_REQ); err != nil {
+		return err
+	}
+	if b[0] == CTL_FLOW_HW {
+		m.Handshake = sers.RTSCTS_HANDSHAKE
+	}
+	p.mu.Lock()
+	p.mode = m
+	p.mu.Unlock()
+	_, err = p.request(CPO_SET_MODEMSTATE_MASK, 0xff)
+	return err
+}
+
+// read decodes what the server sends.
+func (p *Port) read() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := p.conn.Read(buf)
+		// answer goes with p.mu held
+		p.mu.Lock()
+		p.buf = p.tn.decode(p.buf, buf[:n])
+		reply := p.tn.reply
+		p.tn.reply = nil
+		if err != nil {
+			p.err = err
+		}
+		p.cond.Broadcast()
+		p.mu.Unlock()
+		if len(reply) > 0 {
+			p.write(reply)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// answer takes a COM-PORT-OPTION answer, it is called with p.mu held.
+func (p *Port) answer(b []byte) {
+	if len(b) < 3 || b[0] != OPT_COM_PORT || b[1] < CPO_SERVER {
+		return
+	}
+	cmd, v := b[1]-CPO_SERVER, b[2:]
+	if cmd == CPO_NOTIFY_MODEMSTATE {
+		p.lines &= sers.DTR_LINE | sers.RTS_LINE
+		for _, m := range []struct {
+			ms   byte
+			line uint32
+		}{
+			{MS_CD, sers.DCD_LINE},
+			{MS_RI, sers.RI_LINE},
+			{MS_DSR, sers.DSR_LINE},
+			{MS_CTS, sers.CTS_LINE},
+		} {
+			if v[0]&m.ms != 0 {
+				p.lines |= m.line
+			}
+		}
+		return
+	}
+	p.answers[cmd] = append([]byte(nil), v...)
+}
+
+var errNoAnswer = errors.New("netser: no answer from the server")
+
+// request sends a COM-PORT-OPTION command and waits for its answer.
+func (p *Port) request(cmd byte, v ...byte) ([]byte, error) {
+	p.mu.Lock()
+	delete(p.answers, cmd)
+	p.mu.Unlock()
+	if err := p.write(subneg(OPT_COM_PORT, append([]byte{cmd}, v...))); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expired := false
+	t := time.AfterFunc(ANSWER_TIMEOUT, func() {
+		p.mu.Lock()
+		expired = true
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	})
+	defer t.Stop()
+	for {
+		if a, ok := p.answers[cmd]; ok && len(a) >= len(v) {
+			return a, nil
+		}
+		if p.err != nil {
+			return nil, p.err
+		}
+		if !p.tn.us[OPT_COM_PORT] {
+			// refused
+			return nil, ErrNoComPort
+		}
+		if expired {
+			return nil, errNoAnswer
+		}
+		p.cond.Wait()
+	}
+}
+
+func (p *Port) write(b []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	_, err := p.conn.Write(b)
+	return err
+}
+
+func (p *Port) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expired := false
+	if p.timeout > 0 {
+		t := time.AfterFunc(p.timeout, func() {
+			p.mu.Lock()
+			expired = true
+			p.cond.Broadcast()
+			p.mu.Unlock()
+		})
+		defer t.Stop()
+	}
+	for len(p.buf) == 0 && p.err == nil && !expired {
+		p.cond.Wait()
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	if n == 0 && p.err != nil {
+		return 0, p.err
+	}
+	return n, nil
+}
+
+func (p *Port) Write(b []byte) (int, error) {
+	if err := p.write(escapeIAC(nil, b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *Port) Close() error {
+	return p.conn.Close()
+}
+
+// SetMode sets the mode of the remote port, the server has to confirm
+// every part.
+func (p *Port) SetMode(baudrate, databits, parity, stopbits, handshake uint32) error {
+	if parity > sers.O {
+		return &sers.ParameterError{Parameter: "parity", Reason: "has to be N, E or O"}
+	}
+	br := make([]byte, 4)
+	binary.BigEndian.PutUint32(br, baudrate)
+	flow := byte(CTL_FLOW_NONE)
+	if handshake == sers.RTSCTS_HANDSHAKE {
+		flow = CTL_FLOW_HW
+	}
+	for _, r := range []struct {
+		name string
+		cmd  byte
+		v    []byte
+	}{
+		{"baudrate", CPO_SET_BAUDRATE, br},
+		{"databits", CPO_SET_DATASIZE, []byte{byte(databits)}},
+		{"parity", CPO_SET_PARITY, []byte{rfcParity[parity]}},
+		{"stopbits", CPO_SET_STOPSIZE, []byte{byte(stopbits)}},
+		{"handshake", CPO_SET_CONTROL, []byte{flow}},
+	} {
+		a, err := p.request(r.cmd, r.v...)
+		if err != nil {
+			return err
+		}
+		if string(a[:len(r.v)]) != string(r.v) {
+			return &sers.ParameterError{Parameter: r.name, Reason: "not confirmed by the server"}
+		}
+	}
+	p.mu.Lock()
+	p.mode = sers.Mode{Baudrate: baudrate, Databits: databits, Parity: parity,
+		Stopbits: stopbits, Handshake: handshake}
+	p.mu.Unlock()
+	return nil
+}
+
+// SetReadParams sets the Read timeout, a Read waits for one byte at
+// least.
+func (p *Port) SetReadParams(minread int, timeout float64) error {
+	p.mu.Lock()
+	p.timeout = time.Duration(timeout * float64(time.Second))
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Port) Baudrate() (uint32, uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mode.Baudrate, p.mode.Baudrate
+}
+
+func (p *Port) control(v, on, line uint32) error {
+	a, err := p.request(CPO_SET_CONTROL, byte(v))
+	if err != nil {
+		return err
+	}
+	if uint32(a[0]) != v {
+		return sers.StringError("netser: the server refused the control change")
+	}
+	p.mu.Lock()
+	if v == on {
+		p.lines |= line
+	} else {
+		p.lines &^= line
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Port) SetDTR(on bool) error {
+	if on {
+		return p.control(CTL_DTR_ON, CTL_DTR_ON, sers.DTR_LINE)
+	}
+	return p.control(CTL_DTR_OFF, CTL_DTR_ON, sers.DTR_LINE)
+}
+
+func (p *Port) SetRTS(on bool) error {
+	if on {
+		return p.control(CTL_RTS_ON, CTL_RTS_ON, sers.RTS_LINE)
+	}
+	return p.control(CTL_RTS_OFF, CTL_RTS_ON, sers.RTS_LINE)
+}
+
+// ModemLines returns the output lines as set and the input lines as
+// the server last notified them.
+func (p *Port) ModemLines() (uint32, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lines, nil
+}
+
+func (p *Port) SendBreak(d time.Duration) error {
+	if _, err := p.request(CPO_SET_CONTROL, CTL_BREAK_ON); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	_, err := p.request(CPO_SET_CONTROL, CTL_BREAK_OFF)
+	return err
+}
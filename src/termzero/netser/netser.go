@@ -0,0 +1,498 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package netser serves a serial port on TCP, the way ser2net does:
+// every client reads what the port receives, the writer policy
+// decides who may write to it.
+package netser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"termzero/sers"
+)
+
+type Mode int
+
+const (
+	RAW     Mode = iota // the bytes as they are
+	TELNET              // Telnet, character mode and IAC escaped
+	RFC2217             // Telnet with the COM-PORT-OPTION controlling the port
+)
+
+var modeNames = []string{"raw", "telnet", "rfc2217"}
+
+func ParseMode(s string) (Mode, error) {
+	for i, n := range modeNames {
+		if n == s {
+			return Mode(i), nil
+		}
+	}
+	return RAW, fmt.Errorf("unknown server mode %q, have %s",
+		s, strings.Join(modeNames, ", "))
+}
+
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(modeNames) {
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+	return modeNames[m]
+}
+
+// Policy tells which clients may write to the port.
+type Policy int
+
+const (
+	ALL   Policy = iota // every client
+	FIRST               // the longest connected client, the others only read
+	ONE                 // a single client at a time, more are turned away
+
+	// Spectators attached as such only read and don't count.
+)
+
+var policyNames = []string{"all", "first", "one"}
+
+func ParsePolicy(s string) (Policy, error) {
+	for i, n := range policyNames {
+		if n == s {
+			return Policy(i), nil
+		}
+	}
+	return ALL, fmt.Errorf("unknown writer policy %q, have %s",
+		s, strings.Join(policyNames, ", "))
+}
+
+func (p Policy) String() string {
+	if p < 0 || int(p) >= len(policyNames) {
+		return fmt.Sprintf("Policy(%d)", int(p))
+	}
+	return policyNames[p]
+}
+
+// ParseAllow parses a comma separated list of addresses and networks,
+// e.g. "127.0.0.1,192.168.1.0/24".
+func ParseAllow(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address %q", f)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, fmt.Errorf("bad network %q", f)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+const QUEUE = 64 // chunks queued for a client before it is dropped
+
+var ErrClosed = errors.New("netser: server closed")
+
+type Config struct {
+	Mode    Mode
+	Writers Policy
+	// Idle drops a client after that long without data either way,
+	// never if 0.
+	Idle  time.Duration
+	Allow []*net.IPNet // the allowed clients, all if empty
+	// Logf reports clients coming and going.
+	Logf func(format string, a ...interface{})
+
+	// Port and Line are the port RFC 2217 clients control and its
+	// settings, without Port they can only ask for them.
+	Port sers.SerialPort
+	Line sers.Mode
+}
+
+func (c *Config) logf(format string, a ...interface{}) {
+	if c.Logf != nil {
+		c.Logf(format, a...)
+	}
+}
+
+func (c *Config) allowed(addr net.Addr) bool {
+	if len(c.Allow) == 0 {
+		return true
+	}
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range c.Allow {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Server shares a port among its clients.
+type Server struct {
+	port io.ReadWriter
+	c    Config
+
+	wmu sync.Mutex // serializes the writes to the port
+
+	mu      sync.Mutex
+	clients []*client // in the order they came
+	closed  bool
+	quit    chan struct{} // closed by Close
+
+	// the state of the port for RFC 2217, guarded by mu
+	dtr, rts bool
+	brk      time.Time // BREAK on since, zero if off
+	modem    byte      // the last modem state sent
+}
+
+func New(port io.ReadWriter, c Config) *Server {
+	// opening a port raises DTR and RTS, unless it tells otherwise
+	s := &Server{port: port, c: c, quit: make(chan struct{}), dtr: true, rts: true}
+	if c.Port != nil {
+		if l, err := c.Port.ModemLines(); err == nil {
+			s.dtr, s.rts = l&sers.DTR_LINE != 0, l&sers.RTS_LINE != 0
+		}
+	}
+	return s
+}
+
+type client struct {
+	conn   net.Conn
+	name   string
+	out    chan []byte // to the client, encoded
+	tn     *telnet     // nil in raw mode
+	last   int64       // unix nanoseconds of the last data sent
+	reason string      // why it was dropped
+	mask   byte        // modem state changes to notify, RFC 2217
+
+	spectator bool // only reads
+}
+
+func (c *client) active() {
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+}
+
+// Serve accepts clients on ln and shares the port with them until
+// the port fails or Close is called.
+func (s *Server) Serve(ln net.Listener) error {
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				s.Close()
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	go func() {
+		// Close ends the accept loop
+		<-s.quit
+		ln.Close()
+	}()
+	return s.Run()
+}
+
+// Run reads the port for the clients until it fails or Close is
+// called, it runs once. Serve runs it, a server with clients only
+// from Attach needs it run.
+func (s *Server) Run() error {
+	errc := make(chan error, 1)
+	go func() { errc <- s.readPort() }()
+	if s.c.Mode == RFC2217 && s.c.Port != nil {
+		go s.watchModem()
+	}
+	var err error
+	select {
+	case err = <-errc:
+	case <-s.quit:
+		err = ErrClosed
+	}
+	s.Close()
+	return err
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Close drops all clients and stops Serve.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.quit)
+	}
+	for _, c := range s.clients {
+		c.conn.Close()
+	}
+	return nil
+}
+
+// Clients returns the names of the connected clients, the longest
+// connected first.
+func (s *Server) Clients() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var a []string
+	for _, c := range s.clients {
+		a = append(a, c.name)
+	}
+	return a
+}
+
+// Owner returns the name of the longest connected client that isn't a
+// spectator, the writer under the FIRST and ONE policies.
+func (s *Server) Owner() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.owner(); c != nil {
+		return c.name
+	}
+	return ""
+}
+
+// readPort copies what the port receives to all clients.
+func (s *Server) readPort() error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.port.Read(buf)
+		if n > 0 {
+			s.broadcast(buf[:n])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) broadcast(p []byte) {
+	var raw, escaped []byte
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clients {
+		var b []byte
+		if c.tn == nil {
+			if raw == nil {
+				raw = append([]byte(nil), p...)
+			}
+			b = raw
+		} else {
+			if escaped == nil {
+				escaped = escapeIAC(nil, p)
+			}
+			b = escaped
+		}
+		s.queue(c, b)
+	}
+}
+
+// queue queues b for c, which is dropped if it can't keep up. It is
+// called with s.mu held.
+func (s *Server) queue(c *client, b []byte) {
+	select {
+	case c.out <- b:
+	default:
+		if c.reason == "" {
+			c.reason = "too slow"
+			c.conn.Close()
+		}
+	}
+}
+
+var ErrInUse = errors.New("netser: port in use")
+
+// add adds c, false if the policy turns it away.
+func (s *Server) add(c *client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.c.Writers == ONE && !c.spectator && s.owner() != nil {
+		return false
+	}
+	s.clients = append(s.clients, c)
+	return true
+}
+
+// owner returns the longest connected client that isn't a spectator,
+// it is called with s.mu held.
+func (s *Server) owner() *client {
+	for _, c := range s.clients {
+		if !c.spectator {
+			return c
+		}
+	}
+	return nil
+}
+
+// remove removes c and returns the client writing in its place, if
+// any.
+func (s *Server) remove(c *client) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owner := s.owner() == c
+	for i, k := range s.clients {
+		if k == c {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			close(c.out)
+			break
+		}
+	}
+	if next := s.owner(); owner && s.c.Writers == FIRST && next != nil {
+		return next.name
+	}
+	return ""
+}
+
+// writer tells if c may write to the port.
+func (s *Server) writer(c *client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !c.spectator && (s.c.Writers != FIRST || s.owner() == c)
+}
+
+// serve serves a client from the listener.
+func (s *Server) serve(conn net.Conn) {
+	name := conn.RemoteAddr().String()
+	if !s.c.allowed(conn.RemoteAddr()) {
+		s.c.logf("%s refused, not allowed", name)
+		conn.Close()
+		return
+	}
+	if err := s.Attach(conn, name, false, nil); err == ErrInUse {
+		conn.Write([]byte("port in use\r\n"))
+		conn.Close()
+	}
+}
+
+// Attach serves conn, named name in the log, sending greeting first.
+// A spectator only reads. Attach returns at once, with ErrInUse if the
+// writer policy turns conn away, it is up to the caller to close it
+// then.
+func (s *Server) Attach(conn net.Conn, name string, spectator bool, greeting []byte) error {
+	c := &client{conn: conn, name: name, out: make(chan []byte, QUEUE), mask: 0xff,
+		spectator: spectator}
+	c.active()
+	if len(greeting) > 0 {
+		c.out <- greeting
+	}
+	switch s.c.Mode {
+	case TELNET:
+		// echoing without go-aheads puts clients in character mode
+		c.tn = newTelnet([]byte{OPT_BINARY, OPT_ECHO, OPT_SGA}, []byte{OPT_BINARY, OPT_SGA})
+		c.out <- c.tn.start([]byte{OPT_ECHO, OPT_SGA}, []byte{OPT_SGA})
+	case RFC2217:
+		c.tn = newTelnet([]byte{OPT_BINARY, OPT_SGA}, []byte{OPT_BINARY, OPT_SGA, OPT_COM_PORT})
+		c.tn.sub = func(b []byte) { s.comPort(c, b) }
+		c.out <- c.tn.start([]byte{OPT_BINARY, OPT_SGA}, []byte{OPT_BINARY, OPT_SGA, OPT_COM_PORT})
+	}
+	if !s.add(c) {
+		s.c.logf("%s refused, the port is in use", name)
+		return ErrInUse
+	}
+	if s.writer(c) {
+		s.c.logf("%s connected", name)
+	} else {
+		s.c.logf("%s connected, read only", name)
+	}
+	go func() {
+		for b := range c.out {
+			if _, err := conn.Write(b); err != nil {
+				conn.Close()
+			}
+			c.active()
+		}
+	}()
+	go func() {
+		err := s.readClient(c)
+		conn.Close()
+		next := s.remove(c)
+		s.mu.Lock()
+		reason := c.reason
+		s.mu.Unlock()
+		switch {
+		case reason != "":
+		case err == io.EOF:
+			reason = "disconnected"
+		default:
+			reason = err.Error()
+		}
+		s.c.logf("%s dropped, %s", name, reason)
+		if next != "" {
+			s.c.logf("%s writes now", next)
+		}
+	}()
+	return nil
+}
+
+// readClient copies what c sends to the port, if it may write.
+func (s *Server) readClient(c *client) error {
+	buf := make([]byte, 4096)
+	var data []byte
+	for {
+		if s.c.Idle > 0 {
+			last := time.Unix(0, atomic.LoadInt64(&c.last))
+			c.conn.SetReadDeadline(last.Add(s.c.Idle))
+		}
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				last := time.Unix(0, atomic.LoadInt64(&c.last))
+				if time.Since(last) < s.c.Idle {
+					// it got data meanwhile
+					continue
+				}
+				s.mu.Lock()
+				c.reason = "idle"
+				s.mu.Unlock()
+			}
+			return err
+		}
+		c.active()
+		data = buf[:n]
+		if c.tn != nil {
+			data = c.tn.decode(data[:0:0], buf[:n])
+			if len(c.tn.reply) > 0 {
+				s.mu.Lock()
+				s.queue(c, c.tn.reply)
+				s.mu.Unlock()
+				c.tn.reply = nil
+			}
+		}
+		if len(data) == 0 || !s.writer(c) {
+			continue
+		}
+		s.wmu.Lock()
+		_, err = s.port.Write(data)
+		s.wmu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,336 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package netser
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"termzero/sers/serstest"
+)
+
+// logs collects what the server logs.
+type logs struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *logs) logf(format string, a ...interface{}) {
+	l.mu.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, a...))
+	l.mu.Unlock()
+}
+
+func (l *logs) has(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// serve serves one end of a virtual port pair on a loopback port. It
+// returns the server, its address and the other end, the device.
+// RFC 2217 clients control the served end.
+func serve(t *testing.T, c Config) (s *Server, addr string, dev *serstest.Port) {
+	t.Helper()
+	a, b := serstest.Pair(serstest.Options{})
+	b.SetReadParams(0, 0.05)
+	if c.Mode == RFC2217 {
+		c.Port, c.Line = a, a.Mode()
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = New(a, c)
+	go s.Serve(ln)
+	t.Cleanup(func() {
+		s.Close()
+		a.Close()
+		b.Close()
+	})
+	return s, ln.Addr().String(), b
+}
+
+// dial connects to addr and waits for the server to count n clients.
+func dial(t *testing.T, s *Server, addr string, n int) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	wait(t, fmt.Sprintf("%d clients", n), func() bool { return len(s.Clients()) == n })
+	return conn
+}
+
+// wait waits up to 2s for ok.
+func wait(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	for end := time.Now().Add(2 * time.Second); !ok(); {
+		if time.Now().After(end) {
+			t.Fatalf("no %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// recv reads what r gets until it is quiet for a while.
+func recv(r io.Reader) string {
+	var got []byte
+	buf := make([]byte, 256)
+	for quiet := 0; quiet < 4; {
+		if c, ok := r.(net.Conn); ok {
+			c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		}
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if n > 0 {
+			quiet = 0
+			continue
+		}
+		if err != nil && err != io.EOF {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				break
+			}
+		}
+		quiet++
+	}
+	return string(got)
+}
+
+// closed tells if the server closes conn.
+func closed(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := io.ReadAll(conn)
+	return err == nil
+}
+
+func TestAll(t *testing.T) {
+	s, addr, dev := serve(t, Config{Writers: ALL})
+	c1 := dial(t, s, addr, 1)
+	c2 := dial(t, s, addr, 2)
+	dev.Write([]byte("hello"))
+	for i, c := range []net.Conn{c1, c2} {
+		if got := recv(c); got != "hello" {
+			t.Errorf("client %d read %q", i+1, got)
+		}
+	}
+	c1.Write([]byte("1"))
+	c2.Write([]byte("2"))
+	if got := recv(dev); got != "12" && got != "21" {
+		t.Errorf("the port got %q", got)
+	}
+}
+
+func TestFirst(t *testing.T) {
+	var l logs
+	s, addr, dev := serve(t, Config{Writers: FIRST, Logf: l.logf})
+	c1 := dial(t, s, addr, 1)
+	c2 := dial(t, s, addr, 2)
+	if s.Owner() != c1.LocalAddr().String() {
+		t.Errorf("owner %s, want %s", s.Owner(), c1.LocalAddr())
+	}
+	c2.Write([]byte("2"))
+	c1.Write([]byte("1"))
+	if got := recv(dev); got != "1" {
+		t.Errorf("the port got %q", got)
+	}
+	dev.Write([]byte("both"))
+	if recv(c1) != "both" || recv(c2) != "both" {
+		t.Error("a reader missed the port")
+	}
+
+	// the next takes over
+	c1.Close()
+	wait(t, "handover", func() bool { return s.Owner() == c2.LocalAddr().String() })
+	wait(t, "handover log", func() bool { return l.has(c2.LocalAddr().String() + " writes now") })
+	c2.Write([]byte("2"))
+	if got := recv(dev); got != "2" {
+		t.Errorf("the port got %q from the new owner", got)
+	}
+}
+
+func TestOne(t *testing.T) {
+	s, addr, dev := serve(t, Config{Writers: ONE})
+	c1 := dial(t, s, addr, 1)
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if got := recv(c2); got != "port in use\r\n" {
+		t.Errorf("the second client read %q", got)
+	}
+	if len(s.Clients()) != 1 {
+		t.Errorf("clients %v", s.Clients())
+	}
+	c1.Write([]byte("1"))
+	if got := recv(dev); got != "1" {
+		t.Errorf("the port got %q", got)
+	}
+
+	// free again
+	c1.Close()
+	wait(t, "disconnect", func() bool { return len(s.Clients()) == 0 })
+	c3 := dial(t, s, addr, 1)
+	c3.Write([]byte("3"))
+	if got := recv(dev); got != "3" {
+		t.Errorf("the port got %q", got)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	var l logs
+	s, addr, _ := serve(t, Config{Idle: 200 * time.Millisecond, Logf: l.logf})
+	start := time.Now()
+	c := dial(t, s, addr, 1)
+	if !closed(c) {
+		t.Fatal("an idle client wasn't dropped")
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("dropped after %v", d)
+	}
+	wait(t, "idle log", func() bool { return l.has("dropped, idle") })
+}
+
+func TestAllow(t *testing.T) {
+	var l logs
+	allow, err := ParseAllow("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, addr, _ := serve(t, Config{Allow: allow, Logf: l.logf})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !closed(c) {
+		t.Error("a client not allowed wasn't closed")
+	}
+	if len(s.Clients()) != 0 || !l.has("refused, not allowed") {
+		t.Errorf("clients %v, log %q", s.Clients(), l.lines)
+	}
+
+	allow, _ = ParseAllow("127.0.0.1")
+	s, addr, _ = serve(t, Config{Allow: allow})
+	dial(t, s, addr, 1)
+
+	if _, err := ParseAllow("10.0.0.0/33"); err == nil {
+		t.Error("ParseAllow took a bad network")
+	}
+}
+
+func TestTelnet(t *testing.T) {
+	s, addr, dev := serve(t, Config{Mode: TELNET})
+	c := dial(t, s, addr, 1)
+	if got, want := recv(c), "\xff\xfb\x01\xff\xfb\x03\xff\xfd\x03"; got != want {
+		t.Errorf("negotiation %q, want %q", got, want)
+	}
+
+	// NVT: the NUL after a CR is padding
+	c.Write([]byte("a\xff\xffb\r\x00c\r\n"))
+	if got := recv(dev); got != "a\xffb\rc\r\n" {
+		t.Errorf("the port got %q", got)
+	}
+	dev.Write([]byte("x\xffy"))
+	if got := recv(c); got != "x\xff\xffy" {
+		t.Errorf("the client read %q", got)
+	}
+
+	// binary keeps the NULs, an unknown option is refused
+	c.Write([]byte("\xff\xfb\x00\xff\xfb\x18"))
+	if got := recv(c); got != "\xff\xfd\x00\xff\xfe\x18" {
+		t.Errorf("answers %q", got)
+	}
+	c.Write([]byte("\r\x00"))
+	if got := recv(dev); got != "\r\x00" {
+		t.Errorf("the port got %q in binary", got)
+	}
+}
+
+// attach attaches one end of a pipe to s and returns the other.
+func attach(t *testing.T, s *Server, name string, spectator bool) (net.Conn, error) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { b.Close() })
+	if err := s.Attach(a, name, spectator, []byte(name+"\r\n")); err != nil {
+		a.Close()
+		return b, err
+	}
+	if got := recv(b); got != name+"\r\n" {
+		t.Errorf("%s was greeted with %q", name, got)
+	}
+	return b, nil
+}
+
+func TestSpectator(t *testing.T) {
+	s, _, dev := serve(t, Config{Writers: ONE})
+	sp, _ := attach(t, s, "spectator", true)
+	if s.Owner() != "" {
+		t.Errorf("the spectator owns the port")
+	}
+	sp.Write([]byte("s"))
+	if got := recv(dev); got != "" {
+		t.Errorf("the port got %q from the spectator", got)
+	}
+
+	// one writer besides spectators
+	c1, err := attach(t, s, "one", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := attach(t, s, "two", false); err != ErrInUse {
+		t.Errorf("a second writer: %v, want %v", err, ErrInUse)
+	}
+	if _, err := attach(t, s, "another spectator", true); err != nil {
+		t.Errorf("a second spectator: %v", err)
+	}
+	if s.Owner() != "one" || len(s.Clients()) != 3 {
+		t.Errorf("owner %q, clients %v", s.Owner(), s.Clients())
+	}
+	c1.Write([]byte("1"))
+	if got := recv(dev); got != "1" {
+		t.Errorf("the port got %q", got)
+	}
+	dev.Write([]byte("all"))
+	if recv(sp) != "all" {
+		t.Error("the spectator missed the port")
+	}
+}
+
+func TestSpectatorHandover(t *testing.T) {
+	var l logs
+	s, _, dev := serve(t, Config{Writers: FIRST, Logf: l.logf})
+	attach(t, s, "spectator", true)
+	c1, _ := attach(t, s, "one", false)
+	c2, _ := attach(t, s, "two", false)
+	if s.Owner() != "one" {
+		t.Errorf("owner %q, want one", s.Owner())
+	}
+
+	// the next writer takes over, not the spectator
+	c1.Close()
+	wait(t, "handover", func() bool { return s.Owner() == "two" })
+	wait(t, "handover log", func() bool { return l.has("two writes now") })
+	c2.Write([]byte("2"))
+	if got := recv(dev); got != "2" {
+		t.Errorf("the port got %q from the new owner", got)
+	}
+	c2.Close()
+	wait(t, "the last writer to leave", func() bool { return s.Owner() == "" })
+}
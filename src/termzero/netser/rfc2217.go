@@ -0,0 +1,262 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package netser
+
+import (
+	"encoding/binary"
+	"time"
+
+	"termzero/sers"
+)
+
+// RFC 2217 COM-PORT-OPTION commands, the server answers with the
+// command + CPO_SERVER.
+const (
+	CPO_SIGNATURE           = 0
+	CPO_SET_BAUDRATE        = 1
+	CPO_SET_DATASIZE        = 2
+	CPO_SET_PARITY          = 3
+	CPO_SET_STOPSIZE        = 4
+	CPO_SET_CONTROL         = 5
+	CPO_NOTIFY_LINESTATE    = 6
+	CPO_NOTIFY_MODEMSTATE   = 7
+	CPO_FLOWCONTROL_SUSPEND = 8
+	CPO_FLOWCONTROL_RESUME  = 9
+	CPO_SET_LINESTATE_MASK  = 10
+	CPO_SET_MODEMSTATE_MASK = 11
+	CPO_PURGE_DATA          = 12
+
+	CPO_SERVER = 100
+)
+
+// SET-CONTROL values.
+const (
+	CTL_FLOW_REQ  = 0
+	CTL_FLOW_NONE = 1
+	CTL_FLOW_XON  = 2
+	CTL_FLOW_HW   = 3
+	CTL_BREAK_REQ = 4
+	CTL_BREAK_ON  = 5
+	CTL_BREAK_OFF = 6
+	CTL_DTR_REQ   = 7
+	CTL_DTR_ON    = 8
+	CTL_DTR_OFF   = 9
+	CTL_RTS_REQ   = 10
+	CTL_RTS_ON    = 11
+	CTL_RTS_OFF   = 12
+)
+
+// Modem state bits, the low nibble flags changes.
+const (
+	MS_CD        = 0x80
+	MS_RI        = 0x40
+	MS_DSR       = 0x20
+	MS_CTS       = 0x10
+	MS_DELTA_CD  = 0x08
+	MS_TERI      = 0x04
+	MS_DELTA_DSR = 0x02
+	MS_DELTA_CTS = 0x01
+)
+
+// SIGNATURE is what the server answers a signature request with.
+const SIGNATURE = "termzero"
+
+// parity codes, by sers parity
+var rfcParity = []byte{sers.N: 1, sers.O: 2, sers.E: 3}
+
+func sersParity(p byte) (uint32, bool) {
+	for i, c := range rfcParity {
+		if c == p {
+			return uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+// modemState maps the sers *_LINE bits to the RFC 2217 ones.
+func modemState(lines uint32) byte {
+	var ms byte
+	for _, m := range []struct {
+		line uint32
+		ms   byte
+	}{
+		{sers.DCD_LINE, MS_CD},
+		{sers.RI_LINE, MS_RI},
+		{sers.DSR_LINE, MS_DSR},
+		{sers.CTS_LINE, MS_CTS},
+	} {
+		if lines&m.line != 0 {
+			ms |= m.ms
+		}
+	}
+	return ms
+}
+
+// comPort serves a COM-PORT-OPTION request of c. Only writers change
+// the port, everybody gets the current settings.
+func (s *Server) comPort(c *client, b []byte) {
+	if len(b) < 3 || b[0] != OPT_COM_PORT {
+		return
+	}
+	cmd, v := b[1], b[2:]
+	w := s.writer(c)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	line := s.c.Line
+	switch cmd {
+	case CPO_SIGNATURE:
+		c.tn.subneg(OPT_COM_PORT, append([]byte{CPO_SERVER + CPO_SIGNATURE}, SIGNATURE...)...)
+		return
+	case CPO_SET_BAUDRATE:
+		if len(v) != 4 {
+			return
+		}
+		if br := binary.BigEndian.Uint32(v); br != 0 && w {
+			line.Baudrate = br
+		}
+	case CPO_SET_DATASIZE:
+		if v[0] >= 5 && v[0] <= 8 && w {
+			line.Databits = uint32(v[0])
+		}
+	case CPO_SET_PARITY:
+		if p, ok := sersParity(v[0]); ok && w {
+			line.Parity = p
+		}
+	case CPO_SET_STOPSIZE:
+		// no 1.5
+		if (v[0] == 1 || v[0] == 2) && w {
+			line.Stopbits = uint32(v[0])
+		}
+	case CPO_SET_CONTROL:
+		s.control(c, v[0], w)
+		return
+	case CPO_SET_MODEMSTATE_MASK:
+		c.mask = v[0]
+		c.tn.subneg(OPT_COM_PORT, CPO_SERVER+cmd, v[0])
+		c.tn.subneg(OPT_COM_PORT, CPO_SERVER+CPO_NOTIFY_MODEMSTATE, s.modem&c.mask)
+		return
+	case CPO_SET_LINESTATE_MASK, CPO_PURGE_DATA:
+		// no line states, nothing to purge
+		c.tn.subneg(OPT_COM_PORT, CPO_SERVER+cmd, v[0])
+		return
+	default:
+		return
+	}
+	if line != s.c.Line && s.c.Port != nil {
+		if err := line.Apply(s.c.Port); err != nil {
+			s.c.logf("%s can't set %s: %v", c.name, &line, err)
+		} else {
+			s.c.logf("%s set %s", c.name, &line)
+			s.c.Line = line
+		}
+	}
+	var a []byte
+	switch cmd {
+	case CPO_SET_BAUDRATE:
+		a = make([]byte, 4)
+		binary.BigEndian.PutUint32(a, s.c.Line.Baudrate)
+	case CPO_SET_DATASIZE:
+		a = []byte{byte(s.c.Line.Databits)}
+	case CPO_SET_PARITY:
+		a = []byte{rfcParity[s.c.Line.Parity%3]}
+	case CPO_SET_STOPSIZE:
+		a = []byte{byte(s.c.Line.Stopbits)}
+	}
+	c.tn.subneg(OPT_COM_PORT, append([]byte{CPO_SERVER + cmd}, a...)...)
+}
+
+// control serves a SET-CONTROL request, it is called with s.mu held.
+func (s *Server) control(c *client, v byte, w bool) {
+	p := s.c.Port
+	w = w && p != nil
+	var a byte
+	switch v {
+	case CTL_FLOW_REQ, CTL_FLOW_NONE, CTL_FLOW_XON, CTL_FLOW_HW:
+		line := s.c.Line
+		if v == CTL_FLOW_NONE {
+			line.Handshake = sers.NO_HANDSHAKE
+		} else if v == CTL_FLOW_HW {
+			line.Handshake = sers.RTSCTS_HANDSHAKE
+		}
+		if line != s.c.Line && w {
+			if err := line.Apply(p); err == nil {
+				s.c.Line = line
+			}
+		}
+		a = CTL_FLOW_NONE
+		if s.c.Line.Handshake == sers.RTSCTS_HANDSHAKE {
+			a = CTL_FLOW_HW
+		}
+	case CTL_BREAK_REQ, CTL_BREAK_ON, CTL_BREAK_OFF:
+		// the port only sends whole BREAKs, it goes out as long as it
+		// was on when it ends
+		if v == CTL_BREAK_ON && w && s.brk.IsZero() {
+			s.brk = time.Now()
+		} else if v == CTL_BREAK_OFF && w && !s.brk.IsZero() {
+			go p.SendBreak(time.Since(s.brk))
+			s.brk = time.Time{}
+		}
+		a = CTL_BREAK_OFF
+		if !s.brk.IsZero() {
+			a = CTL_BREAK_ON
+		}
+	case CTL_DTR_REQ, CTL_DTR_ON, CTL_DTR_OFF:
+		if v != CTL_DTR_REQ && w {
+			if err := p.SetDTR(v == CTL_DTR_ON); err == nil {
+				s.dtr = v == CTL_DTR_ON
+			}
+		}
+		a = CTL_DTR_OFF
+		if s.dtr {
+			a = CTL_DTR_ON
+		}
+	case CTL_RTS_REQ, CTL_RTS_ON, CTL_RTS_OFF:
+		if v != CTL_RTS_REQ && w {
+			if err := p.SetRTS(v == CTL_RTS_ON); err == nil {
+				s.rts = v == CTL_RTS_ON
+			}
+		}
+		a = CTL_RTS_OFF
+		if s.rts {
+			a = CTL_RTS_ON
+		}
+	default:
+		// no inbound flow control
+		return
+	}
+	c.tn.subneg(OPT_COM_PORT, CPO_SERVER+CPO_SET_CONTROL, a)
+}
+
+// watchModem notifies the RFC 2217 clients of the modem state
+// changes, as long as the port reports them.
+func (s *Server) watchModem() {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-t.C:
+		}
+		lines, err := s.c.Port.ModemLines()
+		if err != nil {
+			return
+		}
+		ms := modemState(lines)
+		s.mu.Lock()
+		if ms != s.modem {
+			ms |= (ms ^ s.modem) >> 4
+			s.modem = ms &^ 0x0f
+			for _, c := range s.clients {
+				if ms&c.mask != 0 {
+					s.queue(c, subneg(OPT_COM_PORT, []byte{CPO_SERVER + CPO_NOTIFY_MODEMSTATE, ms & c.mask}))
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,113 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package netser
+
+import (
+	"testing"
+	"time"
+
+	"termzero/sers"
+)
+
+// open opens the RFC 2217 port at addr, closed at the end of the test.
+func open(t *testing.T, addr string) sers.SerialPort {
+	t.Helper()
+	p, err := sers.Open("rfc2217://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	p.SetReadParams(0, 0.05)
+	return p
+}
+
+func TestRFC2217(t *testing.T) {
+	s, addr, dev := serve(t, Config{Mode: RFC2217, Writers: FIRST})
+	p := open(t, addr)
+	if br, _ := p.Baudrate(); br != 9600 {
+		t.Errorf("baud rate %d, want 9600", br)
+	}
+
+	m := sers.Mode{Baudrate: 115200, Databits: 7, Parity: sers.E, Stopbits: 2,
+		Handshake: sers.RTSCTS_HANDSHAKE}
+	if err := m.Apply(p); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.Peer().Mode(); got != m {
+		t.Errorf("the port is at %s, want %s", &got, &m)
+	}
+	if br, _ := p.Baudrate(); br != 115200 {
+		t.Errorf("baud rate %d, want 115200", br)
+	}
+
+	// IAC is data both ways, on 8 bits
+	m.Databits, m.Parity, m.Stopbits = 8, sers.N, 1
+	if err := m.Apply(p); err != nil {
+		t.Fatal(err)
+	}
+	m.Apply(dev)
+	p.Write([]byte("x\xffy"))
+	if got := recv(dev); got != "x\xffy" {
+		t.Errorf("the port got %q", got)
+	}
+	dev.Write([]byte("\xff\xfa\x00"))
+	if got := recv(p); got != "\xff\xfa\x00" {
+		t.Errorf("the client read %q", got)
+	}
+
+	// the output lines go to the port, the input lines are notified
+	if err := p.SetDTR(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetRTS(false); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := dev.ModemLines(); l&(sers.DSR_LINE|sers.CTS_LINE) != 0 {
+		t.Errorf("the device sees DSR or CTS: %#x", l)
+	}
+	if l, _ := p.ModemLines(); l&(sers.DTR_LINE|sers.RTS_LINE) != 0 {
+		t.Errorf("DTR or RTS still on: %#x", l)
+	}
+	lines := func() uint32 {
+		l, _ := p.ModemLines()
+		return l & (sers.CTS_LINE | sers.DSR_LINE | sers.DCD_LINE)
+	}
+	wait(t, "modem state", func() bool { return lines() == sers.CTS_LINE|sers.DSR_LINE|sers.DCD_LINE })
+	dev.SetDTR(false)
+	dev.SetRTS(false)
+	wait(t, "modem state change", func() bool { return lines() == 0 })
+
+	if err := p.SendBreak(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, "BREAK", func() bool { return dev.Stats().Breaks == 1 })
+
+	// a reader can't change the port
+	r := open(t, addr)
+	wait(t, "reader", func() bool { return len(s.Clients()) == 2 })
+	err := r.SetMode(9600, 8, sers.N, 1, sers.NO_HANDSHAKE)
+	if pe, ok := err.(*sers.ParameterError); !ok || pe.Parameter != "baudrate" ||
+		pe.Reason != "not confirmed by the server" {
+		t.Errorf("reader SetMode: %v", err)
+	}
+	if err := r.SetDTR(true); err == nil {
+		t.Error("reader SetDTR went through")
+	}
+	if br, _ := r.Baudrate(); br != 115200 {
+		t.Errorf("the reader sees %d baud", br)
+	}
+	if got := dev.Peer().Mode(); got != m {
+		t.Errorf("the reader set %s", &got)
+	}
+}
+
+func TestNoComPort(t *testing.T) {
+	_, addr, _ := serve(t, Config{Mode: TELNET})
+	if _, err := sers.Open("rfc2217://" + addr); err != ErrNoComPort {
+		t.Errorf("got %v, want %v", err, ErrNoComPort)
+	}
+}
@@ -0,0 +1,186 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package netser
+
+// Telnet commands and options (RFC 854, 856, 857, 858).
+const (
+	SE   = 240
+	SB   = 250
+	WILL = 251
+	WONT = 252
+	DO   = 253
+	DONT = 254
+	IAC  = 255
+
+	OPT_BINARY   = 0
+	OPT_ECHO     = 1
+	OPT_SGA      = 3
+	OPT_COM_PORT = 44 // RFC 2217
+)
+
+// decoder states
+const (
+	tData = iota
+	tCR   // after a CR, a NUL following it is padding
+	tIAC
+	tVerb // WILL, WONT, DO or DONT, the option follows
+	tSB
+	tSBIAC
+)
+
+// telnet strips the Telnet commands from what a client sends and
+// answers the option negotiation.
+type telnet struct {
+	state int
+	verb  byte
+	sb    []byte
+	us    [256]bool // options enabled on our side
+	him   [256]bool // options enabled on the client's side
+
+	// the options agreed to on our side and on the peer's
+	ours, his [256]bool
+	sub       func(b []byte) // subnegotiation, without IAC SB and IAC SE
+	reply     []byte         // answers to send to the peer
+}
+
+// newTelnet returns a codec agreeing to the options ours on our side
+// and his on the peer's.
+func newTelnet(ours, his []byte) *telnet {
+	t := &telnet{}
+	for _, o := range ours {
+		t.ours[o] = true
+	}
+	for _, o := range his {
+		t.his[o] = true
+	}
+	return t
+}
+
+// start asks for the options ours on our side and his on the peer's.
+func (t *telnet) start(ours, his []byte) []byte {
+	var b []byte
+	for _, o := range ours {
+		t.us[o] = true
+		b = append(b, IAC, WILL, o)
+	}
+	for _, o := range his {
+		t.him[o] = true
+		b = append(b, IAC, DO, o)
+	}
+	return b
+}
+
+// subneg appends the subnegotiation of opt with data to the replies.
+func (t *telnet) subneg(opt byte, data ...byte) {
+	t.reply = append(t.reply, subneg(opt, data)...)
+}
+
+func subneg(opt byte, data []byte) []byte {
+	b := escapeIAC([]byte{IAC, SB, opt}, data)
+	return append(b, IAC, SE)
+}
+
+func (t *telnet) send(verb, opt byte) {
+	t.reply = append(t.reply, IAC, verb, opt)
+}
+
+// negotiate answers a request, only changes are acknowledged so the
+// answers don't loop.
+func (t *telnet) negotiate(verb, opt byte) {
+	switch verb {
+	case DO:
+		if !t.ours[opt] {
+			t.send(WONT, opt)
+		} else if !t.us[opt] {
+			t.us[opt] = true
+			t.send(WILL, opt)
+		}
+	case DONT:
+		if t.us[opt] {
+			t.us[opt] = false
+			t.send(WONT, opt)
+		}
+	case WILL:
+		if !t.his[opt] {
+			t.send(DONT, opt)
+		} else if !t.him[opt] {
+			t.him[opt] = true
+			t.send(DO, opt)
+		}
+	case WONT:
+		if t.him[opt] {
+			t.him[opt] = false
+			t.send(DONT, opt)
+		}
+	}
+}
+
+// decode appends the data in p to dst.
+func (t *telnet) decode(dst, p []byte) []byte {
+	for _, c := range p {
+		switch t.state {
+		case tData, tCR:
+			cr := t.state == tCR
+			t.state = tData
+			switch {
+			case c == IAC:
+				t.state = tIAC
+			case c == 0 && cr && !t.him[OPT_BINARY]:
+			default:
+				if c == '\r' {
+					t.state = tCR
+				}
+				dst = append(dst, c)
+			}
+		case tIAC:
+			t.state = tData
+			switch c {
+			case IAC:
+				dst = append(dst, IAC)
+			case WILL, WONT, DO, DONT:
+				t.verb, t.state = c, tVerb
+			case SB:
+				t.sb, t.state = t.sb[:0], tSB
+			}
+			// the rest (NOP, AYT, BRK, ...) is ignored
+		case tVerb:
+			t.state = tData
+			t.negotiate(t.verb, c)
+		case tSB:
+			if c == IAC {
+				t.state = tSBIAC
+			} else {
+				t.sb = append(t.sb, c)
+			}
+		case tSBIAC:
+			switch c {
+			case IAC:
+				t.sb, t.state = append(t.sb, IAC), tSB
+			case SE:
+				t.state = tData
+				if t.sub != nil {
+					t.sub(t.sb)
+				}
+			default:
+				// broken, drop it
+				t.state = tData
+			}
+		}
+	}
+	return dst
+}
+
+// escape doubles the IAC bytes in p.
+func escapeIAC(dst, p []byte) []byte {
+	for _, c := range p {
+		if c == IAC {
+			dst = append(dst, IAC)
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
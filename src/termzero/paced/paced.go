@@ -0,0 +1,121 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package paced sends text to targets without flow control: with a
+// delay after every character and line, optionally waiting for the
+// target to echo the line or to show its prompt.
+package paced
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"termzero/link"
+)
+
+var ErrAbort = errors.New("paced: aborted")
+
+type Options struct {
+	CharDelay time.Duration // after every character
+	LineDelay time.Duration // after every line
+	Echo      bool          // wait for the line to come back
+	Prompt    []byte        // wait for the prompt after every line
+	Timeout   time.Duration // for Echo and Prompt, 5s if 0
+
+	// Progress, if set, is called after every line.
+	Progress func(sent int64)
+	// Abort stops the sending once closed.
+	Abort <-chan struct{}
+}
+
+// Send sends r line by line to w. The link l delivers the received
+// data, it is only needed for Echo and Prompt.
+func Send(w io.Writer, l *link.Link, r io.Reader, o *Options) error {
+	timeout := o.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	if (o.Echo || len(o.Prompt) > 0) && l == nil {
+		return errors.New("paced: waiting needs a link")
+	}
+	br := bufio.NewReader(r)
+	var sent int64
+	for lineNo := 1; ; lineNo++ {
+		line, rerr := br.ReadBytes('\n')
+		if rerr != nil && rerr != io.EOF {
+			return rerr
+		}
+		if len(line) == 0 {
+			return nil
+		}
+		if l != nil {
+			l.Purge()
+		}
+		if err := writeLine(w, line, o); err != nil {
+			return err
+		}
+		sent += int64(len(line))
+		if o.Echo {
+			echo := bytes.TrimRight(line, "\r\n")
+			if len(echo) > 0 {
+				if err := l.WaitFor(echo, timeout); err != nil {
+					return fmt.Errorf("line %d: no echo: %v", lineNo, err)
+				}
+			}
+		}
+		if len(o.Prompt) > 0 {
+			if err := l.WaitFor(o.Prompt, timeout); err != nil {
+				return fmt.Errorf("line %d: no prompt: %v", lineNo, err)
+			}
+		}
+		if o.Progress != nil {
+			o.Progress(sent)
+		}
+		if err := sleep(o.LineDelay, o.Abort); err != nil {
+			return err
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+	}
+}
+
+func writeLine(w io.Writer, line []byte, o *Options) error {
+	if o.CharDelay == 0 {
+		_, err := w.Write(line)
+		return err
+	}
+	for i := range line {
+		if _, err := w.Write(line[i : i+1]); err != nil {
+			return err
+		}
+		if err := sleep(o.CharDelay, o.Abort); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sleep(d time.Duration, abort <-chan struct{}) error {
+	if d == 0 {
+		select {
+		case <-abort:
+			return ErrAbort
+		default:
+			return nil
+		}
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-abort:
+		return ErrAbort
+	}
+}
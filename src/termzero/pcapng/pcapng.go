@@ -0,0 +1,259 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package pcapng writes serial traffic to pcapng files for
+// Wireshark. Every direction gets an interface of its own ("rx" and
+// "tx") and every packet carries the direction in its flags. The
+// byte stream is split into packets on idle gaps.
+//
+// The default link type is LINKTYPE_USER0, assign a dissector to it
+// in Wireshark with Preferences / Protocols / DLT_USER.
+package pcapng
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"termzero/capture"
+)
+
+const (
+	LINKTYPE_USER0 = 147
+
+	blockSHB = 0x0a0d0d0a
+	blockIDB = 0x00000001
+	blockEPB = 0x00000006
+
+	optEnd      = 0
+	optComment  = 1
+	shbUserAppl = 4
+	ifName      = 2
+	ifDesc      = 3
+	ifTsresol   = 9
+	epbFlags    = 2
+
+	flagInbound  = 1
+	flagOutbound = 2
+
+	maxPacket = 65535
+)
+
+var le = binary.LittleEndian
+
+// Config describes a capture.
+type Config struct {
+	LinkType uint16        // LINKTYPE_USER0 if 0
+	Gap      time.Duration // split packets after that much silence
+	Comment  string        // e.g. the port and its mode
+}
+
+// Writer writes a pcapng file. It is a capture.Recorder, so it can
+// be put behind a capture.Tap, and Dir returns plain io.Writers for
+// the two directions.
+type Writer struct {
+	c   Config
+	mu  sync.Mutex
+	w   *bufio.Writer
+	err error
+	pk  [2]packet // rx, tx
+}
+
+// packet collects the bytes of one direction until a gap.
+type packet struct {
+	start time.Time
+	last  time.Time
+	data  []byte
+	timer *time.Timer
+}
+
+// NewWriter writes the section header and the two interface
+// descriptions to w.
+func NewWriter(w io.Writer, c Config) (*Writer, error) {
+	if c.LinkType == 0 {
+		c.LinkType = LINKTYPE_USER0
+	}
+	if c.Gap <= 0 {
+		c.Gap = 10 * time.Millisecond
+	}
+	pw := &Writer{c: c, w: bufio.NewWriter(w)}
+
+	var opt []byte
+	opt = appendOpt(opt, shbUserAppl, []byte("termzero"))
+	if c.Comment != "" {
+		opt = appendOpt(opt, optComment, []byte(c.Comment))
+	}
+	body := make([]byte, 16)
+	le.PutUint32(body[0:], 0x1a2b3c4d)
+	le.PutUint16(body[4:], 1)
+	le.PutUint16(body[6:], 0)
+	le.PutUint64(body[8:], 0xffffffffffffffff) // section length unknown
+	pw.block(blockSHB, append(body, endOpts(opt)...))
+
+	for _, name := range []string{"rx", "tx"} {
+		body = make([]byte, 8)
+		le.PutUint16(body[0:], c.LinkType)
+		le.PutUint32(body[4:], 0) // no snap length
+		opt = appendOpt(nil, ifName, []byte(name))
+		opt = appendOpt(opt, ifTsresol, []byte{9}) // nanoseconds
+		if c.Comment != "" {
+			opt = appendOpt(opt, ifDesc, []byte(c.Comment))
+		}
+		pw.block(blockIDB, append(body, endOpts(opt)...))
+	}
+	if err := pw.flush(); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func appendOpt(b []byte, code uint16, v []byte) []byte {
+	var h [4]byte
+	le.PutUint16(h[0:], code)
+	le.PutUint16(h[2:], uint16(len(v)))
+	b = append(b, h[:]...)
+	b = append(b, v...)
+	return append(b, make([]byte, pad(len(v)))...)
+}
+
+func endOpts(b []byte) []byte {
+	return append(b, 0, 0, 0, 0)
+}
+
+func pad(n int) int {
+	return (4 - n%4) % 4
+}
+
+// block writes a block, body must be 32 bit aligned.
+func (w *Writer) block(typ uint32, body []byte) {
+	if w.err != nil {
+		return
+	}
+	var h [8]byte
+	n := uint32(12 + len(body))
+	le.PutUint32(h[0:], typ)
+	le.PutUint32(h[4:], n)
+	w.w.Write(h[:])
+	w.w.Write(body)
+	_, w.err = w.w.Write(h[4:8])
+}
+
+func (w *Writer) flush() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+// packet writes the enhanced packet block for the collected data of
+// direction i.
+func (w *Writer) packet(i int) {
+	pk := &w.pk[i]
+	if len(pk.data) == 0 {
+		return
+	}
+	ts := uint64(pk.start.UnixNano())
+	body := make([]byte, 20, 20+len(pk.data)+16)
+	le.PutUint32(body[0:], uint32(i))
+	le.PutUint32(body[4:], uint32(ts>>32))
+	le.PutUint32(body[8:], uint32(ts))
+	le.PutUint32(body[12:], uint32(len(pk.data)))
+	le.PutUint32(body[16:], uint32(len(pk.data)))
+	body = append(body, pk.data...)
+	body = append(body, make([]byte, pad(len(pk.data)))...)
+	var flags [4]byte
+	le.PutUint32(flags[:], uint32(flagInbound+i)) // rx in, tx out
+	body = append(body, endOpts(appendOpt(nil, epbFlags, flags[:]))...)
+	w.block(blockEPB, body)
+	w.flush()
+	pk.data = pk.data[:0]
+}
+
+func index(dir capture.Dir) int {
+	if dir == capture.TX {
+		return 1
+	}
+	return 0
+}
+
+// Record adds p, seen at t, to the current packet of dir. The
+// packet is written once the line stayed idle for the gap.
+func (w *Writer) Record(dir capture.Dir, t time.Time, p []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	i := index(dir)
+	pk := &w.pk[i]
+	if len(pk.data) > 0 && t.Sub(pk.last) >= w.c.Gap {
+		w.packet(i)
+	}
+	for len(p) > 0 {
+		if len(pk.data) == 0 {
+			pk.start = t
+		}
+		n := maxPacket - len(pk.data)
+		if n > len(p) {
+			n = len(p)
+		}
+		pk.data = append(pk.data, p[:n]...)
+		p = p[n:]
+		if len(pk.data) == maxPacket {
+			w.packet(i)
+		}
+	}
+	pk.last = t
+	if pk.timer == nil {
+		pk.timer = time.AfterFunc(w.c.Gap, func() { w.idle(i) })
+	} else {
+		pk.timer.Reset(w.c.Gap)
+	}
+	return w.err
+}
+
+// idle writes the packet of direction i if the gap is over.
+func (w *Writer) idle(i int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pk := &w.pk[i]
+	if d := w.c.Gap - time.Since(pk.last); d > 0 {
+		pk.timer.Reset(d)
+		return
+	}
+	w.packet(i)
+}
+
+// Close writes the pending packets, it doesn't close the underlying
+// writer.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := range w.pk {
+		if w.pk[i].timer != nil {
+			w.pk[i].timer.Stop()
+		}
+		w.packet(i)
+	}
+	return w.flush()
+}
+
+// Dir returns an io.Writer recording everything written to it as
+// traffic in direction dir, e.g. for io.TeeReader(port, w.Dir(RX)).
+func (w *Writer) Dir(dir capture.Dir) io.Writer {
+	return dirWriter{w, dir}
+}
+
+type dirWriter struct {
+	w   *Writer
+	dir capture.Dir
+}
+
+func (d dirWriter) Write(p []byte) (int, error) {
+	if err := d.w.Record(d.dir, time.Now(), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
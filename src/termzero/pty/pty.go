@@ -0,0 +1,228 @@
+// +build linux
+
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package pty creates pseudo-terminals standing in for serial ports:
+// programs open the slave like a port, the master side sees the data
+// and, in packet mode, learns when the slave's settings change.
+package pty
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"termzero/sers"
+)
+
+// Linux ioctls and flags missing in syscall.
+const (
+	TCGETS2 = 0x802c542a
+	TCSETS2 = 0x402c542b
+	BOTHER  = 0010000
+	CBAUD   = 0010017
+	EXTPROC = 0200000
+	CRTSCTS = 020000000000
+
+	TIOCPKT_DATA  = 0x00
+	TIOCPKT_IOCTL = 0x40 // the slave's termios changed
+)
+
+// termios2 is struct termios2, with the speeds as numbers.
+type termios2 struct {
+	Iflag, Oflag, Cflag, Lflag uint32
+	Line                       uint8
+	Cc                         [19]uint8
+	Ispeed, Ospeed             uint32
+}
+
+// ioctl runs an ioctl on f, without Fd putting it in blocking mode.
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// PTY is a pseudo-terminal, the slave is kept open so the master
+// doesn't see a hangup while no program has it open.
+type PTY struct {
+	Master *os.File
+	Slave  *os.File
+	Name   string // of the slave
+	packet bool
+	buf    []byte // for ReadPacket
+}
+
+// Open opens a pty with the slave in raw mode.
+func Open() (*PTY, error) {
+	m, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	var n uint32
+	if err := ioctl(m, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		m.Close()
+		return nil, err
+	}
+	var unlock int32
+	if err := ioctl(m, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		m.Close()
+		return nil, err
+	}
+	name := fmt.Sprintf("/dev/pts/%d", n)
+	s, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	p := &PTY{Master: m, Slave: s, Name: name}
+	t, err := p.termios()
+	if err == nil {
+		// cfmakeraw
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK |
+			syscall.ISTRIP | syscall.INLCR | syscall.IGNCR |
+			syscall.ICRNL | syscall.IXON
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON |
+			syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB
+		t.Cflag |= syscall.CS8
+		t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+		err = p.setTermios(t)
+	}
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PTY) Close() error {
+	p.Slave.Close()
+	return p.Master.Close()
+}
+
+func (p *PTY) termios() (*termios2, error) {
+	t := &termios2{}
+	return t, ioctl(p.Slave, TCGETS2, unsafe.Pointer(t))
+}
+
+func (p *PTY) setTermios(t *termios2) error {
+	return ioctl(p.Slave, TCSETS2, unsafe.Pointer(t))
+}
+
+// SetPacket puts the master into packet mode, with EXTPROC on the
+// slave so its termios changes are reported. Then only ReadPacket
+// reads the master.
+func (p *PTY) SetPacket() error {
+	on := int32(1)
+	if err := ioctl(p.Master, syscall.TIOCPKT, unsafe.Pointer(&on)); err != nil {
+		return err
+	}
+	t, err := p.termios()
+	if err != nil {
+		return err
+	}
+	t.Lflag |= EXTPROC
+	if err := p.setTermios(t); err != nil {
+		return err
+	}
+	p.packet = true
+	return nil
+}
+
+// ReadPacket reads what the slave's program wrote, ioctl tells that
+// it changed the settings, with no data then.
+func (p *PTY) ReadPacket(b []byte) (n int, ioctl bool, err error) {
+	if !p.packet {
+		n, err = p.Master.Read(b)
+		return n, false, err
+	}
+	if len(p.buf) < len(b)+1 {
+		p.buf = make([]byte, len(b)+1)
+	}
+	buf := p.buf[:len(b)+1]
+	for {
+		k, err := p.Master.Read(buf)
+		if err != nil || k == 0 {
+			return 0, false, err
+		}
+		if buf[0] == TIOCPKT_DATA {
+			return copy(b, buf[1:k]), false, nil
+		}
+		if buf[0]&TIOCPKT_IOCTL != 0 {
+			return 0, true, nil
+		}
+		// flushes and flow control
+	}
+}
+
+// Mode returns the settings of the slave. Linux keeps ptys at 8 data
+// bits without parity, whatever the program sets, only the baud rate,
+// stop bits and handshake tell.
+func (p *PTY) Mode() (sers.Mode, error) {
+	t, err := p.termios()
+	if err != nil {
+		return sers.Mode{}, err
+	}
+	m := sers.Mode{
+		Baudrate: t.Ospeed,
+		Databits: 5 + (t.Cflag&syscall.CSIZE)/syscall.CS6,
+		Stopbits: 1,
+	}
+	if t.Cflag&syscall.CSTOPB != 0 {
+		m.Stopbits = 2
+	}
+	if t.Cflag&syscall.PARENB != 0 {
+		m.Parity = sers.E
+		if t.Cflag&syscall.PARODD != 0 {
+			m.Parity = sers.O
+		}
+	}
+	if t.Cflag&CRTSCTS != 0 {
+		m.Handshake = sers.RTSCTS_HANDSHAKE
+	}
+	return m, nil
+}
+
+// SetMode sets the settings of the slave, as a port would have them.
+func (p *PTY) SetMode(m sers.Mode) error {
+	t, err := p.termios()
+	if err != nil {
+		return err
+	}
+	t.Cflag &^= CBAUD | syscall.CSIZE | syscall.CSTOPB | syscall.PARENB |
+		syscall.PARODD | CRTSCTS
+	t.Cflag |= BOTHER | (m.Databits-5)*syscall.CS6
+	t.Ispeed, t.Ospeed = m.Baudrate, m.Baudrate
+	if m.Stopbits == 2 {
+		t.Cflag |= syscall.CSTOPB
+	}
+	switch m.Parity {
+	case sers.E:
+		t.Cflag |= syscall.PARENB
+	case sers.O:
+		t.Cflag |= syscall.PARENB | syscall.PARODD
+	}
+	if m.Handshake == sers.RTSCTS_HANDSHAKE {
+		t.Cflag |= CRTSCTS
+	}
+	return p.setTermios(t)
+}
@@ -0,0 +1,167 @@
+// +build linux
+
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"termzero/pty"
+	"termzero/sers"
+)
+
+// linkPty opens a pty at mode with the slave symlinked at link.
+func linkPty(link string, mode sers.Mode) (*pty.PTY, error) {
+	p, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.SetMode(mode); err != nil {
+		p.Close()
+		return nil, err
+	}
+	if fi, err := os.Lstat(link); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		// left by a killed termzero
+		os.Remove(link)
+	}
+	if err := os.Symlink(p.Name, link); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// dropWriter writes to a pty master nobody may be reading: what it
+// can't take is dropped rather than stall the writer.
+type dropWriter struct {
+	f        *os.File
+	dropping bool
+}
+
+func (w *dropWriter) Write(b []byte) (int, error) {
+	w.f.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := w.f.Write(b)
+	if os.IsTimeout(err) {
+		if !w.dropping {
+			ptyLogf("the pty isn't read, dropping")
+		}
+		w.dropping = true
+		return len(b), nil
+	}
+	w.dropping = false
+	return n, err
+}
+
+// ptyLogf prints a timestamped line.
+func ptyLogf(format string, a ...interface{}) {
+	fmt.Printf("%s %s\n", time.Now().Format("2006-01-02 15:04:05"),
+		fmt.Sprintf(format, a...))
+}
+
+// simPty opens a pty at mode for the simulator, symlinked at link. It
+// returns the master, dropping what isn't read, the slave's name and
+// a func closing the pty and removing the link.
+func simPty(link string, mode sers.Mode) (io.ReadWriter, string, func(), error) {
+	p, err := linkPty(link, mode)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return rw{p.Master, &dropWriter{f: p.Master}}, p.Name, func() {
+		p.Close()
+		os.Remove(link)
+	}, nil
+}
+
+// exposePty forwards between the port and a new pty, symlinked at
+// link, until a signal ends it. The baud rate, stop bits and
+// handshake the pty's program sets go to the port.
+func exposePty(link string, mode sers.Mode, port sers.SerialPort, rx io.Reader, tx io.Writer) error {
+	p, err := linkPty(link, mode)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	defer os.Remove(link)
+	if err := p.SetPacket(); err != nil {
+		return err
+	}
+	fmt.Printf("port on %s -> %s\n", link, p.Name)
+
+	errc := make(chan error, 2)
+	go func() {
+		// nobody may read the pty, what it can't take is dropped
+		// rather than stall the port and its log
+		w := &dropWriter{f: p.Master}
+		_, err := io.Copy(w, rx)
+		if err == nil {
+			err = io.EOF
+		}
+		errc <- err
+	}()
+	changed := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, ioctl, err := p.ReadPacket(buf)
+			if err != nil {
+				errc <- err
+				return
+			}
+			if ioctl {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+			if n > 0 {
+				if _, err := tx.Write(buf[:n]); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	// a program clearing EXTPROC goes unreported, polling catches it
+	tick := time.NewTicker(500 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case <-sig:
+			return nil
+		case <-changed:
+		case <-tick.C:
+		}
+		pm, err := p.Mode()
+		if err != nil {
+			continue
+		}
+		m := mode
+		m.Baudrate, m.Stopbits, m.Handshake = pm.Baudrate, pm.Stopbits, pm.Handshake
+		if m == mode {
+			continue
+		}
+		if err := m.Apply(port); err != nil {
+			ptyLogf("can't set %s: %v", &m, err)
+		} else {
+			ptyLogf("mode %s", &m)
+		}
+		// once, failed or not
+		mode = m
+	}
+}
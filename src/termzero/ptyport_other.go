@@ -0,0 +1,28 @@
+// +build !linux
+
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"errors"
+	"io"
+
+	"termzero/sers"
+)
+
+// The pty package is Linux only.
+var errNoPty = errors.New("only supported on Linux")
+
+func exposePty(link string, mode sers.Mode, port sers.SerialPort, rx io.Reader, tx io.Writer) error {
+	return errNoPty
+}
+
+func simPty(link string, mode sers.Mode) (io.ReadWriter, string, func(), error) {
+	return nil, "", nil, errNoPty
+}
@@ -0,0 +1,63 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"termzero/filter"
+	"termzero/script"
+	"termzero/sers"
+)
+
+// msgWriter prints what is written to it as termzero messages.
+type msgWriter struct {
+	s *session
+}
+
+func (w msgWriter) Write(p []byte) (int, error) {
+	w.s.print(string(p))
+	return len(p), nil
+}
+
+// runScript runs sc on the port, showing what the port sends, and
+// returns the exit status: 0 for success, that of fail or exit.
+func runScript(s *session, sc *script.Script, name string, port sers.SerialPort,
+	rx io.Reader, tx io.Writer) int {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	done := make(chan error, 1)
+	go func() {
+		done <- sc.Run(rw{rx, tx}, &script.Env{
+			Port:  port,
+			Mode:  s.mode,
+			Out:   filter.NewWriter(rxWriter{s}, s.imap),
+			Print: msgWriter{s},
+		})
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-sig:
+		s.printf("\n*** script %s interrupted\n", name)
+		return 1
+	}
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *script.Error:
+		s.printf("\n*** script %s\n", e)
+		return e.Code
+	default:
+		s.printf("\n*** script %s: %v\n", name, err)
+		return 1
+	}
+}
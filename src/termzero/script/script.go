@@ -0,0 +1,584 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package script runs expect-style scripts on a serial port, a step
+// per line:
+//
+//	timeout 5s                 # for the expects without one
+//	retry:
+//	pulse dtr 100ms            # the board's reset
+//	expect /U-Boot (\S+)/ into version timeout 10s else retry
+//	expect "login:" "=>" goto uboot
+//	send "root\r"
+//	sleep 500ms
+//	set baud 115200
+//	print "U-Boot {version}\n"
+//	exit 0
+//	uboot:
+//	fail "stuck in U-Boot {version}"
+//
+// Steps: send <template>, expect, sleep <duration>, timeout <duration>,
+// set baud <rate>, set mode <mode>, set dtr|rts on|off,
+// pulse dtr|rts <duration>, break [duration], let <var> <template>,
+// add <var> <number>, if <var>=<value> goto <label> (or !=),
+// goto <label>, print <template>, fail [template], exit [code] and
+// "<label>:". A "literal" has the C escapes, a /regex/ is Go's syntax.
+//
+// expect waits for any of its patterns in what came from the port
+// since the last match; each pattern may have a "goto <label>" and an
+// "into <var>..." taking its regex groups. Without a match within the
+// timeout the script goes to the "else" label, or fails. Templates
+// expand {var} and {match}, the text the last expect matched; {{ is a
+// brace.
+package script
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"termzero/input"
+	"termzero/sers"
+)
+
+// The default expect timeout.
+const TIMEOUT = 10 * time.Second
+
+// MAX_BUFFER bounds what expect keeps of the input while nothing
+// matches.
+const MAX_BUFFER = 64 * 1024
+
+// errExit ends a script by exit 0.
+var errExit = errors.New("script: exit")
+
+// Error ends a script that failed, by fail, exit with a code other
+// than 0 or an expect timing out without an else.
+type Error struct {
+	Pos  string // file:line
+	Msg  string
+	Code int // exit status
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+type pattern struct {
+	src  string // for the messages
+	lit  []byte
+	re   *regexp.Regexp
+	jump string   // label
+	into []string // variables for the groups
+}
+
+type step struct {
+	pos  string
+	op   string
+	args []input.Token
+	pats []pattern     // expect
+	d    time.Duration // expect timeout, 0 the default
+	n    int
+	jump string // goto, else, if
+}
+
+// Script is a parsed script.
+type Script struct {
+	steps  []*step
+	labels map[string]int
+}
+
+// Parse reads a script from r, name is for the errors.
+func Parse(r io.Reader, name string) (*Script, error) {
+	s := &Script{labels: map[string]int{}}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		pos := fmt.Sprintf("%s:%d", name, n)
+		ts, err := input.Tokenize(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", pos, err)
+		}
+		if len(ts) == 0 {
+			continue
+		}
+		if w := ts[0].S; len(ts) == 1 && !ts[0].Quoted && !ts[0].Regex &&
+			strings.HasSuffix(w, ":") && len(w) > 1 {
+			if _, ok := s.labels[w[:len(w)-1]]; ok {
+				return nil, fmt.Errorf("%s: label %s again", pos, w)
+			}
+			s.labels[w[:len(w)-1]] = len(s.steps)
+			continue
+		}
+		st, err := parseStep(ts, pos)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", pos, err)
+		}
+		s.steps = append(s.steps, st)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for _, st := range s.steps {
+		ls := []string{st.jump}
+		for _, p := range st.pats {
+			ls = append(ls, p.jump)
+		}
+		for _, l := range ls {
+			if _, ok := s.labels[l]; l != "" && !ok {
+				return nil, fmt.Errorf("%s: no label %s", st.pos, l)
+			}
+		}
+	}
+	return s, nil
+}
+
+func word(t input.Token) bool {
+	return !t.Quoted && !t.Regex
+}
+
+func parseStep(ts []input.Token, pos string) (*step, error) {
+	st := &step{pos: pos, op: ts[0].S, args: ts[1:]}
+	if !word(ts[0]) {
+		return nil, fmt.Errorf("want a step, not %q", ts[0].S)
+	}
+	a := st.args
+	nargs := func(min, max int) error {
+		if len(a) < min || len(a) > max {
+			return fmt.Errorf("wrong number of arguments for %s", st.op)
+		}
+		return nil
+	}
+	var err error
+	switch st.op {
+	case "send", "print":
+		if err = nargs(1, 1); err == nil && !a[0].Quoted {
+			err = fmt.Errorf("want %s \"template\"", st.op)
+		}
+	case "fail":
+		if err = nargs(0, 1); err == nil && len(a) == 1 && !a[0].Quoted {
+			err = fmt.Errorf("want fail \"template\"")
+		}
+	case "exit":
+		if err = nargs(0, 1); err == nil && len(a) == 1 {
+			st.n, err = strconv.Atoi(a[0].S)
+			if err == nil && (st.n < 0 || st.n > 255) {
+				err = fmt.Errorf("exit status %d out of 0..255", st.n)
+			}
+		}
+	case "sleep", "timeout":
+		if err = nargs(1, 1); err == nil {
+			st.d, err = time.ParseDuration(a[0].S)
+		}
+	case "break":
+		st.d = 250 * time.Millisecond
+		if err = nargs(0, 1); err == nil && len(a) == 1 {
+			st.d, err = time.ParseDuration(a[0].S)
+		}
+	case "set":
+		if err = nargs(2, 2); err != nil {
+			break
+		}
+		switch a[0].S {
+		case "baud":
+			var b uint64
+			b, err = strconv.ParseUint(a[1].S, 10, 32)
+			if err == nil && b == 0 {
+				err = fmt.Errorf("baud rate 0")
+			}
+		case "mode":
+			var m sers.Mode
+			err = m.Set(a[1].S)
+		case "dtr", "rts":
+			if a[1].S != "on" && a[1].S != "off" {
+				err = fmt.Errorf("want set %s on or off", a[0].S)
+			}
+		default:
+			err = fmt.Errorf("can't set %s, let sets variables", a[0].S)
+		}
+	case "pulse":
+		if err = nargs(2, 2); err != nil {
+			break
+		}
+		if a[0].S != "dtr" && a[0].S != "rts" {
+			err = fmt.Errorf("want pulse dtr or rts")
+			break
+		}
+		st.d, err = time.ParseDuration(a[1].S)
+	case "let":
+		if err = nargs(2, 2); err == nil && (!word(a[0]) || a[1].Regex) {
+			err = fmt.Errorf("want let <var> <template>")
+		}
+	case "add":
+		if err = nargs(2, 2); err == nil {
+			st.n, err = strconv.Atoi(a[1].S)
+		}
+	case "goto":
+		if err = nargs(1, 1); err == nil {
+			st.jump = a[0].S
+		}
+	case "if":
+		if err = nargs(3, 3); err != nil {
+			break
+		}
+		if !strings.Contains(a[0].S, "=") || a[1].S != "goto" {
+			err = fmt.Errorf("want if <var>=<value> goto <label>")
+		}
+		st.jump = a[2].S
+	case "expect":
+		err = parseExpect(st)
+	default:
+		err = fmt.Errorf("unknown step %q", st.op)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// keywords end the variables of an into.
+var keywords = map[string]bool{"goto": true, "into": true, "timeout": true, "else": true}
+
+func parseExpect(st *step) error {
+	a := st.args
+	for i := 0; i < len(a); i++ {
+		t := a[i]
+		switch {
+		case t.Quoted:
+			if t.S == "" {
+				return fmt.Errorf("empty literal")
+			}
+			st.pats = append(st.pats, pattern{src: strconv.Quote(t.S), lit: []byte(t.S)})
+			continue
+		case t.Regex:
+			re, err := regexp.Compile(t.S)
+			if err != nil {
+				return err
+			}
+			st.pats = append(st.pats, pattern{src: "/" + t.S + "/", re: re})
+			continue
+		}
+		if i+1 == len(a) {
+			return fmt.Errorf("%s needs an argument", t.S)
+		}
+		var p *pattern
+		if len(st.pats) > 0 {
+			p = &st.pats[len(st.pats)-1]
+		}
+		switch t.S {
+		case "goto", "into":
+			if p == nil {
+				return fmt.Errorf("%s before a pattern", t.S)
+			}
+			if t.S == "goto" {
+				i++
+				p.jump = a[i].S
+				break
+			}
+			if p.re == nil {
+				return fmt.Errorf("into after a literal")
+			}
+			for i+1 < len(a) && word(a[i+1]) && !keywords[a[i+1].S] {
+				i++
+				p.into = append(p.into, a[i].S)
+			}
+			if len(p.into) == 0 || len(p.into) > p.re.NumSubexp() {
+				return fmt.Errorf("into wants 1 to %d variables", p.re.NumSubexp())
+			}
+		case "timeout":
+			i++
+			d, err := time.ParseDuration(a[i].S)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("bad timeout %q", a[i].S)
+			}
+			st.d = d
+		case "else":
+			i++
+			st.jump = a[i].S
+		default:
+			return fmt.Errorf("unknown %q", t.S)
+		}
+	}
+	if len(st.pats) == 0 {
+		return fmt.Errorf("expect what?")
+	}
+	return nil
+}
+
+// Env is where a script runs.
+type Env struct {
+	// Port takes the settings and control lines, it may be the port
+	// read and written.
+	Port sers.SerialPort
+	// Mode is the port's mode, changed by set baud and set mode.
+	Mode sers.Mode
+	// Out, if set, gets what comes from the port.
+	Out io.Writer
+	// Print gets what print prints.
+	Print io.Writer
+	// Logf, if set, logs the steps.
+	Logf func(format string, a ...interface{})
+	// Vars are the variables; Run sets them.
+	Vars map[string]string
+}
+
+// run is a running script.
+type run struct {
+	*Script
+	e   *Env
+	rw  io.ReadWriter
+	mu  sync.Mutex
+	in  []byte // since the last match
+	err error  // of the read
+	got chan struct{}
+
+	timeout time.Duration // set by timeout
+}
+
+// Run runs the script on rw, the port or the port logged. It returns
+// nil for the script's success, an *Error for its failure. The read
+// of rw goes on after, until rw is closed.
+func (s *Script) Run(rw io.ReadWriter, e *Env) error {
+	if e.Vars == nil {
+		e.Vars = map[string]string{}
+	}
+	r := &run{Script: s, e: e, rw: rw, got: make(chan struct{}, 1)}
+	go r.read()
+	for pc := 0; pc < len(s.steps); {
+		st := s.steps[pc]
+		pc++
+		if e.Logf != nil && st.op != "print" {
+			e.Logf("%s: %s", st.pos, st.op)
+		}
+		jump, err := r.step(st)
+		if err == errExit {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if jump != "" {
+			pc = s.labels[jump]
+		}
+	}
+	return nil
+}
+
+func (r *run) read() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.rw.Read(buf)
+		if n > 0 && r.e.Out != nil {
+			r.e.Out.Write(buf[:n])
+		}
+		r.mu.Lock()
+		r.in = append(r.in, buf[:n]...)
+		if len(r.in) > MAX_BUFFER {
+			r.in = r.in[:copy(r.in, r.in[len(r.in)/2:])]
+		}
+		r.err = err
+		r.mu.Unlock()
+		select {
+		case r.got <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// expand fills the template t in.
+func (r *run) expand(t string) string {
+	var b []byte
+	for i := 0; i < len(t); i++ {
+		if t[i] != '{' {
+			b = append(b, t[i])
+			continue
+		}
+		if i+1 < len(t) && t[i+1] == '{' {
+			b = append(b, '{')
+			i++
+			continue
+		}
+		k := strings.IndexByte(t[i:], '}')
+		if k < 0 {
+			b = append(b, t[i:]...)
+			break
+		}
+		b = append(b, r.e.Vars[t[i+1:i+k]]...)
+		i += k
+	}
+	return string(b)
+}
+
+func (r *run) fail(st *step, code int, format string, a ...interface{}) error {
+	return &Error{Pos: st.pos, Msg: fmt.Sprintf(format, a...), Code: code}
+}
+
+// step runs st and returns the label to go to.
+func (r *run) step(st *step) (string, error) {
+	a := st.args
+	e := r.e
+	switch st.op {
+	case "send":
+		if _, err := io.WriteString(r.rw, r.expand(a[0].S)); err != nil {
+			return "", err
+		}
+	case "print":
+		if e.Print != nil {
+			io.WriteString(e.Print, r.expand(a[0].S))
+		}
+	case "fail":
+		msg := "failed"
+		if len(a) == 1 {
+			msg = r.expand(a[0].S)
+		}
+		return "", r.fail(st, 1, "%s", msg)
+	case "exit":
+		if st.n != 0 {
+			return "", r.fail(st, st.n, "exit %d", st.n)
+		}
+		return "", errExit
+	case "sleep":
+		time.Sleep(st.d)
+	case "timeout":
+		r.timeout = st.d
+	case "break":
+		if e.Port == nil {
+			return "", r.fail(st, 1, "no port for break")
+		}
+		if err := e.Port.SendBreak(st.d); err != nil {
+			return "", err
+		}
+	case "set":
+		if e.Port == nil {
+			return "", r.fail(st, 1, "no port to set %s", a[0].S)
+		}
+		var err error
+		switch a[0].S {
+		case "baud", "mode":
+			m := e.Mode
+			if err = m.Set(a[1].S); err == nil {
+				if err = m.Apply(e.Port); err == nil {
+					e.Mode = m
+				}
+			}
+		case "dtr":
+			err = e.Port.SetDTR(a[1].S == "on")
+		case "rts":
+			err = e.Port.SetRTS(a[1].S == "on")
+		}
+		if err != nil {
+			return "", r.fail(st, 1, "set %s %s: %v", a[0].S, a[1].S, err)
+		}
+	case "pulse":
+		if e.Port == nil {
+			return "", r.fail(st, 1, "no port to pulse %s", a[0].S)
+		}
+		l, err := e.Port.ModemLines()
+		if err != nil {
+			return "", r.fail(st, 1, "pulse %s: %v", a[0].S, err)
+		}
+		set, bit := e.Port.SetDTR, uint32(sers.DTR_LINE)
+		if a[0].S == "rts" {
+			set, bit = e.Port.SetRTS, sers.RTS_LINE
+		}
+		on := l&bit != 0
+		if err := set(!on); err != nil {
+			return "", r.fail(st, 1, "pulse %s: %v", a[0].S, err)
+		}
+		time.Sleep(st.d)
+		if err := set(on); err != nil {
+			return "", r.fail(st, 1, "pulse %s: %v", a[0].S, err)
+		}
+	case "let":
+		e.Vars[a[0].S] = r.expand(a[1].S)
+	case "add":
+		n, _ := strconv.Atoi(e.Vars[a[0].S])
+		e.Vars[a[0].S] = strconv.Itoa(n + st.n)
+	case "goto":
+		return st.jump, nil
+	case "if":
+		k := strings.IndexByte(a[0].S, '=')
+		name, value, not := a[0].S[:k], r.expand(a[0].S[k+1:]), false
+		if strings.HasSuffix(name, "!") {
+			name, not = name[:len(name)-1], true
+		}
+		if (e.Vars[name] == value) != not {
+			return st.jump, nil
+		}
+	case "expect":
+		return r.expect(st)
+	}
+	return "", nil
+}
+
+// expect waits for the patterns of st.
+func (r *run) expect(st *step) (string, error) {
+	d := st.d
+	if d == 0 {
+		d = r.timeout
+	}
+	if d == 0 {
+		d = TIMEOUT
+	}
+	deadline := time.NewTimer(d)
+	defer deadline.Stop()
+	for {
+		r.mu.Lock()
+		var best *pattern
+		var m []int
+		for i := range st.pats {
+			p := &st.pats[i]
+			var pm []int
+			if p.lit != nil {
+				if k := bytes.Index(r.in, p.lit); k >= 0 {
+					pm = []int{k, k + len(p.lit)}
+				}
+			} else {
+				pm = p.re.FindSubmatchIndex(r.in)
+			}
+			if pm != nil && (m == nil || pm[1] < m[1]) {
+				best, m = p, pm
+			}
+		}
+		if best != nil {
+			r.e.Vars["match"] = string(r.in[m[0]:m[1]])
+			for k, v := range best.into {
+				r.e.Vars[v] = ""
+				if g := 2 * (k + 1); m[g] >= 0 {
+					r.e.Vars[v] = string(r.in[m[g]:m[g+1]])
+				}
+			}
+			r.in = r.in[:copy(r.in, r.in[m[1]:])]
+			r.mu.Unlock()
+			return best.jump, nil
+		}
+		err := r.err
+		r.mu.Unlock()
+		if err != nil {
+			return "", err
+		}
+		select {
+		case <-r.got:
+		case <-deadline.C:
+			if st.jump != "" {
+				return st.jump, nil
+			}
+			var ps []string
+			for _, p := range st.pats {
+				ps = append(ps, p.src)
+			}
+			return "", r.fail(st, 1, "timeout waiting for %s", strings.Join(ps, " or "))
+		}
+	}
+}
@@ -0,0 +1,188 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package script
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"termzero/sers"
+	"termzero/sers/serstest"
+)
+
+// start runs the script on one end of a pair, the other plays the
+// device. It returns the device, what the script printed and its
+// result.
+func start(t *testing.T, script string) (dev *serstest.Port, print *bytes.Buffer, done chan error) {
+	t.Helper()
+	s, err := Parse(strings.NewReader(script), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := serstest.Pair(serstest.Options{})
+	b.SetReadParams(0, 0.05)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	print = &bytes.Buffer{}
+	done = make(chan error, 1)
+	go func() { done <- s.Run(a, &Env{Port: a, Mode: a.Mode(), Print: print}) }()
+	return b, print, done
+}
+
+// result waits for the script to end.
+func result(t *testing.T, done chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("the script runs on")
+	}
+	return nil
+}
+
+// failed checks that err is a failure at line with msg and code.
+func failed(t *testing.T, err error, line, msg string, code int) {
+	t.Helper()
+	if e, ok := err.(*Error); !ok || e.Pos != "test:"+line || e.Msg != msg || e.Code != code {
+		t.Errorf("got %v, want test:%s: %s, code %d", err, line, msg, code)
+	}
+}
+
+const boot = `timeout 200ms
+send "hello\r"
+expect "login:" goto login /U-Boot (\S+) \((\w+)/ into version month
+print "uboot {version} {month} [{match}]\n"
+goto next
+login:
+print "login\n"
+next:
+expect "never" timeout 100ms else late
+fail "no else"
+late:
+expect "x"
+`
+
+func TestExpect(t *testing.T) {
+	for _, c := range []struct{ in, out string }{
+		// the match ending first wins, not the first pattern
+		{"U-Boot 2015.01 (Jan 01 2015)\r\nlogin:", "uboot 2015.01 Jan [U-Boot 2015.01 (Jan]\n"},
+		{"login: U-Boot 2015.01 (Jan", "login\n"},
+	} {
+		dev, print, done := start(t, boot)
+		dev.Write([]byte(c.in))
+		failed(t, result(t, done), "12", `timeout waiting for "x"`, 1)
+		if got := print.String(); got != c.out {
+			t.Errorf("%q: printed %q, want %q", c.in, got, c.out)
+		}
+		b := make([]byte, 16)
+		if n, _ := dev.Read(b); string(b[:n]) != "hello\r" {
+			t.Errorf("the device got %q", b[:n])
+		}
+	}
+}
+
+func TestIf(t *testing.T) {
+	_, print, done := start(t, `
+let a x
+if a=x goto yes
+fail
+yes:
+if a!=x goto no
+if a!={b}y goto done
+no:
+fail "no"
+done:
+add n 2
+add n -5
+print "{a} {n} {{\n"
+exit 3
+print "after"
+`)
+	failed(t, result(t, done), "14", "exit 3", 3)
+	if got := print.String(); got != "x -3 {\n" {
+		t.Errorf("printed %q", got)
+	}
+}
+
+func TestEnd(t *testing.T) {
+	for _, c := range []struct {
+		script string
+		line   string // of the failure, none for success
+		msg    string
+	}{
+		{"let v 1\nfail \"bad {v}\"", "2", "bad 1"},
+		{"fail", "1", "failed"},
+		{"exit\nfail", "", ""},
+		{"exit 0\nfail", "", ""},
+		{"print \"x\"", "", ""},
+	} {
+		_, _, done := start(t, c.script)
+		err := result(t, done)
+		if c.line == "" {
+			if err != nil {
+				t.Errorf("%q: %v", c.script, err)
+			}
+			continue
+		}
+		failed(t, err, c.line, c.msg, 1)
+	}
+}
+
+func TestLines(t *testing.T) {
+	dev, _, done := start(t, "set baud 115200\npulse rts 300ms\nsleep 300ms\nset dtr off\n")
+	lines := func() uint32 {
+		l, _ := dev.ModemLines()
+		return l & (sers.CTS_LINE | sers.DSR_LINE)
+	}
+	for _, want := range []uint32{sers.DSR_LINE, sers.CTS_LINE | sers.DSR_LINE, sers.CTS_LINE} {
+		for end := time.Now().Add(2 * time.Second); lines() != want; {
+			if time.Now().After(end) {
+				t.Fatalf("the device sees %#x, want %#x", lines(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err := result(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if br := dev.Peer().Mode().Baudrate; br != 115200 {
+		t.Errorf("baud rate %d", br)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, c := range []struct{ script, err string }{
+		{"goto nowhere", "test:1: no label nowhere"},
+		{"expect \"a\" goto b\nb:\nexpect \"x\" else c", "test:3: no label c"},
+		{"a:\na:", "test:2: label a: again"},
+		{"frob", `test:1: unknown step "frob"`},
+		{`expect "x" into v`, "test:1: into after a literal"},
+		{`expect /(a)/ into x y`, "test:1: into wants 1 to 1 variables"},
+		{`expect into v /(a)/`, "test:1: into before a pattern"},
+		{`expect ""`, "test:1: empty literal"},
+		{`expect "x" timeout 0s`, `test:1: bad timeout "0s"`},
+		{"expect timeout 1s", "test:1: expect what?"},
+		{"set speed 1", "test:1: can't set speed, let sets variables"},
+		{"set dtr maybe", "test:1: want set dtr on or off"},
+		{"pulse cts 1s", "test:1: want pulse dtr or rts"},
+		{"if a goto b", "test:1: want if <var>=<value> goto <label>"},
+		{"send x", `test:1: want send "template"`},
+		{"exit 1 2", "test:1: wrong number of arguments for exit"},
+		{"exit 256", "test:1: exit status 256 out of 0..255"},
+		{"exit -1", "test:1: exit status -1 out of 0..255"},
+	} {
+		_, err := Parse(strings.NewReader(c.script), "test")
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%q: got %v, want %s", c.script, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Mode bundles the SetMode parameters. It implements flag.Value,
+// the textual form is "baudrate,8N1[,rtscts]". Set accepts any
+// subset of the comma separated fields and leaves the others alone,
+// so "115200", "7E1" and "rtscts" are all valid.
+type Mode struct {
+	Baudrate  uint32
+	Databits  uint32
+	Parity    uint32
+	Stopbits  uint32
+	Handshake uint32
+}
+
+var parityNames = "NEO"
+
+func (m *Mode) String() string {
+	if m == nil {
+		return ""
+	}
+	s := fmt.Sprintf("%d,%d%c%d", m.Baudrate, m.Databits,
+		parityNames[m.Parity%3], m.Stopbits)
+	if m.Handshake == RTSCTS_HANDSHAKE {
+		s += ",rtscts"
+	}
+	return s
+}
+
+func (m *Mode) Set(s string) error {
+	n := *m
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		switch strings.ToLower(f) {
+		case "":
+			continue
+		case "rtscts":
+			n.Handshake = RTSCTS_HANDSHAKE
+			continue
+		case "none", "nohs":
+			n.Handshake = NO_HANDSHAKE
+			continue
+		}
+		if br, err := strconv.ParseUint(f, 10, 32); err == nil {
+			if br == 0 {
+				return &ParameterError{"baudrate", "has to be > 0"}
+			}
+			n.Baudrate = uint32(br)
+			continue
+		}
+		if len(f) != 3 || f[0] < '5' || f[0] > '8' ||
+			(f[2] != '1' && f[2] != '2') {
+			return &ParameterError{"mode", fmt.Sprintf("can't parse %q", f)}
+		}
+		p := strings.IndexByte(parityNames, f[1]&^0x20)
+		if p < 0 {
+			return &ParameterError{"parity", "has to be N, E or O"}
+		}
+		n.Databits = uint32(f[0] - '0')
+		n.Parity = uint32(p)
+		n.Stopbits = uint32(f[2] - '0')
+	}
+	*m = n
+	return nil
+}
+
+// Apply configures p with the mode m.
+func (m *Mode) Apply(p SerialPort) error {
+	return p.SetMode(m.Baudrate, m.Databits, m.Parity, m.Stopbits, m.Handshake)
+}
@@ -13,6 +13,9 @@ package sers
 import (
 	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -26,6 +29,16 @@ const (
 	RTSCTS_HANDSHAKE = 1
 )
 
+// Modem control line bits as returned by ModemLines.
+const (
+	DTR_LINE = 1 << iota
+	RTS_LINE
+	CTS_LINE
+	DSR_LINE
+	RI_LINE
+	DCD_LINE
+)
+
 // Serialport represents a serial port and offers configuration of baud
 // rate, frame format, handshaking and read paramters.
 type SerialPort interface {
@@ -48,6 +61,47 @@ type SerialPort interface {
 
 	// Give current input/output baudrate.
 	Baudrate() (uint32, uint32)
+
+	// SetDTR and SetRTS set the state of the DTR and RTS modem
+	// control lines.
+	SetDTR(on bool) error
+	SetRTS(on bool) error
+
+	// ModemLines returns the state of the modem control lines as a
+	// mask of *_LINE bits.
+	ModemLines() (uint32, error)
+
+	// SendBreak holds the transmit line in the BREAK condition for
+	// the duration d.
+	SendBreak(d time.Duration) error
+}
+
+var (
+	schemesMu sync.Mutex
+	schemes   = map[string]func(addr string) (SerialPort, error){}
+)
+
+// Register makes Open open the names "scheme://addr" with open, for
+// ports that aren't devices, e.g. "rfc2217://host:port".
+func Register(scheme string, open func(addr string) (SerialPort, error)) {
+	schemesMu.Lock()
+	schemes[scheme] = open
+	schemesMu.Unlock()
+}
+
+// Open opens the serial port device fn, or the port of a registered
+// scheme.
+func Open(fn string) (SerialPort, error) {
+	if i := strings.Index(fn, "://"); i > 0 {
+		schemesMu.Lock()
+		open := schemes[fn[:i]]
+		schemesMu.Unlock()
+		if open == nil {
+			return nil, &ParameterError{"fn", fmt.Sprintf("unknown scheme %q", fn[:i])}
+		}
+		return open(fn[i+3:])
+	}
+	return openDevice(fn)
 }
 
 type StringError string
@@ -62,7 +116,7 @@ type ParameterError struct {
 }
 
 func (pe *ParameterError) Error() string {
-	return fmt.Sprintf("error in parameter '%s': %s")
+	return fmt.Sprintf("error in parameter '%s': %s", pe.Parameter, pe.Reason)
 }
 
 type Error struct {
@@ -21,6 +21,7 @@ import "C"
 import (
 	"os"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -237,7 +238,67 @@ func (bp *baseport) Baudrate() (uint32, uint32) {
 	return uint32(tio.c_ispeed), uint32(tio.c_ospeed)
 }
 
-func Open(fn string) (SerialPort, error) {
+// ioctl takes arg as a pointer, converted to a uintptr in the call
+// expression so the pointee stays alive during the syscall.
+func (bp *baseport) ioctl(req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, bp.f.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (bp *baseport) setModemBits(bits int, on bool) error {
+	var req uintptr = syscall.TIOCMBIC
+	if on {
+		req = syscall.TIOCMBIS
+	}
+	return bp.ioctl(req, unsafe.Pointer(&bits))
+}
+
+func (bp *baseport) SetDTR(on bool) error {
+	return bp.setModemBits(syscall.TIOCM_DTR, on)
+}
+
+func (bp *baseport) SetRTS(on bool) error {
+	return bp.setModemBits(syscall.TIOCM_RTS, on)
+}
+
+var modemLines = []struct {
+	tiocm int
+	line  uint32
+}{
+	{syscall.TIOCM_DTR, DTR_LINE},
+	{syscall.TIOCM_RTS, RTS_LINE},
+	{syscall.TIOCM_CTS, CTS_LINE},
+	{syscall.TIOCM_DSR, DSR_LINE},
+	{syscall.TIOCM_RI, RI_LINE},
+	{syscall.TIOCM_CD, DCD_LINE},
+}
+
+func (bp *baseport) ModemLines() (uint32, error) {
+	var bits int
+	if err := bp.ioctl(syscall.TIOCMGET, unsafe.Pointer(&bits)); err != nil {
+		return 0, err
+	}
+	var lines uint32
+	for _, m := range modemLines {
+		if bits&m.tiocm != 0 {
+			lines |= m.line
+		}
+	}
+	return lines, nil
+}
+
+func (bp *baseport) SendBreak(d time.Duration) error {
+	if err := bp.ioctl(syscall.TIOCSBRK, nil); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return bp.ioctl(syscall.TIOCCBRK, nil)
+}
+
+func openDevice(fn string) (SerialPort, error) {
 	// the order of system calls is taken from Apple's SerialPortSample
 	// open the TTY device read/write, nonblocking, i.e. not waiting
 	// for the CARRIER signal and without the TTY controlling the process
@@ -15,6 +15,7 @@ import (
 	"os"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -25,6 +26,8 @@ type serialPort struct {
 	wl sync.Mutex
 	ro *syscall.Overlapped
 	wo *syscall.Overlapped
+	// windows can't report the state of outgoing lines
+	dtr, rts bool
 }
 
 type structDCB struct {
@@ -45,7 +48,7 @@ type structTimeouts struct {
 }
 
 //func openPort(name string) (rwc io.ReadWriteCloser, err error) { // TODO
-func Open(name string) (rwc SerialPort, err error) {
+func openDevice(name string) (rwc SerialPort, err error) {
 	if len(name) > 0 && name[0] != '\\' {
 		name = "\\\\.\\" + name
 	}
@@ -155,7 +158,11 @@ var (
 	nSetupComm,
 	nGetOverlappedResult,
 	nCreateEvent,
-	nResetEvent uintptr
+	nResetEvent,
+	nEscapeCommFunction,
+	nGetCommModemStatus,
+	nSetCommBreak,
+	nClearCommBreak uintptr
 )
 
 func init() {
@@ -172,6 +179,10 @@ func init() {
 	nGetOverlappedResult = getProcAddr(k32, "GetOverlappedResult")
 	nCreateEvent = getProcAddr(k32, "CreateEventW")
 	nResetEvent = getProcAddr(k32, "ResetEvent")
+	nEscapeCommFunction = getProcAddr(k32, "EscapeCommFunction")
+	nGetCommModemStatus = getProcAddr(k32, "GetCommModemStatus")
+	nSetCommBreak = getProcAddr(k32, "SetCommBreak")
+	nClearCommBreak = getProcAddr(k32, "ClearCommBreak")
 }
 
 func getProcAddr(lib syscall.Handle, name string) uintptr {
@@ -325,6 +336,86 @@ func (sp *serialPort) SetReadParams(minread int, timeout float64) error {
 	//return StringError("SetReadParams not implemented yet on Windows")
 }
 
+func commCall(fn uintptr, h syscall.Handle, arg uintptr) error {
+	r, _, err := syscall.Syscall(fn, 2, uintptr(h), arg, 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func (sp *serialPort) SetDTR(on bool) error {
+	const SETDTR, CLRDTR = 5, 6
+	f := uintptr(CLRDTR)
+	if on {
+		f = SETDTR
+	}
+	if err := commCall(nEscapeCommFunction, sp.fd, f); err != nil {
+		return err
+	}
+	sp.dtr = on
+	return nil
+}
+
+func (sp *serialPort) SetRTS(on bool) error {
+	const SETRTS, CLRRTS = 3, 4
+	f := uintptr(CLRRTS)
+	if on {
+		f = SETRTS
+	}
+	if err := commCall(nEscapeCommFunction, sp.fd, f); err != nil {
+		return err
+	}
+	sp.rts = on
+	return nil
+}
+
+func (sp *serialPort) ModemLines() (uint32, error) {
+	const (
+		MS_CTS_ON  = 0x10
+		MS_DSR_ON  = 0x20
+		MS_RING_ON = 0x40
+		MS_RLSD_ON = 0x80
+	)
+	var st uint32
+	if err := commCall(nGetCommModemStatus, sp.fd, uintptr(unsafe.Pointer(&st))); err != nil {
+		return 0, err
+	}
+	var lines uint32
+	if sp.dtr {
+		lines |= DTR_LINE
+	}
+	if sp.rts {
+		lines |= RTS_LINE
+	}
+	if st&MS_CTS_ON != 0 {
+		lines |= CTS_LINE
+	}
+	if st&MS_DSR_ON != 0 {
+		lines |= DSR_LINE
+	}
+	if st&MS_RING_ON != 0 {
+		lines |= RI_LINE
+	}
+	if st&MS_RLSD_ON != 0 {
+		lines |= DCD_LINE
+	}
+	return lines, nil
+}
+
+func (sp *serialPort) SendBreak(d time.Duration) error {
+	r, _, err := syscall.Syscall(nSetCommBreak, 1, uintptr(sp.fd), 0, 0)
+	if r == 0 {
+		return err
+	}
+	time.Sleep(d)
+	r, _, err = syscall.Syscall(nClearCommBreak, 1, uintptr(sp.fd), 0, 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
 type winSersTimeout struct{}
 
 func (wst winSersTimeout) Error() string {
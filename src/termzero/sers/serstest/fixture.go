@@ -0,0 +1,55 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package serstest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+)
+
+// Bytes returns n repeatable bytes, all the values in them.
+func Bytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// Buffer is a file to receive into, it notes that it was closed.
+type Buffer struct {
+	bytes.Buffer
+	Closed bool
+}
+
+func (b *Buffer) Close() error {
+	b.Closed = true
+	return nil
+}
+
+// Exchange connects a pair with o and runs send on one port and
+// receive on the other, like the two ends of a file transfer. It
+// returns the ports, closed, and the error of either end.
+func Exchange(o Options, send, receive func(p *Port) error) (a, b *Port, err error) {
+	a, b = Pair(o)
+	errc := make(chan error, 1)
+	go func() { errc <- send(a) }()
+	rerr := receive(b)
+	if rerr != nil {
+		// don't wait for the sender to give up
+		b.Close()
+	}
+	serr := <-errc
+	a.Close()
+	b.Close()
+	switch {
+	case rerr != nil:
+		return a, b, fmt.Errorf("receive: %v", rerr)
+	case serr != nil:
+		return a, b, fmt.Errorf("send: %v", serr)
+	}
+	return a, b, nil
+}
@@ -0,0 +1,52 @@
+// +build linux
+
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package serstest
+
+import (
+	"os"
+
+	"termzero/pty"
+	"termzero/sers"
+)
+
+// Pty is a real sers port, opened on the slave of a pty, so the termios
+// code runs. The test talks to it through Peer.
+type Pty struct {
+	sers.SerialPort
+	Peer *os.File // the master
+	Name string   // of the slave
+	p    *pty.PTY
+}
+
+// OpenPty opens a pty and the sers port on its slave.
+func OpenPty() (*Pty, error) {
+	p, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	port, err := sers.Open(p.Name)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return &Pty{SerialPort: port, Peer: p.Master, Name: p.Name, p: p}, nil
+}
+
+// Mode returns the settings the port left on the slave. Linux keeps
+// ptys at 8 data bits without parity, the baud rate, stop bits and
+// handshake tell.
+func (t *Pty) Mode() (sers.Mode, error) {
+	return t.p.Mode()
+}
+
+func (t *Pty) Close() error {
+	err := t.SerialPort.Close()
+	t.p.Close()
+	return err
+}
@@ -0,0 +1,54 @@
+// +build linux
+
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package serstest
+
+import (
+	"testing"
+
+	"termzero/sers"
+)
+
+func TestOpenPty(t *testing.T) {
+	p, err := OpenPty()
+	if err != nil {
+		t.Skip("no pty:", err)
+	}
+	defer p.Close()
+	if err := p.SetMode(115200, 8, sers.N, 2, sers.RTSCTS_HANDSHAKE); err != nil {
+		t.Fatal(err)
+	}
+	if i, o := p.Baudrate(); i != 115200 || o != 115200 {
+		t.Errorf("Baudrate %d %d, want 115200", i, o)
+	}
+	m, err := p.Mode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sers.Mode{Baudrate: 115200, Databits: 8, Parity: sers.N, Stopbits: 2,
+		Handshake: sers.RTSCTS_HANDSHAKE}
+	if m != want {
+		t.Errorf("termios has %s, want %s", &m, &want)
+	}
+	// a rate without a Bnnn constant
+	if err := p.SetMode(250000, 8, sers.N, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ = p.Mode(); m.Baudrate != 250000 {
+		t.Errorf("termios has %d baud, want 250000", m.Baudrate)
+	}
+
+	p.Write([]byte("ping"))
+	if got := readN(t, p.Peer, 4); string(got) != "ping" {
+		t.Errorf("master got %q", got)
+	}
+	p.Peer.Write([]byte("pong"))
+	if got := readN(t, p, 4); string(got) != "pong" {
+		t.Errorf("port got %q", got)
+	}
+}
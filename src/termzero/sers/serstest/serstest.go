@@ -0,0 +1,409 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package serstest provides virtual serial ports for testing code that
+// uses sers.SerialPort without hardware: Pair connects two ports in
+// memory like a null modem cable, OpenPty puts the real termios code
+// on a pseudo-terminal.
+package serstest
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"termzero/sers"
+)
+
+var ErrClosed = errors.New("serstest: port closed")
+
+// Options are the line between the ports of a pair.
+type Options struct {
+	// Throttle paces the data to the sender's baud rate, a character
+	// takes its start, data, parity and stop bits.
+	Throttle bool
+	// Latency delays every character on its way.
+	Latency time.Duration
+	// Loss is the probability of a character getting lost.
+	Loss float64
+	// Errors is the probability of a bit flipping in a character, it
+	// arrives with a parity error if the receiver checks the parity,
+	// with a framing error otherwise.
+	Errors float64
+	// Seed seeds the loss and errors, for repeatable tests.
+	Seed int64
+}
+
+// Stats counts what a port sent and received.
+type Stats struct {
+	Sent     int // characters written
+	Received int // characters arrived, errors included
+	Lost     int // characters lost on the way here
+	Framing  int // characters arrived with a framing error
+	Parity   int // characters arrived with a parity error
+	Breaks   int // BREAKs received, each arrives as a NUL
+}
+
+type item struct {
+	c  byte
+	at time.Time // of the arrival
+}
+
+// Port is one end of a pair. Unlike a real port, it reads io.EOF once
+// the other end is closed and everything it sent is read.
+type Port struct {
+	o    *Options
+	mu   *sync.Mutex // of the pair
+	cond *sync.Cond
+	rnd  *rand.Rand
+	peer *Port
+
+	mode     sers.Mode
+	dtr, rts bool
+	minread  int
+	timeout  time.Duration
+	in       []item    // to read
+	txDone   time.Time // when the last character sent is out
+	closed   bool
+	stats    Stats
+}
+
+// Pair returns two connected ports at 9600,8N1 with DTR and RTS on,
+// their reads waiting for a character as a raw port's.
+// DTR goes to the other's DSR and DCD, RTS to its CTS.
+func Pair(o Options) (a, b *Port) {
+	mu := &sync.Mutex{}
+	cond := sync.NewCond(mu)
+	rnd := rand.New(rand.NewSource(o.Seed))
+	mode := sers.Mode{Baudrate: 9600, Databits: 8, Parity: sers.N, Stopbits: 1}
+	a = &Port{o: &o, mu: mu, cond: cond, rnd: rnd, mode: mode, dtr: true, rts: true, minread: 1}
+	b = &Port{o: &o, mu: mu, cond: cond, rnd: rnd, mode: mode, dtr: true, rts: true, minread: 1}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+// Peer returns the other end.
+func (p *Port) Peer() *Port {
+	return p.peer
+}
+
+// Mode returns the settings of the port.
+func (p *Port) Mode() sers.Mode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mode
+}
+
+// Stats returns the counters of the port.
+func (p *Port) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Buffered returns the number of characters on their way to the port
+// or waiting to be read.
+func (p *Port) Buffered() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.in)
+}
+
+// charTime is how long a character takes on the line at m.
+func charTime(m sers.Mode) time.Duration {
+	bits := 1 + m.Databits + m.Stopbits
+	if m.Parity != sers.N {
+		bits++
+	}
+	return time.Duration(bits) * time.Second / time.Duration(m.Baudrate)
+}
+
+func parityOf(c byte) byte {
+	c ^= c >> 4
+	c ^= c >> 2
+	c ^= c >> 1
+	return c & 1
+}
+
+// send puts c on the line to the peer, with the mu held.
+func (p *Port) send(c byte, brk time.Duration) {
+	now := time.Now()
+	at := now
+	if p.o.Throttle {
+		if p.txDone.After(now) {
+			at = p.txDone
+		}
+		if brk > 0 {
+			at = at.Add(brk)
+		} else {
+			at = at.Add(charTime(p.mode))
+		}
+		p.txDone = at
+	}
+	at = at.Add(p.o.Latency)
+	p.stats.Sent++
+
+	r := p.peer
+	if r.closed {
+		return
+	}
+	if brk > 0 {
+		r.stats.Breaks++
+		r.stats.Received++
+		r.in = append(r.in, item{0, at})
+		return
+	}
+	if p.o.Loss > 0 && p.rnd.Float64() < p.o.Loss {
+		r.stats.Lost++
+		return
+	}
+	tx, rx := p.mode, r.mode
+	mask := byte(0xff >> (8 - rx.Databits))
+	switch {
+	case tx.Baudrate != rx.Baudrate || tx.Databits != rx.Databits ||
+		tx.Stopbits < rx.Stopbits:
+		// garbage
+		r.stats.Framing++
+		c ^= byte(1 + p.rnd.Intn(255))
+	case p.o.Errors > 0 && p.rnd.Float64() < p.o.Errors:
+		c ^= 1 << uint(p.rnd.Intn(int(rx.Databits)))
+		if rx.Parity != sers.N {
+			r.stats.Parity++
+		} else {
+			r.stats.Framing++
+		}
+	case rx.Parity != sers.N:
+		// the bit after the data is the sender's parity or stop bit
+		bit := byte(1)
+		switch tx.Parity {
+		case sers.E:
+			bit = parityOf(c & mask)
+		case sers.O:
+			bit = 1 ^ parityOf(c&mask)
+		}
+		want := parityOf(c & mask)
+		if rx.Parity == sers.O {
+			want ^= 1
+		}
+		if bit != want {
+			r.stats.Parity++
+		}
+	}
+	r.stats.Received++
+	r.in = append(r.in, item{c & mask, at})
+}
+
+// wake wakes the waiting at t.
+func (p *Port) wake(t time.Time) *time.Timer {
+	return time.AfterFunc(t.Sub(time.Now()), func() {
+		p.mu.Lock()
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	})
+}
+
+// Read reads what arrived, as SetReadParams asks: with neither a
+// minimum nor a timeout it doesn't wait, with a timeout it returns
+// 0, nil when nothing came.
+func (p *Port) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(b) == 0 {
+		return 0, nil
+	}
+	want := 1
+	if p.minread > 1 {
+		want = p.minread
+		if want > len(b) {
+			want = len(b)
+		}
+	}
+	var deadline time.Time
+	if p.timeout > 0 {
+		deadline = time.Now().Add(p.timeout)
+	}
+	for {
+		if p.closed {
+			return 0, ErrClosed
+		}
+		now := time.Now()
+		n := 0
+		for n < len(p.in) && !p.in[n].at.After(now) {
+			n++
+		}
+		if n >= want || p.minread == 0 && p.timeout == 0 ||
+			!deadline.IsZero() && !now.Before(deadline) {
+			break
+		}
+		if n == len(p.in) && p.peer.closed {
+			if n > 0 {
+				break
+			}
+			return 0, io.EOF
+		}
+		next := deadline
+		if n < len(p.in) && (next.IsZero() || p.in[n].at.Before(next)) {
+			next = p.in[n].at
+		}
+		var t *time.Timer
+		if !next.IsZero() {
+			t = p.wake(next)
+		}
+		p.cond.Wait()
+		if t != nil {
+			t.Stop()
+		}
+	}
+	now := time.Now()
+	n := 0
+	for n < len(b) && n < len(p.in) && !p.in[n].at.After(now) {
+		b[n] = p.in[n].c
+		n++
+	}
+	p.in = p.in[n:]
+	return n, nil
+}
+
+// Write sends b. With RTS/CTS handshake it waits while the peer holds
+// RTS off. What is sent to a closed peer gets lost.
+func (p *Port) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range b {
+		for p.mode.Handshake == sers.RTSCTS_HANDSHAKE && !p.peer.rts &&
+			!p.closed && !p.peer.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			return i, ErrClosed
+		}
+		p.send(c, 0)
+	}
+	p.cond.Broadcast()
+	return len(b), nil
+}
+
+func (p *Port) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.closed = true
+	p.cond.Broadcast()
+	return nil
+}
+
+func (p *Port) SetMode(baudrate, databits, parity, stopbits, handshake uint32) error {
+	switch {
+	case baudrate == 0:
+		return &sers.ParameterError{Parameter: "baudrate", Reason: "has to be > 0"}
+	case databits < 5 || databits > 8:
+		return &sers.ParameterError{Parameter: "databits", Reason: "has to be 5, 6, 7 or 8"}
+	case parity > sers.O:
+		return &sers.ParameterError{Parameter: "parity", Reason: "has to be N, E or O"}
+	case stopbits != 1 && stopbits != 2:
+		return &sers.ParameterError{Parameter: "stopbits", Reason: "has to be 1 or 2"}
+	case handshake > sers.RTSCTS_HANDSHAKE:
+		return &sers.ParameterError{Parameter: "handshake", Reason: "has to be NO_HANDSHAKE or RTSCTS_HANDSHAKE"}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.mode = sers.Mode{Baudrate: baudrate, Databits: databits, Parity: parity,
+		Stopbits: stopbits, Handshake: handshake}
+	p.cond.Broadcast()
+	return nil
+}
+
+func (p *Port) SetReadParams(minread int, timeout float64) error {
+	if minread < 0 {
+		return &sers.ParameterError{Parameter: "minread", Reason: "needs to be 0 or higher"}
+	}
+	if timeout < 0 {
+		return &sers.ParameterError{Parameter: "timeout", Reason: "needs to be 0 or higher"}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.minread = minread
+	p.timeout = time.Duration(timeout * float64(time.Second))
+	return nil
+}
+
+func (p *Port) Baudrate() (uint32, uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mode.Baudrate, p.mode.Baudrate
+}
+
+func (p *Port) SetDTR(on bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.dtr = on
+	return nil
+}
+
+func (p *Port) SetRTS(on bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.rts = on
+	p.cond.Broadcast()
+	return nil
+}
+
+// ModemLines returns DTR and RTS and, from the peer, CTS, DSR and DCD.
+// A closed peer drops its lines.
+func (p *Port) ModemLines() (uint32, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, ErrClosed
+	}
+	var l uint32
+	if p.dtr {
+		l |= sers.DTR_LINE
+	}
+	if p.rts {
+		l |= sers.RTS_LINE
+	}
+	if !p.peer.closed {
+		if p.peer.rts {
+			l |= sers.CTS_LINE
+		}
+		if p.peer.dtr {
+			l |= sers.DSR_LINE | sers.DCD_LINE
+		}
+	}
+	return l, nil
+}
+
+// SendBreak holds the line in BREAK for d, the peer reads a NUL and
+// counts a break.
+func (p *Port) SendBreak(d time.Duration) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	if d <= 0 {
+		d = 250 * time.Millisecond
+	}
+	p.send(0, d)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	time.Sleep(d)
+	return nil
+}
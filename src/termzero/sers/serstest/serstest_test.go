@@ -0,0 +1,247 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package serstest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"termzero/sers"
+)
+
+// readN reads n bytes from p or fails.
+func readN(t *testing.T, p io.Reader, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := io.ReadFull(p, b); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return b
+}
+
+func TestNullModem(t *testing.T) {
+	a, b := Pair(Options{})
+	l, err := b.ModemLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := uint32(sers.DTR_LINE | sers.RTS_LINE | sers.CTS_LINE | sers.DSR_LINE | sers.DCD_LINE)
+	if l != all {
+		t.Errorf("lines %06b, want %06b", l, all)
+	}
+	a.SetDTR(false)
+	if l, _ = b.ModemLines(); l&(sers.DSR_LINE|sers.DCD_LINE) != 0 || l&sers.CTS_LINE == 0 {
+		t.Errorf("DTR off: lines %06b, want CTS without DSR and DCD", l)
+	}
+	a.SetDTR(true)
+	a.SetRTS(false)
+	if l, _ = b.ModemLines(); l&sers.CTS_LINE != 0 || l&sers.DSR_LINE == 0 {
+		t.Errorf("RTS off: lines %06b, want DSR without CTS", l)
+	}
+	a.Close()
+	if l, _ = b.ModemLines(); l != sers.DTR_LINE|sers.RTS_LINE {
+		t.Errorf("peer closed: lines %06b, want only its own", l)
+	}
+}
+
+func TestRTSCTS(t *testing.T) {
+	a, b := Pair(Options{})
+	if err := a.SetMode(9600, 8, sers.N, 1, sers.RTSCTS_HANDSHAKE); err != nil {
+		t.Fatal(err)
+	}
+	b.SetRTS(false)
+	done := make(chan time.Time, 1)
+	go func() {
+		a.Write([]byte("held"))
+		done <- time.Now()
+	}()
+	select {
+	case <-done:
+		t.Fatal("Write went through with CTS off")
+	case <-time.After(100 * time.Millisecond):
+	}
+	b.SetRTS(true)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Write still held with CTS on")
+	}
+	if got := readN(t, b, 4); string(got) != "held" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	a, b := Pair(Options{Throttle: true, Latency: 20 * time.Millisecond})
+	// 8N1 is 10 bits, 96 characters at 9600 take 100ms
+	start := time.Now()
+	a.Write(make([]byte, 96))
+	readN(t, b, 96)
+	if d := time.Since(start); d < 115*time.Millisecond || d > 300*time.Millisecond {
+		t.Errorf("96 characters at 9600 with 20ms latency took %v", d)
+	}
+	// 8E2 is 12 bits
+	a.SetMode(2400, 8, sers.E, 2, 0)
+	b.SetMode(2400, 8, sers.E, 2, 0)
+	start = time.Now()
+	a.Write(make([]byte, 20))
+	readN(t, b, 20)
+	if d := time.Since(start); d < 115*time.Millisecond || d > 300*time.Millisecond {
+		t.Errorf("20 characters at 2400,8E2 with 20ms latency took %v", d)
+	}
+}
+
+func TestLossAndErrors(t *testing.T) {
+	counts := func() Stats {
+		a, b := Pair(Options{Loss: 0.1, Errors: 0.1, Seed: 1})
+		a.Write(bytes.Repeat([]byte{'U'}, 1000))
+		a.Close()
+		n := 0
+		buf := make([]byte, 256)
+		for {
+			k, err := b.Read(buf)
+			n += k
+			if err == io.EOF {
+				break
+			}
+		}
+		st := b.Stats()
+		if n != st.Received || st.Received+st.Lost != 1000 {
+			t.Errorf("read %d, stats %+v", n, st)
+		}
+		return st
+	}
+	st := counts()
+	if st.Lost < 50 || st.Lost > 150 || st.Framing < 50 || st.Framing > 150 || st.Parity != 0 {
+		t.Errorf("10%% loss and errors without parity: %+v", st)
+	}
+	if again := counts(); again != st {
+		t.Errorf("the same seed gave %+v, then %+v", st, again)
+	}
+
+	// with parity the flipped bits are parity errors
+	a, b := Pair(Options{Errors: 0.5, Seed: 2})
+	a.SetMode(9600, 8, sers.E, 1, 0)
+	b.SetMode(9600, 8, sers.E, 1, 0)
+	a.Write(bytes.Repeat([]byte{'U'}, 100))
+	got := readN(t, b, 100)
+	st = b.Stats()
+	if st.Framing != 0 || st.Parity < 30 || st.Parity > 70 {
+		t.Errorf("50%% errors with even parity: %+v", st)
+	}
+	if bad := 100 - bytes.Count(got, []byte{'U'}); bad != st.Parity {
+		t.Errorf("%d characters changed, %d parity errors", bad, st.Parity)
+	}
+}
+
+func TestParityMismatch(t *testing.T) {
+	a, b := Pair(Options{})
+	a.SetMode(9600, 8, sers.E, 1, 0)
+	b.SetMode(9600, 8, sers.O, 1, 0)
+	a.Write([]byte("xyz"))
+	if got := readN(t, b, 3); string(got) != "xyz" {
+		t.Errorf("got %q", got)
+	}
+	if st := b.Stats(); st.Parity != 3 {
+		t.Errorf("even to odd: %+v, want 3 parity errors", st)
+	}
+}
+
+func TestBaudMismatch(t *testing.T) {
+	a, b := Pair(Options{Seed: 3})
+	b.SetMode(19200, 8, sers.N, 1, 0)
+	a.Write([]byte("hello"))
+	got := readN(t, b, 5)
+	if st := b.Stats(); st.Framing != 5 {
+		t.Errorf("9600 to 19200: %+v, want 5 framing errors", st)
+	}
+	for i, c := range got {
+		if c == "hello"[i] {
+			t.Errorf("%q came through at the wrong baud rate", c)
+		}
+	}
+
+	// 7 data bits keep the low ones
+	a.SetMode(9600, 7, sers.N, 1, 0)
+	b.SetMode(9600, 7, sers.N, 1, 0)
+	a.Write([]byte{0xc1})
+	if got := readN(t, b, 1); got[0] != 0x41 {
+		t.Errorf("7N1 got %#x, want 0x41", got[0])
+	}
+}
+
+func TestBreak(t *testing.T) {
+	a, b := Pair(Options{})
+	start := time.Now()
+	if err := a.SendBreak(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("SendBreak returned after %v", d)
+	}
+	if got := readN(t, b, 1); got[0] != 0 {
+		t.Errorf("BREAK read as %#x, want a NUL", got[0])
+	}
+	if st := b.Stats(); st.Breaks != 1 {
+		t.Errorf("stats %+v, want a break", st)
+	}
+}
+
+func TestReadParams(t *testing.T) {
+	a, b := Pair(Options{})
+	b.SetReadParams(0, 0.05)
+	start := time.Now()
+	if n, err := b.Read(make([]byte, 8)); n != 0 || err != nil {
+		t.Errorf("timed out read: %d, %v", n, err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("read timed out after %v", d)
+	}
+	b.SetReadParams(0, 0)
+	if n, err := b.Read(make([]byte, 8)); n != 0 || err != nil {
+		t.Errorf("non-blocking read: %d, %v", n, err)
+	}
+	a.Close()
+	b.SetReadParams(1, 0)
+	if _, err := b.Read(make([]byte, 8)); err != io.EOF {
+		t.Errorf("read after the peer closed: %v, want EOF", err)
+	}
+	if err := b.SetMode(0, 8, sers.N, 1, 0); err == nil {
+		t.Error("SetMode took baud rate 0")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	d := Bytes(300)
+	_, b, err := Exchange(Options{}, func(p *Port) error {
+		_, err := p.Write(d)
+		return err
+	}, func(p *Port) error {
+		if got := readN(t, p, len(d)); !bytes.Equal(got, d) {
+			return errors.New("the data came different")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := b.Stats(); st.Received != len(d) {
+		t.Errorf("stats %+v", st)
+	}
+
+	// a failed receiver doesn't wait for the sender
+	_, _, err = Exchange(Options{}, func(p *Port) error {
+		_, err := p.Read(make([]byte, 1))
+		return err
+	}, func(p *Port) error { return errors.New("no") })
+	if err == nil || err.Error() != "receive: no" {
+		t.Errorf("got %v", err)
+	}
+}
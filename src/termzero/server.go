@@ -0,0 +1,52 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"termzero/netser"
+)
+
+// rw joins the two sides of the port, each possibly logged.
+type rw struct {
+	io.Reader
+	io.Writer
+}
+
+// serve serves the port on addr instead of the terminal, until the
+// port fails or a signal ends it.
+func serve(addr string, c netser.Config, rx io.Reader, tx io.Writer) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	c.Logf = func(format string, a ...interface{}) {
+		fmt.Printf("%s %s\n", time.Now().Format("2006-01-02 15:04:05"),
+			fmt.Sprintf(format, a...))
+	}
+	srv := netser.New(rw{rx, tx}, c)
+	fmt.Printf("serving on %s, %s, writers %s\n", ln.Addr(), c.Mode, c.Writers)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		srv.Close()
+	}()
+	err = srv.Serve(ln)
+	if err == netser.ErrClosed {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,513 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package sim plays a serial device by a rule file, for working on the
+// host side without the board:
+//
+//	# variables and their start values
+//	set mode idle
+//	set count 0
+//
+//	# a rule matches what comes in and runs its clauses in order
+//	on "PING" reply "PONG\r\n"
+//	on line /^SET (\w+)$/ set mode {1} reply "OK\r\n"
+//	on line "GET" if mode!=idle add count 1 delay 50ms reply "{mode} {count}\r\n"
+//	on line /.*/ reply "ERROR\r\n"
+//
+//	# unsolicited messages
+//	every 1s if mode=run reply "T {time} {uptime}\r\n"
+//
+// "on" patterns match in the byte stream, "on line" patterns whole
+// lines, ended by CR or LF, the empty ones skipped; a stream match
+// ends the line too. A "literal" has the C escapes, a /regex/ is Go's
+// syntax. The first rule that matches, its conditions holding, fires;
+// in the stream the earliest match goes first. The clauses are
+// "if var=value", "if var!=value", "delay <duration>",
+// "reply <template>", "set <var> <template>" and "add <var> <number>".
+// Templates expand {var}, the regex groups {0} to {9}, {time} and
+// {uptime} in seconds; {{ is a brace. The variables change as the rule
+// fires, the replies go out in order after their delays.
+package sim
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"termzero/input"
+)
+
+// MAX_BUFFER bounds what is kept of the stream and of a line while no
+// rule matches.
+const MAX_BUFFER = 4096
+
+type action struct {
+	op   string // reply, delay, set or add
+	name string
+	tmpl []byte
+	d    time.Duration
+	n    int
+}
+
+type cond struct {
+	name, value string
+	not         bool
+}
+
+type rule struct {
+	pos     string // file:line
+	line    bool
+	lit     []byte
+	re      *regexp.Regexp
+	every   time.Duration
+	conds   []cond
+	actions []action
+}
+
+// step is a reply going out after its delay.
+type step struct {
+	d time.Duration
+	b []byte
+}
+
+// Sim is a device played by rules.
+type Sim struct {
+	// Logf, if set, logs the fired rules.
+	Logf func(format string, a ...interface{})
+
+	rules  []*rule // on
+	timers []*rule // every
+
+	mu    sync.Mutex
+	vars  map[string]string
+	start time.Time
+}
+
+// Parse reads the rules from r, name is for the errors.
+func Parse(r io.Reader, name string) (*Sim, error) {
+	s := &Sim{vars: map[string]string{}}
+	used := map[string]string{} // variable, where
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		pos := fmt.Sprintf("%s:%d", name, n)
+		ts, err := input.Tokenize(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", pos, err)
+		}
+		if len(ts) == 0 {
+			continue
+		}
+		switch ts[0].S {
+		case "set":
+			if len(ts) != 3 || ts[1].Quoted || ts[1].Regex || ts[2].Regex {
+				return nil, fmt.Errorf("%s: want set <name> <value>", pos)
+			}
+			s.vars[ts[1].S] = ts[2].S
+		case "on", "every":
+			r, err := parseRule(ts, pos, used)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", pos, err)
+			}
+			if r.every > 0 {
+				s.timers = append(s.timers, r)
+			} else {
+				s.rules = append(s.rules, r)
+			}
+		default:
+			return nil, fmt.Errorf("%s: want set, on or every, not %q", pos, ts[0].S)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for v, pos := range used {
+		if _, ok := s.vars[v]; !ok {
+			return nil, fmt.Errorf("%s: %s has no start value, set it", pos, v)
+		}
+	}
+	if len(s.rules) == 0 && len(s.timers) == 0 {
+		return nil, fmt.Errorf("%s: no rules", name)
+	}
+	return s, nil
+}
+
+func parseRule(ts []input.Token, pos string, used map[string]string) (*rule, error) {
+	r := &rule{pos: pos}
+	i := 1
+	if ts[0].S == "every" {
+		if len(ts) < 2 {
+			return nil, fmt.Errorf("want every <duration>")
+		}
+		d, err := time.ParseDuration(ts[1].S)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("bad interval %q", ts[1].S)
+		}
+		r.every = d
+		i = 2
+	} else {
+		if i < len(ts) && ts[i].S == "line" && !ts[i].Quoted {
+			r.line = true
+			i++
+		}
+		if i == len(ts) {
+			return nil, fmt.Errorf("want a \"literal\" or /regex/")
+		}
+		switch {
+		case ts[i].Quoted:
+			if ts[i].S == "" {
+				return nil, fmt.Errorf("empty literal")
+			}
+			r.lit = []byte(ts[i].S)
+		case ts[i].Regex:
+			re, err := regexp.Compile(ts[i].S)
+			if err != nil {
+				return nil, err
+			}
+			// in the stream it would match before every byte
+			if !r.line && re.MatchString("") {
+				return nil, fmt.Errorf("/%s/ matches the empty string, use on line", ts[i].S)
+			}
+			r.re = re
+		default:
+			return nil, fmt.Errorf("want a \"literal\" or /regex/, not %q", ts[i].S)
+		}
+		i++
+	}
+	// the templates' variables
+	use := func(t []byte) {
+		for _, v := range names(t) {
+			if _, err := strconv.Atoi(v); err != nil && v != "time" && v != "uptime" {
+				used[v] = pos
+			}
+		}
+	}
+	for i < len(ts) {
+		kw := ts[i]
+		if kw.Quoted || kw.Regex || i+1 == len(ts) {
+			return nil, fmt.Errorf("want a clause at %q", kw.S)
+		}
+		arg := ts[i+1]
+		i += 2
+		switch kw.S {
+		case "if":
+			c := cond{}
+			k := strings.Index(arg.S, "=")
+			if k < 1 || arg.Quoted || arg.Regex {
+				return nil, fmt.Errorf("want if <var>=<value> or <var>!=<value>")
+			}
+			c.name, c.value = arg.S[:k], arg.S[k+1:]
+			if strings.HasSuffix(c.name, "!") {
+				c.name, c.not = c.name[:len(c.name)-1], true
+			}
+			used[c.name] = pos
+			r.conds = append(r.conds, c)
+		case "delay":
+			d, err := time.ParseDuration(arg.S)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("bad delay %q", arg.S)
+			}
+			r.actions = append(r.actions, action{op: "delay", d: d})
+		case "reply":
+			if !arg.Quoted {
+				return nil, fmt.Errorf("want reply \"template\"")
+			}
+			use([]byte(arg.S))
+			r.actions = append(r.actions, action{op: "reply", tmpl: []byte(arg.S)})
+		case "set", "add":
+			if i == len(ts) || arg.Quoted || arg.Regex || ts[i].Regex {
+				return nil, fmt.Errorf("want %s <var> <value>", kw.S)
+			}
+			a := action{op: kw.S, name: arg.S, tmpl: []byte(ts[i].S)}
+			if kw.S == "add" {
+				n, err := strconv.Atoi(ts[i].S)
+				if err != nil {
+					return nil, fmt.Errorf("bad number %q", ts[i].S)
+				}
+				a.n = n
+			} else {
+				use(a.tmpl)
+			}
+			used[a.name] = pos
+			r.actions = append(r.actions, a)
+			i++
+		default:
+			return nil, fmt.Errorf("unknown clause %q", kw.S)
+		}
+	}
+	if len(r.actions) == 0 {
+		return nil, fmt.Errorf("the rule does nothing")
+	}
+	return r, nil
+}
+
+// names returns the {names} in the template t.
+func names(t []byte) []string {
+	var ns []string
+	for i := 0; i < len(t); i++ {
+		if t[i] != '{' {
+			continue
+		}
+		if i+1 < len(t) && t[i+1] == '{' {
+			i++
+			continue
+		}
+		if k := bytes.IndexByte(t[i:], '}'); k > 0 {
+			ns = append(ns, string(t[i+1:i+k]))
+			i += k
+		}
+	}
+	return ns
+}
+
+// expand fills the template t in, with the mu held.
+func (s *Sim) expand(t []byte, groups [][]byte) []byte {
+	var b []byte
+	for i := 0; i < len(t); i++ {
+		if t[i] != '{' {
+			b = append(b, t[i])
+			continue
+		}
+		if i+1 < len(t) && t[i+1] == '{' {
+			b = append(b, '{')
+			i++
+			continue
+		}
+		k := bytes.IndexByte(t[i:], '}')
+		if k < 0 {
+			b = append(b, t[i:]...)
+			break
+		}
+		name := string(t[i+1 : i+k])
+		i += k
+		if g, err := strconv.Atoi(name); err == nil {
+			if g >= 0 && g < len(groups) {
+				b = append(b, groups[g]...)
+			}
+			continue
+		}
+		switch name {
+		case "time":
+			b = append(b, time.Now().Format("15:04:05")...)
+		case "uptime":
+			b = strconv.AppendInt(b, int64(time.Since(s.start)/time.Second), 10)
+		default:
+			b = append(b, s.vars[name]...)
+		}
+	}
+	return b
+}
+
+// holds tells whether the conditions of r hold, with the mu held.
+func (s *Sim) holds(r *rule) bool {
+	for _, c := range r.conds {
+		if (s.vars[c.name] == c.value) == c.not {
+			return false
+		}
+	}
+	return true
+}
+
+// fire runs the clauses of r, with the mu held, and returns the
+// replies.
+func (s *Sim) fire(r *rule, groups [][]byte) []step {
+	var steps []step
+	var d time.Duration
+	for _, a := range r.actions {
+		switch a.op {
+		case "delay":
+			d += a.d
+		case "reply":
+			steps = append(steps, step{d, s.expand(a.tmpl, groups)})
+			d = 0
+		case "set":
+			s.vars[a.name] = string(s.expand(a.tmpl, groups))
+		case "add":
+			n, _ := strconv.Atoi(s.vars[a.name])
+			s.vars[a.name] = strconv.Itoa(n + a.n)
+		}
+	}
+	if d > 0 {
+		// a trailing delay holds back what comes after
+		steps = append(steps, step{d, nil})
+	}
+	if s.Logf != nil {
+		what := "timer"
+		if len(groups) > 0 {
+			what = fmt.Sprintf("%q", groups[0])
+		}
+		s.Logf("%s: %s", r.pos, what)
+	}
+	return steps
+}
+
+// matchLine fires the first line rule matching the line l.
+func (s *Sim) matchLine(l []byte) []step {
+	for _, r := range s.rules {
+		if !r.line || !s.holds(r) {
+			continue
+		}
+		if r.lit != nil && bytes.Equal(l, r.lit) {
+			return s.fire(r, [][]byte{l})
+		}
+		if r.re != nil {
+			if g := r.re.FindSubmatch(l); g != nil {
+				return s.fire(r, g)
+			}
+		}
+	}
+	return nil
+}
+
+// matchStream fires the stream rule matching earliest in buf and
+// returns how much of buf that took, 0 if none matched.
+func (s *Sim) matchStream(buf []byte) ([]step, int) {
+	var best *rule
+	var groups [][]byte
+	end := -1
+	for _, r := range s.rules {
+		if r.line || !s.holds(r) {
+			continue
+		}
+		var e int
+		var g [][]byte
+		if r.lit != nil {
+			k := bytes.Index(buf, r.lit)
+			if k < 0 {
+				continue
+			}
+			e, g = k+len(r.lit), [][]byte{r.lit}
+		} else {
+			m := r.re.FindSubmatchIndex(buf)
+			if m == nil {
+				continue
+			}
+			e = m[1]
+			for k := 0; k < len(m); k += 2 {
+				if m[k] < 0 {
+					g = append(g, nil)
+				} else {
+					g = append(g, buf[m[k]:m[k+1]])
+				}
+			}
+		}
+		if end < 0 || e < end {
+			best, groups, end = r, g, e
+		}
+	}
+	if best == nil {
+		return nil, 0
+	}
+	return s.fire(best, groups), end
+}
+
+// Run plays the device on port until reading it fails.
+func (s *Sim) Run(port io.ReadWriter) error {
+	s.mu.Lock()
+	s.start = time.Now()
+	s.mu.Unlock()
+	out := make(chan []step, 64)
+	quit := make(chan struct{})
+	defer close(quit)
+	errc := make(chan error, 1)
+
+	go func() {
+		for {
+			select {
+			case steps := <-out:
+				for _, st := range steps {
+					time.Sleep(st.d)
+					if len(st.b) == 0 {
+						continue
+					}
+					if _, err := port.Write(st.b); err != nil {
+						errc <- err
+						return
+					}
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	send := func(steps []step) {
+		if len(steps) > 0 {
+			select {
+			case out <- steps:
+			case <-quit:
+			}
+		}
+	}
+	for _, r := range s.timers {
+		go func(r *rule) {
+			t := time.NewTicker(r.every)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+				case <-quit:
+					return
+				}
+				s.mu.Lock()
+				var steps []step
+				if s.holds(r) {
+					steps = s.fire(r, nil)
+				}
+				s.mu.Unlock()
+				send(steps)
+			}
+		}(r)
+	}
+
+	var stream, line []byte
+	buf := make([]byte, 1024)
+	for {
+		n, err := port.Read(buf)
+		if n > 0 {
+			for _, c := range buf[:n] {
+				stream = append(stream, c)
+				s.mu.Lock()
+				steps, k := s.matchStream(stream)
+				s.mu.Unlock()
+				if k > 0 {
+					stream = stream[:copy(stream, stream[k:])]
+					line = line[:0]
+					send(steps)
+					continue
+				} else if len(stream) > MAX_BUFFER {
+					stream = stream[:copy(stream, stream[len(stream)/2:])]
+				}
+				if c != '\r' && c != '\n' {
+					if len(line) < MAX_BUFFER {
+						line = append(line, c)
+					}
+					continue
+				}
+				if len(line) == 0 {
+					continue
+				}
+				s.mu.Lock()
+				steps = s.matchLine(line)
+				s.mu.Unlock()
+				line = line[:0]
+				send(steps)
+			}
+		}
+		select {
+		case err := <-errc:
+			return err
+		default:
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
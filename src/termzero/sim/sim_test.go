@@ -0,0 +1,171 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"termzero/sers/serstest"
+)
+
+// run plays the rules on one end of a pair and returns the other.
+func run(t *testing.T, rules string) *serstest.Port {
+	t.Helper()
+	s, err := Parse(strings.NewReader(rules), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := serstest.Pair(serstest.Options{})
+	b.SetReadParams(0, 0.05)
+	done := make(chan struct{})
+	go func() {
+		s.Run(a)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+		<-done
+	})
+	return b
+}
+
+// recv reads what p gets until it is quiet for a while.
+func recv(p *serstest.Port) string {
+	var got []byte
+	buf := make([]byte, 256)
+	for quiet := 0; quiet < 4; {
+		n, err := p.Read(buf)
+		if err != nil {
+			break
+		}
+		if n == 0 {
+			quiet++
+			continue
+		}
+		got = append(got, buf[:n]...)
+		quiet = 0
+	}
+	return string(got)
+}
+
+// ask sends q and checks the device answers want.
+func ask(t *testing.T, p *serstest.Port, q, want string) {
+	t.Helper()
+	p.Write([]byte(q))
+	if got := recv(p); got != want {
+		t.Errorf("%q: got %q, want %q", q, got, want)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	p := run(t, `
+on "PING" reply "PONG\n"
+on /AT(\d)/ reply "at {1}\n"
+on line /^GET (\w+)$/ reply "got {1}\n"
+on line "ls" reply "a b\n"
+on line /.*/ reply "ERROR {0}\n"
+`)
+	// the stream within a line, the line then starts afresh
+	ask(t, p, "xxPINGls\r\n", "PONG\na b\n")
+	ask(t, p, "GET x\r\nGET x y\n", "got x\nERROR GET x y\n")
+	// the empty lines of CR LF are skipped
+	ask(t, p, "\r\n\r\n", "")
+	// the match ending first goes first, whatever the rule order
+	ask(t, p, "AT1PING", "at 1\nPONG\n")
+	ask(t, p, "PIAT2NG", "at 2\n")
+}
+
+func TestVariables(t *testing.T) {
+	p := run(t, `
+set mode idle
+set count 0
+on line /^SET (\w+)$/ set mode {1} reply "OK\n"
+on line "GET" if mode!=idle add count 2 reply "{mode} {count} {{x}\n"
+on line "GET" if mode=idle reply "idle\n"
+on line "ADD" add count -1 add count 10 reply "{count}\n"
+`)
+	ask(t, p, "GET\n", "idle\n")
+	ask(t, p, "SET run\n", "OK\n")
+	ask(t, p, "GET\n", "run 2 {x}\n")
+	ask(t, p, "GET\n", "run 4 {x}\n")
+	ask(t, p, "ADD\n", "13\n")
+	ask(t, p, "SET idle\nGET\n", "OK\nidle\n")
+}
+
+func TestDelay(t *testing.T) {
+	p := run(t, `on "go" reply "1" delay 200ms reply "2" delay 100ms`+"\n"+`on "x" reply "x"`)
+	start := time.Now()
+	p.Write([]byte("gox"))
+	var got []byte
+	var at []time.Duration
+	buf := make([]byte, 16)
+	for len(got) < 3 && time.Since(start) < 2*time.Second {
+		n, _ := p.Read(buf)
+		for range buf[:n] {
+			at = append(at, time.Since(start))
+		}
+		got = append(got, buf[:n]...)
+	}
+	// the reply to x waits for the trailing delay too
+	if string(got) != "12x" {
+		t.Fatalf("got %q", got)
+	}
+	if at[0] > 100*time.Millisecond || at[1] < 200*time.Millisecond || at[2] < 300*time.Millisecond {
+		t.Errorf("replies after %v", at)
+	}
+}
+
+func TestEvery(t *testing.T) {
+	p := run(t, `
+set on no
+on "start" set on yes
+every 100ms if on=yes reply "T"
+`)
+	time.Sleep(250 * time.Millisecond)
+	if got := recv(p); got != "" {
+		t.Errorf("the timer fired while off: %q", got)
+	}
+	p.Write([]byte("start"))
+	// it keeps sending, read a while
+	var got string
+	buf := make([]byte, 16)
+	for end := time.Now().Add(450 * time.Millisecond); time.Now().Before(end); {
+		n, _ := p.Read(buf)
+		got += string(buf[:n])
+	}
+	if len(got) < 3 || strings.Trim(got, "T") != "" {
+		t.Errorf("the timer sent %q", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, c := range []struct{ rules, err string }{
+		{"", "test: no rules"},
+		{"set x", "test:1: want set <name> <value>"},
+		{"\nsend x", `test:2: want set, on or every, not "send"`},
+		{`on ""`, "test:1: empty literal"},
+		{`on "x"`, "test:1: the rule does nothing"},
+		{`on "x" reply`, `test:1: want a clause at "reply"`},
+		{`on "x" reply y`, `test:1: want reply "template"`},
+		{`on "x" delay 1 reply "y"`, `test:1: bad delay "1"`},
+		{`on "x" add n x`, `test:1: bad number "x"`},
+		{`on "x" shout "y"`, `test:1: unknown clause "shout"`},
+		{`on "x" if n reply "y"`, "test:1: want if <var>=<value> or <var>!=<value>"},
+		{`every 0s reply "y"`, `test:1: bad interval "0s"`},
+		{`on /(/ reply "y"`, "test:1: error parsing regexp"},
+		{`on /a*/ reply "y"`, "test:1: /a*/ matches the empty string, use on line"},
+		{`on line "x" reply "{n}"`, "test:1: n has no start value, set it"},
+	} {
+		_, err := Parse(strings.NewReader(c.rules), "test")
+		if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+			t.Errorf("%q: got %v, want %s", c.rules, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"termzero/sers"
+	"termzero/sim"
+)
+
+// simulateMain: termzero simulate [-port dev | -pty path] [-mode m] <rules>
+func simulateMain(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	dev := fs.String("port", "", "Serial port device or rfc2217://host:port to play the device on, the first of the usual ones if empty")
+	link := fs.String("pty", "", "Play the device on a pseudo-terminal symlinked at the path, e.g. /tmp/ttyV0, instead of a port")
+	quiet := fs.Bool("q", false, "Don't log the rules that fire")
+	mode := sers.Mode{Baudrate: uint32(defBaudrate), Databits: databits,
+		Parity: parity, Stopbits: stopbits, Handshake: handshake}
+	fs.Var(&mode, "mode", "Mode of the port, e.g. 115200,8N1")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: termzero simulate [flags] <rules>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Println("Fatal:", err)
+		return 1
+	}
+	s, err := sim.Parse(f, fs.Arg(0))
+	f.Close()
+	if err != nil {
+		fmt.Println("Fatal:", err)
+		return 1
+	}
+	if !*quiet {
+		s.Logf = func(format string, a ...interface{}) {
+			fmt.Printf("%s %s\n", time.Now().Format("2006-01-02 15:04:05"),
+				fmt.Sprintf(format, a...))
+		}
+	}
+
+	var port io.ReadWriter
+	if *link != "" {
+		p, name, closePty, err := simPty(*link, mode)
+		if err != nil {
+			fmt.Println("Fatal: pty:", err)
+			return 1
+		}
+		defer closePty()
+		port = p
+		fmt.Printf("simulating %s on %s -> %s\n", fs.Arg(0), *link, name)
+	} else {
+		if *dev == "" {
+			*dev = findSerialPortDevice()
+		}
+		p, err := sers.Open(*dev)
+		if err == nil {
+			err = mode.Apply(p)
+		}
+		if err != nil {
+			fmt.Println("Fatal: serial port:", err)
+			return 1
+		}
+		// not closed, that waits for the blocked read; the exit does
+		port = p
+		fmt.Printf("simulating %s on %s at %s\n", fs.Arg(0), *dev, &mode)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run(port) }()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		fmt.Println("Fatal:", err)
+		return 1
+	case <-sig:
+	}
+	return 0
+}
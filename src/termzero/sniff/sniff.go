@@ -0,0 +1,117 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package sniff renders the traffic of both directions of a line
+// interleaved: every line starts with a time stamp and the direction,
+// a change of direction starts a new line.
+package sniff
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"termzero/display"
+	"termzero/stamp"
+)
+
+// Dir is a direction of the traffic.
+type Dir int
+
+const (
+	A_TO_B Dir = iota
+	B_TO_A
+)
+
+// ANSI colors of the directions.
+var colors = [2]string{"\x1b[32m", "\x1b[33m"}
+
+const RESET = "\x1b[0m"
+
+// Writer renders the two directions to w.
+type Writer struct {
+	w      io.Writer
+	st     *stamp.Stamper
+	labels [2]string
+	color  bool
+
+	mu   sync.Mutex
+	disp [2]*display.Writer // per direction, for the hex offsets
+	buf  [2]bytes.Buffer
+	last Dir
+	bol  bool // at the beginning of a line
+	out  []byte
+}
+
+// NewWriter renders to w in the display mode m, stamped by st, the
+// lines labeled e.g. "A>B" and "B>A", colored if color.
+func NewWriter(w io.Writer, m display.Mode, st *stamp.Stamper, labels [2]string, color bool) *Writer {
+	sw := &Writer{w: w, st: st, labels: labels, color: color, bol: true}
+	for d := range sw.disp {
+		sw.disp[d] = display.NewWriter(&sw.buf[d], m)
+	}
+	return sw
+}
+
+// WriteAt renders p which went in the direction d at t.
+func (w *Writer) WriteAt(d Dir, p []byte, t time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf[d].Reset()
+	w.disp[d].Write(p)
+	r := w.buf[d].Bytes()
+	w.out = w.out[:0]
+	if !w.bol && d != w.last {
+		w.out = append(w.out, '\n')
+		w.bol = true
+	}
+	w.last = d
+	for len(r) > 0 {
+		if w.bol {
+			if w.color {
+				w.out = append(w.out, colors[d]...)
+			}
+			w.out = append(w.out, w.st.Format(t)...)
+			w.out = append(w.out, w.labels[d]...)
+			w.out = append(w.out, ' ')
+			w.bol = false
+		} else if w.color {
+			w.out = append(w.out, colors[d]...)
+		}
+		i := bytes.IndexByte(r, '\n') + 1
+		if i == 0 {
+			i = len(r)
+		}
+		line := r[:i]
+		if i > 0 && line[i-1] == '\n' {
+			line = line[:i-1]
+			w.bol = true
+		}
+		w.out = append(w.out, line...)
+		if w.color {
+			w.out = append(w.out, RESET...)
+		}
+		if w.bol {
+			w.out = append(w.out, '\n')
+		}
+		r = r[i:]
+	}
+	_, err := w.w.Write(w.out)
+	return err
+}
+
+// Flush ends the current line.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.bol {
+		return nil
+	}
+	w.bol = true
+	_, err := io.WriteString(w.w, "\n")
+	return err
+}
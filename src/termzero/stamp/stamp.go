@@ -0,0 +1,146 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package stamp prefixes received lines or chunks with the time
+// they arrived at.
+package stamp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+type Mode int
+
+const (
+	NO_STAMP Mode = iota
+	ABS           // wall clock
+	REL           // since the start of the session
+	DELTA         // since the previous stamp
+)
+
+var modeNames = []string{"none", "abs", "rel", "delta"}
+
+func ParseMode(s string) (Mode, error) {
+	for i, n := range modeNames {
+		if n == s {
+			return Mode(i), nil
+		}
+	}
+	return NO_STAMP, fmt.Errorf("unknown timestamp mode %q, have %s",
+		s, strings.Join(modeNames, ", "))
+}
+
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(modeNames) {
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+	return modeNames[m]
+}
+
+// Stamper formats time stamps.
+type Stamper struct {
+	Mode  Mode
+	Micro bool // microseconds instead of milliseconds
+	start time.Time
+	last  time.Time
+}
+
+func NewStamper(m Mode, micro bool, start time.Time) *Stamper {
+	return &Stamper{Mode: m, Micro: micro, start: start, last: start}
+}
+
+// Format returns the stamp for t, e.g. "[12:04:05.123] ".
+func (s *Stamper) Format(t time.Time) string {
+	var d time.Duration
+	switch s.Mode {
+	case NO_STAMP:
+		return ""
+	case ABS:
+		if s.Micro {
+			return t.Format("[15:04:05.000000] ")
+		}
+		return t.Format("[15:04:05.000] ")
+	case REL:
+		d = t.Sub(s.start)
+	case DELTA:
+		d = t.Sub(s.last)
+	}
+	s.last = t
+	if s.Micro {
+		return fmt.Sprintf("[+%.6f] ", d.Seconds())
+	}
+	return fmt.Sprintf("[+%.3f] ", d.Seconds())
+}
+
+// Writer inserts stamps into a stream. The data goes to w, the
+// stamps to sw, which may well be the same writer.
+type Writer struct {
+	st    *Stamper
+	w, sw io.Writer
+	// Chunk stamps every write on a line of its own instead of
+	// every line, for binary data. A write is taken to end its line
+	// when it ends in a LF, or when w has an AtLineStart method
+	// saying so.
+	Chunk bool
+	bol   bool // at the beginning of a line
+}
+
+func NewWriter(w, sw io.Writer, st *Stamper) *Writer {
+	return &Writer{st: st, w: w, sw: sw, bol: true}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.WriteAt(p, time.Now())
+}
+
+// WriteAt writes p which arrived at t.
+func (w *Writer) WriteAt(p []byte, t time.Time) (int, error) {
+	if w.st.Mode == NO_STAMP {
+		return w.w.Write(p)
+	}
+	if w.Chunk {
+		if !w.bol {
+			io.WriteString(w.sw, "\n")
+		}
+		if _, err := io.WriteString(w.sw, strings.TrimSpace(w.st.Format(t))+"\n"); err != nil {
+			return 0, err
+		}
+		w.bol = true
+		n, err := w.w.Write(p)
+		if ls, ok := w.w.(interface{ AtLineStart() bool }); ok && n > 0 {
+			w.bol = ls.AtLineStart()
+		} else if n > 0 {
+			w.bol = p[n-1] == '\n'
+		}
+		return n, err
+	}
+	n := 0
+	for len(p) > 0 {
+		if w.bol {
+			if _, err := io.WriteString(w.sw, w.st.Format(t)); err != nil {
+				return n, err
+			}
+			w.bol = false
+		}
+		i := bytes.IndexByte(p, '\n') + 1
+		if i == 0 {
+			i = len(p)
+		} else {
+			w.bol = true
+		}
+		m, err := w.w.Write(p[:i])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[i:]
+	}
+	return n, nil
+}
@@ -0,0 +1,331 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package stk500 implements the part of the STK500 version 1
+// protocol the Arduino bootloaders (Optiboot and its elders) speak,
+// enough to flash and verify an Atmel Mega or Tiny over its UART.
+package stk500
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"termzero/fwimage"
+	"termzero/link"
+)
+
+const (
+	STK_OK      = 0x10
+	STK_FAILED  = 0x11
+	STK_INSYNC  = 0x14
+	STK_NOSYNC  = 0x15
+	CRC_EOP     = 0x20 // ends every command
+	MEM_FLASH   = 'F'
+	MEM_EEPROM  = 'E'
+	FLASH_FILL  = 0xff // erased flash
+	MAX_ADDRESS = 1 << 17
+
+	STK_GET_SYNC       = 0x30
+	STK_GET_PARAMETER  = 0x41
+	STK_SET_DEVICE     = 0x42
+	STK_SET_DEVICE_EXT = 0x45
+	STK_ENTER_PROGMODE = 0x50
+	STK_LEAVE_PROGMODE = 0x51
+	STK_LOAD_ADDRESS   = 0x55 // word address, low byte first
+	STK_UNIVERSAL      = 0x56
+	STK_PROG_PAGE      = 0x64
+	STK_READ_PAGE      = 0x74
+	STK_READ_SIGN      = 0x75
+
+	PARM_SW_MAJOR = 0x81
+	PARM_SW_MINOR = 0x82
+)
+
+var (
+	ErrSync   = errors.New("stk500: not in sync")
+	ErrFailed = errors.New("stk500: command failed")
+	ErrNoSync = errors.New("stk500: no answer from the bootloader")
+)
+
+type Options struct {
+	PageSize int // flash page size, taken from the signature if 0
+	Retries  int // sync attempts, 20 if 0
+	// Timeout for an answer, 1s if 0. Sync attempts wait a fifth.
+	Timeout  time.Duration
+	Progress func(n int64) // image bytes written plus verified
+}
+
+func (o *Options) retries() int {
+	if o == nil || o.Retries == 0 {
+		return 20
+	}
+	return o.Retries
+}
+
+func (o *Options) timeout() time.Duration {
+	if o == nil || o.Timeout == 0 {
+		return time.Second
+	}
+	return o.Timeout
+}
+
+func (o *Options) progress(n int64) {
+	if o != nil && o.Progress != nil {
+		o.Progress(n)
+	}
+}
+
+// Lines are the modem control lines of a port.
+type Lines interface {
+	SetDTR(on bool) error
+	SetRTS(on bool) error
+}
+
+// Reset pulses DTR and RTS the way the Arduino boards want it: the
+// lines go inactive and then active again, the edge resets the chip
+// through a capacitor and its bootloader waits for us.
+func Reset(p Lines) error {
+	if err := setLines(p, false); err != nil {
+		return err
+	}
+	time.Sleep(250 * time.Millisecond)
+	if err := setLines(p, true); err != nil {
+		return err
+	}
+	time.Sleep(50 * time.Millisecond)
+	return nil
+}
+
+func setLines(p Lines, on bool) error {
+	if err := p.SetDTR(on); err != nil {
+		return err
+	}
+	return p.SetRTS(on)
+}
+
+// Part describes an AVR.
+type Part struct {
+	Name      string
+	Sig       [3]byte
+	FlashSize int
+	PageSize  int
+}
+
+var parts = []Part{
+	{"ATmega8", [3]byte{0x1e, 0x93, 0x07}, 8 << 10, 64},
+	{"ATmega88", [3]byte{0x1e, 0x93, 0x0a}, 8 << 10, 64},
+	{"ATmega168", [3]byte{0x1e, 0x94, 0x06}, 16 << 10, 128},
+	{"ATmega168P", [3]byte{0x1e, 0x94, 0x0b}, 16 << 10, 128},
+	{"ATmega328", [3]byte{0x1e, 0x95, 0x14}, 32 << 10, 128},
+	{"ATmega328P", [3]byte{0x1e, 0x95, 0x0f}, 32 << 10, 128},
+	{"ATmega32U4", [3]byte{0x1e, 0x95, 0x87}, 32 << 10, 128},
+	{"ATmega644P", [3]byte{0x1e, 0x96, 0x0a}, 64 << 10, 256},
+	{"ATmega1280", [3]byte{0x1e, 0x97, 0x03}, 128 << 10, 256},
+	{"ATmega1284P", [3]byte{0x1e, 0x97, 0x05}, 128 << 10, 256},
+	{"ATmega2560", [3]byte{0x1e, 0x98, 0x01}, 256 << 10, 256},
+	{"ATtiny84", [3]byte{0x1e, 0x93, 0x0c}, 8 << 10, 64},
+	{"ATtiny85", [3]byte{0x1e, 0x93, 0x0b}, 8 << 10, 64},
+}
+
+// LookupPart finds the part with the signature sig.
+func LookupPart(sig [3]byte) *Part {
+	for i := range parts {
+		if parts[i].Sig == sig {
+			return &parts[i]
+		}
+	}
+	return nil
+}
+
+// Programmer talks to a bootloader.
+type Programmer struct {
+	l   *link.Link
+	o   *Options
+	ext int // extended address byte sent last, -1 if none
+}
+
+func New(l *link.Link, o *Options) *Programmer {
+	if o == nil {
+		o = &Options{}
+	}
+	return &Programmer{l: l, o: o, ext: -1}
+}
+
+// command sends cmd with args and returns the n bytes of the answer
+// between INSYNC and OK.
+func (p *Programmer) command(n int, cmd byte, args ...byte) ([]byte, error) {
+	b := append([]byte{cmd}, args...)
+	if _, err := p.l.Write(append(b, CRC_EOP)); err != nil {
+		return nil, err
+	}
+	return p.answer(n, p.o.timeout())
+}
+
+func (p *Programmer) answer(n int, d time.Duration) ([]byte, error) {
+	c, err := p.l.GetByte(d)
+	if err == link.ErrTimeout {
+		return nil, ErrNoSync
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c != STK_INSYNC {
+		return nil, ErrSync
+	}
+	b := make([]byte, n+1)
+	if err := p.l.ReadFull(b, d); err == link.ErrTimeout {
+		return nil, ErrNoSync
+	} else if err != nil {
+		return nil, err
+	}
+	switch b[n] {
+	case STK_OK:
+		return b[:n], nil
+	case STK_FAILED:
+		return nil, ErrFailed
+	}
+	return nil, ErrSync
+}
+
+// Sync gets in sync with a bootloader that was just reset.
+func (p *Programmer) Sync() error {
+	err := ErrNoSync
+	for try := 0; try < p.o.retries(); try++ {
+		p.l.Purge()
+		if _, err = p.l.Write([]byte{STK_GET_SYNC, CRC_EOP}); err != nil {
+			return err
+		}
+		if _, err = p.answer(0, p.o.timeout()/5); err == nil {
+			// the answers to the attempts before
+			p.l.Drain(50 * time.Millisecond)
+			return nil
+		}
+		if err != ErrNoSync && err != ErrSync {
+			return err
+		}
+	}
+	return err
+}
+
+// Parameter reads a parameter, e.g. the software version.
+func (p *Programmer) Parameter(id byte) (byte, error) {
+	b, err := p.command(1, STK_GET_PARAMETER, id)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Signature reads the signature bytes of the chip.
+func (p *Programmer) Signature() ([3]byte, error) {
+	var sig [3]byte
+	b, err := p.command(3, STK_READ_SIGN)
+	if err == nil {
+		copy(sig[:], b)
+	}
+	return sig, err
+}
+
+func (p *Programmer) Enter() error {
+	_, err := p.command(0, STK_ENTER_PROGMODE)
+	return err
+}
+
+// Leave ends programming, the bootloader starts the application.
+func (p *Programmer) Leave() error {
+	_, err := p.command(0, STK_LEAVE_PROGMODE)
+	return err
+}
+
+// load sets the byte address addr for the next page command.
+func (p *Programmer) load(addr uint32) error {
+	if addr >= MAX_ADDRESS || p.ext > 0 {
+		// past 128K the word address needs the extended byte
+		if ext := int(addr >> 17); ext != p.ext {
+			if _, err := p.command(1, STK_UNIVERSAL, 0x4d, 0x00, byte(ext), 0x00); err != nil {
+				return err
+			}
+			p.ext = ext
+		}
+	}
+	w := addr >> 1
+	_, err := p.command(0, STK_LOAD_ADDRESS, byte(w), byte(w>>8))
+	return err
+}
+
+// WritePage writes a flash page at the byte address addr.
+func (p *Programmer) WritePage(addr uint32, data []byte) error {
+	if err := p.load(addr); err != nil {
+		return err
+	}
+	n := len(data)
+	args := append([]byte{byte(n >> 8), byte(n), MEM_FLASH}, data...)
+	_, err := p.command(0, STK_PROG_PAGE, args...)
+	return err
+}
+
+// ReadPage reads n bytes of flash at the byte address addr.
+func (p *Programmer) ReadPage(addr uint32, n int) ([]byte, error) {
+	if err := p.load(addr); err != nil {
+		return nil, err
+	}
+	return p.command(n, STK_READ_PAGE, byte(n>>8), byte(n), MEM_FLASH)
+}
+
+// Flash syncs with a freshly reset bootloader, writes and verifies m
+// and starts the application. It returns the part it found, nil if
+// the signature is unknown and o has the page size.
+func Flash(l *link.Link, m *fwimage.Image, o *Options) (*Part, error) {
+	p := New(l, o)
+	if err := p.Sync(); err != nil {
+		return nil, err
+	}
+	sig, err := p.Signature()
+	if err != nil {
+		return nil, err
+	}
+	part := LookupPart(sig)
+	size := p.o.PageSize
+	if size == 0 {
+		if part == nil {
+			return nil, fmt.Errorf("stk500: unknown signature %02x%02x%02x, give the page size",
+				sig[0], sig[1], sig[2])
+		}
+		size = part.PageSize
+	}
+	if _, hi := m.Bounds(); part != nil && hi > uint32(part.FlashSize) {
+		return part, fmt.Errorf("stk500: image ends at 0x%x, the %s has %d bytes of flash",
+			hi, part.Name, part.FlashSize)
+	}
+	if err := p.Enter(); err != nil {
+		return part, err
+	}
+	pages := m.Pages(size, FLASH_FILL)
+	var n int64
+	for _, pg := range pages {
+		if err := p.WritePage(pg.Addr, pg.Data); err != nil {
+			return part, fmt.Errorf("%v at 0x%05x", err, pg.Addr)
+		}
+		n += int64(m.Count(pg.Addr, pg.End()))
+		p.o.progress(n)
+	}
+	for _, pg := range pages {
+		b, err := p.ReadPage(pg.Addr, len(pg.Data))
+		if err != nil {
+			return part, fmt.Errorf("%v at 0x%05x", err, pg.Addr)
+		}
+		for i := range b {
+			if a := pg.Addr + uint32(i); b[i] != pg.Data[i] && m.Count(a, a+1) > 0 {
+				return part, fmt.Errorf("stk500: verify error at 0x%05x: 0x%02x, want 0x%02x",
+					a, b[i], pg.Data[i])
+			}
+		}
+		n += int64(m.Count(pg.Addr, pg.End()))
+		p.o.progress(n)
+	}
+	return part, p.Leave()
+}
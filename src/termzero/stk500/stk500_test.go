@@ -0,0 +1,124 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package stk500
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"termzero/fwimage"
+	"termzero/link"
+	"termzero/sers/serstest"
+)
+
+// flash flashes m into t over a virtual port pair.
+func flash(t *testing.T, tg *Target, m *fwimage.Image) (*Part, error) {
+	t.Helper()
+	a, b := serstest.Pair(serstest.Options{})
+	defer a.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- tg.Serve(b)
+		b.Close()
+	}()
+	part, err := Flash(link.New(a), m, &Options{Timeout: 500 * time.Millisecond})
+	if err == nil {
+		if serr := <-done; serr != nil {
+			t.Errorf("target: %v", serr)
+		}
+	}
+	return part, err
+}
+
+func TestFlash(t *testing.T) {
+	p := LookupPart([3]byte{0x1e, 0x95, 0x0f})
+	if p == nil || p.Name != "ATmega328P" {
+		t.Fatalf("LookupPart found %v", p)
+	}
+	tg := NewTarget(*p)
+	m := &fwimage.Image{}
+	code := bytes.Repeat([]byte{0x0c, 0x94, 0x5c, 0x00}, 75) // 300 bytes, 3 pages
+	m.Write(0, code)
+	m.Write(0x1003, []byte{1, 2, 3}) // in a page of its own, unaligned
+	var progress int64
+	o := &Options{Timeout: 500 * time.Millisecond, Progress: func(n int64) { progress = n }}
+
+	a, b := serstest.Pair(serstest.Options{})
+	defer a.Close()
+	done := make(chan error, 1)
+	go func() { done <- tg.Serve(b) }()
+	part, err := Flash(link.New(a), m, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("the target didn't leave the programming mode: %v", err)
+	}
+	if part != p {
+		t.Errorf("found %v, want the %s", part, p.Name)
+	}
+	if progress != 2*int64(m.Len()) {
+		t.Errorf("progress %d, want %d written plus verified", progress, 2*m.Len())
+	}
+	if !bytes.Equal(tg.Flash[:300], code) {
+		t.Error("the code didn't make it")
+	}
+	if got := tg.Flash[0x1000:0x1008]; !bytes.Equal(got, []byte{0xff, 0xff, 0xff, 1, 2, 3, 0xff, 0xff}) {
+		t.Errorf("at 0x1000: % x", got)
+	}
+	if tg.Flash[300] != FLASH_FILL || tg.Flash[0x7fff] != FLASH_FILL {
+		t.Error("flash outside the image changed")
+	}
+}
+
+func TestFlashExtended(t *testing.T) {
+	p := LookupPart([3]byte{0x1e, 0x98, 0x01})
+	tg := NewTarget(*p)
+	m := &fwimage.Image{}
+	m.Write(0x20100, []byte("above 128K"))
+	if _, err := flash(t, tg, m); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(tg.Flash[0x20100:0x2010a]); got != "above 128K" {
+		t.Errorf("at 0x20100: %q", got)
+	}
+}
+
+func TestVerifyError(t *testing.T) {
+	// the signature of a 328P, but flash that takes only 1K
+	p := *LookupPart([3]byte{0x1e, 0x95, 0x0f})
+	p.FlashSize = 1024
+	m := &fwimage.Image{}
+	m.Write(0x800, []byte{0xde, 0xad})
+	_, err := flash(t, NewTarget(p), m)
+	if err == nil || !strings.Contains(err.Error(), "verify error at 0x00800") {
+		t.Errorf("got %v, want a verify error at 0x00800", err)
+	}
+}
+
+func TestTooBig(t *testing.T) {
+	p := LookupPart([3]byte{0x1e, 0x93, 0x0b}) // ATtiny85, 8K
+	m := &fwimage.Image{}
+	m.Write(0x2000, []byte{0})
+	if _, err := flash(t, NewTarget(*p), m); err == nil || !strings.Contains(err.Error(), "ATtiny85 has 8192") {
+		t.Errorf("got %v, want the image too big", err)
+	}
+}
+
+func TestNoBootloader(t *testing.T) {
+	a, b := serstest.Pair(serstest.Options{})
+	defer a.Close()
+	defer b.Close()
+	m := &fwimage.Image{}
+	m.Write(0, []byte{0})
+	_, err := Flash(link.New(a), m, &Options{Retries: 3, Timeout: 100 * time.Millisecond})
+	if err != ErrNoSync {
+		t.Errorf("got %v, want %v", err, ErrNoSync)
+	}
+}
@@ -0,0 +1,117 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package stk500
+
+import (
+	"bufio"
+	"io"
+)
+
+// Target emulates an Optiboot bootloader, for trying the programmer
+// on a pty or a loopback without an AVR at hand.
+type Target struct {
+	Part  Part
+	Flash []byte // erased to FLASH_FILL
+	addr  uint32 // byte address
+	ext   uint32 // extended address byte
+}
+
+func NewTarget(part Part) *Target {
+	t := &Target{Part: part, Flash: make([]byte, part.FlashSize)}
+	for i := range t.Flash {
+		t.Flash[i] = FLASH_FILL
+	}
+	return t
+}
+
+// Serve answers the commands read from rw until the programmer
+// leaves the programming mode. It returns nil then, like the real
+// bootloader jumps to the application.
+func (t *Target) Serve(rw io.ReadWriter) error {
+	r := bufio.NewReader(rw)
+	get := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		var args []byte
+		switch c {
+		case STK_GET_PARAMETER, STK_SET_DEVICE_EXT:
+			n := 1
+			if c == STK_SET_DEVICE_EXT {
+				n = 5
+			}
+			args, err = get(n)
+		case STK_SET_DEVICE:
+			args, err = get(20)
+		case STK_LOAD_ADDRESS:
+			args, err = get(2)
+		case STK_UNIVERSAL:
+			args, err = get(4)
+		case STK_PROG_PAGE, STK_READ_PAGE:
+			if args, err = get(3); err == nil && c == STK_PROG_PAGE {
+				var data []byte
+				data, err = get(int(args[0])<<8 | int(args[1]))
+				args = append(args, data...)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if eop, err := r.ReadByte(); err != nil {
+			return err
+		} else if eop != CRC_EOP {
+			rw.Write([]byte{STK_NOSYNC})
+			continue
+		}
+		out := []byte{STK_INSYNC}
+		switch c {
+		case STK_GET_PARAMETER:
+			switch args[0] {
+			case PARM_SW_MAJOR:
+				out = append(out, 4)
+			case PARM_SW_MINOR:
+				out = append(out, 4)
+			default:
+				out = append(out, 3)
+			}
+		case STK_LOAD_ADDRESS:
+			t.addr = t.ext<<17 | (uint32(args[0])|uint32(args[1])<<8)<<1
+		case STK_UNIVERSAL:
+			if args[0] == 0x4d {
+				t.ext = uint32(args[2])
+			}
+			out = append(out, 0)
+		case STK_PROG_PAGE:
+			if args[2] == MEM_FLASH && t.addr+uint32(len(args)-3) <= uint32(len(t.Flash)) {
+				copy(t.Flash[t.addr:], args[3:])
+			}
+		case STK_READ_PAGE:
+			n := uint32(args[0])<<8 | uint32(args[1])
+			for i := uint32(0); i < n; i++ {
+				b := byte(FLASH_FILL)
+				if t.addr+i < uint32(len(t.Flash)) {
+					b = t.Flash[t.addr+i]
+				}
+				out = append(out, b)
+			}
+		case STK_READ_SIGN:
+			out = append(out, t.Part.Sig[:]...)
+		}
+		if _, err := rw.Write(append(out, STK_OK)); err != nil {
+			return err
+		}
+		if c == STK_LEAVE_PROGMODE {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,402 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package stm32 implements the USART protocol of the STM32 system
+// memory bootloader (ST application note AN3155), at 8E1 and a baud
+// rate the bootloader detects from the first byte.
+package stm32
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"termzero/cksum"
+	"termzero/fwimage"
+	"termzero/link"
+)
+
+const (
+	INIT = 0x7f // autobaud
+	ACK  = 0x79
+	NACK = 0x1f
+
+	CMD_GET          = 0x00
+	CMD_GET_VERSION  = 0x01
+	CMD_GET_ID       = 0x02
+	CMD_READ         = 0x11
+	CMD_GO           = 0x21
+	CMD_WRITE        = 0x31
+	CMD_ERASE        = 0x43 // the old one, 8 bit page numbers
+	CMD_EXT_ERASE    = 0x44
+	CMD_WRITE_UNPROT = 0x73
+
+	BLOCK_SIZE    = 256 // per read or write
+	FLASH_BASE    = 0x08000000
+	FLASH_FILL    = 0xff
+	MASS_ERASE    = 0xffff // extended erase of everything
+	BOOT_MODE     = "115200,8E1"
+	ERASE_TIMEOUT = 60 * time.Second
+)
+
+var (
+	ErrNACK   = errors.New("stm32: command refused")
+	ErrNoSync = errors.New("stm32: no answer from the bootloader")
+	ErrAnswer = errors.New("stm32: bad answer")
+)
+
+type Options struct {
+	Retries int // init attempts, 10 if 0
+	// Timeout for an answer, 1s if 0. Erasing waits ERASE_TIMEOUT.
+	Timeout  time.Duration
+	Progress func(n int64) // image bytes written plus verified
+}
+
+func (o *Options) retries() int {
+	if o == nil || o.Retries == 0 {
+		return 10
+	}
+	return o.Retries
+}
+
+func (o *Options) timeout() time.Duration {
+	if o == nil || o.Timeout == 0 {
+		return time.Second
+	}
+	return o.Timeout
+}
+
+func (o *Options) progress(n int64) {
+	if o != nil && o.Progress != nil {
+		o.Progress(n)
+	}
+}
+
+// Lines are the modem control lines of a port. The usual wiring puts
+// NRST on DTR, an active line resets the chip, and BOOT0 on RTS, an
+// active line selects the system memory.
+type Lines interface {
+	SetDTR(on bool) error
+	SetRTS(on bool) error
+}
+
+// Enter resets the chip with BOOT0 high, it starts the bootloader.
+func Enter(p Lines) error {
+	return reset(p, true)
+}
+
+// Reset resets the chip with BOOT0 low, it starts the application.
+func Reset(p Lines) error {
+	return reset(p, false)
+}
+
+func reset(p Lines, boot0 bool) error {
+	if err := p.SetRTS(boot0); err != nil {
+		return err
+	}
+	if err := p.SetDTR(true); err != nil {
+		return err
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := p.SetDTR(false); err != nil {
+		return err
+	}
+	// the bootloader takes a moment to start
+	time.Sleep(100 * time.Millisecond)
+	return nil
+}
+
+var chips = map[uint16]string{
+	0x410: "STM32F10x medium-density",
+	0x412: "STM32F10x low-density",
+	0x414: "STM32F10x high-density",
+	0x418: "STM32F105/107",
+	0x413: "STM32F405/407/415/417",
+	0x419: "STM32F42x/43x",
+	0x423: "STM32F401xB/C",
+	0x431: "STM32F411xC/E",
+	0x433: "STM32F401xD/E",
+	0x440: "STM32F030x8/F05x",
+	0x444: "STM32F03x",
+	0x448: "STM32F07x",
+	0x416: "STM32L1 medium-density",
+	0x415: "STM32L47x/48x",
+	0x460: "STM32G07x/08x",
+	0x468: "STM32G431/441",
+}
+
+// ChipName names the product ID pid.
+func ChipName(pid uint16) string {
+	if s, ok := chips[pid]; ok {
+		return s
+	}
+	return fmt.Sprintf("STM32 with ID 0x%03x", pid)
+}
+
+// Programmer talks to the bootloader.
+type Programmer struct {
+	l    *link.Link
+	o    *Options
+	cmds []byte // supported commands, from Get
+}
+
+func New(l *link.Link, o *Options) *Programmer {
+	if o == nil {
+		o = &Options{}
+	}
+	return &Programmer{l: l, o: o}
+}
+
+// ack waits up to d for an ACK.
+func (p *Programmer) ack(d time.Duration) error {
+	c, err := p.l.GetByte(d)
+	switch {
+	case err == link.ErrTimeout:
+		return ErrNoSync
+	case err != nil:
+		return err
+	case c == NACK:
+		return ErrNACK
+	case c != ACK:
+		return ErrAnswer
+	}
+	return nil
+}
+
+// send writes b and waits for the ACK.
+func (p *Programmer) send(d time.Duration, b ...byte) error {
+	if _, err := p.l.Write(b); err != nil {
+		return err
+	}
+	return p.ack(d)
+}
+
+// sendSum sends b with its xor checksum.
+func (p *Programmer) sendSum(d time.Duration, b ...byte) error {
+	return p.send(d, append(b, cksum.Xor8(b))...)
+}
+
+func (p *Programmer) command(cmd byte) error {
+	p.l.Purge()
+	return p.send(p.o.timeout(), cmd, ^cmd)
+}
+
+func (p *Programmer) address(addr uint32) error {
+	return p.sendSum(p.o.timeout(), byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr))
+}
+
+// Init lets the bootloader measure the baud rate. A bootloader that
+// did that already NACKs the byte, which is fine too.
+func (p *Programmer) Init() error {
+	err := ErrNoSync
+	for try := 0; try < p.o.retries(); try++ {
+		p.l.Purge()
+		if err = p.send(p.o.timeout()/2, INIT); err == nil || err == ErrNACK {
+			return nil
+		}
+		if err != ErrNoSync && err != ErrAnswer {
+			return err
+		}
+	}
+	return err
+}
+
+// Get returns the bootloader version and the supported commands.
+func (p *Programmer) Get() (byte, []byte, error) {
+	if err := p.command(CMD_GET); err != nil {
+		return 0, nil, err
+	}
+	n, err := p.l.GetByte(p.o.timeout())
+	if err != nil {
+		return 0, nil, err
+	}
+	b := make([]byte, int(n)+1)
+	if err := p.l.ReadFull(b, p.o.timeout()); err != nil {
+		return 0, nil, err
+	}
+	if err := p.ack(p.o.timeout()); err != nil {
+		return 0, nil, err
+	}
+	p.cmds = b[1:]
+	return b[0], b[1:], nil
+}
+
+// Has reports whether Get listed cmd.
+func (p *Programmer) Has(cmd byte) bool {
+	for _, c := range p.cmds {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// GetID returns the product ID.
+func (p *Programmer) GetID() (uint16, error) {
+	if err := p.command(CMD_GET_ID); err != nil {
+		return 0, err
+	}
+	b := make([]byte, 4)
+	if err := p.l.ReadFull(b[:1], p.o.timeout()); err != nil {
+		return 0, err
+	}
+	if b[0] != 1 {
+		return 0, ErrAnswer
+	}
+	if err := p.l.ReadFull(b[1:3], p.o.timeout()); err != nil {
+		return 0, err
+	}
+	if err := p.ack(p.o.timeout()); err != nil {
+		return 0, err
+	}
+	return uint16(b[1])<<8 | uint16(b[2]), nil
+}
+
+// Read reads n bytes at addr.
+func (p *Programmer) Read(addr uint32, n int) ([]byte, error) {
+	var out []byte
+	for n > 0 {
+		k := n
+		if k > BLOCK_SIZE {
+			k = BLOCK_SIZE
+		}
+		b := make([]byte, k)
+		err := p.command(CMD_READ)
+		if err == nil {
+			err = p.address(addr)
+		}
+		if err == nil {
+			err = p.send(p.o.timeout(), byte(k-1), ^byte(k-1))
+		}
+		if err == nil {
+			err = p.l.ReadFull(b, p.o.timeout())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v at 0x%08x", err, addr)
+		}
+		out = append(out, b...)
+		addr += uint32(k)
+		n -= k
+	}
+	return out, nil
+}
+
+// Write writes data at addr. The bootloader writes words, a short
+// last one is padded with erased flash.
+func (p *Programmer) Write(addr uint32, data []byte) error {
+	for len(data) > 0 {
+		k := len(data)
+		if k > BLOCK_SIZE {
+			k = BLOCK_SIZE
+		}
+		b := append([]byte{0}, data[:k]...)
+		for len(b)%4 != 1 {
+			b = append(b, FLASH_FILL)
+		}
+		b[0] = byte(len(b) - 2)
+		err := p.command(CMD_WRITE)
+		if err == nil {
+			err = p.address(addr)
+		}
+		if err == nil {
+			err = p.sendSum(p.o.timeout(), b...)
+		}
+		if err != nil {
+			return fmt.Errorf("%v at 0x%08x", err, addr)
+		}
+		addr += uint32(k)
+		data = data[k:]
+	}
+	return nil
+}
+
+// Erase erases the pages, all of the flash if pages is nil. It uses
+// the extended erase when the bootloader has it.
+func (p *Programmer) Erase(pages []uint16) error {
+	if p.cmds == nil {
+		if _, _, err := p.Get(); err != nil {
+			return err
+		}
+	}
+	if !p.Has(CMD_EXT_ERASE) {
+		if err := p.command(CMD_ERASE); err != nil {
+			return err
+		}
+		if pages == nil {
+			return p.send(ERASE_TIMEOUT, 0xff, 0x00)
+		}
+		b := []byte{byte(len(pages) - 1)}
+		for _, pg := range pages {
+			b = append(b, byte(pg))
+		}
+		return p.sendSum(ERASE_TIMEOUT, b...)
+	}
+	if err := p.command(CMD_EXT_ERASE); err != nil {
+		return err
+	}
+	if pages == nil {
+		return p.sendSum(ERASE_TIMEOUT, MASS_ERASE>>8, MASS_ERASE&0xff)
+	}
+	n := len(pages) - 1
+	b := []byte{byte(n >> 8), byte(n)}
+	for _, pg := range pages {
+		b = append(b, byte(pg>>8), byte(pg))
+	}
+	return p.sendSum(ERASE_TIMEOUT, b...)
+}
+
+// Go starts the code whose vector table is at addr.
+func (p *Programmer) Go(addr uint32) error {
+	if err := p.command(CMD_GO); err != nil {
+		return err
+	}
+	return p.address(addr)
+}
+
+// Flash mass erases the chip, writes and verifies m and starts it
+// from its lowest address. It returns the product ID.
+func Flash(l *link.Link, m *fwimage.Image, o *Options) (uint16, error) {
+	p := New(l, o)
+	if err := p.Init(); err != nil {
+		return 0, err
+	}
+	if _, _, err := p.Get(); err != nil {
+		return 0, err
+	}
+	pid, err := p.GetID()
+	if err != nil {
+		return 0, err
+	}
+	if err := p.Erase(nil); err != nil {
+		return pid, err
+	}
+	// whole blocks, the gaps are erased anyway
+	blocks := m.Pages(BLOCK_SIZE, FLASH_FILL)
+	var n int64
+	for _, b := range blocks {
+		if err := p.Write(b.Addr, b.Data); err != nil {
+			return pid, err
+		}
+		n += int64(m.Count(b.Addr, b.End()))
+		p.o.progress(n)
+	}
+	for _, b := range blocks {
+		r, err := p.Read(b.Addr, len(b.Data))
+		if err != nil {
+			return pid, err
+		}
+		for i := range r {
+			if r[i] != b.Data[i] {
+				return pid, fmt.Errorf("stm32: verify error at 0x%08x: 0x%02x, want 0x%02x",
+					b.Addr+uint32(i), r[i], b.Data[i])
+			}
+		}
+		n += int64(m.Count(b.Addr, b.End()))
+		p.o.progress(n)
+	}
+	lo, _ := m.Bounds()
+	return pid, p.Go(lo)
+}
@@ -0,0 +1,180 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package stm32
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"termzero/fwimage"
+	"termzero/link"
+	"termzero/sers/serstest"
+)
+
+// serve runs tg on a virtual port pair and returns a programmer for
+// it, and a channel with the end of Serve. The caller closes a.
+func serve(t *testing.T, tg *Target) (p *Programmer, a *serstest.Port, done chan error) {
+	t.Helper()
+	a, b := serstest.Pair(serstest.Options{})
+	done = make(chan error, 1)
+	go func() {
+		done <- tg.Serve(b)
+		b.Close()
+	}()
+	p = New(link.New(a), &Options{Timeout: 500 * time.Millisecond})
+	if err := p.Init(); err != nil {
+		a.Close()
+		t.Fatal(err)
+	}
+	return p, a, done
+}
+
+func TestGet(t *testing.T) {
+	tg := NewTarget(0x410, 64<<10, 1024)
+	p, a, done := serve(t, tg)
+	// the baud rate is known now, the bootloader NACKs and that's fine
+	if err := p.Init(); err != nil {
+		t.Errorf("second Init: %v", err)
+	}
+	v, cmds, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 0x31 || len(cmds) != 7 || !p.Has(CMD_EXT_ERASE) || p.Has(CMD_ERASE) {
+		t.Errorf("Get: version %#x, commands % x", v, cmds)
+	}
+	pid, err := p.GetID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != 0x410 || ChipName(pid) != "STM32F10x medium-density" {
+		t.Errorf("GetID: 0x%03x, %s", pid, ChipName(pid))
+	}
+	if ChipName(0x999) != "STM32 with ID 0x999" {
+		t.Errorf("unknown chip: %s", ChipName(0x999))
+	}
+	a.Close()
+	if err := <-done; err != io.EOF {
+		t.Errorf("target: %v", err)
+	}
+}
+
+func TestFlash(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		tg := NewTarget(0x410, 64<<10, 1024)
+		tg.Legacy = legacy
+		tg.Flash[0x8000] = 0 // some old code
+		m := &fwimage.Image{}
+		code := bytes.Repeat([]byte{0x00, 0x20, 0x00, 0x20, 0x01, 0x01}, 100) // 600 bytes, 3 blocks
+		m.Write(FLASH_BASE+0x1100, code)
+		m.Write(FLASH_BASE+0x4003, []byte{1, 2, 3, 4, 5})
+		var progress int64
+		o := &Options{Timeout: 500 * time.Millisecond, Progress: func(n int64) { progress = n }}
+
+		a, b := serstest.Pair(serstest.Options{})
+		done := make(chan error, 1)
+		go func() { done <- tg.Serve(b) }()
+		pid, err := Flash(link.New(a), m, o)
+		a.Close()
+		if err != nil {
+			t.Errorf("legacy %v: %v", legacy, err)
+			continue
+		}
+		if err := <-done; err != nil {
+			t.Errorf("legacy %v: the target didn't start the code: %v", legacy, err)
+		}
+		if pid != 0x410 {
+			t.Errorf("legacy %v: product ID 0x%03x", legacy, pid)
+		}
+		if tg.GoAddr != FLASH_BASE+0x1100 {
+			t.Errorf("legacy %v: started at 0x%08x, want the lowest address", legacy, tg.GoAddr)
+		}
+		if progress != 2*int64(m.Len()) {
+			t.Errorf("legacy %v: progress %d, want %d written plus verified", legacy, progress, 2*m.Len())
+		}
+		if !bytes.Equal(tg.Flash[0x1100:0x1100+len(code)], code) {
+			t.Errorf("legacy %v: the code didn't make it", legacy)
+		}
+		if got := tg.Flash[0x4000:0x4009]; !bytes.Equal(got, []byte{0xff, 0xff, 0xff, 1, 2, 3, 4, 5, 0xff}) {
+			t.Errorf("legacy %v: at 0x4000: % x", legacy, got)
+		}
+		if tg.Flash[0x8000] != FLASH_FILL || tg.Flash[0x2000] != FLASH_FILL {
+			t.Errorf("legacy %v: the chip wasn't erased or the gap written", legacy)
+		}
+	}
+}
+
+func TestErasePages(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		tg := NewTarget(0x410, 8<<10, 1024)
+		tg.Legacy = legacy
+		for i := range tg.Flash {
+			tg.Flash[i] = 0
+		}
+		p, a, done := serve(t, tg)
+		if err := p.Erase([]uint16{1, 3}); err != nil {
+			t.Errorf("legacy %v: %v", legacy, err)
+		}
+		a.Close()
+		<-done
+		for pg := 0; pg < 8; pg++ {
+			want := byte(0)
+			if pg == 1 || pg == 3 {
+				want = FLASH_FILL
+			}
+			if tg.Flash[pg*1024] != want || tg.Flash[pg*1024+1023] != want {
+				t.Errorf("legacy %v: page %d has 0x%02x", legacy, pg, tg.Flash[pg*1024])
+			}
+		}
+	}
+}
+
+func TestNACK(t *testing.T) {
+	tg := NewTarget(0x410, 8<<10, 1024)
+	tg.Legacy = true
+	p, a, done := serve(t, tg)
+	defer func() {
+		a.Close()
+		<-done
+	}()
+	if _, _, err := p.Get(); err != nil {
+		t.Fatal(err)
+	}
+	// the extended erase isn't there
+	if err := p.command(CMD_EXT_ERASE); err != ErrNACK {
+		t.Errorf("extended erase on the legacy bootloader: got %v, want %v", err, ErrNACK)
+	}
+	err := p.Write(FLASH_BASE+2, []byte{1, 2, 3, 4})
+	if err == nil || err.Error() != "stm32: command refused at 0x08000002" {
+		t.Errorf("unaligned write: got %v", err)
+	}
+	if _, err := p.Read(FLASH_BASE+8<<10-4, 8); err == nil || !strings.HasPrefix(err.Error(), ErrNACK.Error()) {
+		t.Errorf("read past the flash: got %v", err)
+	}
+	if err := p.Go(0x20000000); err != ErrNACK {
+		t.Errorf("Go to RAM: got %v, want %v", err, ErrNACK)
+	}
+	// the bootloader still answers
+	if _, err := p.GetID(); err != nil {
+		t.Errorf("GetID after the NACKs: %v", err)
+	}
+}
+
+func TestNoBootloader(t *testing.T) {
+	a, b := serstest.Pair(serstest.Options{})
+	defer a.Close()
+	defer b.Close()
+	m := &fwimage.Image{}
+	m.Write(FLASH_BASE, []byte{0})
+	_, err := Flash(link.New(a), m, &Options{Retries: 2, Timeout: 100 * time.Millisecond})
+	if err != ErrNoSync {
+		t.Errorf("got %v, want %v", err, ErrNoSync)
+	}
+}
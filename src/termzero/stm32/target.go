@@ -0,0 +1,251 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package stm32
+
+import (
+	"bufio"
+	"io"
+
+	"termzero/cksum"
+)
+
+// Target emulates the bootloader, for trying the programmer on a pty
+// or a loopback without an STM32 at hand. Like flash, writes can only
+// clear bits.
+type Target struct {
+	PID      uint16
+	Flash    []byte // at FLASH_BASE
+	PageSize int    // erase unit
+	Legacy   bool   // offers the old erase instead of the extended one
+	GoAddr   uint32 // set by Go
+}
+
+func NewTarget(pid uint16, size, page int) *Target {
+	t := &Target{PID: pid, Flash: make([]byte, size), PageSize: page}
+	t.erase(0, size)
+	return t
+}
+
+func (t *Target) erase(off, n int) {
+	for i := off; i < off+n && i < len(t.Flash); i++ {
+		t.Flash[i] = FLASH_FILL
+	}
+}
+
+// mem returns the flash at addr, nil if it isn't all inside.
+func (t *Target) mem(addr uint32, n int) []byte {
+	if addr < FLASH_BASE || int(addr-FLASH_BASE)+n > len(t.Flash) {
+		return nil
+	}
+	return t.Flash[addr-FLASH_BASE : int(addr-FLASH_BASE)+n]
+}
+
+// Serve answers the commands read from rw until the programmer sends
+// Go, it returns nil then.
+func (t *Target) Serve(rw io.ReadWriter) error {
+	r := bufio.NewReader(rw)
+	ack := func() { rw.Write([]byte{ACK}) }
+	nack := func() { rw.Write([]byte{NACK}) }
+	// get reads n bytes and the xor checksum, including extra in it.
+	get := func(n int, extra ...byte) ([]byte, bool, error) {
+		b := make([]byte, n+1)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, false, err
+		}
+		ok := cksum.Xor8(append(extra, b...)) == 0
+		return b[:n], ok, nil
+	}
+	address := func() (uint32, bool, error) {
+		b, ok, err := get(4)
+		if err != nil || !ok {
+			return 0, false, err
+		}
+		return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]), true, nil
+	}
+	inited := false
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if !inited {
+			if c == INIT {
+				inited = true
+				ack()
+			}
+			continue
+		}
+		if c == INIT {
+			// measured the baud rate already
+			nack()
+			continue
+		}
+		x, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if x != ^c {
+			nack()
+			continue
+		}
+		switch c {
+		case CMD_GET:
+			cmds := []byte{CMD_GET, CMD_GET_VERSION, CMD_GET_ID, CMD_READ,
+				CMD_GO, CMD_WRITE, CMD_EXT_ERASE}
+			if t.Legacy {
+				cmds[len(cmds)-1] = CMD_ERASE
+			}
+			ack()
+			rw.Write(append([]byte{byte(len(cmds)), 0x31}, cmds...))
+			ack()
+		case CMD_GET_ID:
+			ack()
+			rw.Write([]byte{1, byte(t.PID >> 8), byte(t.PID)})
+			ack()
+		case CMD_READ:
+			ack()
+			addr, ok, err := address()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				nack()
+				continue
+			}
+			ack()
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return err
+			}
+			m := t.mem(addr, int(b[0])+1)
+			if b[1] != ^b[0] || m == nil {
+				nack()
+				continue
+			}
+			ack()
+			rw.Write(m)
+		case CMD_WRITE:
+			ack()
+			addr, ok, err := address()
+			if err != nil {
+				return err
+			}
+			if !ok || addr%4 != 0 {
+				nack()
+				continue
+			}
+			ack()
+			n, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			data, ok, err := get(int(n)+1, n)
+			if err != nil {
+				return err
+			}
+			m := t.mem(addr, len(data))
+			if !ok || m == nil || len(data)%4 != 0 {
+				nack()
+				continue
+			}
+			for i, b := range data {
+				m[i] &= b
+			}
+			ack()
+		case CMD_ERASE, CMD_EXT_ERASE:
+			if (c == CMD_ERASE) != t.Legacy {
+				nack()
+				continue
+			}
+			ack()
+			if err := t.serveErase(r, c, get); err != nil {
+				if err == ErrNACK {
+					nack()
+					continue
+				}
+				return err
+			}
+			ack()
+		case CMD_GO:
+			ack()
+			addr, ok, err := address()
+			if err != nil {
+				return err
+			}
+			if !ok || t.mem(addr, 8) == nil {
+				nack()
+				continue
+			}
+			ack()
+			t.GoAddr = addr
+			return nil
+		default:
+			nack()
+		}
+	}
+}
+
+func (t *Target) serveErase(r *bufio.Reader, c byte,
+	get func(n int, extra ...byte) ([]byte, bool, error)) error {
+
+	var pages []int
+	if c == CMD_ERASE {
+		n, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if n == 0xff {
+			// global erase, the checksum is 0
+			if x, err := r.ReadByte(); err != nil {
+				return err
+			} else if x != 0 {
+				return ErrNACK
+			}
+			t.erase(0, len(t.Flash))
+			return nil
+		}
+		b, ok, err := get(int(n)+1, n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrNACK
+		}
+		for _, pg := range b {
+			pages = append(pages, int(pg))
+		}
+	} else {
+		h := make([]byte, 2)
+		if _, err := io.ReadFull(r, h); err != nil {
+			return err
+		}
+		if n := int(h[0])<<8 | int(h[1]); n == MASS_ERASE {
+			if x, err := r.ReadByte(); err != nil {
+				return err
+			} else if x != h[0]^h[1] {
+				return ErrNACK
+			}
+			t.erase(0, len(t.Flash))
+			return nil
+		} else {
+			b, ok, err := get(2*(n+1), h...)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return ErrNACK
+			}
+			for i := 0; i < len(b); i += 2 {
+				pages = append(pages, int(b[i])<<8|int(b[i+1]))
+			}
+		}
+	}
+	for _, pg := range pages {
+		t.erase(pg*t.PageSize, t.PageSize)
+	}
+	return nil
+}
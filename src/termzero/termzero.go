@@ -19,8 +19,23 @@ import (
 	"os"
 	//"os/exec"
 	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"termzero/cksum"
+	"termzero/display"
+	"termzero/filter"
+	"termzero/input"
+	"termzero/logfile"
+	"termzero/netser"
+	"termzero/paced"
+	"termzero/pcapng"
+	"termzero/script"
 	"termzero/sers"
+	"termzero/stamp"
+	"termzero/zmodem"
 )
 
 const (
@@ -34,18 +49,295 @@ const (
 	handshake uint32 = sers.NO_HANDSHAKE
 )
 
+// session is the state shared by the keyboard loop, the port reader
+// and the escape menu.
+type session struct {
+	dev   string
+	port  sers.SerialPort
+	mode  sers.Mode
+	esc   byte // escape key, 0 if the menu is disabled
+	log   *logfile.Log
+	txlog *logfile.Log // the sent data, nil if not logged
+
+	tx   io.Writer // output to the port, translated and echoed
+	raw  io.Writer // output to the port as is
+	pace paced.Options
+	echo *filter.Echo
+	imap filter.Map
+	omap filter.Map
+	in   input.Mode // keyboard input mode
+	ck   cksum.Kind // checksum appended in the hex and escape modes
+
+	mu   sync.Mutex // guards the terminal output
+	w    *bufio.Writer
+	disp *display.Writer
+	st   *stamp.Stamper
+	ts   *stamp.Writer // stamps received data, writes to disp
+	xfer *xfer         // running transfer
+
+	zdir    string           // ZMODEM downloads
+	zresume bool             // resume interrupted ZMODEM transfers
+	zauto   *zmodem.Detector // nil without ZMODEM auto-start
+}
+
+// print writes a termzero message to the terminal.
+func (s *session) print(a ...interface{}) {
+	s.mu.Lock()
+	fmt.Fprint(s.w, a...)
+	s.w.Flush()
+	s.mu.Unlock()
+}
+
+func (s *session) printf(format string, a ...interface{}) {
+	s.print(fmt.Sprintf(format, a...))
+}
+
+// show writes b received from (or echoed to) the port to the terminal.
+func (s *session) show(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.disp.Write(b)
+	s.w.Flush()
+	return err
+}
+
+// showAt shows b received from the port at t.
+func (s *session) showAt(b []byte, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ts.Chunk = s.disp.Mode() != display.RAW
+	_, err := s.ts.WriteAt(b, t)
+	s.w.Flush()
+	return err
+}
+
+// Write shows p on the terminal, it is the local echo sink.
+func (s *session) Write(p []byte) (int, error) {
+	if err := s.show(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// atExit functions restore the terminal, close logs and the like.
+var atExit []func()
+
+// exit runs the atExit functions, last first, and leaves.
+func exit(code int) {
+	for i := len(atExit) - 1; i >= 0; i-- {
+		atExit[i]()
+	}
+	os.Exit(code)
+}
+
 func main() {
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "daemon":
+			os.Exit(daemonMain(os.Args[2:]))
+		case "attach":
+			os.Exit(attachMain(os.Args[2:]))
+		case "simulate":
+			os.Exit(simulateMain(os.Args[2:]))
+		}
+	}
+
+	var port_flag *string = flag.String("port", "", "Serial port device or rfc2217://host:port, the first of the usual ones if empty")
 	var baudrate_flag *uint = flag.Uint("b", defBaudrate, "Baud rate")
+	var esc_flag *string = flag.String("e", "a", "Escape key is ctrl+<key>, empty disables the menu")
+	var echo_flag *bool = flag.Bool("echo", false, "Local echo")
+	var imap_flag *string = flag.String("imap", "", "Input (from port) map: crlf,crcrlf,lfcr,lfcrlf,igncr,ignlf,delbs,bsdel")
+	var omap_flag *string = flag.String("omap", "", "Output (to port) map, as -imap")
+	var disp_flag *string = flag.String("display", "raw", "Display mode: raw, hex, mixed, caret or c")
+	var in_flag *string = flag.String("input", "text", "Input mode: text, hex (01 03 0A) or esc (\\x02STATUS\\r)")
+	var ck_flag *string = flag.String("cksum", "none", "Checksum appended in the hex and esc input modes: none, sum, xor, crc8 or modbus")
+	var ts_flag *string = flag.String("ts", "none", "Timestamp received lines: none, abs, rel or delta")
+	var tsus_flag *bool = flag.Bool("tsus", false, "Timestamps with microseconds")
+	var log_flag *string = flag.String("log", "", "Log the raw received data to a file named by the template, e.g. {dev}-{date}-{time}.log")
+	var logtx_flag *bool = flag.Bool("logtx", false, "Log the sent data as well, to the log's name with .tx before the extension")
+	var logsize_flag *string = flag.String("logsize", "0", "Rotate the log at that size, e.g. 10M")
+	var logage_flag *time.Duration = flag.Duration("logage", 0, "Rotate the log after that time, e.g. 24h")
+	var loggz_flag *bool = flag.Bool("loggz", false, "Gzip the rotated logs")
+	var capture_flag *string = flag.String("capture", "", "Capture the traffic with its timing to a file")
+	var replay_flag *string = flag.String("replay", "", "Replay a capture file")
+	var replayto_flag *string = flag.String("replayto", "port", "Replay to the port or the display")
+	var replaydir_flag *string = flag.String("replaydir", "", "Direction to replay: rx, tx or rx,tx; default tx to the port, rx to the display")
+	var replayscale_flag *float64 = flag.Float64("replayscale", 1, "Scale the replay timing, 0 is as fast as possible")
+	var pcap_flag *string = flag.String("pcap", "", "Write the traffic to a pcapng file for Wireshark")
+	var pcapgap_flag *time.Duration = flag.Duration("pcapgap", 10*time.Millisecond, "Split pcapng packets on idle gaps that long")
+	var pcaplink_flag *uint = flag.Uint("pcaplink", pcapng.LINKTYPE_USER0, "pcapng link type")
+	var send_flag *string = flag.String("send", "", "Send a file paced by the options below")
+	var cd_flag *time.Duration = flag.Duration("chardelay", 0, "Delay after every character sent from a file")
+	var ld_flag *time.Duration = flag.Duration("linedelay", 0, "Delay after every line sent from a file")
+	var prompt_flag *string = flag.String("prompt", "", "Wait for the prompt after every line sent from a file, C escapes allowed")
+	var waitecho_flag *bool = flag.Bool("waitecho", false, "Wait for the echo of every line sent from a file")
+	var waittimeout_flag *time.Duration = flag.Duration("waittimeout", 5*time.Second, "Timeout for -prompt and -waitecho")
+	var zdir_flag *string = flag.String("zdir", ".", "Directory for ZMODEM downloads")
+	var zauto_flag *bool = flag.Bool("zauto", true, "Start a ZMODEM download when the peer runs sz")
+	var zresume_flag *bool = flag.Bool("zresume", false, "Resume interrupted ZMODEM transfers")
+	var pty_flag *string = flag.String("pty", "", "Expose the port on a pseudo-terminal symlinked at the path, e.g. /tmp/ttyV0, instead of the terminal")
+	var listen_flag *string = flag.String("listen", "", "Serve the port on a TCP address, e.g. :2000, instead of the terminal")
+	var netmode_flag *string = flag.String("netmode", "raw", "Server mode: raw, telnet or rfc2217")
+	var writers_flag *string = flag.String("writers", "all", "Server clients that write to the port: all, first (the others read) or one (at a time)")
+	var idle_flag *time.Duration = flag.Duration("idle", 0, "Drop server clients idle that long")
+	var allow_flag *string = flag.String("allow", "", "Server clients allowed, e.g. 127.0.0.1,192.168.1.0/24; all if empty")
+	var bridge_flag *string = flag.String("bridge", "", "Bridge the port to a second one and show both directions, instead of the terminal")
+	var bridgemode_flag *string = flag.String("bridgemode", "", "Mode of the second port, e.g. 9600,8E1; that of the first if empty")
+	var color_flag *bool = flag.Bool("color", true, "Color the directions of a bridge on a terminal")
+	var script_flag *string = flag.String("script", "", "Run an expect script on the port instead of the terminal, exit with its status")
 	flag.Parse()
 	baudrate := uint32(*baudrate_flag)
 
-	fmt.Print("termzero v1.1 - ")
+	imap, err := filter.ParseMap(*imap_flag)
+	if err != nil {
+		fmt.Println("Fatal: -imap:", err)
+		os.Exit(1)
+	}
+	omap, err := filter.ParseMap(*omap_flag)
+	if err != nil {
+		fmt.Println("Fatal: -omap:", err)
+		os.Exit(1)
+	}
+
+	dm, err := display.ParseMode(*disp_flag)
+	if err != nil {
+		fmt.Println("Fatal: -display:", err)
+		os.Exit(1)
+	}
+
+	in, err := input.ParseMode(*in_flag)
+	if err != nil {
+		fmt.Println("Fatal: -input:", err)
+		os.Exit(1)
+	}
+	ck, err := cksum.ParseKind(*ck_flag)
+	if err != nil {
+		fmt.Println("Fatal: -cksum:", err)
+		os.Exit(1)
+	}
+
+	tsm, err := stamp.ParseMode(*ts_flag)
+	if err != nil {
+		fmt.Println("Fatal: -ts:", err)
+		os.Exit(1)
+	}
+
+	logsize, err := logfile.ParseSize(*logsize_flag)
+	if err != nil {
+		fmt.Println("Fatal: -logsize:", err)
+		os.Exit(1)
+	}
+
+	prompt, err := input.Unescape(*prompt_flag)
+	if err != nil {
+		fmt.Println("Fatal: -prompt:", err)
+		os.Exit(1)
+	}
+
+	netmode, err := netser.ParseMode(*netmode_flag)
+	if err != nil {
+		fmt.Println("Fatal: -netmode:", err)
+		os.Exit(1)
+	}
+	writers, err := netser.ParsePolicy(*writers_flag)
+	if err != nil {
+		fmt.Println("Fatal: -writers:", err)
+		os.Exit(1)
+	}
+	allow, err := netser.ParseAllow(*allow_flag)
+	if err != nil {
+		fmt.Println("Fatal: -allow:", err)
+		os.Exit(1)
+	}
+
+	// each of them takes the place of the terminal
+	var instead []string
+	for _, f := range []struct{ name, v string }{
+		{"-listen", *listen_flag}, {"-pty", *pty_flag},
+		{"-bridge", *bridge_flag}, {"-script", *script_flag},
+	} {
+		if f.v != "" {
+			instead = append(instead, f.name)
+		}
+	}
+	if len(instead) > 1 {
+		fmt.Println("Fatal: use one of", strings.Join(instead, ", "))
+		os.Exit(1)
+	}
+
+	var sc *script.Script
+	if *script_flag != "" {
+		f, err := os.Open(*script_flag)
+		if err != nil {
+			fmt.Println("Fatal: script:", err)
+			os.Exit(1)
+		}
+		sc, err = script.Parse(f, *script_flag)
+		f.Close()
+		if err != nil {
+			fmt.Println("Fatal: script:", err)
+			os.Exit(1)
+		}
+	}
+
+	var replay *replay
+	if *replay_flag != "" {
+		replay, err = openReplay(*replay_flag, *replayto_flag,
+			*replaydir_flag, *replayscale_flag)
+		if err != nil {
+			fmt.Println("Fatal: replay:", err)
+			os.Exit(1)
+		}
+	}
 
 	r := bufio.NewReader(os.Stdin)
 	w := bufio.NewWriter(os.Stdout)
 
-	pd := findSerialPortDevice()
+	s := &session{
+		mode: sers.Mode{
+			Baudrate:  baudrate,
+			Databits:  databits,
+			Parity:    parity,
+			Stopbits:  stopbits,
+			Handshake: handshake,
+		},
+		imap: imap,
+		omap: omap,
+		in:   in,
+		ck:   ck,
+		w:    w,
+		disp: display.NewWriter(w, dm),
+		st:   stamp.NewStamper(tsm, *tsus_flag, time.Now()),
+		pace: paced.Options{
+			CharDelay: *cd_flag,
+			LineDelay: *ld_flag,
+			Echo:      *waitecho_flag,
+			Prompt:    prompt,
+			Timeout:   *waittimeout_flag,
+		},
+		zdir:    *zdir_flag,
+		zresume: *zresume_flag,
+	}
+	if *zauto_flag {
+		s.zauto = &zmodem.Detector{}
+	}
+	s.ts = stamp.NewWriter(s.disp, w, s.st)
+
+	if replay != nil && !replay.toPort {
+		if err = replay.run(s, filter.NewWriter(rxWriter{s}, imap)); err != nil {
+			fmt.Println("Fatal: replay:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	fmt.Print("termzero v1.1 - ")
+
+	pd := *port_flag
+	if pd == "" {
+		pd = findSerialPortDevice()
+	}
 	fmt.Print(pd, " - ")
 	port, err := sers.Open(pd)
 	//port, err := os.Open(pd)
@@ -59,11 +351,71 @@ func main() {
 	bi, bo := port.Baudrate()
 	fmt.Printf("baudrate (i/o): %d %d\n", bo, bi)
 
-	err = port.SetMode(baudrate, databits, parity, stopbits, handshake)
+	s.dev, s.port = pd, port
+	err = s.mode.Apply(port)
 	if err != nil {
 		fmt.Println("Fatal: setup serial port:", err)
 	}
 
+	if *capture_flag != "" {
+		tap, err := openCapture(*capture_flag, pd, &s.mode, port)
+		if err != nil {
+			fmt.Println("Fatal: capture:", err)
+			os.Exit(1)
+		}
+		port = tap
+	}
+
+	if *pcap_flag != "" {
+		tap, err := openPcap(*pcap_flag, pd, &s.mode, *pcapgap_flag,
+			*pcaplink_flag, port)
+		if err != nil {
+			fmt.Println("Fatal: pcapng:", err)
+			os.Exit(1)
+		}
+		port = tap
+	}
+
+	var rx io.Reader = port
+	var tx io.Writer = port
+	if *log_flag != "" {
+		lc := logfile.Config{
+			Template: *log_flag,
+			Dev:      pd,
+			MaxSize:  logsize,
+			MaxAge:   *logage_flag,
+			Gzip:     *loggz_flag,
+			Header:   s.logHeader(false),
+		}
+		s.log, err = logfile.Open(lc)
+		if err != nil {
+			fmt.Println("Fatal: log:", err)
+			os.Exit(1)
+		}
+		atExit = append(atExit, func() { s.log.Close() })
+		fmt.Println("logging to", s.log.Name())
+		// a bridge logs both directions as it shows them
+		if *bridge_flag == "" {
+			rx = io.TeeReader(port, s.log)
+		}
+		// what goes through a pty is logged both ways, the sent data
+		// to a file of its own
+		if (*logtx_flag || *pty_flag != "") && *bridge_flag == "" {
+			lc.Template, lc.Header = txTemplate(lc.Template), s.logHeader(true)
+			s.txlog, err = logfile.Open(lc)
+			if err != nil {
+				fmt.Println("Fatal: log:", err)
+				os.Exit(1)
+			}
+			atExit = append(atExit, func() { s.txlog.Close() })
+			fmt.Println("logging the sent data to", s.txlog.Name())
+			tx = io.MultiWriter(port, s.txlog)
+		}
+	}
+	s.raw = tx
+	s.echo = filter.NewEcho(tx, s, *echo_flag)
+	s.tx = filter.NewWriter(s.echo, omap)
+
 	// done by setting raw
 	if false {
 		//                     min / time-out
@@ -78,45 +430,220 @@ func main() {
 		fmt.Printf("set baudrate to (i/o): %d %d\n", bo2, bi2)
 	}
 
-	go readFromPort(w, port)
+	if *listen_flag != "" {
+		err = serve(*listen_flag, netser.Config{
+			Mode:    netmode,
+			Writers: writers,
+			Idle:    *idle_flag,
+			Allow:   allow,
+			Port:    port,
+			Line:    s.mode,
+		}, rx, tx)
+		if err != nil {
+			fmt.Println("Fatal: server:", err)
+			exit(1)
+		}
+		exit(0)
+	}
 
-	for {
-		b, err := r.ReadBytes('\n')
+	if *pty_flag != "" {
+		if err = exposePty(*pty_flag, s.mode, port, rx, tx); err != nil {
+			fmt.Println("Fatal: pty:", err)
+			exit(1)
+		}
+		exit(0)
+	}
+
+	if *bridge_flag != "" {
+		if err = runBridge(s, port, *bridge_flag, *bridgemode_flag, dm,
+			tsm, *tsus_flag, *color_flag); err != nil {
+			fmt.Println("Fatal: bridge:", err)
+			exit(1)
+		}
+		exit(0)
+	}
+
+	if sc != nil {
+		exit(runScript(s, sc, *script_flag, port, rx, tx))
+	}
+
+	if *esc_flag != "" && isTerminal(os.Stdin) {
+		restore, err := makeRaw(os.Stdin)
 		if err != nil {
+			fmt.Println("Fatal: stdio raw mode:", err)
+			os.Exit(1)
+		}
+		atExit = append(atExit, restore)
+		s.esc = (*esc_flag)[0] & 0x1f
+		fmt.Printf("escape key is ctrl+%c, ctrl+%c h for help\n",
+			(*esc_flag)[0], (*esc_flag)[0])
+	}
+
+	go readFromPort(s, rx)
+
+	if replay != nil {
+		// raw to the port, no output map and no echo
+		go func() {
+			if err := replay.run(s, tx); err != nil {
+				s.print("\n*** replay: ", err, "\n")
+				return
+			}
+			s.print("\n*** replay done\n")
+		}()
+	}
+
+	if *send_flag != "" {
+		if err = s.sendFile(*send_flag, s.pace); err != nil {
+			fmt.Println("Fatal: send:", err)
+			exit(1)
+		}
+	}
+
+	b := make([]byte, 0, 256)
+	for {
+		if x := s.running(); x != nil {
+			if _, err = r.ReadByte(); err == nil {
+				if s.running() == x {
+					x.stop()
+				} else {
+					// the transfer ended meanwhile, the key is input
+					err = r.UnreadByte()
+				}
+			}
+		} else if s.in != input.TEXT {
+			err = s.sendLine(r)
+		} else {
+			err = s.sendKeys(r, b)
+		}
+		if err == io.EOF {
 			fmt.Println("Fatal: stdio read:", err)
 			// ctrl+d -> EOF
-			os.Exit(0)
+			exit(0)
 		}
-		_, err = port.Write(b)
 		if err != nil {
-			fmt.Println("Fatal: port write:", err)
-			os.Exit(1)
+			fmt.Println("Fatal:", err)
+			exit(1)
 		}
 	}
 
 }
 
-func readFromPort(w *bufio.Writer, rp io.Reader) {
-	b := make([]byte, 256)
-	n, err := rp.Read(b)
+// logHeader starts every log file.
+func (s *session) logHeader(tx bool) string {
+	dir := "received"
+	if tx {
+		dir = "sent"
+	}
+	return fmt.Sprintf("# termzero log {start} port %s mode %s, %s data\n", s.dev, &s.mode, dir)
+}
+
+// txTemplate names the log of the sent data after that of the
+// received, with ".tx" before the extension.
+func txTemplate(t string) string {
+	ext := filepath.Ext(t)
+	if strings.ContainsAny(ext, "{}") {
+		ext = ""
+	}
+	return t[:len(t)-len(ext)] + ".tx" + ext
+}
+
+// sendKeys sends the next keys typed, the escape key opens the menu.
+func (s *session) sendKeys(r *bufio.Reader, b []byte) error {
+	c, err := r.ReadByte()
 	if err != nil {
-		fmt.Println("Fatal: port read:", err)
-		os.Exit(1)
+		return err
 	}
-	b2 := b[:n]
-	for {
-		//w.Write([]byte("."))
-		_, err = w.Write(b2)
+	if s.esc != 0 && c == s.esc {
+		return s.menu(r)
+	}
+	// take whatever else is already there, up to the next escape
+	b = append(b[:0], c)
+	for r.Buffered() > 0 {
+		c, _ = r.ReadByte()
+		if s.esc != 0 && c == s.esc {
+			r.UnreadByte()
+			break
+		}
+		b = append(b, c)
+	}
+	return s.send(b)
+}
+
+// sendLine reads a line in the hex or escape input mode and sends
+// the parsed bytes with the checksum appended.
+func (s *session) sendLine(r *bufio.Reader) error {
+	var line string
+	if s.esc != 0 {
+		s.printf("%s> ", s.in)
+		l, esc, err := s.readLine(r)
 		if err != nil {
-			fmt.Println("Fatal: stdio write:", err)
+			return err
+		}
+		if esc {
+			return s.menu(r)
 		}
-		w.Flush()
-		n, err = rp.Read(b)
+		line = l
+	} else {
+		l, err := r.ReadString('\n')
+		if l == "" && err != nil {
+			return err
+		}
+		line = strings.TrimRight(l, "\r\n")
+	}
+	b, err := input.Parse(s.in, line)
+	if err != nil {
+		s.print("*** ", err, "\n")
+		return nil
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	// a frame, the output map would break it and its checksum
+	return s.sendRaw(s.ck.Append(b))
+}
+
+// send writes b to the port through the output filters.
+func (s *session) send(b []byte) error {
+	if _, err := s.tx.Write(b); err != nil {
+		return fmt.Errorf("port write: %v", err)
+	}
+	return nil
+}
+
+// sendRaw writes b to the port unmapped, echoed if the echo is on.
+func (s *session) sendRaw(b []byte) error {
+	if _, err := s.echo.Write(b); err != nil {
+		return fmt.Errorf("port write: %v", err)
+	}
+	return nil
+}
+
+// readFromPort shows the received data, a running transfer gets it
+// untranslated.
+func readFromPort(s *session, rp io.Reader) {
+	b := make([]byte, 256)
+	var out []byte
+	for {
+		n, err := rp.Read(b)
+		t := time.Now()
 		if err != nil {
 			fmt.Println("Fatal: port read:", err)
-			os.Exit(1)
+			exit(1)
+		}
+		if x := s.running(); x != nil {
+			x.l.Feed(b[:n])
+			if !x.show {
+				continue
+			}
+		} else if k := s.autoStart(b[:n]); k >= 0 {
+			n = k
+		}
+		//w.Write([]byte("."))
+		out = s.imap.Translate(out[:0], b[:n])
+		err = s.showAt(out, t)
+		if err != nil {
+			fmt.Println("Fatal: stdio write:", err)
 		}
-		b2 = b[:n]
 	}
 }
 
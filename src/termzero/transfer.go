@@ -0,0 +1,564 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"termzero/fwimage"
+	"termzero/input"
+	"termzero/kermit"
+	"termzero/link"
+	"termzero/paced"
+	"termzero/xmodem"
+	"termzero/zmodem"
+)
+
+var errAborted = errors.New("aborted")
+
+// xfer is a transfer running in the background. While it runs it
+// gets the received data and any key aborts it.
+type xfer struct {
+	name  string
+	l     *link.Link
+	show  bool // keep showing the received data
+	abort chan struct{}
+	once  sync.Once
+}
+
+func (x *xfer) stop() {
+	x.once.Do(func() {
+		close(x.abort)
+		x.l.FeedError(errAborted)
+	})
+}
+
+// running returns the running transfer, if any.
+func (s *session) running() *xfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.xfer
+}
+
+// startTransfer runs fn in the background with a link fed by the
+// port reader and writing raw bytes to the port.
+func (s *session) startTransfer(name string, show bool,
+	fn func(l *link.Link, abort <-chan struct{}) error) error {
+
+	s.mu.Lock()
+	if s.xfer != nil {
+		s.mu.Unlock()
+		return cmdError(s.xfer.name + " is still running")
+	}
+	x := &xfer{
+		name:  name,
+		l:     link.NewFed(s.raw),
+		show:  show,
+		abort: make(chan struct{}),
+	}
+	s.xfer = x
+	s.mu.Unlock()
+	s.printf("*** %s, any key aborts\n", name)
+	go func() {
+		err := fn(x.l, x.abort)
+		s.mu.Lock()
+		s.xfer = nil
+		s.mu.Unlock()
+		// show what came after the end of the protocol
+		var rest [1024]byte
+		for {
+			n, _ := x.l.ReadTimeout(rest[:], 0)
+			if n == 0 {
+				break
+			}
+			s.showAt(s.imap.Translate(nil, rest[:n]), time.Now())
+		}
+		if err != nil {
+			s.printf("\n*** %s: %v\n", name, err)
+			return
+		}
+		s.printf("\n*** %s done\n", name)
+	}()
+	return nil
+}
+
+// progress returns a function printing the progress of a transfer
+// at most every other second.
+func (s *session) progress(name string, total int64) func(n int64) {
+	var last time.Time
+	return func(n int64) {
+		if time.Since(last) < 2*time.Second && n != total {
+			return
+		}
+		last = time.Now()
+		if total > 0 {
+			s.printf("\n*** %s %d/%d bytes %d%%\n", name, n, total, n*100/total)
+		} else {
+			s.printf("\n*** %s %d bytes\n", name, n)
+		}
+	}
+}
+
+// sendFile sends the file fn paced by o through the output map.
+func (s *session) sendFile(fn string, o paced.Options) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return cmdError(err.Error())
+	}
+	var total int64
+	if fi, err := f.Stat(); err == nil {
+		total = fi.Size()
+	}
+	name := "send " + fn
+	err = s.startTransfer(name, true, func(l *link.Link, abort <-chan struct{}) error {
+		defer f.Close()
+		o.Progress = s.progress(name, total)
+		o.Abort = abort
+		return paced.Send(s.tx, l, f, &o)
+	})
+	if err != nil {
+		f.Close()
+	}
+	return err
+}
+
+// cmdSend: send <file> [cd=<delay>] [ld=<delay>] [prompt=<string>]
+// [echo] [timeout=<duration>], the defaults come from the flags.
+func cmdSend(s *session, args []string) error {
+	if len(args) < 1 {
+		return cmdError("usage: send <file> [cd=10ms] [ld=100ms] [prompt=>] [echo] [timeout=5s]")
+	}
+	o := s.pace
+	for _, a := range args[1:] {
+		kv := strings.SplitN(a, "=", 2)
+		var err error
+		switch {
+		case a == "echo":
+			o.Echo = true
+		case len(kv) != 2:
+			return cmdError("bad option " + a)
+		case kv[0] == "cd":
+			o.CharDelay, err = time.ParseDuration(kv[1])
+		case kv[0] == "ld":
+			o.LineDelay, err = time.ParseDuration(kv[1])
+		case kv[0] == "timeout":
+			o.Timeout, err = time.ParseDuration(kv[1])
+		case kv[0] == "prompt":
+			var p []byte
+			p, err = input.Unescape(kv[1])
+			o.Prompt = p
+		default:
+			return cmdError("bad option " + a)
+		}
+		if err != nil {
+			return cmdError(a + ": " + err.Error())
+		}
+	}
+	return s.sendFile(args[0], o)
+}
+
+// cmdFW: fw <file> [bin|ihex|srec|titxt], a binary goes as is, the
+// text formats paced like send.
+func cmdFW(s *session, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return cmdError("usage: fw <file> [bin|ihex|srec|titxt]")
+	}
+	m, err := fwimage.Load(args[0])
+	if err != nil {
+		return cmdError(err.Error())
+	}
+	f := fwimage.BINARY
+	if len(args) == 2 {
+		if f, err = fwimage.ParseFormat(args[1]); err != nil {
+			return cmdError(err.Error())
+		}
+	}
+	var b bytes.Buffer
+	if err := fwimage.Write(&b, m, f, 0xff); err != nil {
+		return cmdError(err.Error())
+	}
+	name := fmt.Sprintf("send %s as %s", args[0], f)
+	progress := s.progress(name, int64(b.Len()))
+	if f != fwimage.BINARY {
+		o := s.pace
+		return s.startTransfer(name, true, func(l *link.Link, abort <-chan struct{}) error {
+			o.Progress = progress
+			o.Abort = abort
+			return paced.Send(s.tx, l, &b, &o)
+		})
+	}
+	data := b.Bytes()
+	return s.startTransfer(name, true, func(l *link.Link, abort <-chan struct{}) error {
+		for off := 0; off < len(data); {
+			select {
+			case <-abort:
+				return errAborted
+			default:
+			}
+			n := len(data) - off
+			if n > 1024 {
+				n = 1024
+			}
+			if _, err := l.Write(data[off : off+n]); err != nil {
+				return err
+			}
+			off += n
+			progress(int64(off))
+		}
+		return nil
+	})
+}
+
+// cmdSX: sx <file> [1k]
+func cmdSX(s *session, args []string) error {
+	if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "1k") {
+		return cmdError("usage: sx <file> [1k]")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return cmdError(err.Error())
+	}
+	var total int64
+	if fi, err := f.Stat(); err == nil {
+		total = fi.Size()
+	}
+	name := "xmodem send " + args[0]
+	o := &xmodem.Options{OneK: len(args) == 2, Progress: s.progress(name, total)}
+	err = s.startTransfer(name, false, func(l *link.Link, abort <-chan struct{}) error {
+		defer f.Close()
+		_, err := xmodem.Send(l, f, o)
+		return err
+	})
+	if err != nil {
+		f.Close()
+	}
+	return err
+}
+
+// cmdRX: rx <file> [sum]
+func cmdRX(s *session, args []string) error {
+	if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "sum") {
+		return cmdError("usage: rx <file> [sum]")
+	}
+	// don't truncate the file for a transfer that can't start
+	if x := s.running(); x != nil {
+		return cmdError(x.name + " is still running")
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return cmdError(err.Error())
+	}
+	name := "xmodem receive " + args[0]
+	o := &xmodem.Options{Checksum: len(args) == 2, Progress: s.progress(name, 0)}
+	err = s.startTransfer(name, false, func(l *link.Link, abort <-chan struct{}) error {
+		_, err := xmodem.Receive(l, f, o)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	if err != nil {
+		f.Close()
+	}
+	return err
+}
+
+// openFiles opens the files to send, all or none.
+func openFiles(names []string) ([]*os.File, []os.FileInfo, error) {
+	var files []*os.File
+	var infos []os.FileInfo
+	for _, fn := range names {
+		f, err := os.Open(fn)
+		if err == nil {
+			var fi os.FileInfo
+			if fi, err = f.Stat(); err == nil {
+				files = append(files, f)
+				infos = append(infos, fi)
+				continue
+			}
+			f.Close()
+		}
+		closeFiles(files)
+		return nil, nil, err
+	}
+	return files, infos, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// cmdSB: sb <file>...
+func cmdSB(s *session, args []string) error {
+	if len(args) < 1 {
+		return cmdError("usage: sb <file>...")
+	}
+	osf, infos, err := openFiles(args)
+	if err != nil {
+		return cmdError(err.Error())
+	}
+	var files []xmodem.File
+	var total int64
+	for i, f := range osf {
+		files = append(files, xmodem.File{
+			Name:    filepath.Base(f.Name()),
+			Size:    infos[i].Size(),
+			ModTime: infos[i].ModTime(),
+			R:       f,
+		})
+		total += infos[i].Size()
+	}
+	name := fmt.Sprintf("ymodem send %d files", len(files))
+	o := &xmodem.Options{OneK: true, Progress: s.progress(name, total)}
+	err = s.startTransfer(name, false, func(l *link.Link, abort <-chan struct{}) error {
+		defer closeFiles(osf)
+		_, err := xmodem.SendBatch(l, files, o)
+		return err
+	})
+	if err != nil {
+		closeFiles(osf)
+	}
+	return err
+}
+
+// cmdRB: rb [dir]
+func cmdRB(s *session, args []string) error {
+	if len(args) > 1 {
+		return cmdError("usage: rb [dir]")
+	}
+	dir := "."
+	if len(args) == 1 {
+		dir = args[0]
+	}
+	name := "ymodem receive to " + dir
+	o := &xmodem.Options{Progress: s.progress(name, 0)}
+	return s.startTransfer(name, false, func(l *link.Link, abort <-chan struct{}) error {
+		_, err := xmodem.ReceiveBatch(l, func(fn string, size int64) (io.WriteCloser, error) {
+			// no paths from the other side
+			fn = filepath.Join(dir, filepath.Base(fn))
+			w, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+			if os.IsExist(err) {
+				s.printf("\n*** skipping %s, exists\n", fn)
+				return nil, xmodem.ErrSkip
+			}
+			if err != nil {
+				return nil, err
+			}
+			s.printf("\n*** receiving %s %d bytes\n", fn, size)
+			return w, nil
+		}, o)
+		return err
+	})
+}
+
+// cmdSZ: sz <file>...
+func cmdSZ(s *session, args []string) error {
+	if len(args) < 1 {
+		return cmdError("usage: sz <file>...")
+	}
+	osf, infos, err := openFiles(args)
+	if err != nil {
+		return cmdError(err.Error())
+	}
+	var files []zmodem.File
+	var total int64
+	for i, f := range osf {
+		files = append(files, zmodem.File{
+			Name:    filepath.Base(f.Name()),
+			Size:    infos[i].Size(),
+			ModTime: infos[i].ModTime(),
+			Mode:    infos[i].Mode(),
+			R:       f,
+		})
+		total += infos[i].Size()
+	}
+	name := fmt.Sprintf("zmodem send %d files", len(files))
+	o := &zmodem.Options{Resume: s.zresume, Progress: s.progress(name, total)}
+	err = s.startTransfer(name, false, func(l *link.Link, abort <-chan struct{}) error {
+		defer closeFiles(osf)
+		_, err := zmodem.Send(l, files, o)
+		return err
+	})
+	if err != nil {
+		closeFiles(osf)
+	}
+	return err
+}
+
+// cmdRZ: rz [dir]
+func cmdRZ(s *session, args []string) error {
+	if len(args) > 1 {
+		return cmdError("usage: rz [dir]")
+	}
+	dir := s.zdir
+	if len(args) == 1 {
+		dir = args[0]
+	}
+	return s.zreceive(dir)
+}
+
+// zreceive starts a ZMODEM receive into dir.
+func (s *session) zreceive(dir string) error {
+	name := "zmodem receive to " + dir
+	o := &zmodem.Options{Resume: s.zresume, Progress: s.progress(name, 0)}
+	return s.startTransfer(name, false, func(l *link.Link, abort <-chan struct{}) error {
+		_, err := zmodem.Receive(l, func(f *zmodem.FileInfo) (io.WriteCloser, int64, error) {
+			return s.zcreate(dir, f)
+		}, o)
+		return err
+	})
+}
+
+// zcreate opens the file for f in dir. Existing files are skipped,
+// unless resuming continues a shorter one.
+func (s *session) zcreate(dir string, f *zmodem.FileInfo) (io.WriteCloser, int64, error) {
+	// no paths from the other side
+	fn := filepath.Join(dir, filepath.Base(f.Name))
+	if fi, err := os.Stat(fn); err == nil {
+		if !f.Resume || !fi.Mode().IsRegular() || f.Size >= 0 && fi.Size() >= f.Size {
+			s.printf("\n*** skipping %s, exists\n", fn)
+			return nil, 0, zmodem.ErrSkip
+		}
+		w, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		s.printf("\n*** resuming %s at %d of %d bytes\n", fn, fi.Size(), f.Size)
+		return mtimeFile{w, f.ModTime}, fi.Size(), nil
+	}
+	w, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.printf("\n*** receiving %s %d bytes\n", fn, f.Size)
+	return mtimeFile{w, f.ModTime}, 0, nil
+}
+
+// mtimeFile sets the modification time when closed.
+type mtimeFile struct {
+	*os.File
+	t time.Time
+}
+
+func (f mtimeFile) Close() error {
+	err := f.File.Close()
+	if err == nil && !f.t.IsZero() {
+		err = os.Chtimes(f.Name(), f.t, f.t)
+	}
+	return err
+}
+
+// autoStart starts a ZMODEM receive into the -zdir when p holds the
+// header a peer's sz starts with. It returns the length of p to show,
+// what came before the header, or -1 for all of it.
+func (s *session) autoStart(p []byte) int {
+	if s.zauto == nil {
+		return -1
+	}
+	i := s.zauto.Scan(p)
+	if i < 0 {
+		return -1
+	}
+	if err := s.zreceive(s.zdir); err != nil {
+		s.printf("\n*** zmodem: %v\n", err)
+		return -1
+	}
+	x := s.running()
+	x.l.Feed(zmodem.AutoStart)
+	x.l.Feed(p[i:])
+	if k := i - len(zmodem.AutoStart); k > 0 {
+		return k
+	}
+	return 0
+}
+
+// cmdKS: ks <file>...
+func cmdKS(s *session, args []string) error {
+	if len(args) < 1 {
+		return cmdError("usage: ks <file>...")
+	}
+	return s.kermitSend(args, false)
+}
+
+// cmdKT: kt <file>...
+func cmdKT(s *session, args []string) error {
+	if len(args) < 1 {
+		return cmdError("usage: kt <file>...")
+	}
+	return s.kermitSend(args, true)
+}
+
+// kermitSend sends files with Kermit, text converts the line ends.
+func (s *session) kermitSend(args []string, text bool) error {
+	osf, infos, err := openFiles(args)
+	if err != nil {
+		return cmdError(err.Error())
+	}
+	var files []kermit.File
+	var total int64
+	for i, f := range osf {
+		files = append(files, kermit.File{
+			Name:    filepath.Base(f.Name()),
+			Size:    infos[i].Size(),
+			ModTime: infos[i].ModTime(),
+			R:       f,
+		})
+		total += infos[i].Size()
+	}
+	name := fmt.Sprintf("kermit send %d files", len(files))
+	o := &kermit.Options{Text: text, Progress: s.progress(name, total)}
+	err = s.startTransfer(name, false, func(l *link.Link, abort <-chan struct{}) error {
+		defer closeFiles(osf)
+		_, err := kermit.Send(l, files, o)
+		return err
+	})
+	if err != nil {
+		closeFiles(osf)
+	}
+	return err
+}
+
+// cmdKR: kr [dir]
+func cmdKR(s *session, args []string) error {
+	if len(args) > 1 {
+		return cmdError("usage: kr [dir]")
+	}
+	dir := "."
+	if len(args) == 1 {
+		dir = args[0]
+	}
+	name := "kermit receive to " + dir
+	o := &kermit.Options{Progress: s.progress(name, 0)}
+	return s.startTransfer(name, false, func(l *link.Link, abort <-chan struct{}) error {
+		_, err := kermit.Receive(l, func(f *kermit.FileInfo) (io.WriteCloser, error) {
+			// no paths from the other side
+			fn := filepath.Join(dir, filepath.Base(f.Name))
+			w, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+			if os.IsExist(err) {
+				s.printf("\n*** skipping %s, exists\n", fn)
+				return nil, kermit.ErrSkip
+			}
+			if err != nil {
+				return nil, err
+			}
+			s.printf("\n*** receiving %s %d bytes\n", fn, f.Size)
+			return mtimeFile{w, f.ModTime}, nil
+		}, o)
+		return err
+	})
+}
@@ -0,0 +1,18 @@
+// +build darwin
+
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import "syscall"
+
+// The ioctls getting and setting the termios of a tty.
+const (
+	tcgets = syscall.TIOCGETA
+	tcsets = syscall.TIOCSETA
+)
@@ -0,0 +1,62 @@
+// +build darwin linux
+
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+//
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func tcget(fd uintptr, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd,
+		tcgets, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func tcset(fd uintptr, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd,
+		tcsets, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	var t syscall.Termios
+	return tcget(f.Fd(), &t) == nil
+}
+
+// makeRaw puts the terminal f into a raw input mode: every key
+// press is delivered as is, ctrl+c and friends included. Output
+// processing stays on, so our own messages still get their CRs.
+// The returned function restores the previous state.
+func makeRaw(f *os.File) (func(), error) {
+	var old syscall.Termios
+	if err := tcget(f.Fd(), &old); err != nil {
+		return nil, err
+	}
+	t := old
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK |
+		syscall.ISTRIP | syscall.INLCR | syscall.IGNCR |
+		syscall.ICRNL | syscall.IXON
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON |
+		syscall.ISIG | syscall.IEXTEN
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := tcset(f.Fd(), &t); err != nil {
+		return nil, err
+	}
+	return func() { tcset(f.Fd(), &old) }, nil
+}
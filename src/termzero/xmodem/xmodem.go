@@ -0,0 +1,564 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package xmodem implements the XMODEM (checksum, CRC and 1K) and
+// YMODEM batch file transfer protocols on top of a link.Link.
+package xmodem
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"termzero/cksum"
+	"termzero/link"
+)
+
+const (
+	SOH = 0x01 // 128 byte block
+	STX = 0x02 // 1024 byte block
+	EOT = 0x04
+	ACK = 0x06
+	NAK = 0x15
+	CAN = 0x18
+	SUB = 0x1a // padding
+	CRC = 'C'  // NAK asking for CRC mode
+)
+
+var (
+	ErrCanceled = errors.New("xmodem: canceled by peer")
+	ErrRetries  = errors.New("xmodem: too many retries")
+	ErrSync     = errors.New("xmodem: lost block sync")
+	ErrSkip     = errors.New("xmodem: skip file")
+)
+
+type Options struct {
+	OneK     bool // send 1024 byte blocks
+	Checksum bool // receive: ask for the checksum instead of CRC mode
+	Retries  int  // per block, 10 if 0
+	// Timeout for a block or its ACK, 10s if 0. The sender waits
+	// twice as long for an ACK, a stalled block gets NAKed first, and
+	// six times as long for the receiver to start.
+	Timeout  time.Duration
+	Progress func(n int64) // called after every block
+}
+
+func (o *Options) retries() int {
+	if o == nil || o.Retries == 0 {
+		return 10
+	}
+	return o.Retries
+}
+
+func (o *Options) timeout() time.Duration {
+	if o == nil || o.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return o.Timeout
+}
+
+func (o *Options) progress(n int64) {
+	if o != nil && o.Progress != nil {
+		o.Progress(n)
+	}
+}
+
+// Cancel tells the peer to give up.
+func Cancel(l *link.Link) {
+	l.Write([]byte{CAN, CAN, CAN, CAN, CAN, 8, 8, 8, 8, 8})
+}
+
+// block builds a block, data is padded with pad.
+func block(blk byte, data []byte, size int, pad byte, crc bool) []byte {
+	b := make([]byte, 3, 3+size+2)
+	b[0] = SOH
+	if size == 1024 {
+		b[0] = STX
+	}
+	b[1], b[2] = blk, ^blk
+	b = append(b, data...)
+	for len(b) < 3+size {
+		b = append(b, pad)
+	}
+	if crc {
+		c := cksum.CRC16CCITT(0, b[3:])
+		return append(b, byte(c>>8), byte(c))
+	}
+	return append(b, cksum.Sum8(b[3:]))
+}
+
+// sender sends blocks, crc is decided by the receiver.
+type sender struct {
+	l   *link.Link
+	o   *Options
+	crc bool
+}
+
+// waitStart waits for the receiver to ask for the first block and
+// reports whether it wants CRC mode.
+func (s *sender) waitStart() error {
+	deadline := time.Now().Add(6 * s.o.timeout())
+	for {
+		c, err := s.l.GetByte(deadline.Sub(time.Now()))
+		if err != nil {
+			return err
+		}
+		switch c {
+		case CRC:
+			s.crc = true
+			return nil
+		case NAK:
+			s.crc = false
+			return nil
+		case CAN:
+			if c, _ = s.l.GetByte(time.Second); c == CAN {
+				return ErrCanceled
+			}
+		}
+	}
+}
+
+// send sends b until it gets ACKed. Only a NAK gets b sent again,
+// the receiver NAKs a block that stalls. Resending after a timeout
+// as well could get the block ACKed twice, the second ACK taken for
+// the next block's.
+func (s *sender) send(b []byte) error {
+	resend := true
+	for try := 0; try < s.o.retries(); try++ {
+		if resend {
+			if _, err := s.l.Write(b); err != nil {
+				return err
+			}
+		}
+		resend = false
+		for {
+			c, err := s.l.GetByte(2 * s.o.timeout())
+			if err == link.ErrTimeout {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if c == ACK {
+				return nil
+			}
+			if c == NAK {
+				resend = true
+				break
+			}
+			if c == CAN {
+				if c, _ = s.l.GetByte(time.Second); c == CAN {
+					return ErrCanceled
+				}
+			}
+			// 'C' or garbage, keep waiting
+		}
+	}
+	return ErrRetries
+}
+
+// data sends r as blocks starting with block number 1.
+func (s *sender) data(r io.Reader) (int64, error) {
+	var n int64
+	buf := make([]byte, 1024)
+	for blk := byte(1); ; blk++ {
+		size := 128
+		if s.o != nil && s.o.OneK {
+			size = 1024
+		}
+		m, err := io.ReadFull(r, buf[:size])
+		if m == 0 {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return n, nil
+			}
+			return n, err
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return n, err
+		}
+		if m <= 128 {
+			size = 128 // don't pad a short tail to 1K
+		}
+		if err := s.send(block(blk, buf[:m], size, SUB, s.crc)); err != nil {
+			return n, err
+		}
+		n += int64(m)
+		s.o.progress(n)
+	}
+}
+
+// eot ends a file. YMODEM receivers NAK the first EOT, XMODEM ones
+// should ACK it.
+func (s *sender) eot() error {
+	for try := 0; try < s.o.retries(); try++ {
+		s.l.Write([]byte{EOT})
+		c, err := s.l.GetByte(s.o.timeout())
+		if err == link.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if c == ACK {
+			return nil
+		}
+	}
+	return ErrRetries
+}
+
+// Send sends r with XMODEM.
+func Send(l *link.Link, r io.Reader, o *Options) (int64, error) {
+	s := &sender{l: l, o: o}
+	if err := s.waitStart(); err != nil {
+		return 0, err
+	}
+	n, err := s.data(r)
+	if err != nil {
+		if err != ErrCanceled {
+			Cancel(l)
+		}
+		return n, err
+	}
+	return n, s.eot()
+}
+
+// receiver receives blocks.
+type receiver struct {
+	l     *link.Link
+	o     *Options
+	crc   bool
+	heard bool // the sender sent something
+	buf   [3 + 1024 + 2]byte
+}
+
+// get receives the next block. ask is sent to request it, whatever
+// the result, it is NAK once the block stream is running. A 'C' is
+// repeated until the sender answers, it takes a NAK for checksum
+// mode. A nil data and nil error mean EOT.
+func (r *receiver) get(ask byte) (blk byte, data []byte, err error) {
+	for try := 0; try < r.o.retries(); try++ {
+		if ask != 0 {
+			r.l.Write([]byte{ask})
+		}
+		if ask != CRC || r.heard {
+			ask = NAK
+		}
+		c, err := r.l.GetByte(r.o.timeout())
+		if err == link.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		r.heard = true
+		size := 0
+		switch c {
+		case SOH:
+			size = 128
+		case STX:
+			size = 1024
+		case EOT:
+			return 0, nil, nil
+		case CAN:
+			if c, _ = r.l.GetByte(time.Second); c == CAN {
+				return 0, nil, ErrCanceled
+			}
+			continue
+		default:
+			// the rest of a block, wait for it to pass
+			r.l.Drain(100 * time.Millisecond)
+			continue
+		}
+		n := 2 + size + 1
+		if r.crc {
+			n++
+		}
+		b := r.buf[:n]
+		if err := r.l.ReadFull(b, r.o.timeout()); err != nil {
+			if err == link.ErrTimeout {
+				continue
+			}
+			return 0, nil, err
+		}
+		if b[0] != ^b[1] {
+			r.l.Drain(100 * time.Millisecond)
+			continue
+		}
+		d := b[2 : 2+size]
+		if r.crc {
+			if cksum.CRC16CCITT(0, d) != uint16(b[n-2])<<8|uint16(b[n-1]) {
+				r.l.Drain(100 * time.Millisecond)
+				continue
+			}
+		} else if cksum.Sum8(d) != b[n-1] {
+			r.l.Drain(100 * time.Millisecond)
+			continue
+		}
+		return b[0], d, nil
+	}
+	return 0, nil, ErrRetries
+}
+
+// start asks for the first block. Unless only CRC is acceptable, it
+// falls back to checksum mode when three 'C's got no block at all.
+func (r *receiver) start(ymodem bool) (blk byte, data []byte, err error) {
+	r.crc = !r.o.Checksum || ymodem
+	r.heard = false
+	if !r.crc || ymodem {
+		ask := byte(NAK)
+		if r.crc {
+			ask = CRC
+		}
+		return r.get(ask)
+	}
+	o := r.o
+	three := *o
+	three.Retries = 3
+	r.o = &three
+	blk, data, err = r.get(CRC)
+	r.o = o
+	if err != ErrRetries {
+		return blk, data, err
+	}
+	// an answer to a 'C' is in CRC mode
+	r.crc = r.heard
+	return r.get(NAK)
+}
+
+// data receives the blocks of one file, first is the block already
+// received by start, if any. size limits what gets written, -1 for
+// no limit. ymodem NAKs the first EOT.
+func (r *receiver) data(w io.Writer, first []byte, size int64, ymodem bool) (int64, error) {
+	var n int64
+	write := func(d []byte) error {
+		if size >= 0 && n+int64(len(d)) > size {
+			d = d[:size-n]
+		}
+		m, err := w.Write(d)
+		n += int64(m)
+		r.o.progress(n)
+		return err
+	}
+	expect := byte(1)
+	if first != nil {
+		if err := write(first); err != nil {
+			return n, err
+		}
+		r.l.Write([]byte{ACK})
+		expect = 2
+	}
+	ask := byte(0)
+	eots := 0
+	for {
+		blk, d, err := r.get(ask)
+		if err != nil {
+			return n, err
+		}
+		ask = 0
+		if d == nil {
+			eots++
+			if ymodem && eots == 1 {
+				ask = NAK
+				continue
+			}
+			r.l.Write([]byte{ACK})
+			return n, nil
+		}
+		switch blk {
+		case expect:
+			if err := write(d); err != nil {
+				return n, err
+			}
+			expect++
+		case expect - 1:
+			// our ACK got lost
+			if ymodem && blk == 0 {
+				// and it was the one for the header
+				r.l.Write([]byte{ACK, CRC})
+				continue
+			}
+		default:
+			return n, ErrSync
+		}
+		r.l.Write([]byte{ACK})
+	}
+}
+
+// Receive receives a file with XMODEM and writes it to w, with the
+// padding of the last block.
+func Receive(l *link.Link, w io.Writer, o *Options) (int64, error) {
+	if o == nil {
+		o = &Options{}
+	}
+	r := &receiver{l: l, o: o}
+	blk, d, err := r.start(false)
+	if err == nil && d != nil && blk != 1 {
+		err = ErrSync
+	}
+	if err != nil {
+		if err != ErrCanceled {
+			Cancel(l)
+		}
+		return 0, err
+	}
+	if d == nil {
+		// EOT right away, an empty file
+		l.Write([]byte{ACK})
+		return 0, nil
+	}
+	n, err := r.data(w, d, -1, false)
+	if err != nil && err != ErrCanceled {
+		Cancel(l)
+	}
+	return n, err
+}
+
+// File is a file for a YMODEM batch.
+type File struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	R       io.Reader
+}
+
+// header builds the YMODEM block 0 payload.
+func (f *File) header() []byte {
+	h := append([]byte(f.Name), 0)
+	h = append(h, fmt.Sprintf("%d %o", f.Size, f.ModTime.Unix())...)
+	return append(h, 0)
+}
+
+// SendBatch sends files with YMODEM. The receiver decides on CRC,
+// the data goes in 1K blocks unless o says otherwise.
+func SendBatch(l *link.Link, files []File, o *Options) (int64, error) {
+	if o == nil {
+		o = &Options{OneK: true}
+	}
+	s := &sender{l: l, o: o}
+	var total int64
+	fail := func(err error) (int64, error) {
+		if err != ErrCanceled {
+			Cancel(l)
+		}
+		return total, err
+	}
+	for _, f := range files {
+		if err := s.waitStart(); err != nil {
+			return fail(err)
+		}
+		h := f.header()
+		size := 128
+		if len(h) > 128 {
+			size = 1024
+		}
+		if err := s.send(block(0, h, size, 0, s.crc)); err != nil {
+			return fail(err)
+		}
+		if err := s.waitStart(); err != nil {
+			return fail(err)
+		}
+		n, err := s.data(f.R)
+		total += n
+		if err != nil {
+			return fail(err)
+		}
+		if err := s.eot(); err != nil {
+			return fail(err)
+		}
+	}
+	// an empty block 0 ends the batch
+	if err := s.waitStart(); err != nil {
+		return fail(err)
+	}
+	if err := s.send(block(0, nil, 128, 0, s.crc)); err != nil {
+		return fail(err)
+	}
+	return total, nil
+}
+
+// ReceiveBatch receives files with YMODEM. create is called for every
+// file with the name and size (-1 if unknown) from the header; ErrSkip
+// throws the file away as it comes, YMODEM can't tell the sender.
+func ReceiveBatch(l *link.Link, create func(name string, size int64) (io.WriteCloser, error), o *Options) (int64, error) {
+	if o == nil {
+		o = &Options{}
+	}
+	r := &receiver{l: l, o: o}
+	var total int64
+	fail := func(err error) (int64, error) {
+		if err != ErrCanceled {
+			Cancel(l)
+		}
+		return total, err
+	}
+	for {
+		blk, d, err := r.start(true)
+		if err == nil && (d == nil || blk != 0) {
+			err = ErrSync
+		}
+		if err != nil {
+			return fail(err)
+		}
+		name, size, err := parseHeader(d)
+		if err != nil {
+			return fail(err)
+		}
+		l.Write([]byte{ACK})
+		if name == "" {
+			return total, nil
+		}
+		w, err := create(name, size)
+		skip := err == ErrSkip
+		if skip {
+			w, err = discard{}, nil
+		}
+		if err != nil {
+			return fail(err)
+		}
+		// the sender waits for a fresh 'C' before the data
+		r.l.Write([]byte{CRC})
+		n, err := r.data(w, nil, size, true)
+		if !skip {
+			total += n
+		}
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+}
+
+// discard takes a skipped file.
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+func (discard) Close() error                { return nil }
+
+func parseHeader(d []byte) (name string, size int64, err error) {
+	i := 0
+	for i < len(d) && d[i] != 0 {
+		i++
+	}
+	name = string(d[:i])
+	size = -1
+	if name == "" || i+1 >= len(d) {
+		return name, size, nil
+	}
+	rest := d[i+1:]
+	j := 0
+	for j < len(rest) && rest[j] >= '0' && rest[j] <= '9' {
+		j++
+	}
+	if j > 0 {
+		if _, err := fmt.Sscanf(string(rest[:j]), "%d", &size); err != nil {
+			return "", 0, fmt.Errorf("xmodem: bad size in header %q", rest[:j])
+		}
+	}
+	return name, size, nil
+}
@@ -0,0 +1,173 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package xmodem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"termzero/link"
+	"termzero/sers/serstest"
+)
+
+// xfer sends d with so and receives it with ro over a virtual port
+// pair with o. It returns what arrived and the receiver's statistics.
+func xfer(t *testing.T, o serstest.Options, d []byte, so, ro *Options) ([]byte, serstest.Stats) {
+	t.Helper()
+	var got bytes.Buffer
+	_, b, err := serstest.Exchange(o, func(p *serstest.Port) error {
+		n, err := Send(link.New(p), bytes.NewReader(d), so)
+		if err == nil && n != int64(len(d)) {
+			err = fmt.Errorf("sent %d bytes", n)
+		}
+		return err
+	}, func(p *serstest.Port) error {
+		n, err := Receive(link.New(p), &got, ro)
+		if err == nil && n != int64(got.Len()) {
+			err = fmt.Errorf("Receive says %d, wrote %d", n, got.Len())
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got.Bytes(), b.Stats()
+}
+
+// unpad checks that got is d padded to whole blocks.
+func unpad(t *testing.T, got, d []byte) {
+	t.Helper()
+	if len(got) < len(d) || !bytes.Equal(got[:len(d)], d) {
+		t.Fatalf("%d bytes came as %d different ones", len(d), len(got))
+	}
+	if pad := got[len(d):]; len(got)%128 != 0 || len(pad) >= 1024 || bytes.Count(pad, []byte{SUB}) != len(pad) {
+		t.Errorf("%d bytes came with %d bytes of padding", len(d), len(pad))
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		so, ro Options
+	}{
+		{"checksum", Options{}, Options{Checksum: true}},
+		{"CRC", Options{}, Options{}},
+		{"1K", Options{OneK: true}, Options{}},
+	} {
+		for _, n := range []int{0, 1, 128, 1000, 3000} {
+			t.Run(fmt.Sprintf("%s/%d", c.name, n), func(t *testing.T) {
+				var blocks int
+				ro := c.ro
+				ro.Progress = func(int64) { blocks++ }
+				d := serstest.Bytes(n)
+				got, _ := xfer(t, serstest.Options{}, d, &c.so, &ro)
+				unpad(t, got, d)
+				want := (n + 127) / 128
+				if c.so.OneK {
+					want = (n + 1023) / 1024
+				}
+				if blocks != want {
+					t.Errorf("%d blocks, want %d", blocks, want)
+				}
+			})
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	mt := time.Unix(1420070400, 0)
+	files := []File{
+		{Name: "one.bin", Size: 1500, ModTime: mt, R: bytes.NewReader(serstest.Bytes(1500))},
+		{Name: "old", Size: 300, R: bytes.NewReader(serstest.Bytes(300))},
+		{Name: "two.txt", Size: 7, ModTime: mt, R: bytes.NewReader([]byte("two\r\n\r\n"))},
+	}
+	got := map[string]*serstest.Buffer{}
+	var names []string
+	var n int64
+	_, _, err := serstest.Exchange(serstest.Options{}, func(p *serstest.Port) error {
+		_, err := SendBatch(link.New(p), files, nil)
+		return err
+	}, func(p *serstest.Port) error {
+		var err error
+		n, err = ReceiveBatch(link.New(p), func(name string, size int64) (io.WriteCloser, error) {
+			names = append(names, fmt.Sprintf("%s %d", name, size))
+			if name == "old" {
+				return nil, ErrSkip
+			}
+			got[name] = &serstest.Buffer{}
+			return got[name], nil
+		}, nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(names) != "[one.bin 1500 old 300 two.txt 7]" {
+		t.Errorf("files %v", names)
+	}
+	if n != 1507 {
+		t.Errorf("received %d bytes, want 1507", n)
+	}
+	// the sizes cut the padding
+	if !bytes.Equal(got["one.bin"].Bytes(), serstest.Bytes(1500)) || got["two.txt"].String() != "two\r\n\r\n" {
+		t.Error("the files came different")
+	}
+	for name, f := range got {
+		if !f.Closed {
+			t.Errorf("%s wasn't closed", name)
+		}
+	}
+}
+
+func TestLossy(t *testing.T) {
+	o := &Options{Timeout: 200 * time.Millisecond}
+	d := serstest.Bytes(4000)
+	got, st := xfer(t, serstest.Options{Loss: 0.002, Seed: 1}, d, o, o)
+	unpad(t, got, d)
+	if st.Lost == 0 {
+		t.Errorf("nothing got lost: %+v", st)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	// the receiver gives up after the first block
+	pa, pb := serstest.Pair(serstest.Options{})
+	defer pa.Close()
+	defer pb.Close()
+	a, b := link.New(pa), link.New(pb)
+	sent := make(chan error, 1)
+	go func() {
+		_, err := Send(a, bytes.NewReader(serstest.Bytes(1000)), nil)
+		sent <- err
+	}()
+	b.Write([]byte{CRC})
+	if c, err := b.GetByte(time.Second); c != SOH || err != nil {
+		t.Fatalf("got %#x, %v, want a block", c, err)
+	}
+	Cancel(b)
+	if err := <-sent; err != ErrCanceled {
+		t.Errorf("send: got %v, want %v", err, ErrCanceled)
+	}
+
+	// the sender gives up before the first block
+	pa, pb = serstest.Pair(serstest.Options{})
+	defer pa.Close()
+	defer pb.Close()
+	a, b = link.New(pa), link.New(pb)
+	go func() {
+		if c, err := a.GetByte(time.Second); c != CRC || err != nil {
+			t.Errorf("got %#x, %v, want a 'C'", c, err)
+		}
+		Cancel(a)
+	}()
+	if _, err := Receive(b, io.Discard, nil); err != ErrCanceled {
+		t.Errorf("receive: got %v, want %v", err, ErrCanceled)
+	}
+}
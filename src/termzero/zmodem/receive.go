@@ -0,0 +1,266 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package zmodem
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"termzero/link"
+)
+
+// FileInfo describes an incoming file.
+type FileInfo struct {
+	Name    string // as sent, may contain a path
+	Size    int64  // -1 if unknown
+	ModTime time.Time
+	Mode    os.FileMode
+	// Resume is set if the sender or Options.Resume asked to
+	// continue a partial file.
+	Resume bool
+}
+
+var errEarlyFin = errors.New("zmodem: sender finished in the middle of a file")
+
+type receiver struct {
+	conn
+	done int64 // bytes of the finished files
+}
+
+// Receive receives files until the sender is done, like rz. open is
+// called for every file and returns where to write it and the offset
+// to continue at, 0 unless resuming; ErrSkip skips the file. Receive
+// returns the bytes received.
+func Receive(l *link.Link, open func(f *FileInfo) (io.WriteCloser, int64, error), o *Options) (int64, error) {
+	if o == nil {
+		o = &Options{}
+	}
+	r := &receiver{conn: conn{l: l, o: o}}
+	fail := func(err error) (int64, error) {
+		if err != ErrCanceled {
+			Cancel(l)
+		}
+		return r.done, err
+	}
+	rinit := header{ZRINIT, [4]byte{0, 0, 0, CANFDX | CANOVIO | CANFC32}}
+	if err := r.sendHex(rinit); err != nil {
+		return fail(err)
+	}
+	tries := 0
+	for {
+		h, err := r.readHeader(o.timeout())
+		if retryable(err) {
+			if tries++; tries >= o.retries() {
+				return fail(ErrRetries)
+			}
+			r.sendHex(rinit)
+			continue
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if err := peerGone(h); err != nil {
+			return fail(err)
+		}
+		switch h.typ {
+		case ZSINIT:
+			// the attention string isn't needed, we stream
+			if _, _, err := r.readData(o.timeout()); err != nil {
+				r.sendHex(header{typ: ZNAK})
+				continue
+			}
+			r.sendHex(header{typ: ZACK})
+		case ZFILE:
+			d, _, err := r.readData(o.timeout())
+			if retryable(err) {
+				r.sendHex(header{typ: ZNAK})
+				continue
+			}
+			if err != nil {
+				return fail(err)
+			}
+			tries = 0
+			if err := r.file(h, d, open); err != nil {
+				return fail(err)
+			}
+			r.sendHex(rinit)
+		case ZFIN:
+			r.sendHex(header{typ: ZFIN})
+			// the sender says "OO" and is gone
+			for i := 0; i < 4; i++ {
+				b, err := l.GetByte(time.Second)
+				if err != nil {
+					break
+				}
+				if b == 'O' {
+					l.GetByte(100 * time.Millisecond)
+					break
+				}
+			}
+			return r.done, nil
+		case ZCOMMAND:
+			// no remote commands here
+			r.readData(o.timeout())
+			r.sendHex(posHeader(ZCOMPL, 1))
+		default:
+			r.sendHex(rinit)
+		}
+	}
+}
+
+// parseInfo parses the data of a ZFILE frame.
+func parseInfo(d []byte) (*FileInfo, error) {
+	i := bytes.IndexByte(d, 0)
+	if i < 0 {
+		i = len(d)
+	}
+	f := &FileInfo{Name: string(d[:i]), Size: -1}
+	if f.Name == "" {
+		return nil, errors.New("zmodem: file without a name")
+	}
+	if i == len(d) {
+		return f, nil
+	}
+	rest := d[i+1:]
+	if j := bytes.IndexByte(rest, 0); j >= 0 {
+		rest = rest[:j]
+	}
+	fields := strings.Fields(string(rest))
+	if len(fields) > 0 {
+		if n, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			f.Size = n
+		}
+	}
+	if len(fields) > 1 {
+		if t, err := strconv.ParseInt(fields[1], 8, 64); err == nil && t > 0 {
+			f.ModTime = time.Unix(t, 0)
+		}
+	}
+	if len(fields) > 2 {
+		if m, err := strconv.ParseUint(fields[2], 8, 32); err == nil {
+			f.Mode = os.FileMode(m).Perm()
+		}
+	}
+	return f, nil
+}
+
+// file receives one file announced by the ZFILE header h with the
+// data d.
+func (r *receiver) file(h header, d []byte, open func(f *FileInfo) (io.WriteCloser, int64, error)) error {
+	fi, err := parseInfo(d)
+	if err != nil {
+		return err
+	}
+	fi.Resume = r.o.Resume || h.zf0() == ZCRESUM
+	w, pos, err := open(fi)
+	if err == ErrSkip {
+		return r.sendHex(header{typ: ZSKIP})
+	}
+	if err != nil {
+		return err
+	}
+	tries, last := 0, pos
+	// retry counts the errors without progress
+	retry := func() error {
+		if pos > last {
+			tries, last = 0, pos
+		}
+		if tries++; tries >= r.o.retries() {
+			return ErrRetries
+		}
+		return nil
+	}
+	for {
+		if err := r.sendHex(posHeader(ZRPOS, pos)); err != nil {
+			w.Close()
+			return err
+		}
+	next:
+		h, err := r.readHeader(r.o.timeout())
+		if err == errGarbage {
+			// the rest of the stream before our ZRPOS
+			goto next
+		}
+		if retryable(err) {
+			err = retry()
+			if err == nil {
+				continue
+			}
+		}
+		if err == nil {
+			err = peerGone(h)
+		}
+		if err != nil {
+			w.Close()
+			return err
+		}
+		switch h.typ {
+		case ZDATA:
+			if h.pos() != pos {
+				// stale too
+				if err := retry(); err != nil {
+					w.Close()
+					return err
+				}
+				goto next
+			}
+			err := r.data(w, &pos)
+			if retryable(err) {
+				err = retry()
+				if err == nil {
+					continue
+				}
+			}
+			if err != nil {
+				w.Close()
+				return err
+			}
+			goto next
+		case ZEOF:
+			if h.pos() != pos {
+				// stale, the data after our ZRPOS is on its way
+				goto next
+			}
+			r.done += pos
+			return w.Close()
+		case ZFILE:
+			// our ZRPOS got lost
+			r.readData(r.o.timeout())
+		case ZFIN:
+			w.Close()
+			return errEarlyFin
+		}
+	}
+}
+
+// data writes the subpackets of a ZDATA frame to w, advancing pos.
+func (r *receiver) data(w io.Writer, pos *int64) error {
+	for {
+		p, end, err := r.readData(r.o.timeout())
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+		*pos += int64(len(p))
+		r.o.progress(r.done + *pos)
+		switch end {
+		case ZCRCW:
+			return r.sendHex(posHeader(ZACK, *pos))
+		case ZCRCQ:
+			r.sendHex(posHeader(ZACK, *pos))
+		case ZCRCE:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,335 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package zmodem
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"termzero/link"
+)
+
+// File is a file to send. R must seek, the receiver picks the
+// position to start at.
+type File struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	R       io.ReadSeeker
+}
+
+var errFileError = errors.New("zmodem: receiver can't write the file")
+
+type sender struct {
+	conn
+	rxbuf int   // receiver buffer, 0 streams
+	done  int64 // bytes of the finished files
+}
+
+// Send sends files, like sz. It returns the bytes sent.
+func Send(l *link.Link, files []File, o *Options) (int64, error) {
+	if o == nil {
+		o = &Options{}
+	}
+	s := &sender{conn: conn{l: l, o: o}}
+	fail := func(err error) (int64, error) {
+		if err != ErrCanceled {
+			Cancel(l)
+		}
+		return s.done, err
+	}
+	if err := s.init(); err != nil {
+		return fail(err)
+	}
+	for i, f := range files {
+		if err := s.file(f, files[i+1:]); err != nil {
+			return fail(err)
+		}
+	}
+	if err := s.fin(); err != nil {
+		return fail(err)
+	}
+	return s.done, nil
+}
+
+// peerGone maps the headers ending the session to errors.
+func peerGone(h header) error {
+	switch h.typ {
+	case ZCAN, ZABORT:
+		return ErrCanceled
+	case ZFERR:
+		return errFileError
+	}
+	return nil
+}
+
+// init waits for the receiver's ZRINIT.
+func (s *sender) init() error {
+	s.write([]byte("rz\r"))
+	for try := 0; try < s.o.retries(); try++ {
+		if err := s.sendHex(header{typ: ZRQINIT}); err != nil {
+			return err
+		}
+		h, err := s.readHeader(s.o.timeout())
+		if retryable(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := peerGone(h); err != nil {
+			return err
+		}
+		switch h.typ {
+		case ZRINIT:
+			flags := h.zf0()
+			s.tx32 = flags&CANFC32 != 0
+			s.escctl = flags&ESCCTL != 0
+			s.rxbuf = int(h.b[0]) | int(h.b[1])<<8
+			return nil
+		case ZCHALLENGE:
+			s.sendHex(posHeader(ZACK, h.pos()))
+			try--
+		}
+	}
+	return ErrRetries
+}
+
+// info is the data of the ZFILE frame, rest are the files after f.
+func info(f File, rest []File) []byte {
+	left := f.Size
+	for _, r := range rest {
+		left += r.Size
+	}
+	var mtime int64
+	if !f.ModTime.IsZero() {
+		mtime = f.ModTime.Unix()
+	}
+	mode := f.Mode.Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	b := append([]byte(f.Name), 0)
+	b = append(b, fmt.Sprintf("%d %o %o 0 %d %d", f.Size, mtime, 0100000|mode, len(rest)+1, left)...)
+	return append(b, 0)
+}
+
+// file offers f and sends it from where the receiver wants it.
+func (s *sender) file(f File, rest []File) error {
+	var zf0 byte = ZCBIN
+	if s.o.Resume {
+		zf0 = ZCRESUM
+	}
+	resend := true
+	wait := s.o.timeout()
+	for try := 0; try < s.o.retries(); try++ {
+		if resend {
+			if err := s.sendBin(header{ZFILE, [4]byte{0, 0, 0, zf0}}); err != nil {
+				return err
+			}
+			if err := s.sendData(info(f, rest), ZCRCW); err != nil {
+				return err
+			}
+		}
+		h, err := s.readHeader(wait)
+		resend, wait = true, s.o.timeout()
+		if retryable(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := peerGone(h); err != nil {
+			return err
+		}
+		switch h.typ {
+		case ZRINIT:
+			// likely an answer to something earlier, offer the
+			// file again only if nothing else follows
+			resend, wait = false, time.Second
+			try--
+		case ZRPOS:
+			return s.data(f, h.pos())
+		case ZSKIP:
+			return nil
+		case ZCRC:
+			// the receiver compares with its partial file
+			crc, err := fileCRC(f.R, h.pos())
+			if err != nil {
+				return err
+			}
+			s.sendBin(posHeader(ZCRC, int64(crc)))
+			resend = false
+			try--
+		}
+	}
+	return ErrRetries
+}
+
+// fileCRC returns the CRC-32 of the first n bytes of r, all if 0.
+func fileCRC(r io.ReadSeeker, n int64) (uint32, error) {
+	if _, err := r.Seek(0, 0); err != nil {
+		return 0, err
+	}
+	var src io.Reader = r
+	if n > 0 {
+		src = io.LimitReader(r, n)
+	}
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, src); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// data streams f from pos and repositions on every ZRPOS until the
+// receiver accepted the ZEOF.
+func (s *sender) data(f File, pos int64) error {
+	buf := make([]byte, subpacketSize)
+	tries, last := 0, pos
+restart:
+	// only count the repositionings without progress
+	if pos > last {
+		tries, last = 0, pos
+	}
+	if tries++; tries > s.o.retries() {
+		return ErrRetries
+	}
+	if _, err := f.R.Seek(pos, 0); err != nil {
+		return err
+	}
+	if err := s.sendBin(posHeader(ZDATA, pos)); err != nil {
+		return err
+	}
+	unacked := 0
+	for {
+		n, err := io.ReadFull(f.R, buf)
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return err
+		}
+		var end byte = ZCRCG
+		unacked += n
+		switch {
+		case eof:
+			end = ZCRCE
+		case s.rxbuf > 0 && unacked+subpacketSize > s.rxbuf:
+			end = ZCRCW
+		}
+		if err := s.sendData(buf[:n], end); err != nil {
+			return err
+		}
+		pos += int64(n)
+		s.o.progress(s.done + pos)
+		if eof {
+			break
+		}
+		if end == ZCRCW {
+			h, err := s.readHeader(s.o.timeout())
+			if retryable(err) {
+				goto restart
+			}
+			if err != nil {
+				return err
+			}
+			if err := peerGone(h); err != nil {
+				return err
+			}
+			switch h.typ {
+			case ZACK:
+				unacked = 0
+			case ZRPOS:
+				pos = h.pos()
+				goto restart
+			case ZSKIP:
+				return nil
+			}
+			continue
+		}
+		h, ok, err := s.poll()
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := peerGone(h); err != nil {
+				return err
+			}
+			switch h.typ {
+			case ZRPOS:
+				pos = h.pos()
+				goto restart
+			case ZSKIP:
+				return nil
+			}
+		}
+	}
+
+	for try := 0; try < s.o.retries(); try++ {
+		if err := s.sendBin(posHeader(ZEOF, pos)); err != nil {
+			return err
+		}
+		h, err := s.readHeader(s.o.timeout())
+		if retryable(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := peerGone(h); err != nil {
+			return err
+		}
+		switch h.typ {
+		case ZRINIT, ZSKIP:
+			s.done += pos
+			return nil
+		case ZRPOS:
+			pos = h.pos()
+			goto restart
+		case ZACK:
+			try--
+		}
+	}
+	return ErrRetries
+}
+
+// fin ends the session.
+func (s *sender) fin() error {
+	resend := true
+	wait := s.o.timeout()
+	for try := 0; try < s.o.retries(); try++ {
+		if resend {
+			if err := s.sendHex(header{typ: ZFIN}); err != nil {
+				return err
+			}
+		}
+		h, err := s.readHeader(wait)
+		resend, wait = true, s.o.timeout()
+		if retryable(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := peerGone(h); err != nil {
+			return err
+		}
+		switch h.typ {
+		case ZFIN:
+			return s.write([]byte("OO"))
+		case ZRINIT:
+			// the answer to the last file, as in file
+			resend, wait = false, time.Second
+			try--
+		}
+	}
+	return ErrRetries
+}
@@ -0,0 +1,504 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package zmodem implements the ZMODEM file transfer protocol on top
+// of a link.Link, compatible with the sz and rz of lrzsz: streaming
+// with CRC-16 or CRC-32 frames, resuming of interrupted transfers and
+// detection of the auto-start header of a sending peer.
+package zmodem
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"time"
+
+	"termzero/cksum"
+	"termzero/link"
+)
+
+const (
+	ZPAD   = '*'
+	ZDLE   = 0x18 // also CAN
+	ZBIN   = 'A'
+	ZHEX   = 'B'
+	ZBIN32 = 'C'
+	XON    = 0x11
+	XOFF   = 0x13
+
+	// frame types
+	ZRQINIT    = 0
+	ZRINIT     = 1
+	ZSINIT     = 2
+	ZACK       = 3
+	ZFILE      = 4
+	ZSKIP      = 5
+	ZNAK       = 6
+	ZABORT     = 7
+	ZFIN       = 8
+	ZRPOS      = 9
+	ZDATA      = 10
+	ZEOF       = 11
+	ZFERR      = 12
+	ZCRC       = 13
+	ZCHALLENGE = 14
+	ZCOMPL     = 15
+	ZCAN       = 16
+	ZFREECNT   = 17
+	ZCOMMAND   = 18
+
+	// data subpacket ends
+	ZCRCE = 'h' // end of frame, header follows
+	ZCRCG = 'i' // frame continues
+	ZCRCQ = 'j' // frame continues, ZACK expected
+	ZCRCW = 'k' // end of frame, ZACK expected
+	ZRUB0 = 'l' // 0x7f
+	ZRUB1 = 'm' // 0xff
+
+	// ZRINIT flags
+	CANFDX  = 0x01 // full duplex
+	CANOVIO = 0x02 // can receive during disk I/O
+	CANFC32 = 0x20 // can use CRC-32
+	ESCCTL  = 0x40 // wants all control characters escaped
+
+	// ZFILE conversion options
+	ZCBIN   = 1 // binary
+	ZCRESUM = 3 // resume an interrupted transfer
+
+	subpacketSize = 1024
+	maxSubpacket  = 8192
+	maxGarbage    = 2048 // bytes before a header
+)
+
+// AutoStart starts the ZRQINIT header a sending peer emits, seeing
+// it in the received data means "start rz now".
+var AutoStart = []byte("**\x18B00")
+
+var (
+	ErrCanceled = errors.New("zmodem: canceled by peer")
+	ErrRetries  = errors.New("zmodem: too many retries")
+	ErrSkip     = errors.New("zmodem: skip file")
+
+	errGarbage = errors.New("zmodem: garbage instead of a header")
+	errCRC     = errors.New("zmodem: bad CRC")
+	errFrame   = errors.New("zmodem: bad frame")
+)
+
+type Options struct {
+	// Resume asks the receiver to continue a partial file, a
+	// receiver resumes when either side asks for it.
+	Resume  bool
+	Retries int           // 10 if 0
+	Timeout time.Duration // for a header, 10s if 0
+	// Progress is called with the bytes transferred so far.
+	Progress func(n int64)
+}
+
+func (o *Options) retries() int {
+	if o == nil || o.Retries == 0 {
+		return 10
+	}
+	return o.Retries
+}
+
+func (o *Options) timeout() time.Duration {
+	if o == nil || o.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return o.Timeout
+}
+
+func (o *Options) progress(n int64) {
+	if o != nil && o.Progress != nil {
+		o.Progress(n)
+	}
+}
+
+// Cancel tells the peer to give up.
+func Cancel(l *link.Link) {
+	b := bytes.Repeat([]byte{ZDLE}, 10)
+	l.Write(append(b, bytes.Repeat([]byte{8}, 10)...))
+}
+
+// Detector finds AutoStart in a stream read in chunks.
+type Detector struct {
+	n int // bytes of AutoStart matched so far
+}
+
+// Scan returns the index in p just past AutoStart, or -1. The
+// pattern may have started in an earlier chunk.
+func (d *Detector) Scan(p []byte) int {
+	for i, c := range p {
+		switch {
+		case c == AutoStart[d.n]:
+			d.n++
+		case c == ZPAD && d.n == 2:
+			// "***" still ends in "**"
+		case c == ZPAD:
+			d.n = 1
+		default:
+			d.n = 0
+		}
+		if d.n == len(AutoStart) {
+			d.n = 0
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// header is a frame header, b holds ZP0..ZP3, which are ZF3..ZF0
+// for the headers carrying flags.
+type header struct {
+	typ byte
+	b   [4]byte
+}
+
+func posHeader(typ byte, pos int64) header {
+	return header{typ, [4]byte{byte(pos), byte(pos >> 8), byte(pos >> 16), byte(pos >> 24)}}
+}
+
+func (h header) pos() int64 {
+	return int64(h.b[0]) | int64(h.b[1])<<8 | int64(h.b[2])<<16 | int64(h.b[3])<<24
+}
+
+// zf0 is the first flags byte.
+func (h header) zf0() byte {
+	return h.b[3]
+}
+
+// conn frames and unframes on a link.
+type conn struct {
+	l      *link.Link
+	o      *Options
+	tx32   bool // send binary frames with CRC-32
+	rx32   bool // the last binary header had CRC-32, so do its data
+	escctl bool // escape all control characters
+	last   byte // last byte sent, for the CR after @ rule
+	cans   int  // CANs seen in a row
+}
+
+func (c *conn) write(b []byte) error {
+	_, err := c.l.Write(b)
+	return err
+}
+
+func (c *conn) sendHex(h header) error {
+	raw := append([]byte{h.typ}, h.b[:]...)
+	crc := cksum.CRC16CCITT(0, raw)
+	raw = append(raw, byte(crc>>8), byte(crc))
+	b := []byte{ZPAD, ZPAD, ZDLE, ZHEX}
+	b = append(b, hex.EncodeToString(raw)...)
+	b = append(b, '\r', '\n'|0x80)
+	if h.typ != ZFIN && h.typ != ZACK {
+		b = append(b, XON)
+	}
+	c.last = 0
+	return c.write(b)
+}
+
+func (c *conn) sendBin(h header) error {
+	raw := append([]byte{h.typ}, h.b[:]...)
+	b := []byte{ZPAD, ZDLE, ZBIN}
+	if c.tx32 {
+		b[2] = ZBIN32
+		b = c.escape(b, raw)
+		b = c.escape(b, crc32le(crc32.ChecksumIEEE(raw)))
+	} else {
+		crc := cksum.CRC16CCITT(0, raw)
+		b = c.escape(b, raw)
+		b = c.escape(b, []byte{byte(crc >> 8), byte(crc)})
+	}
+	return c.write(b)
+}
+
+// sendData sends a data subpacket ending with end.
+func (c *conn) sendData(p []byte, end byte) error {
+	b := make([]byte, 0, len(p)+len(p)/8+16)
+	b = c.escape(b, p)
+	b = append(b, ZDLE, end)
+	if c.tx32 {
+		crc := crc32.Update(crc32.ChecksumIEEE(p), crc32.IEEETable, []byte{end})
+		b = c.escape(b, crc32le(crc))
+	} else {
+		crc := cksum.CRC16CCITT(cksum.CRC16CCITT(0, p), []byte{end})
+		b = c.escape(b, []byte{byte(crc >> 8), byte(crc)})
+	}
+	if end == ZCRCW {
+		b = append(b, XON)
+	}
+	return c.write(b)
+}
+
+func crc32le(crc uint32) []byte {
+	return []byte{byte(crc), byte(crc >> 8), byte(crc >> 16), byte(crc >> 24)}
+}
+
+// escape appends p to b with ZDLE escapes.
+func (c *conn) escape(b, p []byte) []byte {
+	for _, x := range p {
+		esc := false
+		switch x {
+		case ZDLE, 0x10, 0x90, XON, XON | 0x80, XOFF, XOFF | 0x80:
+			esc = true
+		case '\r', '\r' | 0x80:
+			// telnet and friends eat CR after @
+			esc = c.last&0x7f == '@'
+		default:
+			esc = c.escctl && x&0x60 == 0
+		}
+		if esc {
+			b = append(b, ZDLE, x^0x40)
+		} else {
+			b = append(b, x)
+		}
+		c.last = x
+	}
+	return b
+}
+
+// get returns the next byte, counting CANs.
+func (c *conn) get(d time.Duration) (byte, error) {
+	b, err := c.l.GetByte(d)
+	if err != nil {
+		return 0, err
+	}
+	if b == ZDLE {
+		c.cans++
+		if c.cans >= 5 {
+			c.cans = 0
+			return 0, ErrCanceled
+		}
+	} else {
+		c.cans = 0
+	}
+	return b, nil
+}
+
+// get7 returns the next byte without parity, skipping flow control.
+func (c *conn) get7(d time.Duration) (byte, error) {
+	for {
+		b, err := c.get(d)
+		if err != nil {
+			return 0, err
+		}
+		b &= 0x7f
+		if b != XON && b != XOFF {
+			return b, nil
+		}
+	}
+}
+
+// getZ returns the next unescaped byte or, for ZDLE followed by a
+// frame end, the end.
+func (c *conn) getZ(d time.Duration) (b, end byte, err error) {
+	for {
+		if b, err = c.get(d); err != nil {
+			return
+		}
+		switch b {
+		case XON, XON | 0x80, XOFF, XOFF | 0x80:
+			continue
+		case ZDLE:
+		default:
+			return b, 0, nil
+		}
+		for {
+			if b, err = c.get(d); err != nil {
+				return
+			}
+			switch b {
+			case ZCRCE, ZCRCG, ZCRCQ, ZCRCW:
+				return 0, b, nil
+			case ZRUB0:
+				return 0x7f, 0, nil
+			case ZRUB1:
+				return 0xff, 0, nil
+			case XON, XON | 0x80, XOFF, XOFF | 0x80:
+				continue
+			}
+			if b&0x60 == 0x40 {
+				return b ^ 0x40, 0, nil
+			}
+			return 0, 0, errFrame
+		}
+	}
+}
+
+// readHeader waits up to d for a header, skipping garbage.
+func (c *conn) readHeader(d time.Duration) (header, error) {
+	deadline := time.Now().Add(d)
+	garbage := 0
+	for {
+		b, err := c.get(deadline.Sub(time.Now()))
+		if err != nil {
+			return header{}, err
+		}
+		if b&0x7f != ZPAD {
+			if garbage++; garbage > maxGarbage {
+				return header{}, errGarbage
+			}
+			continue
+		}
+		h, err := c.afterPad(deadline)
+		if err != errGarbage {
+			return h, err
+		}
+	}
+}
+
+// afterPad reads the rest of a header after its first ZPAD.
+func (c *conn) afterPad(deadline time.Time) (header, error) {
+	b := byte(ZPAD)
+	var err error
+	for b&0x7f == ZPAD {
+		if b, err = c.get(deadline.Sub(time.Now())); err != nil {
+			return header{}, err
+		}
+	}
+	if b != ZDLE {
+		return header{}, errGarbage
+	}
+	if b, err = c.get7(deadline.Sub(time.Now())); err != nil {
+		return header{}, err
+	}
+	d := deadline.Sub(time.Now())
+	switch b {
+	case ZBIN, ZBIN32:
+		c.rx32 = b == ZBIN32
+		return c.readBin(d)
+	case ZHEX:
+		return c.readHex(d)
+	}
+	return header{}, errGarbage
+}
+
+// poll returns a header the peer sent without waiting for one, ok is
+// false if there is none.
+func (c *conn) poll() (h header, ok bool, err error) {
+	for c.l.Ready() {
+		b, err := c.get(0)
+		if err != nil {
+			return header{}, false, err
+		}
+		if b&0x7f != ZPAD {
+			continue
+		}
+		h, err = c.afterPad(time.Now().Add(c.o.timeout()))
+		if err == nil {
+			return h, true, nil
+		}
+		if !retryable(err) {
+			return header{}, false, err
+		}
+	}
+	return header{}, false, nil
+}
+
+// retryable tells the errors of a garbled or missing frame apart
+// from the fatal ones.
+func retryable(err error) bool {
+	switch err {
+	case link.ErrTimeout, errGarbage, errCRC, errFrame:
+		return true
+	}
+	return false
+}
+
+func (c *conn) readBin(d time.Duration) (header, error) {
+	n := 7
+	if c.rx32 {
+		n = 9
+	}
+	raw := make([]byte, n)
+	for i := range raw {
+		b, end, err := c.getZ(d)
+		if err != nil {
+			return header{}, err
+		}
+		if end != 0 {
+			return header{}, errFrame
+		}
+		raw[i] = b
+	}
+	if c.rx32 {
+		if !bytes.Equal(crc32le(crc32.ChecksumIEEE(raw[:5])), raw[5:]) {
+			return header{}, errCRC
+		}
+	} else if cksum.CRC16CCITT(0, raw) != 0 {
+		return header{}, errCRC
+	}
+	h := header{typ: raw[0]}
+	copy(h.b[:], raw[1:5])
+	return h, nil
+}
+
+func (c *conn) readHex(d time.Duration) (header, error) {
+	var digits [14]byte
+	for i := range digits {
+		b, err := c.get7(d)
+		if err != nil {
+			return header{}, err
+		}
+		digits[i] = b
+	}
+	raw := make([]byte, 7)
+	if _, err := hex.Decode(raw, digits[:]); err != nil {
+		return header{}, errFrame
+	}
+	if cksum.CRC16CCITT(0, raw) != 0 {
+		return header{}, errCRC
+	}
+	// CR LF end the hex header
+	if b, err := c.get7(d); err == nil && b == '\r' {
+		c.get7(d)
+	}
+	h := header{typ: raw[0]}
+	copy(h.b[:], raw[1:5])
+	return h, nil
+}
+
+// readData reads a data subpacket of the last binary header.
+func (c *conn) readData(d time.Duration) ([]byte, byte, error) {
+	var p []byte
+	for {
+		b, end, err := c.getZ(d)
+		if err != nil {
+			return nil, 0, err
+		}
+		if end == 0 {
+			if len(p) == maxSubpacket {
+				return nil, 0, errFrame
+			}
+			p = append(p, b)
+			continue
+		}
+		fe := end
+		n := 2
+		if c.rx32 {
+			n = 4
+		}
+		crc := make([]byte, n)
+		for i := range crc {
+			if crc[i], end, err = c.getZ(d); err != nil {
+				return nil, 0, err
+			}
+			if end != 0 {
+				return nil, 0, errFrame
+			}
+		}
+		if c.rx32 {
+			sum := crc32.Update(crc32.ChecksumIEEE(p), crc32.IEEETable, []byte{fe})
+			if !bytes.Equal(crc32le(sum), crc) {
+				return nil, 0, errCRC
+			}
+		} else if cksum.CRC16CCITT(cksum.CRC16CCITT(0, p), append([]byte{fe}, crc...)) != 0 {
+			return nil, 0, errCRC
+		}
+		return p, fe, nil
+	}
+}
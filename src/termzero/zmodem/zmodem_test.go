@@ -0,0 +1,171 @@
+//
+//	Copyright (c) 2015 Martin Capitanio <capnm@capitanio.org>
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package zmodem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"termzero/link"
+	"termzero/sers/serstest"
+)
+
+// xfer sends files over a virtual port pair with o and receives them
+// with open. It returns what Send and Receive returned and the
+// statistics of the receiving port.
+func xfer(t *testing.T, po serstest.Options, files []File, o *Options,
+	open func(f *FileInfo) (io.WriteCloser, int64, error)) (sent, got int64, st serstest.Stats) {
+
+	t.Helper()
+	_, b, err := serstest.Exchange(po, func(p *serstest.Port) error {
+		var err error
+		sent, err = Send(link.New(p), files, o)
+		return err
+	}, func(p *serstest.Port) error {
+		var err error
+		got, err = Receive(link.New(p), open, o)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sent, got, b.Stats()
+}
+
+func TestBatch(t *testing.T) {
+	mt := time.Unix(1420070400, 0)
+	files := []File{
+		{Name: "one.bin", Size: 5000, ModTime: mt, Mode: 0600, R: bytes.NewReader(serstest.Bytes(5000))},
+		{Name: "empty", R: bytes.NewReader(nil)},
+		{Name: "dir/three.txt", Size: 5, R: bytes.NewReader([]byte("three"))},
+	}
+	got := map[string]*serstest.Buffer{}
+	var infos []string
+	var progress int64
+	o := &Options{Timeout: time.Second, Progress: func(n int64) { progress = n }}
+	sent, n, _ := xfer(t, serstest.Options{}, files, o, func(f *FileInfo) (io.WriteCloser, int64, error) {
+		var mt int64
+		if !f.ModTime.IsZero() {
+			mt = f.ModTime.Unix()
+		}
+		infos = append(infos, fmt.Sprintf("%s %d %d %o %v", f.Name, f.Size, mt, f.Mode, f.Resume))
+		got[f.Name] = &serstest.Buffer{}
+		return got[f.Name], 0, nil
+	})
+	want := fmt.Sprint([]string{
+		"one.bin 5000 1420070400 600 false",
+		"empty 0 0 644 false",
+		"dir/three.txt 5 0 644 false",
+	})
+	if fmt.Sprint(infos) != want {
+		t.Errorf("files %v, want %s", infos, want)
+	}
+	if sent != 5005 || n != 5005 || progress != 5005 {
+		t.Errorf("sent %d, received %d, progress %d, want 5005", sent, n, progress)
+	}
+	if !bytes.Equal(got["one.bin"].Bytes(), serstest.Bytes(5000)) || got["empty"].Len() != 0 ||
+		got["dir/three.txt"].String() != "three" {
+		t.Error("the files came different")
+	}
+	for name, f := range got {
+		if !f.Closed {
+			t.Errorf("%s wasn't closed", name)
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	files := []File{
+		{Name: "old", Size: 3000, R: bytes.NewReader(serstest.Bytes(3000))},
+		{Name: "new", Size: 3, R: bytes.NewReader([]byte("new"))},
+	}
+	var w serstest.Buffer
+	_, n, _ := xfer(t, serstest.Options{}, files, &Options{Timeout: time.Second},
+		func(f *FileInfo) (io.WriteCloser, int64, error) {
+			if f.Name == "old" {
+				return nil, 0, ErrSkip
+			}
+			return &w, 0, nil
+		})
+	if n != 3 || w.String() != "new" {
+		t.Errorf("received %d bytes, %q", n, w.String())
+	}
+}
+
+func TestLossy(t *testing.T) {
+	d := serstest.Bytes(20000)
+	files := []File{{Name: "lossy", Size: int64(len(d)), R: bytes.NewReader(d)}}
+	var w serstest.Buffer
+	po := serstest.Options{Loss: 0.0002, Errors: 0.0001, Seed: 1}
+	_, n, st := xfer(t, po, files, &Options{Timeout: 300 * time.Millisecond},
+		func(f *FileInfo) (io.WriteCloser, int64, error) { return &w, 0, nil })
+	if n != int64(len(d)) || !bytes.Equal(w.Bytes(), d) {
+		t.Errorf("received %d bytes, the file came different", n)
+	}
+	if st.Lost == 0 || st.Framing == 0 {
+		t.Errorf("the link was clean: %+v", st)
+	}
+}
+
+func TestResume(t *testing.T) {
+	d := serstest.Bytes(5000)
+	files := []File{{Name: "part", Size: int64(len(d)), R: bytes.NewReader(d)}}
+	w := &serstest.Buffer{}
+	w.Write(d[:1234]) // the interrupted transfer
+	var resume bool
+	_, n, _ := xfer(t, serstest.Options{}, files, &Options{Resume: true, Timeout: time.Second},
+		func(f *FileInfo) (io.WriteCloser, int64, error) {
+			resume = f.Resume
+			return w, int64(w.Len()), nil
+		})
+	if !resume {
+		t.Error("the receiver wasn't asked to resume")
+	}
+	if n != int64(len(d)) || !bytes.Equal(w.Bytes(), d) {
+		t.Errorf("received up to %d, the file came different", n)
+	}
+}
+
+func TestDetector(t *testing.T) {
+	var d Detector
+	for i, c := range []struct {
+		p    string
+		want int
+	}{
+		{"rz\r*", -1},
+		{"*\x18", -1},
+		{"B0", -1},
+		{"0000000", 1},
+		{"***", -1},
+		{"\x18B00", 4},
+		{"**\x18A00", -1}, // a binary header
+		{"**x\x18B00", -1},
+	} {
+		if got := d.Scan([]byte(c.p)); got != c.want {
+			t.Errorf("%d: Scan(%q) = %d, want %d", i, c.p, got, c.want)
+		}
+	}
+
+	// what sz sends, a byte at a time
+	a, b := serstest.Pair(serstest.Options{})
+	defer a.Close()
+	go Send(link.New(a), nil, &Options{Retries: 1, Timeout: 100 * time.Millisecond})
+	d = Detector{}
+	for n := 0; ; n++ {
+		c := make([]byte, 1)
+		if _, err := b.Read(c); err != nil {
+			t.Fatalf("no auto-start header in %d bytes: %v", n, err)
+		}
+		if d.Scan(c) == 1 {
+			break
+		}
+	}
+	b.Close()
+}